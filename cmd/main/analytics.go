@@ -0,0 +1,554 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Dimensions clicks are rolled up by, besides all the clicks of a link. Bots
+// are only counted by name, and in none of the other rollups.
+const (
+	dimensionReferrer = "referrer"
+	dimensionCountry  = "country"
+	dimensionDevice   = "device"
+	dimensionBot      = "bot"
+)
+
+var (
+	clickDimensions  = []string{dimensionReferrer, dimensionCountry, dimensionDevice}
+	rollupDimensions = []string{dimensionReferrer, dimensionCountry, dimensionDevice, dimensionBot}
+)
+
+// ClickRollup is a row of click_rollups: the clicks of a link in one hour or
+// day, either all of the clicks of people (Dimension "") or those with one
+// value of a dimension, e.g. the clicks from one country or the hits of one
+// bot
+type ClickRollup struct {
+	Granularity  string // pkg.Hourly or pkg.Daily
+	Bucket_start time.Time
+	Link_id      int
+	Dimension    string
+	Value        string
+	Clicks       int64
+}
+
+// RollupProgress is a row of rollup_progress: every click before
+// Rolled_up_to is counted in the rollups of Granularity
+type RollupProgress struct {
+	Granularity  string
+	Rolled_up_to time.Time
+}
+
+const (
+	// rollupDelay is how long after an hour ends it is rolled up, leaving
+	// time for the clicks still in the recorder's buffer to be saved
+	rollupDelay = 5 * time.Minute
+	// maxRollupBuckets is how many hours, and days, one run rolls up at
+	// most, so catching up after a long pause is spread over several runs
+	maxRollupBuckets = 24 * 7
+)
+
+// clickValue returns the value of dimension for event
+func clickValue(event ClickEvent, dimension string) string {
+	switch dimension {
+	case dimensionReferrer:
+		return event.Referrer
+	case dimensionCountry:
+		return event.Country
+	case dimensionDevice:
+		return event.Device
+	case dimensionBot:
+		return event.Bot
+	}
+	return ""
+}
+
+// rollupKey identifies a rollup within its bucket
+type rollupKey struct {
+	Link_id   int
+	Dimension string
+	Value     string
+}
+
+// countClick adds event to counts, once among all the clicks of its link and
+// once for the value of each dimension. The hits of a bot are only counted
+// for its name.
+func countClick(counts map[rollupKey]int64, event ClickEvent) {
+	if event.Bot != "" {
+		counts[rollupKey{event.Link_id, dimensionBot, event.Bot}]++
+		return
+	}
+	counts[rollupKey{Link_id: event.Link_id}]++
+	for _, dimension := range clickDimensions {
+		counts[rollupKey{event.Link_id, dimension, clickValue(event, dimension)}]++
+	}
+}
+
+// saveRollups writes counts as the rollups of the bucket of granularity from
+// start to end, and records that clicks are rolled up to end. Rollups
+// already there are overwritten, so a bucket can be rolled up again to the
+// same effect.
+func saveRollups(tx StorageInterfaces.Store, granularity string, start, end time.Time, counts map[rollupKey]int64) error {
+	keys := make([]rollupKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Link_id != keys[j].Link_id {
+			return keys[i].Link_id < keys[j].Link_id
+		}
+		if keys[i].Dimension != keys[j].Dimension {
+			return keys[i].Dimension < keys[j].Dimension
+		}
+		return keys[i].Value < keys[j].Value
+	})
+
+	for _, key := range keys {
+		rollup := ClickRollup{
+			Granularity:  granularity,
+			Bucket_start: start,
+			Link_id:      key.Link_id,
+			Dimension:    key.Dimension,
+			Value:        key.Value,
+			Clicks:       counts[key],
+		}
+		if err := tx.Upsert("click_rollups", &rollup); err != nil {
+			return err
+		}
+	}
+	return tx.Upsert("rollup_progress", &RollupProgress{Granularity: granularity, Rolled_up_to: end})
+}
+
+// rolledUpTo returns the time up to which clicks are rolled up at
+// granularity, zero when nothing is
+func rolledUpTo(store StorageInterfaces.Store, granularity string) (time.Time, error) {
+	var progress RollupProgress
+	err := store.GetByWhere("rollup_progress", "Granularity = ?", []interface{}{granularity}, &progress)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return progress.Rolled_up_to.UTC(), err
+}
+
+// rollupClicks rolls the clicks of every hour that ended rollupDelay before
+// now up into hourly rollups, and the hourly rollups of every day whose
+// hours are all rolled up into daily rollups. Each bucket is rolled up in a
+// transaction of its own, along with the progress it makes.
+func (app *MyApp) rollupClicks(ctx context.Context, now time.Time) error {
+	end := pkg.BucketStart(now.Add(-rollupDelay), time.Hour)
+	hours, err := rolledUpTo(app.db, pkg.Hourly)
+	if err != nil {
+		return err
+	}
+	if hours.IsZero() {
+		// Start at the oldest click
+		var oldest []ClickEvent
+		if err := app.db.Find("click_events", StorageInterfaces.Query{OrderBy: []StorageInterfaces.Order{{Column: "Clicked_at"}}, Limit: 1}, &oldest); err != nil {
+			return err
+		}
+		hours = end
+		if len(oldest) > 0 {
+			hours = pkg.BucketStart(oldest[0].Clicked_at, time.Hour)
+		}
+	}
+	for n := 0; hours.Before(end) && n < maxRollupBuckets; n++ {
+		start := hours
+		err := app.db.WithTx(ctx, func(tx StorageInterfaces.Store) error {
+			var events []ClickEvent
+			if err := tx.GetAllByWhere("click_events", "Clicked_at >= ? AND Clicked_at < ?", []interface{}{start, start.Add(time.Hour)}, &events); err != nil {
+				return err
+			}
+			counts := make(map[rollupKey]int64)
+			for _, event := range events {
+				countClick(counts, event)
+			}
+			return saveRollups(tx, pkg.Hourly, start, start.Add(time.Hour), counts)
+		})
+		if err != nil {
+			return err
+		}
+		hours = start.Add(time.Hour)
+	}
+
+	days, err := rolledUpTo(app.db, pkg.Daily)
+	if err != nil {
+		return err
+	}
+	if days.IsZero() {
+		// Start on the day of the oldest hour rolled up
+		var oldest []ClickRollup
+		query := StorageInterfaces.Query{Where: "Granularity = ?", Args: []interface{}{pkg.Hourly}, OrderBy: []StorageInterfaces.Order{{Column: "Bucket_start"}}, Limit: 1}
+		if err := app.db.Find("click_rollups", query, &oldest); err != nil {
+			return err
+		}
+		days = pkg.BucketStart(hours, 24*time.Hour)
+		if len(oldest) > 0 {
+			days = pkg.BucketStart(oldest[0].Bucket_start, 24*time.Hour)
+		}
+	}
+	for n := 0; !days.Add(24*time.Hour).After(hours) && n < maxRollupBuckets; n++ {
+		start := days
+		err := app.db.WithTx(ctx, func(tx StorageInterfaces.Store) error {
+			var rollups []ClickRollup
+			if err := tx.GetAllByWhere("click_rollups", "Granularity = ? AND Bucket_start >= ? AND Bucket_start < ?",
+				[]interface{}{pkg.Hourly, start, start.Add(24 * time.Hour)}, &rollups); err != nil {
+				return err
+			}
+			counts := make(map[rollupKey]int64)
+			for _, rollup := range rollups {
+				counts[rollupKey{rollup.Link_id, rollup.Dimension, rollup.Value}] += rollup.Clicks
+			}
+			return saveRollups(tx, pkg.Daily, start, start.Add(24*time.Hour), counts)
+		})
+		if err != nil {
+			return err
+		}
+		days = start.Add(24 * time.Hour)
+	}
+	return nil
+}
+
+// pruneClicks removes the raw clicks from before cutoff. Clicks not rolled
+// up yet are kept whatever their age.
+func (app *MyApp) pruneClicks(cutoff time.Time) error {
+	hours, err := rolledUpTo(app.db, pkg.Hourly)
+	if err != nil || hours.IsZero() {
+		return err
+	}
+	if hours.Before(cutoff) {
+		cutoff = hours
+	}
+	return app.db.Delete("click_events", "Clicked_at < ?", []interface{}{cutoff})
+}
+
+// seriesQuery asks for the clicks of a link, or of every link when Link_id is
+// 0, counted in buckets of Granularity from Since up to Until, and split by
+// the values of Dimension unless it is "". Since and Until fall on bucket
+// boundaries.
+type seriesQuery struct {
+	Link_id     int
+	Granularity string
+	Dimension   string
+	Since       time.Time
+	Until       time.Time
+}
+
+// seriesPoint is the number of clicks in the bucket starting at Start
+type seriesPoint struct {
+	Start  time.Time `json:"start"`
+	Clicks int64     `json:"clicks"`
+}
+
+// clickSeries is the clicks with one value of a dimension, bucket by bucket
+type clickSeries struct {
+	Value  string        `json:"value"`
+	Total  int64         `json:"total"`
+	Points []seriesPoint `json:"points"`
+}
+
+const maxSeriesBuckets = 1000
+
+// defaultSeriesSpans are the time covered by series that do not say when
+// they start
+var defaultSeriesSpans = map[string]time.Duration{pkg.Hourly: 48 * time.Hour, pkg.Daily: 30 * 24 * time.Hour}
+
+// seriesQueryFromValues reads the granularity (hour or day), by, since and
+// until query parameters. Series end with the bucket holding now unless until
+// says otherwise, and cover the last two days, or the last thirty, unless
+// since says otherwise.
+func seriesQueryFromValues(values url.Values, now time.Time) (seriesQuery, error) {
+	q := seriesQuery{Granularity: values.Get("granularity"), Dimension: values.Get("by")}
+	if q.Granularity == "" {
+		q.Granularity = pkg.Daily
+	}
+	size, err := pkg.BucketSize(q.Granularity)
+	if err != nil {
+		return q, err
+	}
+	if q.Dimension != "" && !containsString(rollupDimensions, q.Dimension) {
+		return q, fmt.Errorf("by must be %s, %s, %s or %s", dimensionReferrer, dimensionCountry, dimensionDevice, dimensionBot)
+	}
+
+	q.Until = now
+	if until := values.Get("until"); until != "" {
+		if q.Until, err = parseAuditTime(until); err != nil {
+			return q, fmt.Errorf("until must be a date or an RFC 3339 time")
+		}
+	}
+	if start := pkg.BucketStart(q.Until, size); start.Equal(q.Until) {
+		q.Until = start
+	} else {
+		q.Until = start.Add(size)
+	}
+	q.Since = q.Until.Add(-defaultSeriesSpans[q.Granularity])
+	if since := values.Get("since"); since != "" {
+		if q.Since, err = parseAuditTime(since); err != nil {
+			return q, fmt.Errorf("since must be a date or an RFC 3339 time")
+		}
+	}
+	q.Since = pkg.BucketStart(q.Since, size)
+
+	if !q.Since.Before(q.Until) {
+		return q, fmt.Errorf("since must be before until")
+	}
+	if q.Until.Sub(q.Since) > maxSeriesBuckets*size {
+		return q, fmt.Errorf("series hold at most %d buckets", maxSeriesBuckets)
+	}
+	return q, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// earliest returns whichever of a and b comes first
+func earliest(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// clickSeries counts the clicks q asks for, those of people unless q is by
+// bot, when it counts the hits of each bot. Buckets already rolled up are
+// read from the daily or hourly rollups, and only the clicks of the last
+// hours are counted from the raw events. Series come largest first, each with
+// a point for every bucket.
+func (app *MyApp) clickSeries(q seriesQuery) ([]clickSeries, error) {
+	size, err := pkg.BucketSize(q.Granularity)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]map[time.Time]int64)
+	add := func(value string, at time.Time, clicks int64) {
+		if counts[value] == nil {
+			counts[value] = make(map[time.Time]int64)
+		}
+		counts[value][pkg.BucketStart(at, size)] += clicks
+	}
+	readRollups := func(granularity string, from, to time.Time) error {
+		where := "Granularity = ? AND Dimension = ? AND Bucket_start >= ? AND Bucket_start < ?"
+		args := []interface{}{granularity, q.Dimension, from, to}
+		if q.Link_id != 0 {
+			where += " AND Link_id = ?"
+			args = append(args, q.Link_id)
+		}
+		var rollups []ClickRollup
+		if err := app.db.GetAllByWhere("click_rollups", where, args, &rollups); err != nil {
+			return err
+		}
+		for _, rollup := range rollups {
+			add(rollup.Value, rollup.Bucket_start, rollup.Clicks)
+		}
+		return nil
+	}
+
+	// Clicks before counted are accounted for
+	counted := q.Since
+	if q.Granularity == pkg.Daily {
+		days, err := rolledUpTo(app.db, pkg.Daily)
+		if err != nil {
+			return nil, err
+		}
+		if days.After(counted) {
+			end := earliest(days, q.Until)
+			if err := readRollups(pkg.Daily, counted, end); err != nil {
+				return nil, err
+			}
+			counted = end
+		}
+	}
+	hours, err := rolledUpTo(app.db, pkg.Hourly)
+	if err != nil {
+		return nil, err
+	}
+	if hours.After(counted) && counted.Before(q.Until) {
+		end := earliest(hours, q.Until)
+		if err := readRollups(pkg.Hourly, counted, end); err != nil {
+			return nil, err
+		}
+		counted = end
+	}
+	if counted.Before(q.Until) {
+		where := "Clicked_at >= ? AND Clicked_at < ? AND Bot = ''"
+		if q.Dimension == dimensionBot {
+			where = "Clicked_at >= ? AND Clicked_at < ? AND Bot <> ''"
+		}
+		args := []interface{}{counted, q.Until}
+		if q.Link_id != 0 {
+			where += " AND Link_id = ?"
+			args = append(args, q.Link_id)
+		}
+		var events []ClickEvent
+		if err := app.db.GetAllByWhere("click_events", where, args, &events); err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			add(clickValue(event, q.Dimension), event.Clicked_at, 1)
+		}
+	}
+
+	if q.Dimension == "" && len(counts) == 0 {
+		counts[""] = nil
+	}
+	buckets := pkg.BucketRange(q.Since, q.Until, size)
+	series := make([]clickSeries, 0, len(counts))
+	for value, byBucket := range counts {
+		s := clickSeries{Value: value, Points: make([]seriesPoint, len(buckets))}
+		for i, start := range buckets {
+			s.Points[i] = seriesPoint{Start: start, Clicks: byBucket[start]}
+			s.Total += byBucket[start]
+		}
+		series = append(series, s)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].Total != series[j].Total {
+			return series[i].Total > series[j].Total
+		}
+		return series[i].Value < series[j].Value
+	})
+	return series, nil
+}
+
+// apiStats is the body of a successful /api/stats response
+type apiStats struct {
+	Link_id     int           `json:"link_id,omitempty"` // absent for the clicks of every link
+	Granularity string        `json:"granularity"`
+	By          string        `json:"by,omitempty"`
+	Since       time.Time     `json:"since"`
+	Until       time.Time     `json:"until"`
+	Series      []clickSeries `json:"series"`
+}
+
+// apiStatsHandler returns the clicks of the link with the link query
+// parameter, or of every link, as time series; by=bot gives the hits of each
+// bot instead. The granularity, by, since and until parameters are read by
+// seriesQueryFromValues.
+func (app *MyApp) apiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+		return
+	}
+	if !app.apiAuth(w, r) {
+		return
+	}
+
+	q, err := seriesQueryFromValues(r.URL.Query(), time.Now())
+	if err == nil && r.URL.Query().Get("link") != "" {
+		if q.Link_id, err = strconv.Atoi(r.URL.Query().Get("link")); err != nil {
+			err = fmt.Errorf("link must be a link id")
+		}
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+
+	series, err := app.clickSeries(q)
+	if err != nil {
+		log.Printf("Error counting clicks: %v", err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "internal server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, apiStats{
+		Link_id:     q.Link_id,
+		Granularity: q.Granularity,
+		By:          q.Dimension,
+		Since:       q.Since,
+		Until:       q.Until,
+		Series:      series,
+	})
+}
+
+// statsPage is the data of the stats template
+type statsPage struct {
+	Link       UrlShortener
+	Host       string
+	Query      seriesQuery
+	Total      int64 // clicks of people
+	BotHits    int64
+	Bars       []statsBar
+	Dimensions []string                 // the keys of Breakdown, in order
+	Breakdown  map[string][]clickSeries // the clicks with each value of a dimension
+	Error      string
+}
+
+// statsBar is a bucket of the chart on the stats page
+type statsBar struct {
+	Start  time.Time
+	Clicks int64
+	Width  int // percent of the width of the busiest bucket's bar
+}
+
+// linkStatsHandler shows the clicks of the link with the id query parameter
+// over time, where they came from and the bots that hit it, for the same
+// granularity, since and until parameters as /api/stats
+func (app *MyApp) linkStatsHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := app.linkByID(w, r)
+	if !ok {
+		return
+	}
+	page := statsPage{Link: link, Host: app.domainHosts(r)[link.Domain_id], Dimensions: rollupDimensions, Breakdown: make(map[string][]clickSeries)}
+
+	q, err := seriesQueryFromValues(r.URL.Query(), time.Now())
+	if err != nil {
+		// Show the default range instead
+		page.Error = err.Error()
+		q, _ = seriesQueryFromValues(url.Values{}, time.Now())
+	}
+	q.Link_id = link.Id
+	page.Query = q
+
+	all, err := app.clickSeries(q)
+	for _, dimension := range rollupDimensions {
+		if err != nil {
+			break
+		}
+		byDimension := q
+		byDimension.Dimension = dimension
+		page.Breakdown[dimension], err = app.clickSeries(byDimension)
+	}
+	if err != nil {
+		log.Printf("Error counting the clicks of link %d: %v", link.Id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	var peak int64
+	for _, point := range all[0].Points {
+		if point.Clicks > peak {
+			peak = point.Clicks
+		}
+	}
+	page.Total = all[0].Total
+	for _, bot := range page.Breakdown[dimensionBot] {
+		page.BotHits += bot.Total
+	}
+	for _, point := range all[0].Points {
+		bar := statsBar{Start: point.Start, Clicks: point.Clicks}
+		if peak > 0 {
+			bar.Width = int(point.Clicks * 100 / peak)
+		}
+		page.Bars = append(page.Bars, bar)
+	}
+
+	if err := app.render(w, r, "stats.html", page); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
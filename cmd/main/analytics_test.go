@@ -0,0 +1,291 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var (
+	rollupColumns   = []string{"Granularity", "Bucket_start", "Link_id", "Dimension", "Value", "Clicks"}
+	progressColumns = []string{"Granularity", "Rolled_up_to"}
+	clickColumns    = []string{"Id", "Link_id", "Variant_id", "Clicked_at", "Referrer", "Country", "Device", "Bot"}
+)
+
+const (
+	progressQuery  = "^SELECT \\* FROM rollup_progress WHERE Granularity = \\?"
+	upsertRollup   = "^INSERT INTO click_rollups \\(Granularity, Bucket_start, Link_id, Dimension, Value, Clicks\\) VALUES \\(\\?, \\?, \\?, \\?, \\?, \\?\\) ON DUPLICATE KEY UPDATE "
+	upsertProgress = "^INSERT INTO rollup_progress \\(Granularity, Rolled_up_to\\) VALUES \\(\\?, \\?\\) ON DUPLICATE KEY UPDATE "
+)
+
+func TestRollupClicks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	hour := time.Date(2026, 10, 19, 1, 0, 0, 0, time.UTC)
+	now := time.Date(2026, 10, 19, 2, 7, 0, 0, time.UTC)
+
+	// The hour before last is rolled up; the last one ended too recently
+	mock.ExpectQuery(progressQuery).
+		WithArgs(pkg.Hourly).
+		WillReturnRows(sqlmock.NewRows(progressColumns).AddRow(pkg.Hourly, hour))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM click_events WHERE Clicked_at >= \\? AND Clicked_at < \\?$").
+		WithArgs(hour, hour.Add(time.Hour)).
+		WillReturnRows(sqlmock.NewRows(clickColumns).
+			AddRow(1, 1, 0, hour.Add(time.Minute), "example.com", "DE", "mobile", "").
+			AddRow(2, 1, 0, hour.Add(2*time.Minute), "", "", "desktop", "").
+			AddRow(3, 1, 0, hour.Add(3*time.Minute), "slack.com", "US", "other", "slackbot"))
+	for _, rollup := range []ClickRollup{
+		{Dimension: "", Value: "", Clicks: 2},
+		// The bot is counted apart
+		{Dimension: dimensionBot, Value: "slackbot", Clicks: 1},
+		{Dimension: dimensionCountry, Value: "", Clicks: 1},
+		{Dimension: dimensionCountry, Value: "DE", Clicks: 1},
+		{Dimension: dimensionDevice, Value: "desktop", Clicks: 1},
+		{Dimension: dimensionDevice, Value: "mobile", Clicks: 1},
+		{Dimension: dimensionReferrer, Value: "", Clicks: 1},
+		{Dimension: dimensionReferrer, Value: "example.com", Clicks: 1},
+	} {
+		mock.ExpectExec(upsertRollup).
+			WithArgs(pkg.Hourly, hour, 1, rollup.Dimension, rollup.Value, rollup.Clicks).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec(upsertProgress).
+		WithArgs(pkg.Hourly, hour.Add(time.Hour)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// Every hour of the day before is rolled up now, so the day is too
+	mock.ExpectQuery(progressQuery).
+		WithArgs(pkg.Daily).
+		WillReturnRows(sqlmock.NewRows(progressColumns).AddRow(pkg.Daily, day))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM click_rollups WHERE Granularity = \\? AND Bucket_start >= \\? AND Bucket_start < \\?$").
+		WithArgs(pkg.Hourly, day, day.AddDate(0, 0, 1)).
+		WillReturnRows(sqlmock.NewRows(rollupColumns).
+			AddRow(pkg.Hourly, day.Add(5*time.Hour), 1, "", "", 3).
+			AddRow(pkg.Hourly, day.Add(9*time.Hour), 1, "", "", 2).
+			AddRow(pkg.Hourly, day.Add(9*time.Hour), 2, dimensionDevice, "mobile", 4))
+	mock.ExpectExec(upsertRollup).
+		WithArgs(pkg.Daily, day, 1, "", "", 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(upsertRollup).
+		WithArgs(pkg.Daily, day, 2, dimensionDevice, "mobile", 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(upsertProgress).
+		WithArgs(pkg.Daily, day.AddDate(0, 0, 1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	if err := app.rollupClicks(context.Background(), now); err != nil {
+		t.Errorf("Error rolling up clicks: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRollupClicks_NothingYet(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery(progressQuery).
+		WithArgs(pkg.Hourly).
+		WillReturnRows(sqlmock.NewRows(progressColumns))
+	mock.ExpectQuery("^SELECT \\* FROM click_events ORDER BY Clicked_at LIMIT 1$").
+		WillReturnRows(sqlmock.NewRows(clickColumns))
+	mock.ExpectQuery(progressQuery).
+		WithArgs(pkg.Daily).
+		WillReturnRows(sqlmock.NewRows(progressColumns))
+	mock.ExpectQuery("^SELECT \\* FROM click_rollups WHERE Granularity = \\? ORDER BY Bucket_start LIMIT 1$").
+		WithArgs(pkg.Hourly).
+		WillReturnRows(sqlmock.NewRows(rollupColumns))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	if err := app.rollupClicks(context.Background(), time.Date(2026, 10, 19, 2, 7, 0, 0, time.UTC)); err != nil {
+		t.Errorf("Error rolling up clicks: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPruneClicks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	rolledUp := time.Date(2026, 10, 19, 1, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(progressQuery).
+		WithArgs(pkg.Hourly).
+		WillReturnRows(sqlmock.NewRows(progressColumns).AddRow(pkg.Hourly, rolledUp))
+	mock.ExpectExec("^DELETE FROM click_events WHERE Clicked_at < \\?$").
+		WithArgs(rolledUp.AddDate(0, 0, -90)).
+		WillReturnResult(sqlmock.NewResult(0, 10))
+	// Clicks that are not rolled up yet are kept
+	mock.ExpectQuery(progressQuery).
+		WithArgs(pkg.Hourly).
+		WillReturnRows(sqlmock.NewRows(progressColumns).AddRow(pkg.Hourly, rolledUp))
+	mock.ExpectExec("^DELETE FROM click_events WHERE Clicked_at < \\?$").
+		WithArgs(rolledUp).
+		WillReturnResult(sqlmock.NewResult(0, 10))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	if err := app.pruneClicks(rolledUp.AddDate(0, 0, -90)); err != nil {
+		t.Errorf("Error pruning clicks: %v", err)
+	}
+	if err := app.pruneClicks(rolledUp.Add(time.Hour)); err != nil {
+		t.Errorf("Error pruning clicks: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSeriesQueryFromValues(t *testing.T) {
+	now := time.Date(2026, 10, 19, 14, 30, 0, 0, time.UTC)
+	today := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+
+	q, err := seriesQueryFromValues(url.Values{}, now)
+	if err != nil || q.Granularity != pkg.Daily || !q.Until.Equal(today.AddDate(0, 0, 1)) || !q.Since.Equal(today.AddDate(0, 0, -29)) {
+		t.Errorf("expected the last 30 days, got %+v, %v", q, err)
+	}
+
+	q, err = seriesQueryFromValues(url.Values{"granularity": {"hour"}, "by": {"country"}, "since": {"2026-10-19T10:15:00Z"}, "until": {"2026-10-19T12:00:00Z"}}, now)
+	if err != nil || q.Dimension != dimensionCountry || !q.Since.Equal(today.Add(10*time.Hour)) || !q.Until.Equal(today.Add(12*time.Hour)) {
+		t.Errorf("expected the hours from 10:00 to 12:00, got %+v, %v", q, err)
+	}
+
+	for _, values := range []url.Values{
+		{"granularity": {"week"}},
+		{"by": {"browser"}},
+		{"since": {"yesterday"}},
+		{"since": {"2026-10-20"}, "until": {"2026-10-19"}},
+		{"granularity": {"hour"}, "since": {"2026-01-01"}},
+	} {
+		if _, err := seriesQueryFromValues(values, now); err == nil {
+			t.Errorf("expected an error for %v", values)
+		}
+	}
+}
+
+func TestClickSeries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	days := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	hours := time.Date(2026, 10, 19, 2, 0, 0, 0, time.UTC)
+	q := seriesQuery{Link_id: 1, Granularity: pkg.Daily, Since: days.AddDate(0, 0, -1), Until: days.AddDate(0, 0, 2)}
+	rollupQuery := "^SELECT \\* FROM click_rollups WHERE Granularity = \\? AND Dimension = \\? AND Bucket_start >= \\? AND Bucket_start < \\? AND Link_id = \\?$"
+
+	// Days from the daily rollups, then hours from the hourly ones, then
+	// the rest from the clicks themselves
+	mock.ExpectQuery(progressQuery).
+		WithArgs(pkg.Daily).
+		WillReturnRows(sqlmock.NewRows(progressColumns).AddRow(pkg.Daily, days))
+	mock.ExpectQuery(rollupQuery).
+		WithArgs(pkg.Daily, "", q.Since, days, 1).
+		WillReturnRows(sqlmock.NewRows(rollupColumns).AddRow(pkg.Daily, q.Since, 1, "", "", 7))
+	mock.ExpectQuery(progressQuery).
+		WithArgs(pkg.Hourly).
+		WillReturnRows(sqlmock.NewRows(progressColumns).AddRow(pkg.Hourly, hours))
+	mock.ExpectQuery(rollupQuery).
+		WithArgs(pkg.Hourly, "", days, hours, 1).
+		WillReturnRows(sqlmock.NewRows(rollupColumns).
+			AddRow(pkg.Hourly, days.Add(5*time.Hour), 1, "", "", 3).
+			AddRow(pkg.Hourly, hours.Add(-time.Hour), 1, "", "", 2))
+	mock.ExpectQuery("^SELECT \\* FROM click_events WHERE Clicked_at >= \\? AND Clicked_at < \\? AND Bot = '' AND Link_id = \\?$").
+		WithArgs(hours, q.Until, 1).
+		WillReturnRows(sqlmock.NewRows(clickColumns).AddRow(1, 1, 0, hours.Add(90*time.Minute), "", "", "mobile", ""))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	series, err := app.clickSeries(q)
+	if err != nil {
+		t.Fatalf("Error counting clicks: %v", err)
+	}
+	if len(series) != 1 || series[0].Total != 13 || len(series[0].Points) != 3 {
+		t.Fatalf("expected one series of 13 clicks over 3 days, got %+v", series)
+	}
+	for i, expected := range []int64{7, 3, 3} {
+		if point := series[0].Points[i]; point.Clicks != expected || !point.Start.Equal(q.Since.AddDate(0, 0, i)) {
+			t.Errorf("point %d = %+v; expected %d clicks", i, point, expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAPIStatsHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	// Nothing is rolled up, so every click is counted from click_events
+	mock.ExpectQuery(progressQuery).
+		WithArgs(pkg.Hourly).
+		WillReturnRows(sqlmock.NewRows(progressColumns))
+	mock.ExpectQuery("^SELECT \\* FROM click_events WHERE Clicked_at >= \\? AND Clicked_at < \\? AND Bot = ''$").
+		WithArgs(time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC), time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)).
+		WillReturnRows(sqlmock.NewRows(clickColumns).
+			AddRow(1, 1, 0, time.Date(2026, 10, 19, 10, 5, 0, 0, time.UTC), "", "DE", "", "").
+			AddRow(2, 2, 0, time.Date(2026, 10, 19, 10, 6, 0, 0, time.UTC), "", "FR", "", "").
+			AddRow(3, 1, 0, time.Date(2026, 10, 19, 11, 0, 0, 0, time.UTC), "", "FR", "", ""))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	w := httptest.NewRecorder()
+	app.apiStatsHandler(w, httptest.NewRequest(http.MethodGet, "/api/stats?granularity=hour&by=country&since=2026-10-19T10:00:00Z&until=2026-10-19T12:00:00Z", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var body apiStats
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	if body.By != dimensionCountry || len(body.Series) != 2 {
+		t.Fatalf("expected a series per country, got %+v", body)
+	}
+	if fr := body.Series[0]; fr.Value != "FR" || fr.Total != 2 || fr.Points[0].Clicks != 1 || fr.Points[1].Clicks != 1 {
+		t.Errorf("expected FR first with a click in each hour, got %+v", fr)
+	}
+	if de := body.Series[1]; de.Value != "DE" || de.Total != 1 {
+		t.Errorf("expected DE second, got %+v", de)
+	}
+
+	w = httptest.NewRecorder()
+	app.apiStatsHandler(w, httptest.NewRequest(http.MethodGet, "/api/stats?link=abc", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a bad link, got %d", w.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"cmd/main/pkg/Storage/MySql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiLink is a link as the API returns it
+type apiLink struct {
+	Id          int          `json:"id"`
+	Code        string       `json:"code"`
+	Short_url   string       `json:"short_url"`
+	Destination string       `json:"destination"`
+	Title       string       `json:"title"`
+	Notes       string       `json:"notes"`
+	Tags        []string     `json:"tags"`
+	Folder      string       `json:"folder"`
+	Og          apiOpenGraph `json:"og"`
+	Health      *apiHealth   `json:"health"` // null when the destination was never checked
+}
+
+// apiOpenGraph is the social preview of a link, "" where the destination's
+// own is shown
+type apiOpenGraph struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Image       string `json:"image"`
+}
+
+// apiHealth is what the last check of a link's destination found
+type apiHealth struct {
+	Checked_at   time.Time  `json:"checked_at"`
+	Status       int        `json:"status"`
+	Latency_ms   int        `json:"latency_ms"`
+	Redirects    []string   `json:"redirects"`
+	Error        string     `json:"error,omitempty"`
+	Broken       bool       `json:"broken"`
+	Broken_since *time.Time `json:"broken_since,omitempty"`
+}
+
+func newAPIHealth(health LinkHealth) *apiHealth {
+	redirects := []string{}
+	if health.Redirect_chain != "" {
+		redirects = strings.Split(health.Redirect_chain, "\n")
+	}
+	return &apiHealth{
+		Checked_at:   health.Checked_at.UTC(),
+		Status:       health.Status_code,
+		Latency_ms:   health.Latency_ms,
+		Redirects:    redirects,
+		Error:        health.Error,
+		Broken:       health.Broken,
+		Broken_since: health.Broken_since,
+	}
+}
+
+// apiError is the body of every API response that is not a success
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+// apiLinkList is the body of a successful /api/links response
+type apiLinkList struct {
+	Links      []apiLink `json:"links"`
+	Total      int       `json:"total"`                 // links matching the filter, on every page
+	NextCursor string    `json:"next_cursor,omitempty"` // absent on the last page
+}
+
+// apiPage reads the limit and cursor query parameters into the part of a
+// query selecting a page of links sorted by s. The limit is one more than
+// asked for, to find out whether there is a next page.
+func (app *MyApp) apiPage(r *http.Request, s linkSort) (StorageInterfaces.Query, error) {
+	page := StorageInterfaces.Query{Limit: app.pageSize()}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return page, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		page.Limit = n
+	}
+	page.Limit++
+
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		sortName, values, err := pkg.DecodeCursor(token)
+		if err != nil || sortName != s.Name || len(values) != len(s.OrderBy) {
+			return page, fmt.Errorf("invalid cursor")
+		}
+		page.After = values
+	}
+	return page, nil
+}
+
+// apiLinksHandler lists links as JSON, narrowed down and sorted by the same
+// q, tag, folder and sort query parameters as the viewurls page. Pages hold
+// limit links, and the next one is fetched by passing back next_cursor as
+// the cursor parameter.
+func (app *MyApp) apiLinksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+		return
+	}
+	if !app.apiAuth(w, r) {
+		return
+	}
+
+	filter := linkFilterFromQuery(r.URL.Query())
+	if name := r.URL.Query().Get("sort"); name != "" && filter.Sort != name {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("unknown sort %q", name)})
+		return
+	}
+	linkSort := filter.sort()
+	page, err := app.apiPage(r, linkSort)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+
+	var folders []Folder
+	err = app.db.GetAll("folders", &folders)
+	if err != nil {
+		log.Printf("Error retrieving folders: %v", err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "internal server error"})
+		return
+	}
+
+	links, total, err := app.findLinks(filter, folders, page)
+	if err != nil {
+		log.Printf("Error retrieving links: %v", err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "internal server error"})
+		return
+	}
+
+	result := apiLinkList{Total: total}
+	if len(links) == page.Limit {
+		links = links[:page.Limit-1]
+		values, err := MySql.CursorValues(links[len(links)-1], linkSort.OrderBy)
+		if err == nil {
+			result.NextCursor, err = pkg.EncodeCursor(linkSort.Name, values)
+		}
+		if err != nil {
+			log.Printf("Error making cursor: %v", err)
+			writeJSON(w, http.StatusInternalServerError, apiError{Error: "internal server error"})
+			return
+		}
+	}
+
+	health, err := app.linkHealth(links)
+	if err != nil {
+		log.Printf("Error retrieving link health: %v", err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "internal server error"})
+		return
+	}
+
+	hosts := app.domainHosts(r)
+	names := folderNames(folders)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	result.Links = make([]apiLink, len(links))
+	for i, link := range links {
+		tags := linkTags(link)
+		if tags == nil {
+			tags = []string{}
+		}
+		result.Links[i] = apiLink{
+			Id:          link.Id,
+			Code:        link.Short_url,
+			Short_url:   scheme + "://" + hosts[link.Domain_id] + "/" + link.Short_url,
+			Destination: link.Original_url,
+			Title:       link.Title,
+			Notes:       link.Notes,
+			Tags:        tags,
+			Folder:      names[link.Folder_id],
+			Og:          apiOpenGraph{Title: link.Og_title, Description: link.Og_description, Image: link.Og_image},
+		}
+		if linkHealth, ok := health[link.Id]; ok {
+			result.Links[i].Health = newAPIHealth(linkHealth)
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
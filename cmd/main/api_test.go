@@ -0,0 +1,163 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestApiLinksHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("^SELECT \\* FROM folders$").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}).AddRow(3, "Work"))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM url_shortener WHERE Deleted_at IS NULL AND \\(MATCH\\(Original_url, Title, Tags, Short_url\\) AGAINST \\(\\? IN BOOLEAN MODE\\) OR Short_url = \\?\\)$").
+		WithArgs("+go*", "go").
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(2))
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at IS NULL AND \\(MATCH\\(Original_url, Title, Tags, Short_url\\) AGAINST \\(\\? IN BOOLEAN MODE\\) OR Short_url = \\?\\) ORDER BY Id DESC LIMIT 51$").
+		WithArgs("+go*", "go").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Password_hash", "Title", "Tags", "Folder_id", "Og_title"}).
+			AddRow(1, "https://go.dev", "abc12", "secret", "Go", "go,news", 3, "Build simple, secure, scalable systems").
+			AddRow(2, "https://golang.org", "xyz78", "", "", "", 0, ""))
+	expectLinkHealth(mock, 1, 2)
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	req := httptest.NewRequest("GET", "/api/links?q=go", nil)
+	req.Host = "sho.rt"
+	rr := httptest.NewRecorder()
+
+	app.apiLinksHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("handler returned wrong content type %s", contentType)
+	}
+
+	expected := `{"links":[` +
+		`{"id":1,"code":"abc12","short_url":"http://sho.rt/abc12","destination":"https://go.dev","title":"Go","notes":"","tags":["go","news"],"folder":"Work",` +
+		`"og":{"title":"Build simple, secure, scalable systems","description":"","image":""},"health":null},` +
+		`{"id":2,"code":"xyz78","short_url":"http://sho.rt/xyz78","destination":"https://golang.org","title":"","notes":"","tags":[],"folder":"",` +
+		`"og":{"title":"","description":"","image":""},"health":null}],` +
+		`"total":2}` + "\n"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body:\n got %v\nwant %v", body, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestApiLinksHandler_Cursor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"Id", "Original_url", "Short_url"}
+	mock.ExpectQuery("^SELECT \\* FROM folders$").WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM url_shortener WHERE Deleted_at IS NULL$").
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(3))
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at IS NULL ORDER BY Short_url, Id LIMIT 3$").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(4, "https://a.example", "aaa11").
+			AddRow(2, "https://b.example", "bbb22").
+			AddRow(9, "https://c.example", "ccc33"))
+	expectLinkHealth(mock, 4, 2)
+	mock.ExpectQuery("^SELECT \\* FROM folders$").WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM url_shortener WHERE Deleted_at IS NULL$").
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(3))
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE \\(Deleted_at IS NULL\\) AND \\(Short_url > \\? OR \\(Short_url = \\? AND Id > \\?\\)\\) ORDER BY Short_url, Id LIMIT 3$").
+		WithArgs("bbb22", "bbb22", 2).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(9, "https://c.example", "ccc33"))
+	expectLinkHealth(mock, 9)
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	var codes []string
+	query := "/api/links?sort=code&limit=2"
+	for page := 0; page < 2; page++ {
+		rr := httptest.NewRecorder()
+		app.apiLinksHandler(rr, httptest.NewRequest("GET", query, nil))
+
+		var body apiLinkList
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || rr.Code != http.StatusOK {
+			t.Fatalf("Unexpected response %d %s", rr.Code, rr.Body.String())
+		}
+		if body.Total != 3 {
+			t.Errorf("Expected a total of 3, got %d", body.Total)
+		}
+		for _, link := range body.Links {
+			codes = append(codes, link.Code)
+		}
+		if body.NextCursor == "" {
+			break
+		}
+		query = "/api/links?sort=code&limit=2&cursor=" + body.NextCursor
+	}
+
+	if len(codes) != 3 || codes[0] != "aaa11" || codes[1] != "bbb22" || codes[2] != "ccc33" {
+		t.Errorf("Expected every link once, got %v", codes)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestApiLinksHandler_Errors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("^SELECT \\* FROM folders$").WillReturnError(sqlmock.ErrCancelled)
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	otherSort, _ := pkg.EncodeCursor("oldest", []interface{}{5})
+	testCases := []struct {
+		method string
+		target string
+		status int
+	}{
+		{"POST", "/api/links", http.StatusMethodNotAllowed},
+		{"GET", "/api/links?sort=clicks", http.StatusBadRequest},
+		{"GET", "/api/links?limit=0", http.StatusBadRequest},
+		{"GET", "/api/links?limit=501", http.StatusBadRequest},
+		{"GET", "/api/links?cursor=garbage", http.StatusBadRequest},
+		{"GET", "/api/links?cursor=" + otherSort, http.StatusBadRequest},
+		{"GET", "/api/links", http.StatusInternalServerError},
+	}
+	for _, tc := range testCases {
+		req := httptest.NewRequest(tc.method, tc.target, nil)
+		rr := httptest.NewRecorder()
+
+		app.apiLinksHandler(rr, req)
+
+		var body apiError
+		if status := rr.Code; status != tc.status {
+			t.Errorf("%s %s: handler returned wrong status code: got %v want %v", tc.method, tc.target, status, tc.status)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || body.Error == "" {
+			t.Errorf("%s %s: expected an error message, got %s", tc.method, tc.target, rr.Body.String())
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"cmd/main/pkg"
+	"cmd/main/static"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// assetCacheControl is sent with hashed asset urls, which change whenever the
+// asset does, so browsers may keep them for good
+const assetCacheControl = "public, max-age=31536000, immutable"
+
+// staticFiles returns the built-in templates and assets, with those in dir,
+// when it is not "", taking the place of the built-in ones of the same name
+func staticFiles(dir string) (fs.FS, error) {
+	if dir == "" {
+		return static.Files, nil
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return nil, err
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return pkg.OverlayFS{Upper: os.DirFS(dir), Lower: static.Files}, nil
+}
+
+// parseTemplates parses the page templates of files, with asset urls from
+// assets
+func parseTemplates(files fs.FS, assets *assetManifest) (*template.Template, error) {
+	return template.New("").Funcs(templateFuncs).Funcs(assets.funcs()).ParseFS(files, "templates/*.html")
+}
+
+// asset is a file served under /static/
+type asset struct {
+	name string // its path under /static/
+	hash string // hex, of its content
+	data []byte
+}
+
+// assetManifest holds the assets, every file but the templates, read once
+// at startup. Each is served both under its own name and under a name with
+// its hash in it, which pages link to so the asset can be cached for good.
+type assetManifest struct {
+	byName   map[string]*asset
+	byHashed map[string]*asset
+	modTime  time.Time // of every asset, when the manifest was built
+}
+
+// newAssetManifest reads and hashes every asset of files
+func newAssetManifest(files fs.FS) (*assetManifest, error) {
+	m := &assetManifest{byName: make(map[string]*asset), byHashed: make(map[string]*asset), modTime: time.Now()}
+	err := fs.WalkDir(files, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if name == "templates" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(name, ".go") {
+			return nil
+		}
+		data, err := fs.ReadFile(files, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		a := &asset{name: name, hash: hex.EncodeToString(sum[:]), data: data}
+		m.byName[name] = a
+		m.byHashed[hashedName(name, a.hash)] = a
+		return nil
+	})
+	return m, err
+}
+
+// hashedName puts the first characters of hash before the extension of name,
+// e.g. styles.css becomes styles.0a1b2c3d4e5f.css
+func hashedName(name, hash string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + hash[:12] + ext
+}
+
+// URL returns the address pages link to name with, the hashed one of an
+// asset in the manifest. Names it does not know, and a nil manifest, get the
+// plain address.
+func (m *assetManifest) URL(name string) string {
+	if m != nil {
+		if a, ok := m.byName[name]; ok {
+			return "/static/" + hashedName(name, a.hash)
+		}
+	}
+	return "/static/" + name
+}
+
+// funcs returns the template functions that depend on the manifest
+func (m *assetManifest) funcs() template.FuncMap {
+	return template.FuncMap{"asset": m.URL}
+}
+
+// ServeHTTP serves the assets under /static/. Hashed names are cached for
+// good; plain names are revalidated on every use.
+func (m *assetManifest) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	cacheControl := assetCacheControl
+	a, ok := m.byHashed[name]
+	if !ok {
+		cacheControl = "no-cache"
+		a, ok = m.byName[name]
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("ETag", `"`+a.hash+`"`)
+	http.ServeContent(w, r, a.name, m.modTime, bytes.NewReader(a.data))
+}
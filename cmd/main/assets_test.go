@@ -0,0 +1,138 @@
+package main
+
+import (
+	"cmd/main/static"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestAssetManifest(t *testing.T) {
+	files := fstest.MapFS{
+		"styles.css":           {Data: []byte("body { color: black }")},
+		"img/logo.svg":         {Data: []byte("<svg></svg>")},
+		"templates/index.html": {Data: []byte("<p>not an asset</p>")},
+	}
+	assets, err := newAssetManifest(files)
+	if err != nil {
+		t.Fatalf("Error reading assets: %v", err)
+	}
+
+	hashed := assets.URL("styles.css")
+	if !strings.HasPrefix(hashed, "/static/styles.") || !strings.HasSuffix(hashed, ".css") || hashed == "/static/styles.css" {
+		t.Errorf("expected a hashed url, got %s", hashed)
+	}
+	if got := assets.URL("missing.css"); got != "/static/missing.css" {
+		t.Errorf("expected the plain url of an unknown asset, got %s", got)
+	}
+	var none *assetManifest
+	if got := none.URL("styles.css"); got != "/static/styles.css" {
+		t.Errorf("expected the plain url without a manifest, got %s", got)
+	}
+
+	testCases := []struct {
+		path         string
+		status       int
+		cacheControl string
+	}{
+		{hashed, http.StatusOK, assetCacheControl},
+		{"/static/styles.css", http.StatusOK, "no-cache"},
+		{assets.URL("img/logo.svg"), http.StatusOK, assetCacheControl},
+		{"/static/templates/index.html", http.StatusNotFound, ""},
+		{"/static/styles.000000000000.css", http.StatusNotFound, ""},
+	}
+	for _, tc := range testCases {
+		rr := httptest.NewRecorder()
+		assets.ServeHTTP(rr, httptest.NewRequest("GET", tc.path, nil))
+		if rr.Code != tc.status {
+			t.Errorf("%s: got status %d; expected %d", tc.path, rr.Code, tc.status)
+		}
+		if got := rr.Header().Get("Cache-Control"); got != tc.cacheControl {
+			t.Errorf("%s: got Cache-Control %q; expected %q", tc.path, got, tc.cacheControl)
+		}
+	}
+
+	// A browser holding the asset is told it has not changed
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/static/styles.css", nil)
+	req.Header.Set("If-None-Match", `"`+assets.byName["styles.css"].hash+`"`)
+	assets.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected status %d, got %d", http.StatusNotModified, rr.Code)
+	}
+}
+
+func TestParseTemplates(t *testing.T) {
+	files, err := staticFiles("")
+	if err != nil {
+		t.Fatalf("Error opening static files: %v", err)
+	}
+	assets, err := newAssetManifest(files)
+	if err != nil {
+		t.Fatalf("Error reading assets: %v", err)
+	}
+	tmpl, err := parseTemplates(files, assets)
+	if err != nil {
+		t.Fatalf("Error parsing the built-in templates: %v", err)
+	}
+
+	app := &MyApp{tmpl: tmpl, assets: assets}
+	rr := httptest.NewRecorder()
+	app.indexHandler(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, assets.URL("styles.css")) {
+		t.Errorf("expected the page to link the hashed stylesheet, got %s", body)
+	}
+}
+
+func TestStaticFiles_Override(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "templates"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "templates", "index.html"), []byte(`<link href="{{asset "styles.css"}}">Our brand`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "styles.css"), []byte("body { color: purple }"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := staticFiles(dir)
+	if err != nil {
+		t.Fatalf("Error opening static files: %v", err)
+	}
+	assets, err := newAssetManifest(files)
+	if err != nil {
+		t.Fatalf("Error reading assets: %v", err)
+	}
+	tmpl, err := parseTemplates(files, assets)
+	if err != nil {
+		t.Fatalf("Error parsing templates: %v", err)
+	}
+
+	builtIn, err := newAssetManifest(static.Files)
+	if err != nil {
+		t.Fatalf("Error reading assets: %v", err)
+	}
+	if assets.URL("styles.css") == builtIn.URL("styles.css") {
+		t.Errorf("expected the stylesheet of the directory to be served")
+	}
+	// Templates the directory does not have are the built-in ones
+	if tmpl.Lookup("index.html") == nil || tmpl.Lookup("edit.html") == nil {
+		t.Errorf("expected both the overridden and built-in templates")
+	}
+	var body strings.Builder
+	if err := tmpl.ExecuteTemplate(&body, "index.html", nil); err != nil || !strings.Contains(body.String(), "Our brand") {
+		t.Errorf("expected the template of the directory, got %q, %v", body.String(), err)
+	}
+
+	if _, err := staticFiles(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected an error for a missing directory")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	auditCreate    = "create"
+	auditUpdate    = "update"
+	auditDelete    = "delete"    // moved to the trash
+	auditRestore   = "restore"   // taken back out of the trash
+	auditPurge     = "purge"     // removed from the trash for good
+	auditRollback  = "rollback"  // given the settings of an earlier version
+	auditScheduled = "scheduled" // switched to a destination scheduled earlier
+	auditErase     = "erase"     // removed for good with the rest of its creator's data
+	auditAPIKey    = "api_key.use"
+)
+
+var auditActions = []string{auditCreate, auditUpdate, auditDelete, auditRestore, auditPurge, auditRollback, auditScheduled, auditErase, auditAPIKey}
+
+// AuditEvent is a row of audit_events. The app only ever inserts them, so the
+// log tells who changed which link and when.
+type AuditEvent struct {
+	Id          int64
+	Occurred_at time.Time
+	Action      string
+	Link_id     int // 0 for events about no link, such as API key use
+	Actor       string
+	Ip          string
+	Request_id  string
+	Before_json string // the link before the change, "" when it did not exist
+	After_json  string // the link after the change, "" when it no longer exists; for API key use, the request
+}
+
+// auditActor is who made a request, as recorded in the audit log
+type auditActor struct {
+	Name       string
+	IP         string
+	Request_id string
+}
+
+// Actors of changes that were not requested by anyone
+var systemActor = auditActor{Name: "system"}
+
+// auditActor identifies who made r: the name of the API key it carries, else
+// the user named by the configured actor header, which an authenticating
+// proxy in front of the app sets, else "anonymous"
+func (app *MyApp) auditActor(r *http.Request) auditActor {
+	who := auditActor{Name: "anonymous", IP: app.clientIP(r), Request_id: r.Header.Get(requestIDHeader)}
+	if name, err := app.apiKeyName(r); err == nil && name != "" {
+		who.Name = "api-key:" + name
+	} else if app.cfg.ActorHeader != "" {
+		if user := strings.TrimSpace(r.Header.Get(app.cfg.ActorHeader)); user != "" {
+			who.Name = user
+		}
+	}
+	return who
+}
+
+// auditSnapshot encodes link for the before and after columns. Password
+// hashes are left out, as the log is readable by more people than the links.
+func auditSnapshot(link *UrlShortener) (string, error) {
+	if link == nil {
+		return "", nil
+	}
+	copied := *link
+	if copied.Password_hash != "" {
+		copied.Password_hash = "redacted"
+	}
+	data, err := json.Marshal(copied)
+	return string(data), err
+}
+
+// audit appends an event about a link to the audit log. before and after
+// are nil when the link does not exist before or after the change. Run it
+// in the transaction making the change, so the two are saved together.
+func audit(store StorageInterfaces.Store, who auditActor, action string, before, after *UrlShortener) error {
+	event := AuditEvent{
+		Occurred_at: time.Now().UTC(),
+		Action:      action,
+		Actor:       who.Name,
+		Ip:          who.IP,
+		Request_id:  who.Request_id,
+	}
+	if after != nil {
+		event.Link_id = after.Id
+	} else if before != nil {
+		event.Link_id = before.Id
+	}
+
+	var err error
+	if event.Before_json, err = auditSnapshot(before); err != nil {
+		return err
+	}
+	if event.After_json, err = auditSnapshot(after); err != nil {
+		return err
+	}
+	return store.SaveReturningID("audit_events", &event, "Id")
+}
+
+// requestIDHeader carries the id tying log lines and audit events to the
+// request they were made by
+const requestIDHeader = "X-Request-ID"
+
+// withRequestID makes sure every request has an id, and answers with it.
+// An id from a proxy in front of the app is kept when it looks sane.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("Error generating request id: %v", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// splitAPIKey splits an entry of the API key configuration into the name of
+// the key and the key itself
+func splitAPIKey(entry string) (string, string, error) {
+	name, key, ok := strings.Cut(entry, ":")
+	name, key = strings.TrimSpace(name), strings.TrimSpace(key)
+	if !ok || name == "" || key == "" {
+		// The entry is left out, as it may well be a key
+		return "", "", fmt.Errorf("API keys must be of the form name:key")
+	}
+	return name, key, nil
+}
+
+// apiKeyName returns the name of the API key in the Authorization header of
+// r, "" when there is none, and an error when the key is not configured
+func (app *MyApp) apiKeyName(r *http.Request) (string, error) {
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		return "", nil
+	}
+	presented, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return "", fmt.Errorf("unsupported authorization scheme")
+	}
+
+	for _, entry := range app.cfg.APIKeys {
+		name, key, err := splitAPIKey(entry)
+		if err == nil && subtle.ConstantTimeCompare([]byte(key), []byte(strings.TrimSpace(presented))) == 1 {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("unknown API key")
+}
+
+// apiAuth checks the API key of an API request, and records its use in the
+// audit log. Requests without a key are let through, as the API is as open as
+// the dashboard; ones with a key that is not configured are refused with 401.
+func (app *MyApp) apiAuth(w http.ResponseWriter, r *http.Request) bool {
+	name, err := app.apiKeyName(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+		writeJSON(w, http.StatusUnauthorized, apiError{Error: err.Error()})
+		return false
+	}
+	if name == "" {
+		return true
+	}
+
+	who := app.auditActor(r)
+	request, _ := json.Marshal(map[string]string{"method": r.Method, "path": r.URL.RequestURI()})
+	event := AuditEvent{
+		Occurred_at: time.Now().UTC(),
+		Action:      auditAPIKey,
+		Actor:       who.Name,
+		Ip:          who.IP,
+		Request_id:  who.Request_id,
+		After_json:  string(request),
+	}
+	if err := app.db.SaveReturningID("audit_events", &event, "Id"); err != nil {
+		log.Printf("Error recording use of API key %s: %v", name, err)
+	}
+	return true
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectAudit expects an event about link linkID to be appended to the audit
+// log
+func expectAudit(mock sqlmock.Sqlmock, action string, linkID int) {
+	mock.ExpectExec("^INSERT INTO audit_events ").
+		WithArgs(recentTime{}, action, linkID, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func TestAuditActor(t *testing.T) {
+	app := &MyApp{}
+	app.cfg.ActorHeader = "X-Forwarded-User"
+	app.cfg.APIKeys = []string{"deploy:s3cret"}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"nobody", nil, "anonymous"},
+		{"proxy user", map[string]string{"X-Forwarded-User": " alice "}, "alice"},
+		{"API key", map[string]string{"X-Forwarded-User": "alice", "Authorization": "Bearer s3cret"}, "api-key:deploy"},
+		{"unknown API key", map[string]string{"Authorization": "Bearer wrong"}, "anonymous"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(requestIDHeader, "req-1")
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+
+		got := app.auditActor(req)
+		want := auditActor{Name: tt.want, IP: "192.0.2.1", Request_id: "req-1"}
+		if got != want {
+			t.Errorf("%s: got %+v want %+v", tt.name, got, want)
+		}
+	}
+}
+
+func TestAuditSnapshot_RedactsPassword(t *testing.T) {
+	link := UrlShortener{Id: 7, Short_url: "abc12", Password_hash: "$2a$10$hash"}
+	snapshot, err := auditSnapshot(&link)
+	if err != nil {
+		t.Fatalf("Error taking a snapshot: %v", err)
+	}
+	if strings.Contains(snapshot, "$2a$10$hash") || !strings.Contains(snapshot, `"Password_hash":"redacted"`) {
+		t.Errorf("expected the password hash to be redacted, got %s", snapshot)
+	}
+	if link.Password_hash != "$2a$10$hash" {
+		t.Errorf("expected the link to be left alone, got %q", link.Password_hash)
+	}
+
+	if snapshot, _ := auditSnapshot(nil); snapshot != "" {
+		t.Errorf("expected no snapshot of no link, got %q", snapshot)
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	var seen string
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(requestIDHeader)
+	}))
+
+	for _, id := range []string{"", "abc-123", "not valid!", strings.Repeat("a", 65)} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if id != "" {
+			req.Header.Set(requestIDHeader, id)
+		}
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if !validRequestID(seen) {
+			t.Errorf("%q: expected a valid request id, got %q", id, seen)
+		}
+		if validRequestID(id) && seen != id {
+			t.Errorf("%q: expected the request id to be kept, got %q", id, seen)
+		}
+		if answered := rr.Header().Get(requestIDHeader); answered != seen {
+			t.Errorf("%q: answered with request id %q, handler saw %q", id, answered, seen)
+		}
+	}
+}
+
+func TestSplitAPIKey(t *testing.T) {
+	if name, key, err := splitAPIKey(" deploy : s3cret "); err != nil || name != "deploy" || key != "s3cret" {
+		t.Errorf("got %q, %q, %v", name, key, err)
+	}
+	for _, entry := range []string{"s3cret", ":s3cret", "deploy:"} {
+		_, _, err := splitAPIKey(entry)
+		if err == nil {
+			t.Errorf("%q: expected an error", entry)
+		} else if strings.Contains(err.Error(), "s3cret") {
+			t.Errorf("%q: the error gives the key away: %v", entry, err)
+		}
+	}
+}
+
+func TestApiAuth_UnknownKey(t *testing.T) {
+	app := &MyApp{}
+	app.cfg.APIKeys = []string{"deploy:s3cret"}
+
+	for _, authorization := range []string{"Bearer wrong", "Basic ZGVwbG95OnMzY3JldA=="} {
+		req := httptest.NewRequest("GET", "/api/links", nil)
+		req.Header.Set("Authorization", authorization)
+		rr := httptest.NewRecorder()
+
+		app.apiLinksHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusUnauthorized {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", authorization, status, http.StatusUnauthorized)
+		}
+		if challenge := rr.Header().Get("WWW-Authenticate"); challenge == "" {
+			t.Errorf("%s: expected a WWW-Authenticate header", authorization)
+		}
+	}
+}
+
+func TestApiAuth_RecordsKeyUse(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("^INSERT INTO audit_events ").
+		WithArgs(recentTime{}, auditAPIKey, 0, "api-key:deploy", "192.0.2.1", "req-1", "", `{"method":"GET","path":"/api/links?q=go"}`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	app.cfg.APIKeys = []string{"ci:other", "deploy:s3cret"}
+
+	req := httptest.NewRequest("GET", "/api/links?q=go", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Authorization", "Bearer s3cret")
+	req.Header.Set(requestIDHeader, "req-1")
+	rr := httptest.NewRecorder()
+
+	if !app.apiAuth(rr, req) {
+		t.Errorf("expected the request to be let through, got status %v", rr.Code)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAuditFilter(t *testing.T) {
+	values := url.Values{
+		"link":   {"7"},
+		"actor":  {"alice"},
+		"action": {"update"},
+		"since":  {"2026-10-01"},
+		"until":  {"2026-10-02T12:00:00+02:00"},
+	}
+	filter, err := auditFilterFromQuery(values)
+	if err != nil {
+		t.Fatalf("Error reading the filter: %v", err)
+	}
+
+	where, args := filter.where()
+	expected := "Link_id = ? AND Actor = ? AND Action = ? AND Occurred_at >= ? AND Occurred_at < ?"
+	if where != expected {
+		t.Errorf("got where %q want %q", where, expected)
+	}
+	expectedArgs := []interface{}{7, "alice", "update",
+		time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 10, 2, 10, 0, 0, 0, time.UTC)}
+	if !reflect.DeepEqual(args, expectedArgs) {
+		t.Errorf("got args %v want %v", args, expectedArgs)
+	}
+
+	if again, _ := auditFilterFromQuery(filter.values()); !reflect.DeepEqual(again.values(), filter.values()) {
+		t.Errorf("the filter did not survive a round trip: %v", again.values())
+	}
+
+	for _, bad := range []string{"link=abc", "since=yesterday", "until=2026-13-01"} {
+		values, _ := url.ParseQuery(bad)
+		if _, err := auditFilterFromQuery(values); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestApiAuditHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"Id", "Occurred_at", "Action", "Link_id", "Actor", "Ip", "Request_id", "Before_json", "After_json"}
+	occurred := time.Date(2026, 10, 5, 8, 30, 0, 0, time.UTC)
+	mock.ExpectQuery("^SELECT \\* FROM audit_events WHERE Link_id = \\? ORDER BY Id DESC LIMIT 3$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(12, occurred, "delete", 7, "alice", "192.0.2.1", "req-2", `{"Id":7}`, `{"Id":7,"Deleted_at":"2026-10-05T08:30:00Z"}`).
+			AddRow(9, occurred, "create", 7, "alice", "192.0.2.1", "req-1", "", `{"Id":7}`).
+			AddRow(8, occurred, "api_key.use", 0, "api-key:ci", "", "", "", `{}`))
+	mock.ExpectQuery("^SELECT \\* FROM audit_events WHERE \\(Link_id = \\?\\) AND \\(Id < \\?\\) ORDER BY Id DESC LIMIT 3$").
+		WithArgs(7, 9).
+		WillReturnRows(sqlmock.NewRows(columns))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	req := httptest.NewRequest("GET", "/api/audit?link=7&limit=2", nil)
+	rr := httptest.NewRecorder()
+
+	app.apiAuditHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var result struct {
+		Events     []apiAuditEvent `json:"events"`
+		NextCursor string          `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Error decoding %s: %v", rr.Body.String(), err)
+	}
+	if len(result.Events) != 2 || result.Events[0].Id != 12 || result.Events[1].Id != 9 {
+		t.Fatalf("handler returned unexpected events: %s", rr.Body.String())
+	}
+	if before := string(result.Events[1].Before); before != "null" {
+		t.Errorf("expected no before snapshot of a created link, got %s", before)
+	}
+	if result.NextCursor == "" {
+		t.Fatalf("expected a next cursor")
+	}
+
+	req = httptest.NewRequest("GET", "/api/audit?link=7&limit=2&cursor="+result.NextCursor, nil)
+	rr = httptest.NewRecorder()
+
+	app.apiAuditHandler(rr, req)
+
+	expected := `{"events":[]}` + "\n"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestApiAuditHandler_BadQuery(t *testing.T) {
+	app := &MyApp{}
+	for _, query := range []string{"limit=0", "cursor=nonsense", "since=yesterday"} {
+		req := httptest.NewRequest("GET", "/api/audit?"+query, nil)
+		rr := httptest.NewRecorder()
+
+		app.apiAuditHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", query, status, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestApiAuditExportHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"Id", "Action", "Actor"}
+	batch := sqlmock.NewRows(columns)
+	for id := 1; id <= auditExportBatch; id++ {
+		batch.AddRow(id, "update", "alice")
+	}
+	mock.ExpectQuery("^SELECT \\* FROM audit_events WHERE Actor = \\? ORDER BY Id LIMIT 500$").
+		WithArgs("alice").
+		WillReturnRows(batch)
+	mock.ExpectQuery("^SELECT \\* FROM audit_events WHERE \\(Actor = \\?\\) AND \\(Id > \\?\\) ORDER BY Id LIMIT 500$").
+		WithArgs("alice", auditExportBatch).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(auditExportBatch+1, "delete", "alice"))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	req := httptest.NewRequest("GET", "/api/audit/export?actor=alice", nil)
+	rr := httptest.NewRecorder()
+
+	app.apiAuditExportHandler(rr, req)
+
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("handler returned wrong content type %s", contentType)
+	}
+	lines := strings.Split(strings.TrimSuffix(rr.Body.String(), "\n"), "\n")
+	if len(lines) != auditExportBatch+1 {
+		t.Fatalf("expected %d lines, got %d", auditExportBatch+1, len(lines))
+	}
+	var last apiAuditEvent
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil || last.Id != auditExportBatch+1 || last.Action != "delete" {
+		t.Errorf("unexpected last line %s (%v)", lines[len(lines)-1], err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestAuditHandler_BadQuery(t *testing.T) {
+	tmpl := template.Must(template.New("audit.html").Parse(`{{.Error}} {{len .Events}}`))
+	app := &MyApp{tmpl: tmpl}
+
+	req := httptest.NewRequest("GET", "/audit?link=abc", nil)
+	rr := httptest.NewRecorder()
+
+	app.auditHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	expected := "link must be a link id 0"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", body, expected)
+	}
+}
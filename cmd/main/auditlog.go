@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// auditFilter narrows down the audit events listed by the audit page, the
+// API and the export. It is read from the link, actor, action, since and
+// until query parameters.
+type auditFilter struct {
+	Link_id int
+	Actor   string
+	Action  string
+	Since   time.Time // zero for no lower bound
+	Until   time.Time // zero for no upper bound, exclusive
+}
+
+// parseAuditTime reads a time given either as a date or in RFC 3339
+func parseAuditTime(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func auditFilterFromQuery(values url.Values) (auditFilter, error) {
+	filter := auditFilter{
+		Actor:  strings.TrimSpace(values.Get("actor")),
+		Action: strings.TrimSpace(values.Get("action")),
+	}
+	var err error
+	if link := values.Get("link"); link != "" {
+		if filter.Link_id, err = strconv.Atoi(link); err != nil {
+			return filter, fmt.Errorf("link must be a link id")
+		}
+	}
+	if since := values.Get("since"); since != "" {
+		if filter.Since, err = parseAuditTime(since); err != nil {
+			return filter, fmt.Errorf("since must be a date or an RFC 3339 time")
+		}
+	}
+	if until := values.Get("until"); until != "" {
+		if filter.Until, err = parseAuditTime(until); err != nil {
+			return filter, fmt.Errorf("until must be a date or an RFC 3339 time")
+		}
+	}
+	return filter, nil
+}
+
+// values encodes the filter as query parameters
+func (f auditFilter) values() url.Values {
+	values := url.Values{}
+	if f.Link_id != 0 {
+		values.Set("link", strconv.Itoa(f.Link_id))
+	}
+	if f.Actor != "" {
+		values.Set("actor", f.Actor)
+	}
+	if f.Action != "" {
+		values.Set("action", f.Action)
+	}
+	if !f.Since.IsZero() {
+		values.Set("since", f.Since.Format(time.RFC3339))
+	}
+	if !f.Until.IsZero() {
+		values.Set("until", f.Until.Format(time.RFC3339))
+	}
+	return values
+}
+
+func (f auditFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	if f.Link_id != 0 {
+		conditions = append(conditions, "Link_id = ?")
+		args = append(args, f.Link_id)
+	}
+	if f.Actor != "" {
+		conditions = append(conditions, "Actor = ?")
+		args = append(args, f.Actor)
+	}
+	if f.Action != "" {
+		conditions = append(conditions, "Action = ?")
+		args = append(args, f.Action)
+	}
+	if !f.Since.IsZero() {
+		conditions = append(conditions, "Occurred_at >= ?")
+		args = append(args, f.Since.UTC())
+	}
+	if !f.Until.IsZero() {
+		conditions = append(conditions, "Occurred_at < ?")
+		args = append(args, f.Until.UTC())
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// Audit events are listed newest first, and exported oldest first
+var (
+	auditNewestFirst = []StorageInterfaces.Order{{Column: "Id", Desc: true}}
+	auditOldestFirst = []StorageInterfaces.Order{{Column: "Id"}}
+)
+
+// auditCursorSort names the order of audit event cursors
+const auditCursorSort = "audit"
+
+// findAuditEvents returns the events matching filter, limited and ordered as
+// page says
+func (app *MyApp) findAuditEvents(filter auditFilter, page StorageInterfaces.Query) ([]AuditEvent, error) {
+	var events []AuditEvent
+	page.Where, page.Args = filter.where()
+	return events, app.db.Find("audit_events", page, &events)
+}
+
+// auditPage reads the limit and cursor query parameters into the part of a
+// query selecting a page of audit events, newest first. The limit is one
+// more than asked for, to find out whether there is a next page.
+func (app *MyApp) auditPage(values url.Values) (StorageInterfaces.Query, error) {
+	page := StorageInterfaces.Query{OrderBy: auditNewestFirst, Limit: app.pageSize()}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return page, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		page.Limit = n
+	}
+	page.Limit++
+
+	if token := values.Get("cursor"); token != "" {
+		sortName, after, err := pkg.DecodeCursor(token)
+		if err != nil || sortName != auditCursorSort || len(after) != 1 {
+			return page, fmt.Errorf("invalid cursor")
+		}
+		page.After = after
+	}
+	return page, nil
+}
+
+// nextAuditCursor trims the extra event auditPage asked for, and returns the
+// cursor of the page after it, or "" when there is none
+func nextAuditCursor(events []AuditEvent, page StorageInterfaces.Query) ([]AuditEvent, string) {
+	if len(events) < page.Limit {
+		return events, ""
+	}
+	events = events[:page.Limit-1]
+	cursor, _ := pkg.EncodeCursor(auditCursorSort, []interface{}{events[len(events)-1].Id})
+	return events, cursor
+}
+
+// apiAuditEvent is an audit event as the API and the export return it
+type apiAuditEvent struct {
+	Id          int64           `json:"id"`
+	Occurred_at time.Time       `json:"occurred_at"`
+	Action      string          `json:"action"`
+	Link_id     int             `json:"link_id"`
+	Actor       string          `json:"actor"`
+	Ip          string          `json:"ip"`
+	Request_id  string          `json:"request_id"`
+	Before      json.RawMessage `json:"before"` // null when the link did not exist
+	After       json.RawMessage `json:"after"`  // null when the link no longer exists
+}
+
+func newAPIAuditEvent(event AuditEvent) apiAuditEvent {
+	result := apiAuditEvent{
+		Id:          event.Id,
+		Occurred_at: event.Occurred_at.UTC(),
+		Action:      event.Action,
+		Link_id:     event.Link_id,
+		Actor:       event.Actor,
+		Ip:          event.Ip,
+		Request_id:  event.Request_id,
+	}
+	if event.Before_json != "" {
+		result.Before = json.RawMessage(event.Before_json)
+	}
+	if event.After_json != "" {
+		result.After = json.RawMessage(event.After_json)
+	}
+	return result
+}
+
+// auditViewPage is the data passed to audit.html
+type auditViewPage struct {
+	Events    []auditView
+	Filter    auditFilter
+	Actions   []string
+	Error     string
+	NextURL   string // "" on the last page
+	ExportURL string // the export of every event matching the filter
+}
+
+// auditView is an audit event as listed on the audit page, with its
+// snapshots indented for reading
+type auditView struct {
+	AuditEvent
+	Before string
+	After  string
+}
+
+func indentJSON(value string) string {
+	var out bytes.Buffer
+	if err := json.Indent(&out, []byte(value), "", "  "); err != nil {
+		return value
+	}
+	return out.String()
+}
+
+// auditHandler shows the audit log, newest events first, narrowed down by
+// the same query parameters as the API
+func (app *MyApp) auditHandler(w http.ResponseWriter, r *http.Request) {
+	page := auditViewPage{Actions: auditActions}
+	filter, err := auditFilterFromQuery(r.URL.Query())
+	page.Filter = filter
+	page.ExportURL = "/api/audit/export"
+	if values := filter.values(); len(values) > 0 {
+		page.ExportURL += "?" + values.Encode()
+	}
+	query, queryErr := app.auditPage(r.URL.Query())
+	if err == nil {
+		err = queryErr
+	}
+
+	status := http.StatusOK
+	if err != nil {
+		page.Error = err.Error()
+		status = http.StatusBadRequest
+	} else {
+		events, err := app.findAuditEvents(filter, query)
+		if err != nil {
+			log.Printf("Error retrieving audit events: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		events, cursor := nextAuditCursor(events, query)
+		for _, event := range events {
+			page.Events = append(page.Events, auditView{
+				AuditEvent: event,
+				Before:     indentJSON(event.Before_json),
+				After:      indentJSON(event.After_json),
+			})
+		}
+		if cursor != "" {
+			values := filter.values()
+			values.Set("cursor", cursor)
+			page.NextURL = "/audit?" + values.Encode()
+		}
+	}
+
+	if err := app.renderStatus(w, r, status, "audit.html", page); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// apiAuditHandler lists audit events as JSON, newest first, a page of limit
+// events at a time like /api/links
+func (app *MyApp) apiAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+		return
+	}
+	if !app.apiAuth(w, r) {
+		return
+	}
+
+	filter, err := auditFilterFromQuery(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+	page, err := app.auditPage(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+
+	events, err := app.findAuditEvents(filter, page)
+	if err != nil {
+		log.Printf("Error retrieving audit events: %v", err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "internal server error"})
+		return
+	}
+
+	events, cursor := nextAuditCursor(events, page)
+	result := struct {
+		Events     []apiAuditEvent `json:"events"`
+		NextCursor string          `json:"next_cursor,omitempty"`
+	}{Events: make([]apiAuditEvent, len(events)), NextCursor: cursor}
+	for i, event := range events {
+		result.Events[i] = newAPIAuditEvent(event)
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// auditExportBatch is the number of events the export reads at once
+const auditExportBatch = 500
+
+// apiAuditExportHandler streams every audit event matching the filter as
+// JSON Lines, oldest first
+func (app *MyApp) apiAuditExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+		return
+	}
+	if !app.apiAuth(w, r) {
+		return
+	}
+
+	filter, err := auditFilterFromQuery(r.URL.Query())
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+		return
+	}
+
+	page := StorageInterfaces.Query{OrderBy: auditOldestFirst, Limit: auditExportBatch}
+	encoder := json.NewEncoder(w)
+	for started := false; ; {
+		events, err := app.findAuditEvents(filter, page)
+		if err != nil {
+			log.Printf("Error exporting audit events: %v", err)
+			// Once lines have been sent the status can no longer change,
+			// and the export just stops
+			if !started {
+				writeJSON(w, http.StatusInternalServerError, apiError{Error: "internal server error"})
+			}
+			return
+		}
+
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Header().Set("Content-Disposition", `attachment; filename="audit-events.jsonl"`)
+			started = true
+		}
+		for _, event := range events {
+			if err := encoder.Encode(newAPIAuditEvent(event)); err != nil {
+				log.Printf("Error writing audit export: %v", err)
+				return
+			}
+		}
+		if len(events) < page.Limit {
+			return
+		}
+		page.After = []interface{}{events[len(events)-1].Id}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names given to bots that are told apart by their request rather than by
+// a signature of their user agent
+const (
+	botHeadRequest = "head request"
+	botPrefetch    = "prefetch"
+	botNoUserAgent = "no user agent"
+)
+
+// botRegistry holds the bot signatures in use, so they can be replaced while
+// requests are being served
+type botRegistry struct {
+	mu         sync.RWMutex
+	signatures *pkg.BotSignatures // nil for the built-in list
+}
+
+// loadBots reads the bot signatures file, when one is configured, into the
+// registry
+func (app *MyApp) loadBots() error {
+	if app.cfg.BotSignatures == "" {
+		return nil
+	}
+	signatures, err := pkg.LoadBotSignatures(app.cfg.BotSignatures)
+	if err != nil {
+		return err
+	}
+	app.bots.mu.Lock()
+	app.bots.signatures = signatures
+	app.bots.mu.Unlock()
+	return nil
+}
+
+// refreshBots reloads the bot signatures file every interval, so the list can
+// be updated without restarting the app. A file that cannot be read leaves
+// the signatures as they were.
+func (app *MyApp) refreshBots(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := app.loadBots(); err != nil {
+			log.Printf("Error loading bot signatures: %v", err)
+		}
+	}
+}
+
+// botName returns what made r when it was not a person following a link:
+// the signature its user agent matched, a HEAD request, a browser prefetching
+// the link or a client without a user agent. People get "".
+func (app *MyApp) botName(r *http.Request) string {
+	app.bots.mu.RLock()
+	signatures := app.bots.signatures
+	app.bots.mu.RUnlock()
+	if signatures == nil {
+		signatures = pkg.DefaultBotSignatures()
+	}
+
+	userAgent := strings.TrimSpace(r.UserAgent())
+	if signature := signatures.Match(userAgent); signature != "" {
+		return signature
+	}
+	switch {
+	case pkg.IsPrefetch(r.Header):
+		return botPrefetch
+	case r.Method == http.MethodHead:
+		return botHeadRequest
+	case userAgent == "":
+		return botNoUserAgent
+	}
+	return ""
+}
+
+// crawlerBot reports whether bot reads pages for what they say, as link
+// previews and search engines do. Prefetches must be redirected, as the
+// browser shows what it fetched once the link is followed.
+func crawlerBot(bot string) bool {
+	return bot != "" && bot != botPrefetch && bot != botHeadRequest
+}
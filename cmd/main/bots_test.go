@@ -0,0 +1,160 @@
+package main
+
+import (
+	"cmd/main/internal"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestBotName(t *testing.T) {
+	app := &MyApp{}
+	browser := "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36"
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    string
+	}{
+		{"person", "GET", map[string]string{"User-Agent": browser}, ""},
+		{"link preview", "GET", map[string]string{"User-Agent": "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)"}, "slackbot"},
+		{"prefetch", "GET", map[string]string{"User-Agent": browser, "Sec-Purpose": "prefetch"}, botPrefetch},
+		{"HEAD request", "HEAD", map[string]string{"User-Agent": browser}, botHeadRequest},
+		{"no user agent", "GET", nil, botNoUserAgent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/abc12", nil)
+		req.Header.Del("User-Agent")
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+
+		if got := app.botName(req); got != tt.want {
+			t.Errorf("%s: got %q want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadBots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bots.txt")
+	if err := os.WriteFile(path, []byte("# our own scanner\nlinkwatch\n"), 0o644); err != nil {
+		t.Fatalf("Error writing signatures: %v", err)
+	}
+
+	app := &MyApp{}
+	app.cfg.BotSignatures = path
+	if err := app.loadBots(); err != nil {
+		t.Fatalf("Error loading signatures: %v", err)
+	}
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	req.Header.Set("User-Agent", "LinkWatch/1.0")
+	if got := app.botName(req); got != "linkwatch" {
+		t.Errorf("expected the signature from the file, got %q", got)
+	}
+
+	// A broken update leaves the signatures as they were
+	os.Remove(path)
+	if err := app.loadBots(); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+	if got := app.botName(req); got != "linkwatch" {
+		t.Errorf("expected the signatures to be kept, got %q", got)
+	}
+}
+
+func TestRedirectHandler_BotPreview(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<title>Remote Page</title><meta property="og:image" content="/cover.png">`)
+	}))
+	defer server.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	tmpl := template.Must(template.New("bot_preview.html").Parse("{{.URL}}|{{.Title}}|{{.Image}}|{{.Destination}}"))
+	cfg := internal.Config{MetadataTimeout: time.Second, MetadataCacheTTL: time.Minute, MetadataAllowPrivate: true, BotPreview: true}
+	app := NewMyApp(&MySQLDatabase{DB: db}, tmpl, cfg)
+	app.clicks = newClickRecorder(app.db, 2)
+
+	for i := 0; i < 2; i++ {
+		mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+			WithArgs("abc12", 0).
+			WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url"}).AddRow(1, server.URL+"/page", "abc12"))
+	}
+
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	req.Header.Set("User-Agent", "Twitterbot/1.0")
+	rr := httptest.NewRecorder()
+	app.redirectHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	expected := "http://example.com/abc12|Remote Page|" + server.URL + "/cover.png|" + server.URL + "/page"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, expected)
+	}
+
+	// Prefetches are redirected, as the browser shows what it fetched
+	req = httptest.NewRequest("GET", "/abc12", nil)
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("Sec-Purpose", "prefetch")
+	rr = httptest.NewRecorder()
+	app.redirectHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusFound)
+	}
+
+	// Both hits are recorded as bots
+	close(app.clicks.events)
+	for _, expected := range []string{"twitterbot", botPrefetch} {
+		if click := <-app.clicks.events; click.Bot != expected {
+			t.Errorf("expected a hit of %q, got %+v", expected, click)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRedirectHandler_BotPreviewOnDomain(t *testing.T) {
+	app, mock := newDomainTestApp(t)
+	app.tmpl = template.Must(template.New("bot_preview.html").Parse("{{.URL}}|{{.Site}}"))
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+		WithArgs("abc12", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Domain_id", "Og_title", "Og_description", "Og_image"}).
+			AddRow(1, "https://example.com", "abc12", 2, "Spring sale", "Everything half off", "https://example.com/sale.png"))
+
+	// The short url is that of the configured domain, whatever case or port
+	// the request came with
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	req.Host = "GO.Example:8080"
+	req.Header.Set("User-Agent", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)")
+	rr := httptest.NewRecorder()
+	app.redirectHandler(rr, req)
+
+	if body := rr.Body.String(); body != "http://go.example/abc12|go.example" {
+		t.Errorf("handler returned unexpected body: %v", body)
+	}
+	if vary := rr.Header().Get("Vary"); vary != "User-Agent" {
+		t.Errorf("expected the preview to vary on the user agent, got Vary %q", vary)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
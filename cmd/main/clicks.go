@@ -0,0 +1,98 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ClickEvent is one redirect of a short url
+type ClickEvent struct {
+	Id         int64
+	Link_id    int
+	Variant_id int // 0 unless the link is split tested
+	Clicked_at time.Time
+	Referrer   string // domain of the page linking to the short url, "" when unknown
+	Country    string // "" when unknown
+	Device     string // one of the pkg.Device classes
+	Ip         string // truncated to its network, never the full address
+	Visitor    string // hash of the visitor's address and user agent
+	Bot        string // what made the request when it was not a person, see botName
+}
+
+// newClick describes the redirect of r to variant of link, telling bots
+// apart from people. In privacy mode, visitors sending DNT or Sec-GPC are
+// counted without their address, hash or referrer.
+func (app *MyApp) newClick(r *http.Request, link UrlShortener, variant Variant) ClickEvent {
+	ip := app.clientIP(r)
+	click := ClickEvent{
+		Link_id:    link.Id,
+		Variant_id: variant.Id,
+		Clicked_at: time.Now().UTC(),
+		Country:    app.geoip.Country(ip),
+		Device:     pkg.DeviceClass(r.UserAgent(), r.Header.Get("Sec-CH-UA-Mobile")),
+		Bot:        app.botName(r),
+	}
+	if app.cfg.PrivacyMode && pkg.DoNotTrack(r.Header.Get("DNT"), r.Header.Get("Sec-GPC")) {
+		return click
+	}
+	click.Referrer = pkg.ReferrerDomain(r.Referer())
+	click.Ip = pkg.TruncateIP(ip)
+	click.Visitor = app.visitorID(ip, r.UserAgent(), click.Clicked_at)
+	return click
+}
+
+// clickRecorder saves click events in the background, so redirects do not
+// wait for the database. A nil recorder drops every click.
+type clickRecorder struct {
+	db       *MySQLDatabase
+	events   chan ClickEvent
+	webhooks *webhookRegistry // told about every click, nil to tell no webhooks
+}
+
+func newClickRecorder(db *MySQLDatabase, buffer int) *clickRecorder {
+	return &clickRecorder{db: db, events: make(chan ClickEvent, buffer)}
+}
+
+// Record queues event to be saved. When the queue is full the click is
+// dropped rather than slowing down the redirect.
+func (c *clickRecorder) Record(event ClickEvent) {
+	if c == nil {
+		return
+	}
+	select {
+	case c.events <- event:
+	default:
+		log.Printf("Click buffer full, dropping a click of link %d", event.Link_id)
+	}
+}
+
+// Run saves queued clicks until the queue is closed
+func (c *clickRecorder) Run() {
+	for event := range c.events {
+		if err := c.save(event); err != nil {
+			log.Printf("Error saving click of link %d: %v", event.Link_id, err)
+		}
+	}
+}
+
+// save saves a click, along with its deliveries to the webhooks that want
+// to hear about clicks. Webhooks do not hear of bots.
+func (c *clickRecorder) save(event ClickEvent) error {
+	if event.Bot != "" || len(c.webhooks.subscribers(webhookClicked)) == 0 {
+		return c.db.SaveReturningID("click_events", &event, "Id")
+	}
+	return c.db.WithTx(context.Background(), func(tx StorageInterfaces.Store) error {
+		if err := tx.SaveReturningID("click_events", &event, "Id"); err != nil {
+			return err
+		}
+		return c.webhooks.enqueue(tx, webhookClicked, auditActor{}, webhookClickData{
+			Link_id:    event.Link_id,
+			Variant_id: event.Variant_id,
+			Clicked_at: event.Clicked_at.UTC(),
+		})
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestClickRecorder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	clickedAt := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	mock.ExpectExec("^INSERT INTO click_events \\(Link_id, Variant_id, Clicked_at, Referrer, Country, Device, Ip, Visitor, Bot\\) VALUES \\(\\?, \\?, \\?, \\?, \\?, \\?, \\?, \\?, \\?\\)$").
+		WithArgs(1, 4, clickedAt, "example.com", "DE", "mobile", "203.0.113.0", "5f1d0c3a", "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	recorder := newClickRecorder(&MySQLDatabase{DB: db}, 1)
+	recorder.Record(ClickEvent{Link_id: 1, Variant_id: 4, Clicked_at: clickedAt, Referrer: "example.com", Country: "DE", Device: "mobile", Ip: "203.0.113.0", Visitor: "5f1d0c3a"})
+	// The buffer is full, so this click is dropped
+	recorder.Record(ClickEvent{Link_id: 2, Clicked_at: clickedAt})
+	close(recorder.events)
+	recorder.Run()
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+
+	// Apps without a recorder do not record clicks
+	var none *clickRecorder
+	none.Record(ClickEvent{Link_id: 1})
+}
+
+func TestNewClick(t *testing.T) {
+	geoip, err := pkg.ParseGeoIP(strings.NewReader("2.16.0.0/13,DE\n"))
+	if err != nil {
+		t.Fatalf("Error parsing the GeoIP database: %v", err)
+	}
+	app := &MyApp{geoip: geoip}
+
+	r := httptest.NewRequest(http.MethodGet, "/abc12", nil)
+	r.RemoteAddr = "2.16.1.1:51234"
+	r.Header.Set("Referer", "https://www.example.com/post")
+	r.Header.Set("User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148 Safari/604.1")
+	click := app.newClick(r, UrlShortener{Id: 3}, Variant{Id: 9})
+	if click.Link_id != 3 || click.Variant_id != 9 || click.Referrer != "example.com" || click.Country != "DE" || click.Device != pkg.DeviceMobile {
+		t.Errorf("unexpected click %+v", click)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"net/http"
+)
+
+// Dedupe modes decide what happens when a url that was already shortened is
+// submitted again
+const (
+	DedupeReject         = "reject"          // refuse the url
+	DedupeReturnExisting = "return-existing" // hand back the existing short url
+	DedupeAlwaysNew      = "always-new"      // create another short url
+)
+
+func isDedupeMode(mode string) bool {
+	switch mode {
+	case DedupeReject, DedupeReturnExisting, DedupeAlwaysNew:
+		return true
+	}
+	return false
+}
+
+// dedupeMode returns the mode chosen in the form, falling back to the
+// configured default and then to DedupeReject
+func (app *MyApp) dedupeMode(r *http.Request) string {
+	if mode := r.FormValue("dedupe"); isDedupeMode(mode) {
+		return mode
+	}
+	if isDedupeMode(app.cfg.DedupeMode) {
+		return app.cfg.DedupeMode
+	}
+	return DedupeReject
+}
+
+// normalizeOptions are the configured rules urls are matched on
+func (app *MyApp) normalizeOptions() pkg.NormalizeOptions {
+	return pkg.NormalizeOptions{
+		StripParams:         app.cfg.TrackingParams,
+		RemoveFragment:      app.cfg.DedupeRemoveFragment,
+		RemoveTrailingSlash: app.cfg.DedupeRemoveTrailingSlash,
+	}
+}
+
+// urlHash returns the url_hash of a link to urlStr, which links to the same
+// place share
+func (app *MyApp) urlHash(urlStr string) (string, error) {
+	normalized, err := pkg.NormalizeURL(urlStr, app.normalizeOptions())
+	if err != nil {
+		return "", err
+	}
+	return pkg.HashURL(normalized), nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"cmd/main/internal"
+	"cmd/main/pkg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestFormHandler_ReturnExisting(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	// The submitted url only differs from the stored one by its host case,
+	// default port and tracking parameters
+	rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Url_hash"}).
+		AddRow(1, "https://example.com/?a=1", "abc12", normalizedHash(t, "https://example.com/?a=1"))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Url_hash = \\? AND Domain_id = \\? AND Deleted_at IS NULL FOR UPDATE$").
+		WithArgs(normalizedHash(t, "https://example.com/?a=1"), 0).
+		WillReturnRows(rows)
+	mock.ExpectRollback()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}, cfg: internal.Config{TrackingParams: []string{"utm_*"}}}
+
+	form := strings.NewReader("textInput=" + "https%3A%2F%2FExample.com%3A443%2F%3Futm_source%3Dmail%26a%3D1" + "&dedupe=return-existing")
+	req := httptest.NewRequest("POST", "/submit", form)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusSeeOther {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusSeeOther)
+	}
+
+	if f := expectFlash(t, rr, "/", flashSuccess); f.Short_url != "http://example.com/abc12" {
+		t.Errorf("expected the existing short url in the flash message, got %q", f.Short_url)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFormHandler_AlwaysNew(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	// No lookup of the hash happens before the insert
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO url_shortener").
+		WithArgs(insertArgs(UrlShortener{Original_url: "https://example.com", Url_hash: normalizedHash(t, "https://example.com")})...).
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	expectLinkChanged(mock, auditCreate, 2)
+	mock.ExpectCommit()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}, cfg: internal.Config{DedupeMode: DedupeAlwaysNew}}
+
+	form := strings.NewReader("textInput=https://example.com")
+	req := httptest.NewRequest("POST", "/submit", form)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	if f := expectFlash(t, rr, "/", flashSuccess); !strings.HasPrefix(f.Short_url, "http://example.com/") {
+		t.Errorf("expected the new short url in the flash message, got %q", f.Short_url)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// normalizedHash returns the url_hash stored for urlStr
+func normalizedHash(t *testing.T, urlStr string) string {
+	normalized, err := pkg.NormalizeURL(urlStr, pkg.NormalizeOptions{})
+	if err != nil {
+		t.Fatalf("Failed to normalize %s: %v", urlStr, err)
+	}
+	return pkg.HashURL(normalized)
+}
+
+func TestDedupeMode(t *testing.T) {
+	app := &MyApp{cfg: internal.Config{DedupeMode: DedupeReturnExisting}}
+
+	testCases := []struct {
+		form string
+		mode string
+	}{
+		{"", DedupeReturnExisting},
+		{"dedupe=always-new", DedupeAlwaysNew},
+		{"dedupe=unknown", DedupeReturnExisting},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("POST", "/submit", strings.NewReader(tc.form))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if mode := app.dedupeMode(req); mode != tc.mode {
+			t.Errorf("dedupeMode(%s) = %s, expected %s", tc.form, mode, tc.mode)
+		}
+	}
+
+	if mode := (&MyApp{}).dedupeMode(httptest.NewRequest("GET", "/", nil)); mode != DedupeReject {
+		t.Errorf("Expected %s without configuration, got %s", DedupeReject, mode)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Domain is a branded host that short urls can live on. Links that are not
+// on any of them belong to the default domain, which has id 0.
+type Domain struct {
+	Id            int
+	Host          string
+	Not_found_url string // where unknown short urls on this domain lead
+	Template_dir  string // directory with templates overriding the default ones
+}
+
+// domainRegistry keeps the domains table in memory, along with the parsed
+// templates of every domain that has its own
+type domainRegistry struct {
+	mu        sync.RWMutex
+	byHost    map[string]Domain
+	templates map[int]*template.Template
+}
+
+// loadDomains reads the domains table into the registry
+func (app *MyApp) loadDomains() error {
+	var domains []Domain
+	if err := app.db.GetAll("domains", &domains); err != nil {
+		return err
+	}
+
+	byHost := make(map[string]Domain, len(domains))
+	templates := make(map[int]*template.Template)
+	for _, domain := range domains {
+		byHost[strings.ToLower(domain.Host)] = domain
+		if domain.Template_dir == "" {
+			continue
+		}
+		tmpl, err := template.New("").Funcs(templateFuncs).Funcs(app.assets.funcs()).ParseGlob(filepath.Join(domain.Template_dir, "*.html"))
+		if err != nil {
+			log.Printf("Error parsing templates of %s: %v", domain.Host, err)
+			continue
+		}
+		templates[domain.Id] = tmpl
+	}
+
+	app.domains.mu.Lock()
+	app.domains.byHost = byHost
+	app.domains.templates = templates
+	app.domains.mu.Unlock()
+	return nil
+}
+
+// refreshDomains reloads the domains table every interval, so domains can be
+// added without restarting the app
+func (app *MyApp) refreshDomains(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := app.loadDomains(); err != nil {
+			log.Printf("Error loading domains: %v", err)
+		}
+	}
+}
+
+// domainFor returns the domain the request was made to, based on its Host
+// header. Hosts that are not in the domains table get the default domain.
+func (app *MyApp) domainFor(r *http.Request) Domain {
+	domain, ok := app.lookupDomain(r.Host)
+	if !ok {
+		return Domain{Host: r.Host}
+	}
+	return domain
+}
+
+// lookupDomain finds the domain for host, ignoring case and any port
+func (app *MyApp) lookupDomain(host string) (Domain, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	app.domains.mu.RLock()
+	defer app.domains.mu.RUnlock()
+	domain, ok := app.domains.byHost[strings.ToLower(host)]
+	return domain, ok
+}
+
+// domainHosts maps every domain id to its host. The default domain gets the
+// host the request was made to.
+func (app *MyApp) domainHosts(r *http.Request) map[int]string {
+	app.domains.mu.RLock()
+	defer app.domains.mu.RUnlock()
+
+	hosts := make(map[int]string, len(app.domains.byHost)+1)
+	for _, domain := range app.domains.byHost {
+		hosts[domain.Id] = domain.Host
+	}
+	hosts[0] = r.Host
+	return hosts
+}
+
+// shortURL is the address of link, made on domain
+func shortURL(r *http.Request, domain Domain, link UrlShortener) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + domain.Host + "/" + link.Short_url
+}
+
+// linkNotFound answers a request for a short url that does not exist on the
+// requested domain
+func (app *MyApp) linkNotFound(w http.ResponseWriter, r *http.Request, domain Domain) {
+	if domain.Not_found_url != "" {
+		http.Redirect(w, r, domain.Not_found_url, http.StatusFound)
+		return
+	}
+	http.NotFound(w, r)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newDomainTestApp returns an app that has loaded go.example with id 2 and
+// docs.example with id 3, the latter with its own templates
+func newDomainTestApp(t *testing.T) (*MyApp, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	templateDir := t.TempDir()
+	err = os.WriteFile(filepath.Join(templateDir, "viewurls.html"), []byte("docs:{{range .Links}}{{.Host}}/{{.Short_url}} {{end}}"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write template: %v", err)
+	}
+
+	rows := sqlmock.NewRows([]string{"Id", "Host", "Not_found_url", "Template_dir"}).
+		AddRow(2, "go.example", "https://example.com/missing", "").
+		AddRow(3, "Docs.Example", "", templateDir)
+	mock.ExpectQuery("^SELECT \\* FROM domains$").WillReturnRows(rows)
+
+	tmpl := template.Must(template.New("viewurls.html").Parse("default:{{range .Links}}{{.Host}}/{{.Short_url}} {{end}}"))
+	app := &MyApp{db: &MySQLDatabase{DB: db}, tmpl: tmpl}
+	if err := app.loadDomains(); err != nil {
+		t.Fatalf("Error in loadDomains: %v", err)
+	}
+	return app, mock
+}
+
+func TestDomainFor(t *testing.T) {
+	app, _ := newDomainTestApp(t)
+
+	testCases := []struct {
+		host string
+		id   int
+	}{
+		{"go.example", 2},
+		{"GO.example:8080", 2},
+		{"docs.example", 3},
+		{"localhost:8080", 0},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = tc.host
+		if domain := app.domainFor(req); domain.Id != tc.id {
+			t.Errorf("domainFor(%s) returned domain %d, expected %d", tc.host, domain.Id, tc.id)
+		}
+	}
+}
+
+func TestRedirectHandler_CustomDomain(t *testing.T) {
+	app, mock := newDomainTestApp(t)
+
+	rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Domain_id"}).
+		AddRow(5, "http://example.org", "abc12", 2)
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+		WithArgs("abc12", 2).
+		WillReturnRows(rows)
+
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	req.Host = "go.example"
+	rr := httptest.NewRecorder()
+
+	app.redirectHandler(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "http://example.org" {
+		t.Errorf("handler returned unexpected location: got %v want http://example.org", location)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRedirectHandler_DomainNotFoundUrl(t *testing.T) {
+	app, mock := newDomainTestApp(t)
+
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+		WithArgs("nope1", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"Id"}))
+
+	req := httptest.NewRequest("GET", "/nope1", nil)
+	req.Host = "go.example"
+	rr := httptest.NewRecorder()
+
+	app.redirectHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusFound)
+	}
+
+	if location := rr.Header().Get("Location"); location != "https://example.com/missing" {
+		t.Errorf("handler returned unexpected location: got %v want https://example.com/missing", location)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestViewUrlsHandler_DomainTemplates(t *testing.T) {
+	app, mock := newDomainTestApp(t)
+
+	testCases := []struct {
+		host string
+		body string
+	}{
+		{"localhost:8080", "default:localhost:8080/abc12 go.example/xyz78 "},
+		{"docs.example", "docs:docs.example/abc12 go.example/xyz78 "},
+	}
+
+	for _, tc := range testCases {
+		rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Domain_id"}).
+			AddRow(1, "http://example.com", "abc12", 0).
+			AddRow(2, "http://example.org", "xyz78", 2)
+		mock.ExpectQuery("^SELECT \\* FROM folders$").WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}))
+		mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM url_shortener WHERE Deleted_at IS NULL$").WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(2))
+		mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at IS NULL ORDER BY Id DESC LIMIT 50$").WillReturnRows(rows)
+		expectLinkHealth(mock, 1, 2)
+
+		req := httptest.NewRequest("GET", "/viewurls", nil)
+		req.Host = tc.host
+		rr := httptest.NewRecorder()
+
+		app.viewUrlsHandler(rr, req)
+
+		if body := rr.Body.String(); body != tc.body {
+			t.Errorf("handler returned unexpected body for %s: got %q want %q", tc.host, body, tc.body)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFormHandler_UnknownDomain(t *testing.T) {
+	app, mock := newDomainTestApp(t)
+
+	form := strings.NewReader("textInput=https://example.com&domain=unknown.example")
+	req := httptest.NewRequest("POST", "/submit", form)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	expectFlash(t, rr, "/", flashError)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFormHandler_AssignsDomain(t *testing.T) {
+	app, mock := newDomainTestApp(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Url_hash = \\? AND Domain_id = \\? AND Deleted_at IS NULL FOR UPDATE$").
+		WithArgs(normalizedHash(t, "https://example.com"), 3).
+		WillReturnRows(sqlmock.NewRows([]string{"Id"}))
+	mock.ExpectExec("^INSERT INTO url_shortener").
+		WithArgs(insertArgs(UrlShortener{Original_url: "https://example.com", Url_hash: normalizedHash(t, "https://example.com"), Domain_id: 3})...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectLinkChanged(mock, auditCreate, 1)
+	mock.ExpectCommit()
+
+	form := strings.NewReader("textInput=https://example.com")
+	req := httptest.NewRequest("POST", "/submit", form)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.Host = "docs.example"
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	expectFlash(t, rr, "/", flashSuccess)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// editPage is the data passed to edit.html
+type editPage struct {
+	Link      UrlShortener
+	Host      string
+	Folder    string
+	Rules     []ruleRow    // the link's redirect rules and an empty row for a new one
+	Variants  []variantRow // the link's variants and an empty row for a new one
+	Platforms []string
+	Saved     bool
+	Error     string
+}
+
+// ruleRow is a redirect rule as edited in the form, with lists comma separated
+type ruleRow struct {
+	UserAgents  string
+	Platforms   string
+	Languages   string
+	Countries   string
+	Days        string
+	From        string
+	To          string
+	Timezone    string
+	Destination string
+}
+
+// variantRow is a variant as edited in the form
+type variantRow struct {
+	Id          int
+	Name        string
+	Destination string
+	Weight      string
+}
+
+// editLinkHandler shows the edit page of the link with the id query
+// parameter, and saves the destination, details, redirect rules and split
+// test submitted from it
+func (app *MyApp) editLinkHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := app.linkByID(w, r)
+	if !ok {
+		return
+	}
+	if link.Deleted_at != nil {
+		// Links in the trash are restored before they are edited
+		http.NotFound(w, r)
+		return
+	}
+
+	page := editPage{
+		Link:      link,
+		Host:      app.domainHosts(r)[link.Domain_id],
+		Platforms: pkg.Platforms,
+		Saved:     r.URL.Query().Get("saved") != "",
+	}
+
+	if r.Method != http.MethodPost {
+		rules, err := pkg.ParseRedirectRules(link.Redirect_rules)
+		if err != nil {
+			log.Printf("Error parsing redirect rules of %s: %v", link.Short_url, err)
+		}
+		page.Rules = append(ruleRows(rules), ruleRow{})
+
+		variants, err := app.linkVariants(link)
+		if err != nil {
+			log.Printf("Error retrieving variants of %s: %v", link.Short_url, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		page.Variants = append(variantRows(variants), variantRow{})
+
+		if link.Folder_id != 0 {
+			var folder Folder
+			if err := app.db.GetByWhere("folders", "Id = ?", []interface{}{link.Folder_id}, &folder); err != nil {
+				log.Printf("Error retrieving folder %d: %v", link.Folder_id, err)
+			}
+			page.Folder = folder.Name
+		}
+		app.renderEditPage(w, r, http.StatusOK, page)
+		return
+	}
+
+	ruleInput := formRuleRows(r)
+	variantInput := formVariantRows(r)
+	link.Original_url = strings.TrimSpace(r.FormValue("original_url"))
+	link.Split_test = r.PostFormValue("split_test") != ""
+	link.Sticky_variants = r.PostFormValue("sticky_variants") != ""
+
+	details, err := linkDetailsFromForm(r)
+	details.apply(&link)
+	var rules pkg.RedirectRules
+	if err == nil {
+		rules, err = rulesFromRows(ruleInput)
+	}
+	var variants []Variant
+	if err == nil {
+		variants, err = variantsFromRows(variantInput, link.Id)
+	}
+	if !pkg.IsValidURL(link.Original_url) {
+		err = fmt.Errorf("url must be valid, for example https://www.google.com")
+	} else if err == nil {
+		if destination := app.blockedDestination(link, rules, variants); destination != "" {
+			err = fmt.Errorf("%s cannot be shortened", destination)
+		}
+	}
+	if err != nil {
+		page.Link = link
+		page.Folder = details.Folder
+		page.Rules = append(ruleInput, ruleRow{})
+		page.Variants = append(variantInput, variantRow{})
+		page.Error = err.Error()
+		app.renderEditPage(w, r, http.StatusBadRequest, page)
+		return
+	}
+
+	urlHash, err := app.urlHash(link.Original_url)
+	if err == nil {
+		err = app.db.WithTx(r.Context(), func(tx StorageInterfaces.Store) error {
+			// Read again under a lock: the settings the form does not edit
+			// are kept as they are now, and a link moved to the trash
+			// meanwhile stays there
+			var saved UrlShortener
+			err := tx.GetByWhere("url_shortener", "Id = ? AND Deleted_at IS NULL FOR UPDATE", []interface{}{link.Id}, &saved)
+			if errors.Is(err, sql.ErrNoRows) {
+				return errLinkDeleted
+			} else if err != nil {
+				return err
+			}
+			before := saved
+			saved.Original_url, saved.Url_hash = link.Original_url, urlHash
+			saved.Redirect_rules = rules.String()
+			saved.Split_test, saved.Sticky_variants = link.Split_test, link.Sticky_variants
+			details.apply(&saved)
+			if saved.Folder_id, err = folderID(tx, details.Folder); err != nil {
+				return err
+			}
+			if fields := changedFields(before, saved); len(fields) > 0 {
+				if err := tx.UpdateFields("url_shortener", &saved, "Id", fields...); err != nil {
+					return err
+				}
+			}
+			if err := saveTags(tx, saved.Id, details.Tags); err != nil {
+				return err
+			}
+			if err := saveVariants(tx, saved.Id, variants); err != nil {
+				return err
+			}
+			return app.linkChanged(tx, app.auditActor(r), auditUpdate, &before, &saved)
+		})
+	}
+	if errors.Is(err, errLinkDeleted) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error updating link %d: %v", link.Id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/links/edit?id=%d&saved=1", link.Id), http.StatusSeeOther)
+}
+
+// linkByID loads the link named by the id parameter. When it cannot, it
+// answers with 404 or 500 and returns false.
+func (app *MyApp) linkByID(w http.ResponseWriter, r *http.Request) (UrlShortener, bool) {
+	var link UrlShortener
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return link, false
+	}
+
+	err = app.db.GetByWhere("url_shortener", "Id = ?", []interface{}{id}, &link)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return link, false
+	} else if err != nil {
+		log.Printf("Error retrieving link %d: %v", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return link, false
+	}
+	return link, true
+}
+
+func (app *MyApp) renderEditPage(w http.ResponseWriter, r *http.Request, status int, page editPage) {
+	if err := app.renderStatus(w, r, status, "edit.html", page); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// blockedDestination returns the first destination of link, its redirect
+// rules or its variants that is on the blocklist, or "" when none is
+func (app *MyApp) blockedDestination(link UrlShortener, rules pkg.RedirectRules, variants []Variant) string {
+	destinations := []string{link.Original_url}
+	for _, rule := range rules {
+		destinations = append(destinations, rule.Destination)
+	}
+	for _, variant := range variants {
+		destinations = append(destinations, variant.Destination)
+	}
+	for _, destination := range destinations {
+		if app.blocked.Blocked(destination) {
+			return destination
+		}
+	}
+	return ""
+}
+
+// formRuleRows reads the rule rows of the edit form in order, leaving out
+// rows where nothing was filled in
+func formRuleRows(r *http.Request) []ruleRow {
+	r.ParseForm()
+	field := func(name string, i int) string {
+		if values := r.PostForm[name]; i < len(values) {
+			return strings.TrimSpace(values[i])
+		}
+		return ""
+	}
+
+	var rows []ruleRow
+	for i := range r.PostForm["rule_destination"] {
+		row := ruleRow{
+			UserAgents:  field("rule_user_agents", i),
+			Platforms:   field("rule_platforms", i),
+			Languages:   field("rule_languages", i),
+			Countries:   field("rule_countries", i),
+			Days:        field("rule_days", i),
+			From:        field("rule_from", i),
+			To:          field("rule_to", i),
+			Timezone:    field("rule_timezone", i),
+			Destination: field("rule_destination", i),
+		}
+		if row != (ruleRow{}) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func rulesFromRows(rows []ruleRow) (pkg.RedirectRules, error) {
+	var rules pkg.RedirectRules
+	for _, row := range rows {
+		rule := pkg.RedirectRule{
+			UserAgents:  splitList(row.UserAgents),
+			Platforms:   splitList(strings.ToLower(row.Platforms)),
+			Languages:   splitList(strings.ToLower(row.Languages)),
+			Countries:   splitList(strings.ToUpper(row.Countries)),
+			Destination: row.Destination,
+		}
+		if row.Days != "" || row.From != "" || row.To != "" || row.Timezone != "" {
+			rule.Window = &pkg.TimeWindow{
+				Days:     splitList(strings.ToLower(row.Days)),
+				From:     row.From,
+				To:       row.To,
+				Timezone: row.Timezone,
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rules.Validate()
+}
+
+func ruleRows(rules pkg.RedirectRules) []ruleRow {
+	rows := make([]ruleRow, len(rules))
+	for i, rule := range rules {
+		rows[i] = ruleRow{
+			UserAgents:  strings.Join(rule.UserAgents, ", "),
+			Platforms:   strings.Join(rule.Platforms, ", "),
+			Languages:   strings.Join(rule.Languages, ", "),
+			Countries:   strings.Join(rule.Countries, ", "),
+			Destination: rule.Destination,
+		}
+		if rule.Window != nil {
+			rows[i].Days = strings.Join(rule.Window.Days, ", ")
+			rows[i].From = rule.Window.From
+			rows[i].To = rule.Window.To
+			rows[i].Timezone = rule.Window.Timezone
+		}
+	}
+	return rows
+}
+
+// formVariantRows reads the variant rows of the edit form in order, leaving
+// out rows without a name or destination
+func formVariantRows(r *http.Request) []variantRow {
+	r.ParseForm()
+	field := func(name string, i int) string {
+		if values := r.PostForm[name]; i < len(values) {
+			return strings.TrimSpace(values[i])
+		}
+		return ""
+	}
+
+	var rows []variantRow
+	for i := range r.PostForm["variant_destination"] {
+		id, _ := strconv.Atoi(field("variant_id", i))
+		row := variantRow{
+			Id:          id,
+			Name:        field("variant_name", i),
+			Destination: field("variant_destination", i),
+			Weight:      field("variant_weight", i),
+		}
+		if row.Name != "" || row.Destination != "" {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func variantsFromRows(rows []variantRow, linkID int) ([]Variant, error) {
+	variants := make([]Variant, len(rows))
+	for i, row := range rows {
+		variant := Variant{Id: row.Id, Link_id: linkID, Name: row.Name, Destination: row.Destination, Weight: 1}
+		if variant.Name == "" {
+			variant.Name = fmt.Sprintf("Variant %d", i+1)
+		}
+		if row.Weight != "" {
+			weight, err := strconv.Atoi(row.Weight)
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("variant %d: weight must be a whole number of at least 0", i+1)
+			}
+			variant.Weight = weight
+		}
+		if len(variant.Name) > 64 {
+			return nil, fmt.Errorf("variant %d: name must be at most 64 characters", i+1)
+		}
+		if !pkg.IsValidURL(variant.Destination) {
+			return nil, fmt.Errorf("variant %d: invalid destination %q", i+1, variant.Destination)
+		}
+		variants[i] = variant
+	}
+	return variants, nil
+}
+
+func variantRows(variants []Variant) []variantRow {
+	rows := make([]variantRow, len(variants))
+	for i, variant := range variants {
+		rows[i] = variantRow{
+			Id:          variant.Id,
+			Name:        variant.Name,
+			Destination: variant.Destination,
+			Weight:      strconv.Itoa(variant.Weight),
+		}
+	}
+	return rows
+}
+
+// saveVariants makes variants the variants of the link. Variants that already
+// belong to the link are updated in place, keeping their id for the clicks
+// and cookies that refer to it; the others are added, and variants of the
+// link that are not in the list are removed.
+func saveVariants(tx StorageInterfaces.Store, linkID int, variants []Variant) error {
+	var existing []Variant
+	if err := tx.GetAllByWhere("link_variants", "Link_id = ?", []interface{}{linkID}, &existing); err != nil {
+		return err
+	}
+	kept := map[int]bool{}
+	for _, variant := range existing {
+		kept[variant.Id] = false
+	}
+
+	for i := range variants {
+		if _, ok := kept[variants[i].Id]; ok {
+			kept[variants[i].Id] = true
+			if err := tx.Update("link_variants", &variants[i], "Id"); err != nil {
+				return err
+			}
+			continue
+		}
+		variants[i].Id = 0
+		if err := tx.SaveReturningID("link_variants", &variants[i], "Id"); err != nil {
+			return err
+		}
+	}
+
+	for _, variant := range existing {
+		if !kept[variant.Id] {
+			if err := tx.Delete("link_variants", "Id = ?", []interface{}{variant.Id}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
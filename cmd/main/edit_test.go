@@ -0,0 +1,295 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"database/sql"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const editTestTemplate = `{{.Link.Original_url}}|{{.Error}}|{{.Saved}}|{{range .Rules}}[{{.Platforms}};{{.Days}};{{.Destination}}]{{end}}|` +
+	`{{.Link.Split_test}}|{{range .Variants}}[{{.Id}};{{.Name}};{{.Weight}}]{{end}}`
+
+func newEditTestApp(t *testing.T) (*MyApp, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	tmpl := template.Must(template.New("edit.html").Parse(editTestTemplate))
+	return &MyApp{db: &MySQLDatabase{DB: db}, tmpl: tmpl}, mock
+}
+
+func expectLinkByID(mock sqlmock.Sqlmock, rules string) {
+	rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Url_hash", "Redirect_rules", "Split_test"}).
+		AddRow(7, "https://example.com", "abc12", "oldhash", rules, true)
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\?$").
+		WithArgs(7).
+		WillReturnRows(rows)
+}
+
+// expectLockedLink expects link 7 to be read again under a lock while it is
+// saved
+func expectLockedLink(mock sqlmock.Sqlmock, rules string) {
+	rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Url_hash", "Redirect_rules", "Split_test"}).
+		AddRow(7, "https://example.com", "abc12", "oldhash", rules, true)
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\? AND Deleted_at IS NULL FOR UPDATE$").
+		WithArgs(7).
+		WillReturnRows(rows)
+}
+
+func TestEditLinkHandler_Get(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	expectLinkByID(mock, `[{"platforms":["ios","android"],"window":{"days":["sat"]},"destination":"https://m.example.com"}]`)
+	mock.ExpectQuery("^SELECT \\* FROM link_variants WHERE Link_id = \\? ORDER BY Id$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Name", "Destination", "Weight"}).
+			AddRow(3, 7, "A", "https://example.com/a", 70).
+			AddRow(4, 7, "B", "https://example.com/b", 30))
+
+	req := httptest.NewRequest("GET", "/links/edit?id=7&saved=1", nil)
+	rr := httptest.NewRecorder()
+
+	app.editLinkHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	expected := "https://example.com||true|[ios, android;sat;https://m.example.com][;;]|true|[3;A;70][4;B;30][0;;]"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestEditLinkHandler_NotFound(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\?$").
+		WithArgs(8).
+		WillReturnError(sql.ErrNoRows)
+
+	for _, target := range []string{"/links/edit?id=8", "/links/edit?id=abc"} {
+		req := httptest.NewRequest("GET", target, nil)
+		rr := httptest.NewRecorder()
+
+		app.editLinkHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusNotFound {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", target, status, http.StatusNotFound)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestEditLinkHandler_Save(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	expectLinkByID(mock, "")
+
+	rules := `[{"platforms":["android"],"destination":"https://play.google.com/app"},` +
+		`{"countries":["DE","AT"],"window":{"days":["sat","sun"],"from":"22:00","to":"06:00"},"destination":"https://example.de"}]`
+	// Only the columns the form changed are written, over the link as read
+	// again under a lock
+	mock.ExpectBegin()
+	expectLockedLink(mock, "")
+	mock.ExpectExec("^UPDATE url_shortener SET Original_url = \\?, Url_hash = \\?, Redirect_rules = \\?, Split_test = \\? WHERE Id = \\?$").
+		WithArgs("https://example.org", normalizedHash(t, "https://example.org"), rules, false, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^DELETE FROM link_tags WHERE Link_id = \\?$").
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("^SELECT \\* FROM link_variants WHERE Link_id = \\?$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Name", "Destination", "Weight"}).
+			AddRow(3, 7, "A", "https://example.com/a", 50).
+			AddRow(4, 7, "B", "https://example.com/b", 50))
+	mock.ExpectExec("^UPDATE link_variants SET Link_id = \\?, Name = \\?, Destination = \\?, Weight = \\? WHERE Id = \\?$").
+		WithArgs(7, "A", "https://example.com/a", 70, 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^INSERT INTO link_variants \\(Link_id, Name, Destination, Weight\\) VALUES").
+		WithArgs(7, "Variant 2", "https://example.com/c", 30).
+		WillReturnResult(sqlmock.NewResult(5, 1))
+	mock.ExpectExec("^DELETE FROM link_variants WHERE Id = \\?$").
+		WithArgs(4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLinkChanged(mock, auditUpdate, 7)
+	mock.ExpectCommit()
+
+	form := url.Values{
+		"original_url":     {" https://example.org "},
+		"rule_user_agents": {"", "", ""},
+		"rule_platforms":   {"Android", "", ""},
+		"rule_languages":   {"", "", ""},
+		"rule_countries":   {"", "", "de, at"},
+		"rule_days":        {"", "", "sat,sun"},
+		"rule_from":        {"", "", "22:00"},
+		"rule_to":          {"", "", "06:00"},
+		"rule_timezone":    {"", "", ""},
+		"rule_destination": {"https://play.google.com/app", "", "https://example.de"},
+
+		"variant_id":          {"3", "99", ""},
+		"variant_name":        {"A", "", ""},
+		"variant_destination": {"https://example.com/a", "https://example.com/c", ""},
+		"variant_weight":      {"70", "30", ""},
+	}
+	req := httptest.NewRequest("POST", "/links/edit?id=7", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	app.editLinkHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusSeeOther {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusSeeOther)
+	}
+	if location := rr.Header().Get("Location"); location != "/links/edit?id=7&saved=1" {
+		t.Errorf("handler returned unexpected location: got %v want /links/edit?id=7&saved=1", location)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestEditLinkHandler_TrashedMeanwhile(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	expectLinkByID(mock, "")
+	// Moved to the trash after the link was read: the edit does not bring
+	// it back
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\? AND Deleted_at IS NULL FOR UPDATE$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id"}))
+	mock.ExpectRollback()
+
+	form := url.Values{"original_url": {"https://example.org"}}
+	req := httptest.NewRequest("POST", "/links/edit?id=7", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	app.editLinkHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestEditLinkHandler_InvalidRule(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	expectLinkByID(mock, "")
+
+	form := url.Values{
+		"original_url":     {"https://example.org"},
+		"rule_platforms":   {"symbian"},
+		"rule_destination": {"https://example.com/old"},
+	}
+	req := httptest.NewRequest("POST", "/links/edit?id=7", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	app.editLinkHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	expected := `https://example.org|rule 1: unknown platform &#34;symbian&#34;|false|[symbian;;https://example.com/old][;;]|false|[0;;]`
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestEditLinkHandler_BlockedVariant(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	expectLinkByID(mock, "")
+	blocked, err := pkg.NewBlocklist([]string{"https://example.com/phish"})
+	if err != nil {
+		t.Fatalf("Error creating blocklist: %v", err)
+	}
+	app.blocked = blocked
+
+	form := url.Values{
+		"original_url":        {"https://example.org"},
+		"split_test":          {"1"},
+		"variant_id":          {""},
+		"variant_name":        {"A"},
+		"variant_destination": {"https://EXAMPLE.com/phish/"},
+		"variant_weight":      {"1"},
+	}
+	req := httptest.NewRequest("POST", "/links/edit?id=7", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	app.editLinkHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+	}
+	if body := rr.Body.String(); !strings.Contains(body, "|https://EXAMPLE.com/phish/ cannot be shortened|") {
+		t.Errorf("handler returned unexpected body: %v", body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestEditLinkHandler_InvalidVariant(t *testing.T) {
+	testCases := []struct {
+		weight      string
+		destination string
+		message     string
+	}{
+		{"-1", "https://example.com/a", "variant 1: weight must be a whole number of at least 0"},
+		{"half", "https://example.com/a", "variant 1: weight must be a whole number of at least 0"},
+		{"1", "example.com/a", "variant 1: invalid destination &#34;example.com/a&#34;"},
+	}
+
+	for _, tc := range testCases {
+		app, mock := newEditTestApp(t)
+		expectLinkByID(mock, "")
+
+		form := url.Values{
+			"original_url":        {"https://example.org"},
+			"split_test":          {"1"},
+			"variant_id":          {""},
+			"variant_name":        {"A"},
+			"variant_destination": {tc.destination},
+			"variant_weight":      {tc.weight},
+		}
+		req := httptest.NewRequest("POST", "/links/edit?id=7", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		app.editLinkHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.weight, status, http.StatusBadRequest)
+		}
+		if body := rr.Body.String(); !strings.Contains(body, "|"+tc.message+"|") || !strings.Contains(body, "|true|[0;A;"+tc.weight+"][0;;]") {
+			t.Errorf("%s: handler returned unexpected body: %v", tc.weight, body)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	}
+}
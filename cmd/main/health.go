@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// LinkHealth is a row of link_health: what the last check of a link's
+// destination found
+type LinkHealth struct {
+	Link_id        int
+	Checked_at     time.Time
+	Status_code    int // of the final response, 0 when there was none
+	Latency_ms     int
+	Redirect_chain string // the addresses redirected to, one per line
+	Error          string
+	Failures       int        // failed checks in a row
+	Broken         bool       // failed often enough in a row to be flagged
+	Broken_since   *time.Time // nil while the link is not broken
+}
+
+// Notifier is told about links whose destinations broke
+type Notifier interface {
+	NotifyBroken(ctx context.Context, link UrlShortener, health LinkHealth) error
+}
+
+// logNotifier writes broken links to the log
+type logNotifier struct{}
+
+func (logNotifier) NotifyBroken(ctx context.Context, link UrlShortener, health LinkHealth) error {
+	reason := health.Error
+	if reason == "" {
+		reason = fmt.Sprintf("status %d", health.Status_code)
+	}
+	log.Printf("Destination of link %s is broken: %s (%s)", link.Short_url, link.Original_url, reason)
+	return nil
+}
+
+// webhookNotifier posts broken links as JSON to an address, such as an
+// incoming webhook of a chat service
+type webhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// brokenLinkAlert is the body webhookNotifier posts
+type brokenLinkAlert struct {
+	Text        string    `json:"text"`
+	Link_id     int       `json:"link_id"`
+	Code        string    `json:"code"`
+	Destination string    `json:"destination"`
+	Status      int       `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	Checked_at  time.Time `json:"checked_at"`
+}
+
+func (n webhookNotifier) NotifyBroken(ctx context.Context, link UrlShortener, health LinkHealth) error {
+	body, err := json.Marshal(brokenLinkAlert{
+		Text:        fmt.Sprintf("The destination of %s is broken: %s", link.Short_url, link.Original_url),
+		Link_id:     link.Id,
+		Code:        link.Short_url,
+		Destination: link.Original_url,
+		Status:      health.Status_code,
+		Error:       health.Error,
+		Checked_at:  health.Checked_at,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("posting alert to %s: %s", n.URL, resp.Status)
+	}
+	return nil
+}
+
+// newNotifier picks the notifier the configuration asks for, posting alerts
+// with client
+func newNotifier(alertURL string, client *http.Client) Notifier {
+	if alertURL == "" {
+		return logNotifier{}
+	}
+	return webhookNotifier{URL: alertURL, Client: client}
+}
+
+// nextHealth works out the health of a link from its previous health, the
+// zero value when it was never checked, and the result of a new check. The
+// link is flagged as broken once failures checks in a row failed.
+func nextHealth(previous LinkHealth, result pkg.HealthResult, checkedAt time.Time, failures int) LinkHealth {
+	health := LinkHealth{
+		Link_id:        previous.Link_id,
+		Checked_at:     checkedAt,
+		Status_code:    result.Status,
+		Latency_ms:     int(result.Latency / time.Millisecond),
+		Redirect_chain: strings.Join(result.Redirects, "\n"),
+	}
+	if result.Err != nil {
+		health.Error = result.Err.Error()
+	}
+	if !result.Broken() {
+		return health
+	}
+
+	health.Failures = previous.Failures + 1
+	if health.Failures >= failures {
+		health.Broken = true
+		health.Broken_since = previous.Broken_since
+		if health.Broken_since == nil {
+			health.Broken_since = &checkedAt
+		}
+	}
+	return health
+}
+
+// healthCheckBatch is the number of links checked at once
+const healthCheckBatch = 500
+
+// checkLinks checks the destinations of every link that is not in the trash,
+// saves what it found and tells the notifier about links that just broke
+func (app *MyApp) checkLinks(ctx context.Context) error {
+	page := StorageInterfaces.Query{
+		Where:   "Deleted_at IS NULL",
+		OrderBy: []StorageInterfaces.Order{{Column: "Id"}},
+		Limit:   healthCheckBatch,
+	}
+	for {
+		var links []UrlShortener
+		if err := app.db.Find("url_shortener", page, &links); err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			return nil
+		}
+		if err := app.checkBatch(ctx, links); err != nil {
+			return err
+		}
+		if len(links) < page.Limit {
+			return nil
+		}
+		page.After = []interface{}{links[len(links)-1].Id}
+	}
+}
+
+func (app *MyApp) checkBatch(ctx context.Context, links []UrlShortener) error {
+	previous, err := app.linkHealth(links)
+	if err != nil {
+		return err
+	}
+
+	destinations := make([]string, len(links))
+	for i, link := range links {
+		destinations[i] = link.Original_url
+	}
+	results := app.health.CheckAll(ctx, destinations)
+	if err := ctx.Err(); err != nil {
+		// Checks cut short say nothing about the destinations
+		return err
+	}
+
+	checkedAt := time.Now().UTC().Truncate(time.Second)
+	for i, link := range links {
+		before := previous[link.Id]
+		before.Link_id = link.Id
+		health := nextHealth(before, results[i], checkedAt, app.cfg.HealthFailures)
+		if err := app.db.Upsert("link_health", &health); err != nil {
+			return err
+		}
+		if health.Broken && !before.Broken {
+			if err := app.notifier.NotifyBroken(ctx, link, health); err != nil {
+				log.Printf("Error sending alert about link %d: %v", link.Id, err)
+			}
+		}
+	}
+	return nil
+}
+
+// linkHealth loads the health of links, by link id. Links that were never
+// checked are missing.
+func (app *MyApp) linkHealth(links []UrlShortener) (map[int]LinkHealth, error) {
+	byLink := make(map[int]LinkHealth)
+	if len(links) == 0 {
+		return byLink, nil
+	}
+	placeholders := make([]string, len(links))
+	args := make([]interface{}, len(links))
+	for i, link := range links {
+		placeholders[i] = "?"
+		args[i] = link.Id
+	}
+
+	var rows []LinkHealth
+	err := app.db.GetAllByWhere("link_health", "Link_id IN ("+strings.Join(placeholders, ", ")+")", args, &rows)
+	for _, health := range rows {
+		byLink[health.Link_id] = health
+	}
+	return byLink, err
+}
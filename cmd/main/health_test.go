@@ -0,0 +1,211 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectLinkHealth expects the health of the links with ids to be looked up,
+// and finds none of them checked
+func expectLinkHealth(mock sqlmock.Sqlmock, ids ...int) {
+	placeholders := "\\?"
+	args := []driver.Value{ids[0]}
+	for _, id := range ids[1:] {
+		placeholders += ", \\?"
+		args = append(args, id)
+	}
+	mock.ExpectQuery("^SELECT \\* FROM link_health WHERE Link_id IN \\(" + placeholders + "\\)$").
+		WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"Link_id"}))
+}
+
+// recordingNotifier remembers the links it is told about
+type recordingNotifier struct {
+	broken []string
+}
+
+func (n *recordingNotifier) NotifyBroken(ctx context.Context, link UrlShortener, health LinkHealth) error {
+	n.broken = append(n.broken, link.Short_url)
+	return nil
+}
+
+func TestNextHealth(t *testing.T) {
+	checkedAt := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	since := checkedAt.AddDate(0, 0, -3)
+	ok := pkg.HealthResult{Status: 200, Latency: 120 * time.Millisecond, Redirects: []string{"https://a.example", "https://b.example"}}
+	notFound := pkg.HealthResult{Status: 404}
+	unreachable := pkg.HealthResult{Err: errors.New("connection refused")}
+
+	testCases := []struct {
+		name     string
+		previous LinkHealth
+		result   pkg.HealthResult
+		expected LinkHealth
+	}{
+		{"healthy", LinkHealth{Link_id: 7}, ok,
+			LinkHealth{Link_id: 7, Checked_at: checkedAt, Status_code: 200, Latency_ms: 120, Redirect_chain: "https://a.example\nhttps://b.example"}},
+		{"first failure", LinkHealth{Link_id: 7}, notFound,
+			LinkHealth{Link_id: 7, Checked_at: checkedAt, Status_code: 404, Failures: 1}},
+		{"second failure", LinkHealth{Link_id: 7, Failures: 1}, unreachable,
+			LinkHealth{Link_id: 7, Checked_at: checkedAt, Error: "connection refused", Failures: 2, Broken: true, Broken_since: &checkedAt}},
+		{"still broken", LinkHealth{Link_id: 7, Failures: 5, Broken: true, Broken_since: &since}, notFound,
+			LinkHealth{Link_id: 7, Checked_at: checkedAt, Status_code: 404, Failures: 6, Broken: true, Broken_since: &since}},
+		{"recovered", LinkHealth{Link_id: 7, Failures: 5, Broken: true, Broken_since: &since}, pkg.HealthResult{Status: 204},
+			LinkHealth{Link_id: 7, Checked_at: checkedAt, Status_code: 204}},
+	}
+
+	for _, tc := range testCases {
+		if health := nextHealth(tc.previous, tc.result, checkedAt, 2); !reflect.DeepEqual(health, tc.expected) {
+			t.Errorf("%s: got %+v want %+v", tc.name, health, tc.expected)
+		}
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	since := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at IS NULL ORDER BY Id LIMIT 500$").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url"}).
+			AddRow(1, server.URL+"/ok", "aaa11").
+			AddRow(2, server.URL+"/gone", "bbb22").
+			AddRow(3, server.URL+"/missing", "ccc33"))
+	mock.ExpectQuery("^SELECT \\* FROM link_health WHERE Link_id IN \\(\\?, \\?, \\?\\)$").
+		WithArgs(1, 2, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"Link_id", "Failures", "Broken", "Broken_since"}).
+			AddRow(2, 1, false, nil).
+			AddRow(3, 4, true, since))
+	upsert := "^INSERT INTO link_health \\(Link_id, Checked_at, Status_code, Latency_ms, Redirect_chain, Error, Failures, Broken, Broken_since\\) VALUES .* ON DUPLICATE KEY UPDATE "
+	mock.ExpectExec(upsert).
+		WithArgs(1, recentTime{}, 200, sqlmock.AnyArg(), "", "", 0, false, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(upsert).
+		WithArgs(2, recentTime{}, 404, sqlmock.AnyArg(), "", "", 2, true, recentTime{}).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(upsert).
+		WithArgs(3, recentTime{}, 404, sqlmock.AnyArg(), "", "", 5, true, since).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	notifier := &recordingNotifier{}
+	app := &MyApp{
+		db:       &MySQLDatabase{DB: db},
+		health:   pkg.NewHealthChecker(time.Second, 2, 0),
+		notifier: notifier,
+	}
+	app.health.Client = &http.Client{}
+	app.cfg.HealthFailures = 2
+
+	if err := app.checkLinks(context.Background()); err != nil {
+		t.Errorf("Error checking links: %v", err)
+	}
+	// Link 3 was broken already, and was reported then
+	if !reflect.DeepEqual(notifier.broken, []string{"bbb22"}) {
+		t.Errorf("expected an alert about bbb22 only, got %v", notifier.broken)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var alert brokenLinkAlert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected %s request with content type %s", r.Method, r.Header.Get("Content-Type"))
+		}
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("Error decoding the alert: %v", err)
+		}
+	}))
+	defer server.Close()
+
+	notifier := newNotifier(server.URL, &http.Client{Timeout: time.Second})
+	link := UrlShortener{Id: 7, Original_url: "https://example.com/gone", Short_url: "abc12"}
+	health := LinkHealth{Link_id: 7, Status_code: 404, Checked_at: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)}
+	if err := notifier.NotifyBroken(context.Background(), link, health); err != nil {
+		t.Fatalf("Error sending the alert: %v", err)
+	}
+
+	if alert.Link_id != 7 || alert.Code != "abc12" || alert.Destination != link.Original_url || alert.Status != 404 || alert.Text == "" {
+		t.Errorf("unexpected alert %+v", alert)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer failing.Close()
+	if err := newNotifier(failing.URL, &http.Client{Timeout: time.Second}).NotifyBroken(context.Background(), link, health); err == nil {
+		t.Errorf("expected an error when the alert is refused")
+	}
+
+	// Unless allowed, alerts are only posted to public addresses
+	err := newNotifier(server.URL, outboundClient(time.Second, false)).NotifyBroken(context.Background(), link, health)
+	if !errors.Is(err, pkg.ErrNonPublicAddress) {
+		t.Errorf("expected the alert to a loopback address to be refused, got %v", err)
+	}
+}
+
+func TestApiLinksHandler_Health(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	checkedAt := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("^SELECT \\* FROM folders$").WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM url_shortener WHERE Deleted_at IS NULL AND Id IN \\(SELECT Link_id FROM link_health WHERE Broken\\)$").
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(1))
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at IS NULL AND Id IN \\(SELECT Link_id FROM link_health WHERE Broken\\) ORDER BY Id DESC LIMIT 51$").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url"}).AddRow(2, "https://example.com/old", "abc12"))
+	mock.ExpectQuery("^SELECT \\* FROM link_health WHERE Link_id IN \\(\\?\\)$").
+		WithArgs(2).
+		WillReturnRows(sqlmock.NewRows([]string{"Link_id", "Checked_at", "Status_code", "Latency_ms", "Redirect_chain", "Error", "Failures", "Broken", "Broken_since"}).
+			AddRow(2, checkedAt, 404, 85, "https://example.com/moved", "", 3, true, checkedAt))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	req := httptest.NewRequest("GET", "/api/links?broken=1", nil)
+	rr := httptest.NewRecorder()
+
+	app.apiLinksHandler(rr, req)
+
+	var body struct {
+		Links []struct {
+			Health *apiHealth `json:"health"`
+		} `json:"links"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil || len(body.Links) != 1 || body.Links[0].Health == nil {
+		t.Fatalf("handler returned unexpected body %s", rr.Body.String())
+	}
+	health := body.Links[0].Health
+	if !health.Broken || health.Status != 404 || health.Latency_ms != 85 || !reflect.DeepEqual(health.Redirects, []string{"https://example.com/moved"}) {
+		t.Errorf("handler returned unexpected health %+v", health)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
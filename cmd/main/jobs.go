@@ -0,0 +1,249 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"cmd/main/pkg/Storage/MySql"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// storeJobQueue is the pkg.JobQueue the app runs on: the jobs and
+// job_schedules tables, shared by every instance of the app. Claims lock the
+// rows they hand out with FOR UPDATE SKIP LOCKED, so two instances never
+// claim the same job and neither waits for the other.
+type storeJobQueue struct {
+	db StorageInterfaces.Store
+}
+
+var _ pkg.JobQueue = storeJobQueue{}
+
+// newJobQueue picks the job queue the configuration asks for. The tables are
+// read at READ COMMITTED whatever the isolation level of link changes, so
+// looking for due jobs never waits for locks.
+func newJobQueue(kind string, db *MySQLDatabase) (pkg.JobQueue, error) {
+	switch kind {
+	case "mysql":
+		options := MySql.TxOptions{Isolation: sql.LevelReadCommitted, MaxRetries: db.TxOptions.MaxRetries}
+		return storeJobQueue{db: &MySQLDatabase{DB: db.DB, TxOptions: options}}, nil
+	case "memory":
+		return pkg.NewMemoryJobQueue(), nil
+	}
+	return nil, fmt.Errorf("unknown job queue %q", kind)
+}
+
+func (q storeJobQueue) Enqueue(ctx context.Context, job *pkg.Job) error {
+	return q.db.SaveReturningID("jobs", job, "Id")
+}
+
+func (q storeJobQueue) Claim(ctx context.Context, lock string, now time.Time, lease time.Duration, limit int) ([]pkg.Job, error) {
+	var claimed []pkg.Job
+	err := q.db.WithTx(ctx, func(tx StorageInterfaces.Store) error {
+		claimed = nil
+		var due []pkg.Job
+		err := tx.GetAllByWhere("jobs",
+			"(Status = ? AND Run_at <= ?) OR (Status = ? AND Locked_until <= ?) ORDER BY Run_at, Id LIMIT ? FOR UPDATE SKIP LOCKED",
+			[]interface{}{pkg.JobQueued, now, pkg.JobRunning, now, limit}, &due)
+		if err != nil {
+			return err
+		}
+
+		for _, job := range due {
+			if job.Status == pkg.JobRunning && job.Attempts >= job.Max_attempts {
+				job.Status = pkg.JobFailed
+				job.Finished_at = &now
+				job.Locked_until = nil
+				job.Last_error = "lock expired"
+				if err := tx.Update("jobs", &job, "Id"); err != nil {
+					return err
+				}
+				continue
+			}
+
+			until := now.Add(lease)
+			job.Status = pkg.JobRunning
+			job.Attempts++
+			job.Locked_by = lock
+			job.Locked_until = &until
+			if err := tx.Update("jobs", &job, "Id"); err != nil {
+				return err
+			}
+			claimed = append(claimed, job)
+		}
+		return nil
+	})
+	return claimed, err
+}
+
+func (q storeJobQueue) Finish(ctx context.Context, job pkg.Job) (bool, error) {
+	saved := false
+	err := q.db.WithTx(ctx, func(tx StorageInterfaces.Store) error {
+		saved = false
+		var stored pkg.Job
+		err := tx.GetByWhere("jobs", "Id = ? AND Status = ? AND Locked_by = ? FOR UPDATE",
+			[]interface{}{job.Id, pkg.JobRunning, job.Locked_by}, &stored)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		job.Locked_until = nil
+		saved = true
+		return tx.Update("jobs", &job, "Id")
+	})
+	return saved, err
+}
+
+func (q storeJobQueue) RunSchedules(ctx context.Context, now time.Time, schedules []pkg.Schedule) error {
+	// Most of the time nothing is due, which a plain read tells without
+	// locking anything
+	var states []pkg.JobSchedule
+	if err := q.db.GetAll("job_schedules", &states); err != nil {
+		return err
+	}
+	byKind := make(map[string]pkg.JobSchedule, len(states))
+	for _, state := range states {
+		byKind[state.Kind] = state
+	}
+
+	for _, schedule := range schedules {
+		state, ok := byKind[schedule.Kind]
+		if ok && state.Spec == schedule.Spec && state.Next_run_at.After(now) {
+			continue
+		}
+		err := q.db.WithTx(ctx, func(tx StorageInterfaces.Store) error {
+			return runSchedule(tx, now, schedule)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runSchedule queues the job of schedule if it is due, in tx
+func runSchedule(tx StorageInterfaces.Store, now time.Time, schedule pkg.Schedule) error {
+	var states []pkg.JobSchedule
+	if err := tx.GetAllByWhere("job_schedules", "Kind = ? FOR UPDATE SKIP LOCKED", []interface{}{schedule.Kind}, &states); err != nil {
+		return err
+	}
+	if len(states) == 0 {
+		// Either the schedule is new, or another instance holds it
+		n, err := tx.Count("job_schedules", "Kind = ?", []interface{}{schedule.Kind})
+		if err != nil || n > 0 {
+			return err
+		}
+		// Instances starting together may both add it, to the same effect
+		return tx.Upsert("job_schedules", &pkg.JobSchedule{Kind: schedule.Kind, Spec: schedule.Spec, Next_run_at: schedule.Cron.Next(now)})
+	}
+
+	state := states[0]
+	if state.Spec != schedule.Spec {
+		state.Spec = schedule.Spec
+		state.Next_run_at = schedule.Cron.Next(now)
+		return tx.Update("job_schedules", &state, "Kind")
+	}
+	if state.Next_run_at.After(now) {
+		return nil
+	}
+
+	pending, err := tx.Count("jobs", "Kind = ? AND Status IN (?, ?)", []interface{}{schedule.Kind, pkg.JobQueued, pkg.JobRunning})
+	if err != nil {
+		return err
+	}
+	if pending == 0 {
+		job := pkg.Job{
+			Kind:         schedule.Kind,
+			Status:       pkg.JobQueued,
+			Max_attempts: schedule.Max_attempts,
+			Run_at:       now,
+			Created_at:   now,
+		}
+		if err := tx.SaveReturningID("jobs", &job, "Id"); err != nil {
+			return err
+		}
+	}
+	state.Next_run_at = schedule.Cron.Next(now)
+	return tx.Update("job_schedules", &state, "Kind")
+}
+
+func (q storeJobQueue) Prune(ctx context.Context, cutoff time.Time) error {
+	return q.db.Delete("jobs", "Status = ? AND Finished_at < ?", []interface{}{pkg.JobDone, cutoff})
+}
+
+// Kinds of the app's jobs
+const (
+	jobPurgeTrash      = "trash.purge"
+	jobApplyChanges    = "links.apply_scheduled_changes"
+	jobCheckLinks      = "links.check_health"
+	jobDeliverWebhooks = "webhooks.deliver"
+	jobPruneJobs       = "jobs.prune"
+	jobRollupClicks    = "clicks.rollup"
+	jobPruneAnalytics  = "analytics.prune"
+	jobFillOpenGraph   = "links.fill_opengraph" // the payload is the id of the link
+)
+
+// jobRetention is how long finished jobs are kept before they are pruned.
+// Failed jobs are kept until removed by hand.
+const jobRetention = 24 * time.Hour
+
+// registerJobs sets up the handlers and schedules of the app's background
+// work on runner
+func (app *MyApp) registerJobs(runner *pkg.JobRunner) error {
+	app.jobs = runner
+	runner.Handle(jobPurgeTrash, func(ctx context.Context, job pkg.Job) error {
+		cutoff := time.Now().UTC().AddDate(0, 0, -app.cfg.TrashRetentionDays)
+		return app.purgeTrash(ctx, cutoff)
+	})
+	runner.Handle(jobApplyChanges, func(ctx context.Context, job pkg.Job) error {
+		return app.applyScheduledChanges(ctx, time.Now().UTC())
+	})
+	runner.Handle(jobCheckLinks, func(ctx context.Context, job pkg.Job) error {
+		return app.checkLinks(ctx)
+	})
+	runner.Handle(jobDeliverWebhooks, func(ctx context.Context, job pkg.Job) error {
+		return app.deliverWebhooks(ctx, time.Now().UTC().Truncate(time.Second))
+	})
+	runner.Handle(jobPruneJobs, func(ctx context.Context, job pkg.Job) error {
+		return runner.Queue.Prune(ctx, time.Now().UTC().Add(-jobRetention))
+	})
+	runner.Handle(jobRollupClicks, func(ctx context.Context, job pkg.Job) error {
+		return app.rollupClicks(ctx, time.Now().UTC())
+	})
+	runner.Handle(jobPruneAnalytics, func(ctx context.Context, job pkg.Job) error {
+		return app.pruneAnalytics(time.Now().UTC())
+	})
+	runner.Handle(jobFillOpenGraph, func(ctx context.Context, job pkg.Job) error {
+		id, err := strconv.Atoi(job.Payload)
+		if err != nil {
+			return fmt.Errorf("invalid link id %q: %w", job.Payload, err)
+		}
+		return app.fillOpenGraph(ctx, id)
+	})
+
+	schedules := map[string]string{
+		jobApplyChanges:    "* * * * *",
+		jobDeliverWebhooks: "@every 5s",
+		jobPruneJobs:       "@hourly",
+		jobRollupClicks:    "*/5 * * * *",
+		jobPruneAnalytics:  "@hourly",
+	}
+	if app.cfg.TrashRetentionDays > 0 {
+		schedules[jobPurgeTrash] = "@hourly"
+	}
+	if app.cfg.HealthInterval > 0 {
+		schedules[jobCheckLinks] = "@every " + app.cfg.HealthInterval.String()
+	}
+	for _, kind := range []string{jobPurgeTrash, jobApplyChanges, jobCheckLinks, jobDeliverWebhooks, jobPruneJobs, jobRollupClicks, jobPruneAnalytics} {
+		if spec, ok := schedules[kind]; ok {
+			if err := runner.Schedule(kind, spec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
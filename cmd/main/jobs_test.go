@@ -0,0 +1,179 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var jobColumns = []string{"Id", "Kind", "Payload", "Status", "Attempts", "Max_attempts", "Run_at", "Locked_by", "Locked_until", "Last_error", "Created_at", "Finished_at"}
+
+func TestStoreJobQueue_Claim(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	created := now.Add(-time.Hour)
+	until := now.Add(time.Minute)
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM jobs WHERE \\(Status = \\? AND Run_at <= \\?\\) OR \\(Status = \\? AND Locked_until <= \\?\\) ORDER BY Run_at, Id LIMIT \\? FOR UPDATE SKIP LOCKED$").
+		WithArgs(pkg.JobQueued, now, pkg.JobRunning, now, 2).
+		WillReturnRows(sqlmock.NewRows(jobColumns).
+			AddRow(1, jobPurgeTrash, "", pkg.JobRunning, 3, 3, created, "old", created, "", created, nil).
+			AddRow(2, jobCheckLinks, "", pkg.JobQueued, 0, 3, created, "", nil, "", created, nil))
+	update := "^UPDATE jobs SET Kind = \\?, Payload = \\?, Status = \\?, Attempts = \\?, Max_attempts = \\?, Run_at = \\?, Locked_by = \\?, Locked_until = \\?, Last_error = \\?, Created_at = \\?, Finished_at = \\? WHERE Id = \\?$"
+	// Its lock expired on the last attempt
+	mock.ExpectExec(update).
+		WithArgs(jobPurgeTrash, "", pkg.JobFailed, 3, 3, created, "old", nil, "lock expired", created, now, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(update).
+		WithArgs(jobCheckLinks, "", pkg.JobRunning, 1, 3, created, "worker/1", until, "", created, nil, 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	queue := storeJobQueue{db: &MySQLDatabase{DB: db}}
+	jobs, err := queue.Claim(context.Background(), "worker/1", now, time.Minute, 2)
+	if err != nil {
+		t.Fatalf("Error claiming jobs: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].Id != 2 || jobs[0].Status != pkg.JobRunning || jobs[0].Attempts != 1 || !jobs[0].Locked_until.Equal(until) {
+		t.Errorf("expected job 2 to be claimed, got %+v", jobs)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStoreJobQueue_Finish(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	until := now.Add(time.Minute)
+	job := pkg.Job{Id: 4, Kind: jobPruneJobs, Status: pkg.JobDone, Attempts: 1, Max_attempts: 3, Run_at: now, Locked_by: "worker/1", Locked_until: &until, Created_at: now, Finished_at: &now}
+	lookup := "^SELECT \\* FROM jobs WHERE Id = \\? AND Status = \\? AND Locked_by = \\? FOR UPDATE$"
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lookup).
+		WithArgs(4, pkg.JobRunning, "worker/1").
+		WillReturnRows(sqlmock.NewRows([]string{"Id"}).AddRow(4))
+	mock.ExpectExec("^UPDATE jobs SET ").
+		WithArgs(jobPruneJobs, "", pkg.JobDone, 1, 3, now, "worker/1", nil, "", now, now, 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// Claimed by another worker after the lock expired
+	mock.ExpectBegin()
+	mock.ExpectQuery(lookup).
+		WithArgs(4, pkg.JobRunning, "worker/1").
+		WillReturnRows(sqlmock.NewRows([]string{"Id"}))
+	mock.ExpectCommit()
+
+	queue := storeJobQueue{db: &MySQLDatabase{DB: db}}
+	if saved, err := queue.Finish(context.Background(), job); !saved || err != nil {
+		t.Errorf("Finish = %v, %v; expected the job to be saved", saved, err)
+	}
+	if saved, err := queue.Finish(context.Background(), job); saved || err != nil {
+		t.Errorf("Finish = %v, %v; expected nothing to be saved without the lock", saved, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStoreJobQueue_RunSchedules(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	hourly, _ := pkg.ParseCron("@hourly")
+	daily, _ := pkg.ParseCron("@daily")
+	schedules := []pkg.Schedule{
+		{Kind: jobPurgeTrash, Spec: "@hourly", Cron: hourly, Max_attempts: 5},
+		{Kind: jobPruneJobs, Spec: "@daily", Cron: daily, Max_attempts: 5},
+		{Kind: jobCheckLinks, Spec: "@daily", Cron: daily, Max_attempts: 5},
+	}
+
+	mock.ExpectQuery("^SELECT \\* FROM job_schedules$").
+		WillReturnRows(sqlmock.NewRows([]string{"Kind", "Spec", "Next_run_at"}).
+			AddRow(jobPurgeTrash, "@hourly", now.Add(-time.Minute)).
+			AddRow(jobPruneJobs, "@daily", now.Add(time.Hour)))
+	lock := "^SELECT \\* FROM job_schedules WHERE Kind = \\? FOR UPDATE SKIP LOCKED$"
+
+	// Due, and nothing of its kind is pending
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).
+		WithArgs(jobPurgeTrash).
+		WillReturnRows(sqlmock.NewRows([]string{"Kind", "Spec", "Next_run_at"}).AddRow(jobPurgeTrash, "@hourly", now.Add(-time.Minute)))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM jobs WHERE Kind = \\? AND Status IN \\(\\?, \\?\\)$").
+		WithArgs(jobPurgeTrash, pkg.JobQueued, pkg.JobRunning).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(0))
+	mock.ExpectExec("^INSERT INTO jobs ").
+		WithArgs(jobPurgeTrash, "", pkg.JobQueued, 0, 5, now, "", nil, "", now, nil).
+		WillReturnResult(sqlmock.NewResult(9, 1))
+	mock.ExpectExec("^UPDATE job_schedules SET Spec = \\?, Next_run_at = \\? WHERE Kind = \\?$").
+		WithArgs("@hourly", now.Add(time.Hour), jobPurgeTrash).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// New
+	mock.ExpectBegin()
+	mock.ExpectQuery(lock).
+		WithArgs(jobCheckLinks).
+		WillReturnRows(sqlmock.NewRows([]string{"Kind", "Spec", "Next_run_at"}))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM job_schedules WHERE Kind = \\?$").
+		WithArgs(jobCheckLinks).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(0))
+	mock.ExpectExec("^INSERT INTO job_schedules \\(Kind, Spec, Next_run_at\\) VALUES .* ON DUPLICATE KEY UPDATE ").
+		WithArgs(jobCheckLinks, "@daily", time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	queue := storeJobQueue{db: &MySQLDatabase{DB: db}}
+	if err := queue.RunSchedules(context.Background(), now, schedules); err != nil {
+		t.Errorf("Error running schedules: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNewJobQueue(t *testing.T) {
+	db := &MySQLDatabase{}
+	if queue, err := newJobQueue("memory", db); err != nil {
+		t.Errorf("newJobQueue(memory) returned error %v", err)
+	} else if _, ok := queue.(*pkg.MemoryJobQueue); !ok {
+		t.Errorf("newJobQueue(memory) = %T", queue)
+	}
+	if _, err := newJobQueue("redis", db); err == nil {
+		t.Errorf("expected an error for an unknown queue")
+	}
+}
+
+func TestRegisterJobs(t *testing.T) {
+	app := &MyApp{}
+	app.cfg.TrashRetentionDays = 30
+	app.cfg.HealthInterval = 12 * time.Hour
+	if err := app.registerJobs(pkg.NewJobRunner(pkg.NewMemoryJobQueue(), 1)); err != nil {
+		t.Errorf("Error registering jobs: %v", err)
+	}
+
+	// Health checks run on a schedule of their own interval
+	app.cfg.HealthInterval = 500 * time.Millisecond
+	if err := app.registerJobs(pkg.NewJobRunner(pkg.NewMemoryJobQueue(), 1)); err == nil {
+		t.Errorf("expected an error for a health interval under a second")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"cmd/main/pkg"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+)
+
+// pageLayout is how layout.html frames a page
+type pageLayout struct {
+	Title   string
+	Menu    bool   // show the dashboard menu, left out of the pages visitors of short links see
+	Current string // path of the menu item the page is, "" when it is none of them
+	NoIndex bool   // ask search engines not to index the page
+}
+
+// pageLayouts frames the pages rendered in the layout. Other templates, such
+// as the page shown to crawlers, are complete documents of their own.
+var pageLayouts = map[string]pageLayout{
+	"index.html":    {Title: "Shorten a URL", Menu: true, Current: "/"},
+	"viewurls.html": {Title: "Shortened URLs", Menu: true, Current: "/viewurls"},
+	"trash.html":    {Title: "Trash", Menu: true, Current: "/trash"},
+	"audit.html":    {Title: "Audit log", Menu: true, Current: "/audit"},
+	"webhooks.html": {Title: "Webhooks", Menu: true, Current: "/webhooks"},
+	"edit.html":     {Title: "Edit Link", Menu: true, NoIndex: true},
+	"history.html":  {Title: "Link History", Menu: true, NoIndex: true},
+	"stats.html":    {Title: "Link Stats", Menu: true, NoIndex: true},
+	"password.html": {Title: "Password Required", NoIndex: true},
+	"preview.html":  {Title: "Link Preview", NoIndex: true},
+}
+
+// menuItem is a link of the dashboard menu
+type menuItem struct {
+	Path  string
+	Label string
+}
+
+// dashboardMenu is the menu of the pages with Menu set
+var dashboardMenu = []menuItem{
+	{"/", "Shorten a URL"},
+	{"/viewurls", "View Shortened URLs"},
+	{"/trash", "Trash"},
+	{"/audit", "Audit log"},
+	{"/webhooks", "Webhooks"},
+}
+
+// layoutPage is the data passed to layout.html
+type layoutPage struct {
+	pageLayout
+	MenuItems []menuItem
+	Flash     *flash
+	Content   template.HTML // the page, as executed
+	Page      interface{}   // the data the page was executed with
+}
+
+// Kinds of flash messages, named after the alerts they are shown as
+const (
+	flashSuccess = "success"
+	flashError   = "danger"
+)
+
+const flashCookie = "flash"
+
+// flash is a message for the page a browser is redirected to, shown once
+type flash struct {
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+	Short_url string `json:"short_url,omitempty"` // a short url to show with a copy button
+}
+
+// redirectWithFlash redirects to target, which shows f
+func (app *MyApp) redirectWithFlash(w http.ResponseWriter, r *http.Request, target string, f flash) {
+	app.setFlash(w, r, f)
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// setFlash keeps f in a signed cookie until the next page is rendered
+func (app *MyApp) setFlash(w http.ResponseWriter, r *http.Request, f flash) {
+	value, err := json.Marshal(f)
+	if err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    pkg.SignValue([]byte(app.cfg.CookieSecret), base64.RawURLEncoding.EncodeToString(value)),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// takeFlash returns the flash message of r and removes its cookie, so it is
+// shown once. Cookies without a valid signature are removed and give nil.
+func (app *MyApp) takeFlash(w http.ResponseWriter, r *http.Request) *flash {
+	cookie, err := r.Cookie(flashCookie)
+	if err != nil {
+		return nil
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	value, ok := pkg.VerifyValue([]byte(app.cfg.CookieSecret), cookie.Value)
+	if !ok {
+		return nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil
+	}
+	var f flash
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil
+	}
+	return &f
+}
+
+// render writes the named page with status 200, see renderStatus
+func (app *MyApp) render(w http.ResponseWriter, r *http.Request, name string, data interface{}) error {
+	return app.renderStatus(w, r, http.StatusOK, name, data)
+}
+
+// renderStatus writes the named page with status, in the layout and with the
+// flash message of the request when the page has a layout. Nothing is
+// written when a template fails, so the caller can still answer with an
+// error.
+func (app *MyApp) renderStatus(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) error {
+	var body bytes.Buffer
+	if err := app.execute(&body, r, name, data, app.takeFlash(w, r)); err != nil {
+		return err
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	}
+	w.WriteHeader(status)
+	_, err := body.WriteTo(w)
+	return err
+}
+
+// execute runs the named template, preferring the one from the template
+// directory of the domain the request was made to, and frames it in the
+// layout, again the domain's when it has one
+func (app *MyApp) execute(w io.Writer, r *http.Request, name string, data interface{}, f *flash) error {
+	domain := app.domainFor(r)
+
+	app.domains.mu.RLock()
+	domainTmpl := app.domains.templates[domain.Id]
+	app.domains.mu.RUnlock()
+
+	tmpl, layout := app.tmpl, app.tmpl
+	if domainTmpl != nil && domainTmpl.Lookup(name) != nil {
+		tmpl = domainTmpl
+	}
+	if domainTmpl != nil && domainTmpl.Lookup("layout.html") != nil {
+		layout = domainTmpl
+	}
+
+	frame, framed := pageLayouts[name]
+	if !framed || layout.Lookup("layout.html") == nil {
+		return tmpl.ExecuteTemplate(w, name, data)
+	}
+	var content bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&content, name, data); err != nil {
+		return err
+	}
+	page := layoutPage{pageLayout: frame, MenuItems: dashboardMenu, Flash: f, Content: template.HTML(content.String()), Page: data}
+	return layout.ExecuteTemplate(w, "layout.html", page)
+}
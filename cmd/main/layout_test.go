@@ -0,0 +1,152 @@
+package main
+
+import (
+	"cmd/main/internal"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// responseFlash returns the flash message rr sets, nil when it sets none
+func responseFlash(rr *httptest.ResponseRecorder) *flash {
+	for _, cookie := range rr.Result().Cookies() {
+		if cookie.Name != flashCookie || cookie.MaxAge < 0 {
+			continue
+		}
+		i := strings.LastIndexByte(cookie.Value, '.')
+		if i < 0 {
+			return nil
+		}
+		data, err := base64.RawURLEncoding.DecodeString(cookie.Value[:i])
+		if err != nil {
+			return nil
+		}
+		var f flash
+		if json.Unmarshal(data, &f) != nil {
+			return nil
+		}
+		return &f
+	}
+	return nil
+}
+
+// expectFlash checks that rr redirects to location with a flash message of
+// kind, and returns the message
+func expectFlash(t *testing.T, rr *httptest.ResponseRecorder, location, kind string) *flash {
+	t.Helper()
+	if got := rr.Header().Get("Location"); got != location {
+		t.Errorf("handler returned unexpected location: got %v want %v", got, location)
+	}
+	f := responseFlash(rr)
+	if f == nil || f.Kind != kind {
+		t.Errorf("expected a %s flash message, got %+v", kind, f)
+		return &flash{}
+	}
+	return f
+}
+
+func TestFlash(t *testing.T) {
+	app := &MyApp{cfg: internal.Config{CookieSecret: "secret"}}
+
+	rr := httptest.NewRecorder()
+	app.redirectWithFlash(rr, httptest.NewRequest("POST", "/submit", nil), "/", flash{Kind: flashSuccess, Message: "Done", Short_url: "http://example.com/abc12"})
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusSeeOther)
+	}
+	expected := flash{Kind: flashSuccess, Message: "Done", Short_url: "http://example.com/abc12"}
+	if f := expectFlash(t, rr, "/", flashSuccess); *f != expected {
+		t.Errorf("got flash %+v; expected %+v", *f, expected)
+	}
+	cookies := rr.Result().Cookies()
+
+	// The next page gets the message and clears the cookie
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	if f := app.takeFlash(rr, req); f == nil || *f != expected {
+		t.Errorf("got flash %+v; expected %+v", f, expected)
+	}
+	if cleared := rr.Result().Cookies(); len(cleared) != 1 || cleared[0].MaxAge >= 0 {
+		t.Errorf("expected the flash cookie to be cleared, got %v", cleared)
+	}
+
+	// A cookie signed with another secret is ignored
+	other := &MyApp{cfg: internal.Config{CookieSecret: "other"}}
+	if f := other.takeFlash(httptest.NewRecorder(), req); f != nil {
+		t.Errorf("expected a forged flash to be ignored, got %+v", f)
+	}
+	if f := app.takeFlash(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); f != nil {
+		t.Errorf("expected no flash without a cookie, got %+v", f)
+	}
+}
+
+func TestRender_Layout(t *testing.T) {
+	tmpl := template.Must(template.New("").Parse(`{{define "layout.html"}}<title>{{.Title}}</title>{{with .Flash}}[{{.Message}}]{{end}}<main>{{.Content}}</main>{{end}}` +
+		`{{define "trash.html"}}<p>{{.}}</p>{{end}}{{define "bot_preview.html"}}<html>{{.}}</html>{{end}}`))
+	app := &MyApp{tmpl: tmpl, cfg: internal.Config{CookieSecret: "secret"}}
+
+	setter := httptest.NewRecorder()
+	app.setFlash(setter, httptest.NewRequest("GET", "/", nil), flash{Kind: flashError, Message: "Oops"})
+	req := httptest.NewRequest("GET", "/trash", nil)
+	req.AddCookie(setter.Result().Cookies()[0])
+
+	rr := httptest.NewRecorder()
+	if err := app.render(rr, req, "trash.html", "<b>"); err != nil {
+		t.Fatalf("Error rendering: %v", err)
+	}
+	if body := rr.Body.String(); body != "<title>Trash</title>[Oops]<main><p>&lt;b&gt;</p></main>" {
+		t.Errorf("unexpected body %q", body)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "text/html; charset=utf-8" {
+		t.Errorf("unexpected Content-Type %q", contentType)
+	}
+
+	// Pages without a layout are rendered as they are, with the given status
+	rr = httptest.NewRecorder()
+	if err := app.renderStatus(rr, httptest.NewRequest("GET", "/abc12", nil), http.StatusNotFound, "bot_preview.html", "x"); err != nil {
+		t.Fatalf("Error rendering: %v", err)
+	}
+	if rr.Code != http.StatusNotFound || rr.Body.String() != "<html>x</html>" {
+		t.Errorf("unexpected response %d %q", rr.Code, rr.Body.String())
+	}
+
+	// A template that fails writes nothing
+	rr = httptest.NewRecorder()
+	if err := app.render(rr, req, "missing.html", nil); err == nil || rr.Body.Len() != 0 {
+		t.Errorf("expected an error and no body, got %v and %q", err, rr.Body.String())
+	}
+}
+
+func TestIndexHandler_Flash(t *testing.T) {
+	files, err := staticFiles("")
+	if err != nil {
+		t.Fatalf("Error opening static files: %v", err)
+	}
+	tmpl, err := parseTemplates(files, nil)
+	if err != nil {
+		t.Fatalf("Error parsing the built-in templates: %v", err)
+	}
+	app := &MyApp{tmpl: tmpl, cfg: internal.Config{CookieSecret: "secret"}}
+
+	setter := httptest.NewRecorder()
+	app.setFlash(setter, httptest.NewRequest("POST", "/submit", nil), flash{Kind: flashSuccess, Message: "URL shortened!", Short_url: "http://example.com/abc12"})
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(setter.Result().Cookies()[0])
+	rr := httptest.NewRecorder()
+
+	app.indexHandler(rr, req)
+
+	body := rr.Body.String()
+	for _, expected := range []string{"<title>Shorten a URL</title>", "URL shortened!", `value="http://example.com/abc12"`, `data-copy="flash-short-url"`, `action="/submit"`} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected the page to contain %s", expected)
+		}
+	}
+	if strings.Count(body, "<html") != 1 {
+		t.Errorf("expected a single document, got %s", body)
+	}
+}
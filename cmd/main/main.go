@@ -3,53 +3,195 @@ package main
 import (
 	"cmd/main/internal"
 	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
 	"cmd/main/pkg/Storage/MySql"
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"html/template"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
 type UrlShortener struct {
-	Id           int
-	Original_url string
-	Short_url    string
-}
+	Id            int
+	Original_url  string
+	Short_url     string
+	Url_hash      string
+	Password_hash string
+	Preview       bool // always show the preview page instead of redirecting
+	Domain_id     int
+
+	Redirect_type   int    // 301, 302, 307 or 308, 0 for the configured default
+	Cache_control   string // Cache-Control of the redirect, empty for the default
+	Referrer_policy string
+	Canonical_link  bool // send a Link header marking the destination as canonical
+
+	Query_rules    string // pkg.QueryRules as JSON, applied to the destination on redirect
+	Redirect_rules string // pkg.RedirectRules as JSON, picking a destination other than Original_url
+
+	Split_test      bool // divide visitors over the link's variants
+	Sticky_variants bool // keep each visitor on the variant they got first
+
+	Title     string
+	Notes     string
+	Tags      string // the link's tags joined by commas, a copy of link_tags for full-text search
+	Folder_id int    // 0 when the link is in no folder
 
-type Database interface {
-	GetByWhere(table string, whereClause string, args []interface{}, dest interface{}) error
-	GetAll(table string, dest interface{}) error
-	Save(table string, data interface{}) error
+	// OpenGraph tags of the page social crawlers are shown, prefilled from
+	// the destination's own in the background once the link is created
+	Og_title       string
+	Og_description string
+	Og_image       string // absolute http or https url
+
+	Deleted_at *time.Time // when the link was moved to the trash, nil while it is live
 }
 
+// MySQLDatabase implements StorageInterfaces.Store on top of the MySql package.
+// Inside WithTx the queries run on tx instead of the connection pool.
 type MySQLDatabase struct {
-	DB *sql.DB
+	DB        *sql.DB
+	TxOptions MySql.TxOptions
+	tx        *sql.Tx
+}
+
+var _ StorageInterfaces.Store = (*MySQLDatabase)(nil)
+
+func (m *MySQLDatabase) conn() StorageInterfaces.DBTX {
+	if m.tx != nil {
+		return m.tx
+	}
+	return m.DB
 }
 
 func (m *MySQLDatabase) GetByWhere(table string, whereClause string, args []interface{}, dest interface{}) error {
-	return MySql.GetByWhere(m.DB, table, whereClause, args, dest)
+	return MySql.GetByWhere(m.conn(), table, whereClause, args, dest)
 }
 
 func (m *MySQLDatabase) GetAll(table string, dest interface{}) error {
-	return MySql.GetAll(m.DB, table, dest)
+	return MySql.GetAll(m.conn(), table, dest)
+}
+
+func (m *MySQLDatabase) GetAllByWhere(table string, whereClause string, args []interface{}, dest interface{}) error {
+	return MySql.GetAllByWhere(m.conn(), table, whereClause, args, dest)
+}
+
+func (m *MySQLDatabase) Find(table string, query StorageInterfaces.Query, dest interface{}) error {
+	return MySql.Find(m.conn(), table, query, dest)
+}
+
+func (m *MySQLDatabase) Count(table string, whereClause string, args []interface{}) (int, error) {
+	return MySql.Count(m.conn(), table, whereClause, args)
 }
 
 func (m *MySQLDatabase) Save(table string, data interface{}) error {
-	return MySql.Save(m.DB, table, data)
+	return MySql.Save(m.conn(), table, data)
+}
+
+func (m *MySQLDatabase) SaveReturningID(table string, data interface{}, keyField string) error {
+	return MySql.SaveReturningID(m.conn(), table, data, keyField)
+}
+
+func (m *MySQLDatabase) Update(table string, data interface{}, keyField string) error {
+	return MySql.Update(m.conn(), table, data, keyField)
+}
+
+func (m *MySQLDatabase) UpdateFields(table string, data interface{}, keyField string, fields ...string) error {
+	return MySql.UpdateFields(m.conn(), table, data, keyField, fields...)
+}
+
+func (m *MySQLDatabase) Delete(table string, whereClause string, args []interface{}) error {
+	return MySql.Delete(m.conn(), table, whereClause, args)
+}
+
+func (m *MySQLDatabase) Upsert(table string, data interface{}) error {
+	return MySql.Upsert(m.conn(), table, data)
+}
+
+// WithTx runs fn in a new transaction, or in the current one when m is
+// already bound to a transaction
+func (m *MySQLDatabase) WithTx(ctx context.Context, fn func(tx StorageInterfaces.Store) error) error {
+	if m.tx != nil {
+		return fn(m)
+	}
+	return MySql.WithTx(ctx, m.DB, m.TxOptions, func(tx *sql.Tx) error {
+		return fn(&MySQLDatabase{DB: m.DB, TxOptions: m.TxOptions, tx: tx})
+	})
 }
 
 type MyApp struct {
-	db   *MySQLDatabase
-	tmpl *template.Template
+	db       *MySQLDatabase
+	tmpl     *template.Template
+	cfg      internal.Config
+	limiter  *pkg.AttemptLimiter // failed password attempts per link
+	blocked  *pkg.Blocklist      // destinations that may not be shortened, nil when none are
+	metadata *pkg.MetadataFetcher
+	domains  domainRegistry
+	geoip    *pkg.GeoIP // nil when no GeoIP database is configured
+	clicks   *clickRecorder
+	health   *pkg.HealthChecker
+	notifier Notifier // told about links whose destinations broke
+
+	webhooks      webhookRegistry
+	webhookClient *http.Client
+
+	salts saltCache // visitor salt of the day, in privacy mode
+	bots  botRegistry
+
+	assets *assetManifest // served under /static/
+	jobs   *pkg.JobRunner // runs background work, nil until the jobs are registered
 }
 
-func NewMyApp(db *MySQLDatabase, tmpl *template.Template) *MyApp {
+// templateFuncs are available to every template. asset is replaced by that
+// of the asset manifest when the templates are parsed for the app.
+var templateFuncs = template.FuncMap{
+	"displayURL": pkg.DisplayURL,
+	"asset":      (*assetManifest)(nil).URL,
+}
+
+func NewMyApp(db *MySQLDatabase, tmpl *template.Template, cfg internal.Config) *MyApp {
+	metadata := pkg.NewMetadataFetcher(cfg.MetadataTimeout, cfg.MetadataCacheTTL)
+	if cfg.MetadataAllowPrivate {
+		metadata.Client = &http.Client{}
+	}
+	health := pkg.NewHealthChecker(cfg.HealthTimeout, cfg.HealthConcurrency, cfg.HealthHostDelay)
+	if cfg.HealthAllowPrivate {
+		health.Client = &http.Client{}
+	}
 	return &MyApp{
-		db:   db,
-		tmpl: tmpl,
+		db:       db,
+		tmpl:     tmpl,
+		cfg:      cfg,
+		limiter:  pkg.NewAttemptLimiter(cfg.PasswordMaxAttempts, cfg.PasswordAttemptWindow),
+		metadata: metadata,
+		health:   health,
+		notifier: newNotifier(cfg.HealthAlertURL, outboundClient(cfg.HealthTimeout, cfg.WebhookAllowPrivate)),
+
+		webhookClient: outboundClient(cfg.WebhookTimeout, cfg.WebhookAllowPrivate),
+	}
+}
+
+// outboundClient returns the client webhooks and alerts are posted with. Like
+// the addresses of destinations, those of webhooks are given by users, so it
+// only connects to public addresses unless allowPrivate is set.
+func outboundClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	client := pkg.NewPublicClient()
+	if allowPrivate {
+		client = &http.Client{}
 	}
+	client.Timeout = timeout
+	return client
 }
 
 // Handles the form submission and validation of user input 
@@ -63,84 +205,381 @@ func (app *MyApp) formHandler(w http.ResponseWriter, r *http.Request) {
 	userInput := r.FormValue("textInput") 
 	
 	if userInput == "" {
-		http.Redirect(w, r, "/?error=no_input", http.StatusSeeOther)
+		app.redirectWithFlash(w, r, "/", flash{Kind: flashError, Message: "Please enter a URL to shorten."})
 		return
 	} else if !pkg.IsValidURL(userInput) {
-		http.Redirect(w, r, "/?error=invalid_url", http.StatusSeeOther)
+		app.redirectWithFlash(w, r, "/", flash{Kind: flashError, Message: "The URL must be valid, for example https://www.google.com"})
+		return
+	} else if app.blocked.Blocked(userInput) {
+		log.Println("URL is on the blocklist: " + userInput)
+		app.redirectWithFlash(w, r, "/", flash{Kind: flashError, Message: "This URL cannot be shortened."})
 		return
 	}
 
-	var existingUrlShortener UrlShortener
-	err := app.db.GetByWhere("url_shortener", "Original_url = ?", []interface{}{userInput}, &existingUrlShortener)
-	if err == nil {
-		log.Println("URL already exists in database: " + userInput)
-		http.Redirect(w, r, "/?error=url_exists", http.StatusSeeOther)
-		return
+	domain := app.domainFor(r)
+	if host := r.FormValue("domain"); host != "" {
+		var ok bool
+		if domain, ok = app.lookupDomain(host); !ok {
+			app.redirectWithFlash(w, r, "/", flash{Kind: flashError, Message: "That short domain is not configured."})
+			return
+		}
 	}
 
-	var allShortUrls []string
-	var urlShortenerData []UrlShortener
-	err = app.db.GetAll("url_shortener", &urlShortenerData)
+	redirectType, _ := strconv.Atoi(r.FormValue("redirect_type"))
+	newUrlShortener := UrlShortener{
+		Original_url:    userInput,
+		Preview:         r.FormValue("preview") != "",
+		Domain_id:       domain.Id,
+		Redirect_type:   redirectType,
+		Cache_control:   strings.TrimSpace(r.FormValue("cache_control")),
+		Referrer_policy: r.FormValue("referrer_policy"),
+		Canonical_link:  r.FormValue("canonical_link") != "",
+	}
+	if err := validateRedirectSettings(newUrlShortener); err != nil {
+		log.Printf("Invalid redirect settings: %v", err)
+		app.redirectWithFlash(w, r, "/", flash{Kind: flashError, Message: "Those redirect settings are not supported."})
+		return
+	}
+	queryRules, err := queryRulesFromForm(r)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Invalid query rules: %v", err)
+		app.redirectWithFlash(w, r, "/", flash{Kind: flashError, Message: "Those query parameter settings are not supported."})
+		return
 	}
-
-	for _, result := range urlShortenerData {
-		allShortUrls = append(allShortUrls, result.Short_url)
+	newUrlShortener.Query_rules = queryRules.String()
+	details, err := linkDetailsFromForm(r)
+	if err != nil {
+		log.Printf("Invalid link details: %v", err)
+		app.redirectWithFlash(w, r, "/", flash{Kind: flashError, Message: "The title, tags, folder or social preview are too long, or the preview image is not an http or https URL."})
+		return
+	}
+	details.apply(&newUrlShortener)
+	if newUrlShortener.Folder_id, err = folderID(app.db, details.Folder); err != nil {
+		log.Printf("Error finding folder %q: %v", details.Folder, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if password := r.FormValue("password"); password != "" {
+		passwordHash, err := pkg.HashPassword(password)
+		if err != nil {
+			log.Printf("Error hashing password: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		newUrlShortener.Password_hash = passwordHash
 	}
 
-	shortUrl := pkg.GetUniqueShortUrl(allShortUrls, 5)
-	newUrlShortener := UrlShortener{
-		Id:           len(urlShortenerData) + 1,
-		Original_url: userInput,
-		Short_url:    shortUrl,
+	mode := app.dedupeMode(r)
+	link, err := app.createLink(r.Context(), newUrlShortener, mode, app.auditActor(r))
+	if err == errUrlExists && mode == DedupeReturnExisting {
+		app.redirectWithFlash(w, r, "/", flash{Kind: flashSuccess, Message: "This URL was already shortened, its short URL is:", Short_url: shortURL(r, domain, link)})
+		return
+	} else if err == errUrlExists {
+		log.Println("URL already exists in database: " + userInput)
+		app.redirectWithFlash(w, r, "/", flash{Kind: flashError, Message: "This URL has already been shortened. Find it on the View Shortened URLs page."})
+		return
+	} else if err != nil {
+		log.Printf("Error creating short URL: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
 	}
 
-	err = app.db.Save("url_shortener", &newUrlShortener)
+	app.queueOpenGraph(r.Context(), link)
+	app.redirectWithFlash(w, r, "/", flash{Kind: flashSuccess, Message: "URL shortened! Your short URL is:", Short_url: shortURL(r, domain, link)})
+}
+
+var errUrlExists = errors.New("url already exists")
+
+// shortUrlAttempts is how many random short urls createLink tries before it
+// gives up
+const shortUrlAttempts = 5
+
+// createLink stores link under a new short url. Unless mode is
+// DedupeAlwaysNew, a link whose normalized url was already shortened is
+// returned together with errUrlExists instead; links in the trash do not
+// count. Short urls only need to be unique within the link's domain, which
+// the unique index on domain_id and short_url enforces: a random short url
+// that is already taken, also by a link in the trash, is refused by the
+// insert and another one is tried. The lookup and the inserts of the link,
+// its tags and the audit event of who created it all run in one
+// transaction, and the lookup locks the url hash it reads, so two
+// submissions of the same url deadlock and the one that is retried finds
+// the other's link.
+func (app *MyApp) createLink(ctx context.Context, link UrlShortener, mode string, who auditActor) (UrlShortener, error) {
+	urlHash, err := app.urlHash(link.Original_url)
 	if err != nil {
-		log.Fatal(err)
+		return UrlShortener{}, err
 	}
+	link.Url_hash = urlHash
+
+	var newUrlShortener UrlShortener
+	err = app.db.WithTx(ctx, func(tx StorageInterfaces.Store) error {
+		if mode != DedupeAlwaysNew {
+			err := tx.GetByWhere("url_shortener", "Url_hash = ? AND Domain_id = ? AND Deleted_at IS NULL FOR UPDATE", []interface{}{link.Url_hash, link.Domain_id}, &newUrlShortener)
+			if err == nil {
+				return errUrlExists
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
 
-	http.Redirect(w, r, "/?success=shortened", http.StatusSeeOther)
+		newUrlShortener = link
+		for attempt := 1; ; attempt++ {
+			newUrlShortener.Short_url = pkg.GenerateRandomString(5)
+			err := tx.SaveReturningID("url_shortener", &newUrlShortener, "Id")
+			if err == nil {
+				break
+			} else if !MySql.IsDuplicateEntry(err) || attempt >= shortUrlAttempts {
+				return err
+			}
+		}
+		for _, tag := range linkTags(newUrlShortener) {
+			if err := tx.Save("link_tags", &LinkTag{Link_id: newUrlShortener.Id, Tag: tag}); err != nil {
+				return err
+			}
+		}
+		return app.linkChanged(tx, who, auditCreate, nil, &newUrlShortener)
+	})
+	return newUrlShortener, err
 }
 
-// Handles the redirecting of the user to the original url
+// Handles the redirecting of the user to the original url. The short url is
+// looked up on the domain from the Host header, and one ending in + shows the
+// preview page instead.
 func (app *MyApp) redirectHandler(w http.ResponseWriter, r *http.Request) {
-	shortUrl := r.URL.Path[1:]
+	domain := app.domainFor(r)
+	shortUrl, preview := strings.CutSuffix(r.URL.Path[1:], "+")
 	var urlShortener UrlShortener
-	err := app.db.GetByWhere("url_shortener", "Short_url = ?", []interface{}{shortUrl}, &urlShortener)
+	err := app.db.GetByWhere("url_shortener", "Short_url = ? AND Domain_id = ?", []interface{}{shortUrl, domain.Id}, &urlShortener)
 	if err != nil {
-		http.NotFound(w, r)
+		app.linkNotFound(w, r, domain)
+		return
+	}
+	if urlShortener.Deleted_at != nil {
+		linkGone(w)
 		return
 	}
 
-	http.Redirect(w, r, urlShortener.Original_url, http.StatusFound)
+	if !app.checkLinkPassword(w, r, urlShortener) {
+		return
+	}
+
+	destination, variant := app.pickDestination(w, r, urlShortener)
+	if withQuery, err := app.applyQueryRules(r, domain, urlShortener, destination); err != nil {
+		log.Printf("Error applying query rules of %s: %v", urlShortener.Short_url, err)
+	} else {
+		destination = withQuery
+	}
+
+	if preview || urlShortener.Preview {
+		app.renderPreview(w, r, urlShortener, destination)
+		return
+	}
+
+	click := app.newClick(r, urlShortener, variant)
+	app.clicks.Record(click)
+	// Crawlers get the bot preview where people get the redirect, so caches
+	// must not hand one the answer meant for the other
+	w.Header().Add("Vary", "User-Agent")
+	if crawlerBot(click.Bot) && (app.cfg.BotPreview || pkg.IsSocialCrawler(r.UserAgent())) {
+		app.renderBotPreview(w, r, domain, urlShortener, destination)
+		return
+	}
+	app.writeRedirect(w, r, urlShortener, destination)
+}
+
+// linkView is a link as listed on the viewurls page, with the host its short
+// url lives on
+type linkView struct {
+	UrlShortener
+	Host    string
+	Folder  string
+	TagList []string
+	Health  *LinkHealth // nil when the destination was never checked
+}
+
+// filterChip is a filter on the viewurls page, with the address of the page
+// after clicking it
+type filterChip struct {
+	Label string
+	URL   string
 }
 
-// handles the viewurls route. Allowing the user to view all the urls and their shortened versions
+// viewUrlsPage is the data passed to viewurls.html
+type viewUrlsPage struct {
+	Links    []linkView
+	Filter   linkFilter
+	Active   []filterChip // the filters in use, clicking one removes it
+	TagChips []filterChip // tags of the listed links, clicking one filters on it
+	Folders  []Folder
+	Sorts    []linkSort
+
+	Page    int // starting at 1
+	Pages   int
+	Total   int // links matching the filter, on every page
+	First   int // position of the first link on the page, starting at 1
+	Last    int
+	PrevURL string // "" on the first page
+	NextURL string // "" on the last page
+}
+
+// handles the viewurls route. Allowing the user to view all the urls and their
+// shortened versions, narrowed down by the q, tag and folder query parameters,
+// sorted by the sort parameter and a page at a time
 func (app *MyApp) viewUrlsHandler(w http.ResponseWriter, r *http.Request) {
-	var urlShortenerData []UrlShortener
-	err := app.db.GetAll("url_shortener", &urlShortenerData)
+	var folders []Folder
+	err := app.db.GetAll("folders", &folders)
+	if err != nil {
+		log.Printf("Error retrieving folders: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	filter := linkFilterFromQuery(r.URL.Query())
+	pageNumber, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || pageNumber < 1 {
+		pageNumber = 1
+	}
+	pageSize := app.pageSize()
+	urlShortenerData, total, err := app.findLinks(filter, folders, StorageInterfaces.Query{
+		Limit:  pageSize,
+		Offset: (pageNumber - 1) * pageSize,
+	})
 	if err != nil {
 		log.Printf("Error retrieving data: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
-	err = app.tmpl.ExecuteTemplate(w, "viewurls.html", urlShortenerData)
+
+	hosts := app.domainHosts(r)
+	names := folderNames(folders)
+	page := viewUrlsPage{
+		Filter:  filter,
+		Folders: folders,
+		Sorts:   linkSorts,
+		Page:    pageNumber,
+		Pages:   (total + pageSize - 1) / pageSize,
+		Total:   total,
+	}
+	if len(urlShortenerData) > 0 {
+		page.First = (pageNumber-1)*pageSize + 1
+		page.Last = page.First + len(urlShortenerData) - 1
+	}
+	if pageNumber > 1 {
+		// Past the end, the previous link leads back to the last page
+		prev := pageNumber - 1
+		if prev > page.Pages {
+			prev = page.Pages
+		}
+		page.PrevURL = viewUrlsPageURL(filter, prev)
+	}
+	if pageNumber < page.Pages {
+		page.NextURL = viewUrlsPageURL(filter, pageNumber+1)
+	}
+
+	health, err := app.linkHealth(urlShortenerData)
+	if err != nil {
+		log.Printf("Error retrieving link health: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	seenTags := map[string]bool{}
+	for _, link := range urlShortenerData {
+		view := linkView{UrlShortener: link, Host: hosts[link.Domain_id], Folder: names[link.Folder_id], TagList: linkTags(link)}
+		if linkHealth, ok := health[link.Id]; ok {
+			view.Health = &linkHealth
+		}
+		page.Links = append(page.Links, view)
+
+		for _, tag := range view.TagList {
+			if !seenTags[tag] && !filter.hasTag(tag) {
+				seenTags[tag] = true
+				narrowed := filter
+				narrowed.Tags = append(append([]string(nil), filter.Tags...), tag)
+				page.TagChips = append(page.TagChips, filterChip{Label: tag, URL: viewUrlsURL(narrowed)})
+			}
+		}
+	}
+	sort.Slice(page.TagChips, func(i, j int) bool { return page.TagChips[i].Label < page.TagChips[j].Label })
+	page.Active = activeFilterChips(filter)
+
+	err = app.render(w, r, "viewurls.html", page)
 	if err != nil {
 		log.Printf("Error executing template: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 	}
 }
 
+func viewUrlsURL(filter linkFilter) string {
+	return viewUrlsPageURL(filter, 1)
+}
+
+func viewUrlsPageURL(filter linkFilter, page int) string {
+	values := filter.values()
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if len(values) > 0 {
+		return "/viewurls?" + values.Encode()
+	}
+	return "/viewurls"
+}
+
+// activeFilterChips returns a chip for every filter in use, leading to the
+// page without that filter
+func activeFilterChips(filter linkFilter) []filterChip {
+	var chips []filterChip
+	if filter.Query != "" {
+		without := filter
+		without.Query = ""
+		chips = append(chips, filterChip{Label: "search: " + filter.Query, URL: viewUrlsURL(without)})
+	}
+	for i, tag := range filter.Tags {
+		without := filter
+		without.Tags = append(append([]string(nil), filter.Tags[:i]...), filter.Tags[i+1:]...)
+		chips = append(chips, filterChip{Label: "tag: " + tag, URL: viewUrlsURL(without)})
+	}
+	if filter.Folder != "" {
+		without := filter
+		without.Folder = ""
+		chips = append(chips, filterChip{Label: "folder: " + filter.Folder, URL: viewUrlsURL(without)})
+	}
+	if filter.Broken {
+		without := filter
+		without.Broken = false
+		chips = append(chips, filterChip{Label: "broken destinations", URL: viewUrlsURL(without)})
+	}
+	return chips
+}
+
 // setupRoutes sets up the routes for the application
 func (app *MyApp) setupRoutes() {
-	fs := http.FileServer(http.Dir("static"))
-	http.Handle("/static/", http.StripPrefix("/static/", fs))
+	http.Handle("/static/", app.assets)
 
 	http.HandleFunc("/submit", app.formHandler)
 	http.HandleFunc("/", app.indexHandler)
 	http.HandleFunc("/viewurls", app.viewUrlsHandler)
+	http.HandleFunc("/links/edit", app.editLinkHandler)
+	http.HandleFunc("/links/delete", app.deleteLinkHandler)
+	http.HandleFunc("/links/restore", app.restoreLinkHandler)
+	http.HandleFunc("/links/history", app.linkHistoryHandler)
+	http.HandleFunc("/links/rollback", app.rollbackLinkHandler)
+	http.HandleFunc("/links/schedule", app.scheduleChangeHandler)
+	http.HandleFunc("/links/schedule/cancel", app.cancelScheduledChangeHandler)
+	http.HandleFunc("/links/stats", app.linkStatsHandler)
+	http.HandleFunc("/trash", app.trashHandler)
+	http.HandleFunc("/audit", app.auditHandler)
+	http.HandleFunc("/api/audit", app.apiAuditHandler)
+	http.HandleFunc("/api/audit/export", app.apiAuditExportHandler)
+	http.HandleFunc("/webhooks", app.webhooksHandler)
+	http.HandleFunc("/webhooks/toggle", app.toggleWebhookHandler)
+	http.HandleFunc("/webhooks/delete", app.deleteWebhookHandler)
+	http.HandleFunc("/webhooks/deliveries/retry", app.retryDeliveryHandler)
+	http.HandleFunc("/api/links", app.apiLinksHandler)
+	http.HandleFunc("/api/stats", app.apiStatsHandler)
+	http.HandleFunc("/api/privacy/export", app.apiPrivacyExportHandler)
+	http.HandleFunc("/api/privacy/delete", app.apiPrivacyDeleteHandler)
 }
 
 // indexHandler handles the root route
@@ -149,7 +588,10 @@ func (app *MyApp) indexHandler(w http.ResponseWriter, r *http.Request) {
 		app.redirectHandler(w, r)
 		return
 	}
-	http.ServeFile(w, r, "static/templates/index.html")
+	if err := app.render(w, r, "index.html", nil); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
 }
 
 func main() {
@@ -161,14 +603,127 @@ func main() {
 
 	internal.InitMySqlDB(db) // Make sure database is set up 
 
-	tmpl := template.Must(template.ParseGlob("static/templates/*.html"))	// parse the templates
-	myApp := NewMyApp(&MySQLDatabase{DB: db}, tmpl) 
+	cfg := internal.LoadConfig()
+	isolation, err := MySql.ParseIsolationLevel(cfg.TxIsolation)
+	if err != nil {
+		log.Fatal(err)
+	}
+	txOptions := MySql.TxOptions{Isolation: isolation, MaxRetries: cfg.TxMaxRetries}
+	if !isDedupeMode(cfg.DedupeMode) {
+		log.Fatalf("Unknown dedupe mode %q", cfg.DedupeMode)
+	}
+	if !redirectStatuses[cfg.DefaultRedirectStatus] {
+		log.Fatalf("Unsupported redirect status %d", cfg.DefaultRedirectStatus)
+	}
+	if err := (pkg.QueryRules{Conflict: cfg.QueryConflict}).Validate(); err != nil {
+		log.Fatal(err)
+	}
+	for _, entry := range cfg.APIKeys {
+		if _, _, err := splitAPIKey(entry); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.CookieSecret == "" {
+		log.Println("URL_SHORTENER_COOKIE_SECRET is not set, cookies will not survive a restart")
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatal(err)
+		}
+		cfg.CookieSecret = hex.EncodeToString(secret)
+	}
+
+	blocked, err := pkg.NewBlocklist(cfg.Blocklist)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var geoip *pkg.GeoIP
+	if cfg.GeoIPDatabase != "" {
+		if geoip, err = pkg.LoadGeoIP(cfg.GeoIPDatabase); err != nil {
+			log.Fatalf("Error loading GeoIP database: %v", err)
+		}
+	}
+
+	files, err := staticFiles(cfg.StaticDir) // templates and assets, built in unless overridden
+	if err != nil {
+		log.Fatalf("Error opening static directory: %v", err)
+	}
+	assets, err := newAssetManifest(files)
+	if err != nil {
+		log.Fatalf("Error reading static assets: %v", err)
+	}
+	tmpl := template.Must(parseTemplates(files, assets))	// parse the templates
+	myApp := NewMyApp(&MySQLDatabase{DB: db, TxOptions: txOptions}, tmpl, cfg) 
+	myApp.assets = assets
+	if err := internal.UpdateURLHashes(db, myApp.normalizeOptions().String(), myApp.urlHash); err != nil {
+		log.Fatalf("Error computing url hashes: %v", err)
+	}
+	myApp.geoip = geoip
+	myApp.blocked = blocked
+	myApp.clicks = newClickRecorder(myApp.db, cfg.ClickBuffer)
+	myApp.clicks.webhooks = &myApp.webhooks
+	clicksDone := make(chan struct{})
+	go func() {
+		myApp.clicks.Run()
+		close(clicksDone)
+	}()
+	if err := myApp.loadDomains(); err != nil {
+		log.Fatal(err)
+	}
+	go myApp.refreshDomains(cfg.DomainsRefresh)
+	if err := myApp.loadWebhooks(); err != nil {
+		log.Fatal(err)
+	}
+	go myApp.refreshWebhooks(time.Minute)
+	if err := myApp.loadBots(); err != nil {
+		log.Fatalf("Error loading bot signatures: %v", err)
+	}
+	if cfg.BotSignatures != "" {
+		go myApp.refreshBots(time.Minute)
+	}
+
+	queue, err := newJobQueue(cfg.JobQueue, myApp.db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobs := pkg.NewJobRunner(queue, cfg.JobWorkers)
+	jobs.Poll, jobs.Lease, jobs.Drain = cfg.JobPoll, cfg.JobLease, cfg.JobDrain
+	if err := myApp.registerJobs(jobs); err != nil {
+		log.Fatal(err)
+	}
+
+	// Stopping the app lets requests and jobs in progress finish first
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	jobsDone := make(chan struct{})
+	go func() {
+		jobs.Run(ctx)
+		close(jobsDone)
+	}()
 
 	myApp.setupRoutes() // set up routes
 
+	server := &http.Server{Addr: ":8080", Handler: withRequestID(http.DefaultServeMux)}
+	serverDone := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.JobDrain)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down the server: %v", err)
+		}
+		close(serverDone)
+	}()
+
 	log.Println("Server starting on port 8080...")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatal("ListenAndServe: ", err)
 	}
+	<-serverDone
+	<-jobsDone
+	// No request is left to record clicks, so the queued ones can be saved
+	close(myApp.clicks.events)
+	<-clicksDone
 }
 
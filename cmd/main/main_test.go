@@ -1,6 +1,8 @@
 package main
 
 import (
+	"cmd/main/internal"
+	"cmd/main/pkg"
 	"html/template"
 	"net/http"
 	"net/http/httptest"
@@ -8,8 +10,11 @@ import (
 	"testing"
 
 	"database/sql"
+	"database/sql/driver"
+	"reflect"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 )
 
 func TestRedirectHandler(t *testing.T) {
@@ -22,8 +27,8 @@ func TestRedirectHandler(t *testing.T) {
 	rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url"}).
 		AddRow(1, "http://example.com", "abc123")
 
-	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\?$").
-		WithArgs("abc123").
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+		WithArgs("abc123", 0).
 		WillReturnRows(rows)
 
 	app := &MyApp{db: &MySQLDatabase{DB: db}}
@@ -93,6 +98,36 @@ func TestFormHandler_InvalidURL(t *testing.T) {
 	}
 }
 
+func TestFormHandler_BlockedURL(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+	blocked, err := pkg.NewBlocklist([]string{"evil.example"})
+	if err != nil {
+		t.Fatalf("Error creating blocklist: %v", err)
+	}
+	app := &MyApp{db: &MySQLDatabase{DB: db}, blocked: blocked}
+
+	// Matched on the canonical form, so the spelling does not matter
+	form := strings.NewReader("textInput=https://WWW.Evil.Example:443/login")
+	req := httptest.NewRequest("POST", "/submit", form)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	if f := expectFlash(t, rr, "/", flashError); f != nil && f.Message != "This URL cannot be shortened." {
+		t.Errorf("handler returned unexpected message: %v", f.Message)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestFormHandler_ExistingURL(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -103,9 +138,11 @@ func TestFormHandler_ExistingURL(t *testing.T) {
 	rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url"}).
 		AddRow(1, "http://example.com", "abc123")
 
-	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Original_url = \\?$").
-		WithArgs("http://example.com").
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Url_hash = \\? AND Domain_id = \\? AND Deleted_at IS NULL FOR UPDATE$").
+		WithArgs(normalizedHash(t, "http://example.com"), 0).
 		WillReturnRows(rows)
+	mock.ExpectRollback()
 
 	app := &MyApp{db: &MySQLDatabase{DB: db}}
 
@@ -133,16 +170,16 @@ func TestFormHandler_Success(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Original_url = \\?$").
-		WithArgs("https://example.com").
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Url_hash = \\? AND Domain_id = \\? AND Deleted_at IS NULL FOR UPDATE$").
+		WithArgs(normalizedHash(t, "https://example.com"), 0).
 		WillReturnError(sql.ErrNoRows)
 
-	mock.ExpectQuery("^SELECT \\* FROM url_shortener$").
-		WillReturnRows(sqlmock.NewRows([]string{"Short_url"}))
-
-	mock.ExpectExec("^INSERT INTO url_shortener").
-		WithArgs(sqlmock.AnyArg(), "https://example.com", sqlmock.AnyArg()).
+	mock.ExpectExec("^INSERT INTO url_shortener \\(Original_url, Short_url, Url_hash, ").
+		WithArgs(insertArgs(UrlShortener{Original_url: "https://example.com", Url_hash: normalizedHash(t, "https://example.com")})...).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectLinkChanged(mock, auditCreate, 1)
+	mock.ExpectCommit()
 
 	app := &MyApp{db: &MySQLDatabase{DB: db}}
 
@@ -158,9 +195,96 @@ func TestFormHandler_Success(t *testing.T) {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusSeeOther)
 	}
 
-	location := rr.Header().Get("Location")
-	if !strings.Contains(location, "/?success=shortened") {
-		t.Errorf("handler returned unexpected location header: got %v want '/?success=shortened'", location)
+	expectFlash(t, rr, "/", flashSuccess)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFormHandler_ShortUrlTaken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Url_hash = \\? AND Domain_id = \\? AND Deleted_at IS NULL FOR UPDATE$").
+		WithArgs(normalizedHash(t, "https://example.com"), 0).
+		WillReturnError(sql.ErrNoRows)
+	// The first random short url is already taken on the domain, so the
+	// unique index refuses it and another one is tried
+	args := insertArgs(UrlShortener{Original_url: "https://example.com", Url_hash: normalizedHash(t, "https://example.com")})
+	mock.ExpectExec("^INSERT INTO url_shortener ").
+		WithArgs(args...).
+		WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry '0-abc12' for key 'uq_domain_short_url'"})
+	mock.ExpectExec("^INSERT INTO url_shortener ").
+		WithArgs(args...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectLinkChanged(mock, auditCreate, 1)
+	mock.ExpectCommit()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	form := strings.NewReader("textInput=https://example.com")
+	req := httptest.NewRequest("POST", "/submit", form)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	expectFlash(t, rr, "/", flashSuccess)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+// insertArgs returns the arguments expected when link is inserted. The short
+// url is random, so any value matches it.
+func insertArgs(link UrlShortener) []driver.Value {
+	val := reflect.ValueOf(link)
+	var args []driver.Value
+	for i := 0; i < val.NumField(); i++ {
+		switch val.Type().Field(i).Name {
+		case "Id":
+			// Left to AUTO_INCREMENT
+		case "Short_url":
+			args = append(args, sqlmock.AnyArg())
+		default:
+			args = append(args, val.Field(i).Interface())
+		}
+	}
+	return args
+}
+
+func TestFormHandler_DatabaseError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Url_hash = \\? AND Domain_id = \\? AND Deleted_at IS NULL FOR UPDATE$").
+		WithArgs(normalizedHash(t, "https://example.com"), 0).
+		WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	form := strings.NewReader("textInput=https://example.com")
+	req := httptest.NewRequest("POST", "/submit", form)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusInternalServerError {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusInternalServerError)
 	}
 
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -178,7 +302,10 @@ func TestViewUrlsHandler_TemplateExecutionError(t *testing.T) {
 	rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url"}).
 		AddRow(1, "http://example.com", "xyz123").
 		AddRow(2, "http://example.org", "abc123")
-	mock.ExpectQuery("^SELECT \\* FROM url_shortener$").WillReturnRows(rows)
+	mock.ExpectQuery("^SELECT \\* FROM folders$").WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM url_shortener WHERE Deleted_at IS NULL$").WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(2))
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at IS NULL ORDER BY Id DESC LIMIT 50$").WillReturnRows(rows)
+	expectLinkHealth(mock, 1, 2)
 
 	tmpl, err := template.New("viewurls.html").Parse("{{range .}}{{.NonExistentField}}{{end}}")
 	if err != nil {
@@ -208,7 +335,9 @@ func TestViewUrlsHandler_DatabaseRetrievalError(t *testing.T) {
     }
     defer db.Close()
 
-    mock.ExpectQuery("^SELECT \\* FROM url_shortener$").WillReturnError(sql.ErrNoRows)
+    mock.ExpectQuery("^SELECT \\* FROM folders$").WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}))
+    mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM url_shortener WHERE Deleted_at IS NULL$").WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(2))
+    mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at IS NULL ORDER BY Id DESC LIMIT 50$").WillReturnError(sql.ErrNoRows)
 
     tmpl, err := template.New("viewurls.html").Parse("{{range .}}{{.}}{{end}}")
     if err != nil {
@@ -272,7 +401,7 @@ func TestNewMyApp(t *testing.T) {
 		t.Fatalf("Failed to create mock template: %v", err)
 	}
 
-	myApp := NewMyApp(&MySQLDatabase{DB: db}, tmpl)
+	myApp := NewMyApp(&MySQLDatabase{DB: db}, tmpl, internal.Config{PasswordMaxAttempts: 5})
 
 	if myApp.db == nil {
 		t.Errorf("NewMyApp did not correctly initialize the db field")
@@ -281,4 +410,12 @@ func TestNewMyApp(t *testing.T) {
 	if myApp.tmpl == nil {
 		t.Errorf("NewMyApp did not correctly initialize the tmpl field")
 	}
+
+	if myApp.cfg.PasswordMaxAttempts != 5 {
+		t.Errorf("NewMyApp did not correctly initialize the cfg field")
+	}
+
+	if myApp.limiter == nil {
+		t.Errorf("NewMyApp did not correctly initialize the limiter field")
+	}
 }
\ No newline at end of file
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// passwordPage is the data passed to password.html
+type passwordPage struct {
+	Short_url string
+	Error     string
+}
+
+// checkLinkPassword guards password protected links. It returns true when the
+// visitor may be redirected, and otherwise has already written a response:
+// the password prompt, or a redirect back to the link after a correct password.
+func (app *MyApp) checkLinkPassword(w http.ResponseWriter, r *http.Request, link UrlShortener) bool {
+	if link.Password_hash == "" || app.hasPasswordCookie(r, link) {
+		return true
+	}
+
+	if r.Method != http.MethodPost {
+		app.renderPasswordPrompt(w, r, http.StatusOK, link, "")
+		return false
+	}
+
+	// The attempt is counted before the password is hashed, so concurrent
+	// guesses cannot get past the limit, and only handed back when it was
+	// right. The failures of other visitors still count.
+	key := strconv.Itoa(link.Id)
+	if !app.limiter.Take(key) {
+		log.Printf("Too many failed password attempts for %s", link.Short_url)
+		app.renderPasswordPrompt(w, r, http.StatusTooManyRequests, link, "Too many incorrect attempts. Please try again later.")
+		return false
+	}
+
+	if !pkg.CheckPassword(r.FormValue("password"), link.Password_hash) {
+		app.renderPasswordPrompt(w, r, http.StatusUnauthorized, link, "Incorrect password.")
+		return false
+	}
+
+	app.limiter.Refund(key)
+	app.setPasswordCookie(w, r, link)
+
+	// Send the visitor back to the link, so the actual redirect is a GET. The
+	// query is kept for links that pass it through to the destination.
+	http.Redirect(w, r, r.URL.RequestURI(), http.StatusSeeOther)
+	return false
+}
+
+func (app *MyApp) renderPasswordPrompt(w http.ResponseWriter, r *http.Request, status int, link UrlShortener, message string) {
+	w.Header().Set("Cache-Control", "no-store")
+	err := app.renderStatus(w, r, status, "password.html", passwordPage{Short_url: link.Short_url, Error: message})
+	if err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+func passwordCookieName(link UrlShortener) string {
+	return fmt.Sprintf("link_access_%d", link.Id)
+}
+
+// passwordCookieKey signs with the link's password hash as well as the cookie
+// secret, so changing the password invalidates every cookie handed out before
+func (app *MyApp) passwordCookieKey(link UrlShortener) []byte {
+	return []byte(app.cfg.CookieSecret + link.Password_hash)
+}
+
+// setPasswordCookie remembers that the visitor knows the password of link
+func (app *MyApp) setPasswordCookie(w http.ResponseWriter, r *http.Request, link UrlShortener) {
+	expires := time.Now().Add(app.cfg.PasswordCookieTTL)
+	value := fmt.Sprintf("%d.%d", link.Id, expires.Unix())
+	http.SetCookie(w, &http.Cookie{
+		Name:     passwordCookieName(link),
+		Value:    pkg.SignValue(app.passwordCookieKey(link), value),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// hasPasswordCookie reports whether the request carries an unexpired cookie
+// set by setPasswordCookie for link
+func (app *MyApp) hasPasswordCookie(r *http.Request, link UrlShortener) bool {
+	if app.cfg.CookieSecret == "" {
+		return false
+	}
+	cookie, err := r.Cookie(passwordCookieName(link))
+	if err != nil {
+		return false
+	}
+	value, ok := pkg.VerifyValue(app.passwordCookieKey(link), cookie.Value)
+	if !ok {
+		return false
+	}
+
+	id, expiry, found := strings.Cut(value, ".")
+	if !found || id != strconv.Itoa(link.Id) {
+		return false
+	}
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && time.Now().Unix() < expires
+}
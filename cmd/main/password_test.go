@@ -0,0 +1,212 @@
+package main
+
+import (
+	"cmd/main/internal"
+	"cmd/main/pkg"
+	"database/sql"
+	"database/sql/driver"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newPasswordTestApp returns an app whose database serves the link abc12,
+// protected by the password "secret", for each of the given requests
+func newPasswordTestApp(t *testing.T, requests int) (*MyApp, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	passwordHash, err := pkg.HashPassword("secret")
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	for i := 0; i < requests; i++ {
+		rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Url_hash", "Password_hash"}).
+			AddRow(7, "http://example.com", "abc12", "", passwordHash)
+		mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+			WithArgs("abc12", 0).
+			WillReturnRows(rows)
+	}
+
+	tmpl := template.Must(template.New("password.html").Parse("{{.Short_url}}:{{.Error}}"))
+	cfg := internal.Config{
+		CookieSecret:          "cookie secret",
+		PasswordCookieTTL:     time.Minute,
+		PasswordMaxAttempts:   2,
+		PasswordAttemptWindow: time.Minute,
+	}
+	return NewMyApp(&MySQLDatabase{DB: db}, tmpl, cfg), mock
+}
+
+func postPassword(app *MyApp, password string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/abc12", strings.NewReader("password="+password))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+	app.redirectHandler(rr, req)
+	return rr
+}
+
+func TestRedirectHandler_PasswordPrompt(t *testing.T) {
+	app, mock := newPasswordTestApp(t, 1)
+
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	rr := httptest.NewRecorder()
+
+	app.redirectHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	if body := rr.Body.String(); body != "abc12:" {
+		t.Errorf("handler returned unexpected body: got %v want abc12:", body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRedirectHandler_CorrectPassword(t *testing.T) {
+	app, mock := newPasswordTestApp(t, 2)
+
+	rr := postPassword(app, "secret")
+	if status := rr.Code; status != http.StatusSeeOther {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusSeeOther)
+	}
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "link_access_7" || !cookies[0].HttpOnly {
+		t.Fatalf("handler did not set the access cookie: %v", cookies)
+	}
+
+	// The cookie lets the visitor through without asking again
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+
+	app.redirectHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusFound)
+	}
+
+	if location := rr.Header().Get("Location"); location != "http://example.com" {
+		t.Errorf("handler returned unexpected location: got %v want http://example.com", location)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRedirectHandler_WrongPasswordIsRateLimited(t *testing.T) {
+	app, mock := newPasswordTestApp(t, 3)
+
+	for i := 0; i < 2; i++ {
+		rr := postPassword(app, "wrong")
+		if status := rr.Code; status != http.StatusUnauthorized {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnauthorized)
+		}
+		if len(rr.Result().Cookies()) != 0 {
+			t.Errorf("handler set a cookie for a wrong password")
+		}
+	}
+
+	// Even the correct password is refused once the limit is reached
+	rr := postPassword(app, "secret")
+	if status := rr.Code; status != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestHasPasswordCookie(t *testing.T) {
+	app := &MyApp{cfg: internal.Config{CookieSecret: "cookie secret", PasswordCookieTTL: time.Minute}}
+	link := UrlShortener{Id: 7, Password_hash: "hash"}
+
+	rr := httptest.NewRecorder()
+	app.setPasswordCookie(rr, httptest.NewRequest("POST", "/abc12", nil), link)
+	cookie := rr.Result().Cookies()[0]
+
+	testCases := []struct {
+		name   string
+		link   UrlShortener
+		value  string
+		secret string
+		valid  bool
+	}{
+		{"valid", link, cookie.Value, "cookie secret", true},
+		{"other secret", link, cookie.Value, "other secret", false},
+		{"changed password", UrlShortener{Id: 7, Password_hash: "new hash"}, cookie.Value, "cookie secret", false},
+		{"tampered", link, "8" + cookie.Value[1:], "cookie secret", false},
+		{"expired", link, pkg.SignValue([]byte("cookie secrethash"), "7.1"), "cookie secret", false},
+	}
+
+	for _, tc := range testCases {
+		app.cfg.CookieSecret = tc.secret
+		req := httptest.NewRequest("GET", "/abc12", nil)
+		req.AddCookie(&http.Cookie{Name: cookie.Name, Value: tc.value})
+		if valid := app.hasPasswordCookie(req, tc.link); valid != tc.valid {
+			t.Errorf("%s: hasPasswordCookie = %v, expected %v", tc.name, valid, tc.valid)
+		}
+	}
+}
+
+// passwordHashArg matches a hash of the password "secret"
+type passwordHashArg struct{}
+
+func (passwordHashArg) Match(v driver.Value) bool {
+	hash, ok := v.(string)
+	return ok && pkg.CheckPassword("secret", hash)
+}
+
+func TestFormHandler_WithPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Url_hash = \\? AND Domain_id = \\? AND Deleted_at IS NULL FOR UPDATE$").
+		WithArgs(normalizedHash(t, "https://example.com"), 0).
+		WillReturnError(sql.ErrNoRows)
+	args := insertArgs(UrlShortener{Original_url: "https://example.com", Url_hash: normalizedHash(t, "https://example.com")})
+	args[3] = passwordHashArg{} // Password_hash
+	mock.ExpectExec("^INSERT INTO url_shortener").
+		WithArgs(args...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectLinkChanged(mock, auditCreate, 1)
+	mock.ExpectCommit()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	form := strings.NewReader("textInput=https://example.com&password=secret")
+	req := httptest.NewRequest("POST", "/submit", form)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	if f := expectFlash(t, rr, "/", flashSuccess); !strings.HasPrefix(f.Short_url, "http://example.com/") {
+		t.Errorf("expected the new short url in the flash message, got %q", f.Short_url)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
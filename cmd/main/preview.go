@@ -0,0 +1,214 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// previewPage is the data passed to preview.html
+type previewPage struct {
+	Short_url     string
+	Destination   string // the url the continue button leads to
+	Display       string // the destination as shown to people, its host in punycode
+	Domain        string // in punycode, so lookalike hosts stand out
+	UnicodeDomain string // the domain as it reads in Unicode, "" when it is plain ASCII
+	Title         string
+	Description   string
+}
+
+// renderPreview shows that link leads to destination instead of redirecting.
+// The title and description of the destination are best effort: the page is
+// still shown when they cannot be fetched.
+func (app *MyApp) renderPreview(w http.ResponseWriter, r *http.Request, link UrlShortener, destination string) {
+	page := previewPage{
+		Short_url:   link.Short_url,
+		Destination: destination,
+		Display:     pkg.ASCIIURL(destination),
+	}
+	if u, err := url.Parse(page.Display); err == nil {
+		page.Domain = u.Hostname()
+		if unicode := pkg.ToUnicodeHost(page.Domain); unicode != page.Domain {
+			page.UnicodeDomain = unicode
+		}
+	}
+
+	metadata, err := app.metadata.Fetch(r.Context(), destination)
+	if err != nil {
+		log.Printf("Error fetching metadata of %s: %v", destination, err)
+	}
+	page.Title = metadata.Title
+	page.Description = metadata.Description
+
+	w.Header().Set("X-Robots-Tag", "noindex")
+	err = app.render(w, r, "preview.html", page)
+	if err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// botPreviewPage is the data passed to bot_preview.html
+type botPreviewPage struct {
+	URL         string // the short url, on the domain of the link
+	Destination string
+	Site        string // the host of the domain of the link
+	Title       string
+	Description string
+	Image       string
+}
+
+// renderBotPreview answers a crawler with a page carrying the OpenGraph tags
+// of link instead of redirecting it, so link previews show a title and image
+// under the short url. Tags the link leaves empty are those of the
+// destination, and the title falls back to the link's own. domain is the
+// domain link was found on, whose host is used rather than the one the
+// request names.
+func (app *MyApp) renderBotPreview(w http.ResponseWriter, r *http.Request, domain Domain, link UrlShortener, destination string) {
+	page := botPreviewPage{
+		URL:         shortURL(r, domain, link),
+		Destination: destination,
+		Site:        domain.Host,
+		Title:       link.Og_title,
+		Description: link.Og_description,
+		Image:       link.Og_image,
+	}
+	if page.Title == "" || page.Description == "" || page.Image == "" {
+		metadata := app.destinationOpenGraph(r.Context(), link.Original_url)
+		page.Title = firstNonEmpty(page.Title, metadata.Title)
+		page.Description = firstNonEmpty(page.Description, metadata.Description)
+		page.Image = firstNonEmpty(page.Image, metadata.Image)
+	}
+	page.Title = firstNonEmpty(page.Title, link.Title, pkg.DisplayURL(destination))
+
+	w.Header().Set("X-Robots-Tag", "noindex")
+	w.Header().Set("Cache-Control", "no-store")
+	err := app.render(w, r, "bot_preview.html", page)
+	if err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// prefillOpenGraph fills the OpenGraph tags link leaves empty with those of
+// its destination. Destinations that cannot be fetched leave them empty.
+func (app *MyApp) prefillOpenGraph(ctx context.Context, link *UrlShortener) {
+	if link.Og_title != "" && link.Og_description != "" && link.Og_image != "" {
+		return
+	}
+	metadata := app.destinationOpenGraph(ctx, link.Original_url)
+	link.Og_title = firstNonEmpty(link.Og_title, metadata.Title)
+	link.Og_description = firstNonEmpty(link.Og_description, metadata.Description)
+	link.Og_image = firstNonEmpty(link.Og_image, metadata.Image)
+}
+
+// queueOpenGraph has the OpenGraph tags link leaves empty filled in the
+// background, so creating a link does not wait for its destination to answer
+func (app *MyApp) queueOpenGraph(ctx context.Context, link UrlShortener) {
+	if app.jobs == nil || (link.Og_title != "" && link.Og_description != "" && link.Og_image != "") {
+		return
+	}
+	if err := app.jobs.Enqueue(ctx, jobFillOpenGraph, strconv.Itoa(link.Id), time.Time{}); err != nil {
+		log.Printf("Error queueing the OpenGraph tags of link %d: %v", link.Id, err)
+	}
+}
+
+// fillOpenGraph fills the OpenGraph tags the link with id still leaves empty
+// with those of its destination. The destination is fetched outside of the
+// transaction, and nothing is written when the link was given other tags,
+// another destination or moved to the trash in the meantime.
+func (app *MyApp) fillOpenGraph(ctx context.Context, id int) error {
+	var link UrlShortener
+	err := app.db.GetByWhere("url_shortener", "Id = ?", []interface{}{id}, &link)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	filled := link
+	app.prefillOpenGraph(ctx, &filled)
+
+	return app.db.WithTx(ctx, func(tx StorageInterfaces.Store) error {
+		err := tx.GetByWhere("url_shortener", "Id = ? FOR UPDATE", []interface{}{id}, &link)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if link.Deleted_at != nil || link.Original_url != filled.Original_url {
+			return nil
+		}
+		before := link
+		link.Og_title = firstNonEmpty(link.Og_title, filled.Og_title)
+		link.Og_description = firstNonEmpty(link.Og_description, filled.Og_description)
+		link.Og_image = firstNonEmpty(link.Og_image, filled.Og_image)
+		fields := changedFields(before, link)
+		if len(fields) == 0 {
+			return nil
+		}
+		if err := tx.UpdateFields("url_shortener", &link, "Id", fields...); err != nil {
+			return err
+		}
+		return app.linkChanged(tx, systemActor, auditUpdate, &before, &link)
+	})
+}
+
+// destinationOpenGraph returns what the page at destination says about
+// itself, cut to fit the OpenGraph columns of a link, with its image as an
+// absolute url
+func (app *MyApp) destinationOpenGraph(ctx context.Context, destination string) pkg.PageMetadata {
+	metadata, err := app.metadata.Fetch(ctx, destination)
+	if err != nil {
+		log.Printf("Error fetching metadata of %s: %v", destination, err)
+	}
+	metadata.Title = truncateRunes(metadata.Title, maxTitle)
+	metadata.Description = truncateRunes(metadata.Description, maxOgDescription)
+	if metadata.Image = absoluteURL(destination, metadata.Image); len(metadata.Image) > maxOgImage {
+		metadata.Image = ""
+	}
+	return metadata
+}
+
+// firstNonEmpty returns the first of values that is not ""
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// truncateRunes cuts s to at most n characters
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// absoluteURL resolves ref, as found on the page at base, to an absolute
+// http or https url. Anything else gives "".
+func absoluteURL(base, ref string) string {
+	baseURL, err := url.Parse(base)
+	if err != nil || ref == "" {
+		return ""
+	}
+	refURL, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	resolved := baseURL.ResolveReference(refURL)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return ""
+	}
+	return resolved.String()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"cmd/main/internal"
+	"cmd/main/pkg"
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const previewTestTemplate = "{{.Short_url}}|{{.Domain}}|{{.Title}}|{{.Description}}|{{.Destination}}"
+
+func newPreviewTestApp(t *testing.T, destination string, preview bool) (*MyApp, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Preview"}).
+		AddRow(1, destination, "abc12", preview)
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+		WithArgs("abc12", 0).
+		WillReturnRows(rows)
+
+	tmpl := template.Must(template.New("preview.html").Parse(previewTestTemplate))
+	cfg := internal.Config{MetadataTimeout: time.Second, MetadataCacheTTL: time.Minute, MetadataAllowPrivate: true}
+	return NewMyApp(&MySQLDatabase{DB: db}, tmpl, cfg), mock
+}
+
+func TestRedirectHandler_PreviewSuffix(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<title>Remote Page</title><meta name="description" content="All about it">`)
+	}))
+	defer server.Close()
+
+	app, mock := newPreviewTestApp(t, server.URL+"/page", false)
+
+	req := httptest.NewRequest("GET", "/abc12+", nil)
+	rr := httptest.NewRecorder()
+
+	app.redirectHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	expected := "abc12|127.0.0.1|Remote Page|All about it|" + server.URL + "/page"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRedirectHandler_PreviewSetting(t *testing.T) {
+	// The destination is down, the preview page is still shown
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	app, mock := newPreviewTestApp(t, server.URL, true)
+
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	rr := httptest.NewRecorder()
+
+	app.redirectHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	if body := rr.Body.String(); !strings.HasPrefix(body, "abc12|127.0.0.1|||") {
+		t.Errorf("handler returned unexpected body: got %v", body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRenderPreview(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<title>Page %s</title>", r.URL.Path)
+	}))
+	defer server.Close()
+
+	tmpl := template.Must(template.New("preview.html").Parse("{{.Domain}}|{{.UnicodeDomain}}|{{.Display}}|{{.Title}}"))
+	cfg := internal.Config{MetadataTimeout: time.Second, MetadataCacheTTL: time.Minute, MetadataAllowPrivate: true}
+	app := NewMyApp(nil, tmpl, cfg)
+
+	// The title is that of where Continue leads, a variant here, not of the
+	// link's own destination
+	link := UrlShortener{Short_url: "abc12", Original_url: server.URL + "/original"}
+	rr := httptest.NewRecorder()
+	app.renderPreview(rr, httptest.NewRequest("GET", "/abc12+", nil), link, server.URL+"/variant")
+	if body := rr.Body.String(); !strings.HasSuffix(body, "|Page /variant") {
+		t.Errorf("expected the title of the variant, got %v", body)
+	}
+
+	// Lookalike hosts are shown in punycode, with how they read next to it
+	rr = httptest.NewRecorder()
+	app.metadata = nil
+	app.renderPreview(rr, httptest.NewRequest("GET", "/abc12+", nil), link, "https://аpple.com/login")
+	expected := "xn--pple-43d.com|аpple.com|https://xn--pple-43d.com/login|"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %v want %v", body, expected)
+	}
+}
+
+func TestAbsoluteURL(t *testing.T) {
+	testCases := []struct {
+		base, ref string
+		expected  string
+	}{
+		{"https://example.com/blog/post", "/cover.png", "https://example.com/cover.png"},
+		{"https://example.com/blog/post", "cover.png", "https://example.com/blog/cover.png"},
+		{"https://example.com/", "https://cdn.example.org/a.png", "https://cdn.example.org/a.png"},
+		{"https://example.com/", "javascript:alert(1)", ""},
+		{"https://example.com/", "", ""},
+	}
+
+	for _, tc := range testCases {
+		if got := absoluteURL(tc.base, tc.ref); got != tc.expected {
+			t.Errorf("absoluteURL(%q, %q) = %q; expected %q", tc.base, tc.ref, got, tc.expected)
+		}
+	}
+}
+
+func TestPrefillOpenGraph(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<title>Remote Page</title><meta property="og:description" content="All about it"><meta property="og:image" content="img/cover.png">`)
+	}))
+	defer server.Close()
+
+	app := NewMyApp(nil, nil, internal.Config{MetadataTimeout: time.Second, MetadataCacheTTL: time.Minute, MetadataAllowPrivate: true})
+
+	// What the link says is kept
+	link := UrlShortener{Original_url: server.URL + "/blog/post", Og_title: "Our post"}
+	app.prefillOpenGraph(context.Background(), &link)
+	if link.Og_title != "Our post" || link.Og_description != "All about it" || link.Og_image != server.URL+"/blog/img/cover.png" {
+		t.Errorf("unexpected OpenGraph tags %q, %q, %q", link.Og_title, link.Og_description, link.Og_image)
+	}
+
+	// A destination that cannot be fetched leaves them empty
+	server.Close()
+	link = UrlShortener{Original_url: server.URL + "/gone"}
+	app.prefillOpenGraph(context.Background(), &link)
+	if link.Og_title != "" || link.Og_description != "" || link.Og_image != "" {
+		t.Errorf("expected no OpenGraph tags, got %q, %q, %q", link.Og_title, link.Og_description, link.Og_image)
+	}
+}
+
+func TestQueueOpenGraph(t *testing.T) {
+	queue := pkg.NewMemoryJobQueue()
+	app := &MyApp{jobs: pkg.NewJobRunner(queue, 1)}
+
+	app.queueOpenGraph(context.Background(), UrlShortener{Id: 7, Og_title: "Our post"})
+	// Links with every tag set are left alone
+	app.queueOpenGraph(context.Background(), UrlShortener{Id: 8, Og_title: "a", Og_description: "b", Og_image: "https://example.com/c.png"})
+
+	jobs := queue.Jobs()
+	if len(jobs) != 1 || jobs[0].Kind != jobFillOpenGraph || jobs[0].Payload != "7" {
+		t.Errorf("expected one job filling the tags of link 7, got %+v", jobs)
+	}
+}
+
+func TestFillOpenGraph(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<title>Remote Page</title><meta property="og:description" content="All about it"><meta property="og:image" content="/cover.png">`)
+	}))
+	defer server.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	columns := []string{"Id", "Original_url", "Short_url", "Og_title", "Og_description"}
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\?$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(7, server.URL+"/page", "abc12", "", ""))
+	// The description was set while the destination was fetched, and is kept
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\? FOR UPDATE$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows(columns).AddRow(7, server.URL+"/page", "abc12", "", "Ours"))
+	mock.ExpectExec("^UPDATE url_shortener SET Og_title = \\?, Og_image = \\? WHERE Id = \\?$").
+		WithArgs("Remote Page", server.URL+"/cover.png", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLinkChanged(mock, auditUpdate, 7)
+	mock.ExpectCommit()
+
+	app := NewMyApp(&MySQLDatabase{DB: db}, nil, internal.Config{MetadataTimeout: time.Second, MetadataCacheTTL: time.Minute, MetadataAllowPrivate: true})
+	if err := app.fillOpenGraph(context.Background(), 7); err != nil {
+		t.Errorf("Error filling OpenGraph tags: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRedirectHandler_SocialCrawler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	tmpl := template.Must(template.New("bot_preview.html").Parse("{{.Title}}|{{.Description}}|{{.Image}}"))
+	app := &MyApp{db: &MySQLDatabase{DB: db}, tmpl: tmpl}
+
+	userAgents := map[string]int{
+		"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)": http.StatusOK,
+		// Other bots and people are redirected unless bots get previews
+		"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)": http.StatusFound,
+		"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0":   http.StatusFound,
+	}
+	for userAgent, expected := range userAgents {
+		mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+			WithArgs("abc12", 0).
+			WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Og_title", "Og_description", "Og_image"}).
+				AddRow(1, "https://example.com", "abc12", "Spring sale", "Everything half off", "https://example.com/sale.png"))
+
+		req := httptest.NewRequest("GET", "/abc12", nil)
+		req.Header.Set("User-Agent", userAgent)
+		rr := httptest.NewRecorder()
+
+		app.redirectHandler(rr, req)
+
+		if status := rr.Code; status != expected {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", userAgent, status, expected)
+		}
+		if expected == http.StatusOK {
+			if body := rr.Body.String(); body != "Spring sale|Everything half off|https://example.com/sale.png" {
+				t.Errorf("%s: handler returned unexpected body: %v", userAgent, body)
+			}
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VisitorSalt is a row of visitor_salts: the salt visitors are hashed with
+// on one day (UTC). Salts of days past are deleted, after which the hashes
+// made with them can no longer be tied to an address.
+type VisitorSalt struct {
+	Day  string // 2006-01-02
+	Salt string // hex
+}
+
+const saltDayFormat = "2006-01-02"
+
+// saltCache holds the salt of the current day, so only the first click of
+// the day reads it from visitor_salts, where every instance finds the same
+type saltCache struct {
+	mu   sync.Mutex
+	day  string
+	salt []byte
+}
+
+// visitorSalt returns the salt of the day of now, creating it when no
+// instance has yet
+func (app *MyApp) visitorSalt(now time.Time) ([]byte, error) {
+	day := now.UTC().Format(saltDayFormat)
+	app.salts.mu.Lock()
+	defer app.salts.mu.Unlock()
+	if app.salts.day == day {
+		return app.salts.salt, nil
+	}
+
+	var row VisitorSalt
+	err := app.db.GetByWhere("visitor_salts", "Day = ?", []interface{}{day}, &row)
+	if errors.Is(err, sql.ErrNoRows) {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		row = VisitorSalt{Day: day, Salt: hex.EncodeToString(salt)}
+		if err = app.db.Save("visitor_salts", &row); err != nil {
+			// Another instance may have saved one first
+			err = app.db.GetByWhere("visitor_salts", "Day = ?", []interface{}{day}, &row)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	salt, err := hex.DecodeString(row.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt for %s: %w", day, err)
+	}
+	app.salts.day, app.salts.salt = day, salt
+	return salt, nil
+}
+
+// visitorID hashes the address and user agent of a visitor. In privacy mode
+// the salt changes every day, so visitors can be told apart within a day but
+// not followed from one day to the next; otherwise the cookie secret is used.
+func (app *MyApp) visitorID(ip, userAgent string, now time.Time) string {
+	if !app.cfg.PrivacyMode {
+		return pkg.VisitorHash([]byte(app.cfg.CookieSecret), ip, userAgent)
+	}
+	salt, err := app.visitorSalt(now)
+	if err != nil {
+		log.Printf("Error retrieving the visitor salt: %v", err)
+		return ""
+	}
+	return pkg.VisitorHash(salt, ip, userAgent)
+}
+
+// pruneAnalytics removes what the retention settings keep no longer: raw
+// clicks, click counts and the visitor salts of days past
+func (app *MyApp) pruneAnalytics(now time.Time) error {
+	if days := app.cfg.ClickRetentionDays; days > 0 {
+		if err := app.pruneClicks(now.AddDate(0, 0, -days)); err != nil {
+			return err
+		}
+	}
+	if days := app.cfg.RollupRetentionDays; days > 0 {
+		if err := app.db.Delete("click_rollups", "Bucket_start < ?", []interface{}{now.AddDate(0, 0, -days)}); err != nil {
+			return err
+		}
+	}
+	return app.db.Delete("visitor_salts", "Day < ?", []interface{}{now.UTC().Format(saltDayFormat)})
+}
+
+// erasedActor replaces the name of an erased account in the audit log
+const erasedActor = "erased"
+
+// accountLinksWhere selects the links an account created, by the link id
+// column it follows. Takes auditCreate and the account as arguments.
+const accountLinksWhere = " IN (SELECT Link_id FROM audit_events WHERE Action = ? AND Actor = ?)"
+
+// dataSubject returns the account a privacy request is about. People may ask
+// about their own account, named by the actor header; API keys, held by
+// whoever runs the app, may ask about any account with the account query
+// parameter.
+func (app *MyApp) dataSubject(r *http.Request) (string, error) {
+	who := app.auditActor(r)
+	account := strings.TrimSpace(r.URL.Query().Get("account"))
+	if strings.HasPrefix(who.Name, "api-key:") {
+		if account == "" {
+			return "", fmt.Errorf("account is required")
+		}
+		return account, nil
+	}
+	if who.Name == "anonymous" {
+		return "", fmt.Errorf("anonymous requests have no account")
+	}
+	if account != "" && account != who.Name {
+		return "", fmt.Errorf("only API keys may ask about other accounts")
+	}
+	return who.Name, nil
+}
+
+// apiClick is a click as the data export holds it
+type apiClick struct {
+	Link_id    int       `json:"link_id"`
+	Variant_id int       `json:"variant_id"`
+	Clicked_at time.Time `json:"clicked_at"`
+	Referrer   string    `json:"referrer"`
+	Country    string    `json:"country"`
+	Device     string    `json:"device"`
+	Ip         string    `json:"ip"`      // truncated
+	Visitor    string    `json:"visitor"` // hash
+	Bot        string    `json:"bot,omitempty"`
+}
+
+// apiClickCount is a daily rollup as the data export holds it
+type apiClickCount struct {
+	Link_id   int       `json:"link_id"`
+	Day       time.Time `json:"day"`
+	Dimension string    `json:"dimension"`
+	Value     string    `json:"value"`
+	Clicks    int64     `json:"clicks"`
+}
+
+// privacyExport is everything kept about an account: the links it created,
+// their clicks and click counts, and its own entries in the audit log
+type privacyExport struct {
+	Account      string            `json:"account"`
+	Exported_at  time.Time         `json:"exported_at"`
+	Links        []json.RawMessage `json:"links"`
+	Clicks       []apiClick        `json:"clicks"`
+	Click_counts []apiClickCount   `json:"click_counts"`
+	Audit_events []apiAuditEvent   `json:"audit_events"`
+}
+
+// exportAccount gathers the data of account
+func (app *MyApp) exportAccount(account string) (privacyExport, error) {
+	export := privacyExport{
+		Account:      account,
+		Exported_at:  time.Now().UTC(),
+		Links:        []json.RawMessage{},
+		Clicks:       []apiClick{},
+		Click_counts: []apiClickCount{},
+		Audit_events: []apiAuditEvent{},
+	}
+	args := []interface{}{auditCreate, account}
+
+	var links []UrlShortener
+	if err := app.db.GetAllByWhere("url_shortener", "Id"+accountLinksWhere+" ORDER BY Id", args, &links); err != nil {
+		return export, err
+	}
+	for i := range links {
+		snapshot, err := auditSnapshot(&links[i])
+		if err != nil {
+			return export, err
+		}
+		export.Links = append(export.Links, json.RawMessage(snapshot))
+	}
+
+	var clicks []ClickEvent
+	if err := app.db.GetAllByWhere("click_events", "Link_id"+accountLinksWhere+" ORDER BY Id", args, &clicks); err != nil {
+		return export, err
+	}
+	for _, click := range clicks {
+		export.Clicks = append(export.Clicks, apiClick{
+			Link_id:    click.Link_id,
+			Variant_id: click.Variant_id,
+			Clicked_at: click.Clicked_at.UTC(),
+			Referrer:   click.Referrer,
+			Country:    click.Country,
+			Device:     click.Device,
+			Ip:         click.Ip,
+			Visitor:    click.Visitor,
+			Bot:        click.Bot,
+		})
+	}
+
+	var rollups []ClickRollup
+	where := "Granularity = ? AND Link_id" + accountLinksWhere + " ORDER BY Link_id, Bucket_start, Dimension, Value"
+	if err := app.db.GetAllByWhere("click_rollups", where, append([]interface{}{pkg.Daily}, args...), &rollups); err != nil {
+		return export, err
+	}
+	for _, rollup := range rollups {
+		export.Click_counts = append(export.Click_counts, apiClickCount{
+			Link_id:   rollup.Link_id,
+			Day:       rollup.Bucket_start.UTC(),
+			Dimension: rollup.Dimension,
+			Value:     rollup.Value,
+			Clicks:    rollup.Clicks,
+		})
+	}
+
+	var events []AuditEvent
+	if err := app.db.GetAllByWhere("audit_events", "Actor = ? ORDER BY Id", []interface{}{account}, &events); err != nil {
+		return export, err
+	}
+	for _, event := range events {
+		export.Audit_events = append(export.Audit_events, newAPIAuditEvent(event))
+	}
+	return export, nil
+}
+
+// privacyErasure is the body of a successful /api/privacy/delete response
+type privacyErasure struct {
+	Account               string `json:"account"`
+	Links_deleted         int    `json:"links_deleted"`
+	Audit_events_scrubbed int    `json:"audit_events_scrubbed"`
+}
+
+// eraseAccount deletes the links account created, with their clicks, counts
+// and history, whether in the trash or not. The audit log is append-only
+// except here: the account's entries lose its name and IP, and the entries
+// of its links lose their snapshots. Each link leaves an erase event with
+// nothing but its id, and webhooks hear of it as purged.
+func (app *MyApp) eraseAccount(ctx context.Context, who auditActor, account string) (privacyErasure, error) {
+	var erased privacyErasure
+	if who.Name == account {
+		who = auditActor{Name: erasedActor, Request_id: who.Request_id}
+	}
+	err := app.db.WithTx(ctx, func(tx StorageInterfaces.Store) error {
+		erased = privacyErasure{Account: account}
+		var links []UrlShortener
+		if err := tx.GetAllByWhere("url_shortener", "Id"+accountLinksWhere+" FOR UPDATE", []interface{}{auditCreate, account}, &links); err != nil {
+			return err
+		}
+
+		conditions := []string{"Actor = ?"}
+		args := []interface{}{account}
+		erasedLinks := make(map[int]bool, len(links))
+		if len(links) > 0 {
+			placeholders := make([]string, len(links))
+			for i, link := range links {
+				placeholders[i] = "?"
+				args = append(args, link.Id)
+				erasedLinks[link.Id] = true
+			}
+			conditions = append(conditions, "Link_id IN ("+strings.Join(placeholders, ", ")+")")
+		}
+		var events []AuditEvent
+		if err := tx.GetAllByWhere("audit_events", strings.Join(conditions, " OR ")+" ORDER BY Id", args, &events); err != nil {
+			return err
+		}
+		for _, event := range events {
+			if event.Actor == account {
+				event.Actor, event.Ip = erasedActor, ""
+			}
+			if erasedLinks[event.Link_id] {
+				event.Before_json, event.After_json = "", ""
+			}
+			if err := tx.Update("audit_events", &event, "Id"); err != nil {
+				return err
+			}
+		}
+		erased.Audit_events_scrubbed = len(events)
+
+		for _, link := range links {
+			if err := removeLink(tx, link.Id); err != nil {
+				return err
+			}
+			event := AuditEvent{
+				Occurred_at: time.Now().UTC(),
+				Action:      auditErase,
+				Link_id:     link.Id,
+				Actor:       who.Name,
+				Ip:          who.IP,
+				Request_id:  who.Request_id,
+			}
+			if err := tx.SaveReturningID("audit_events", &event, "Id"); err != nil {
+				return err
+			}
+			if err := app.webhooks.linkEvent(tx, who, auditErase, &UrlShortener{Id: link.Id}, nil); err != nil {
+				return err
+			}
+		}
+		erased.Links_deleted = len(links)
+		return nil
+	})
+	return erased, err
+}
+
+// apiPrivacyExportHandler returns everything kept about an account as JSON,
+// for the account named by dataSubject
+func (app *MyApp) apiPrivacyExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+		return
+	}
+	if !app.apiAuth(w, r) {
+		return
+	}
+	account, err := app.dataSubject(r)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, apiError{Error: err.Error()})
+		return
+	}
+
+	export, err := app.exportAccount(account)
+	if err != nil {
+		log.Printf("Error exporting the data of %s: %v", account, err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "internal server error"})
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="account-data.json"`)
+	writeJSON(w, http.StatusOK, export)
+}
+
+// apiPrivacyDeleteHandler erases an account's links and their analytics, for
+// the account named by dataSubject
+func (app *MyApp) apiPrivacyDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{Error: "method not allowed"})
+		return
+	}
+	if !app.apiAuth(w, r) {
+		return
+	}
+	account, err := app.dataSubject(r)
+	if err != nil {
+		writeJSON(w, http.StatusForbidden, apiError{Error: err.Error()})
+		return
+	}
+
+	erased, err := app.eraseAccount(r.Context(), app.auditActor(r), account)
+	if err != nil {
+		log.Printf("Error erasing the data of %s: %v", account, err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "internal server error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, erased)
+}
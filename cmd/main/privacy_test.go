@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const saltQuery = "^SELECT \\* FROM visitor_salts WHERE Day = \\?$"
+
+func TestVisitorSalt(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	salt := strings.Repeat("ab", 32)
+	mock.ExpectQuery(saltQuery).
+		WithArgs("2026-10-19").
+		WillReturnRows(sqlmock.NewRows([]string{"Day", "Salt"}).AddRow("2026-10-19", salt))
+	// The next day has no salt yet
+	mock.ExpectQuery(saltQuery).
+		WithArgs("2026-10-20").
+		WillReturnRows(sqlmock.NewRows([]string{"Day", "Salt"}))
+	mock.ExpectExec("^INSERT INTO visitor_salts \\(Day, Salt\\) VALUES \\(\\?, \\?\\)$").
+		WithArgs("2026-10-20", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	app.cfg.PrivacyMode = true
+	now := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+
+	first := app.visitorID("203.0.113.77", "Firefox", now)
+	// Read once a day
+	if again := app.visitorID("203.0.113.77", "Firefox", now.Add(time.Hour)); again != first || first == "" {
+		t.Errorf("expected the same visitor on the same day, got %q and %q", first, again)
+	}
+	if tomorrow := app.visitorID("203.0.113.77", "Firefox", now.AddDate(0, 0, 1)); tomorrow == first || tomorrow == "" {
+		t.Errorf("expected a new visitor id the next day, got %q", tomorrow)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestNewClick_DoNotTrack(t *testing.T) {
+	app := &MyApp{}
+	app.cfg.PrivacyMode = true
+
+	r := httptest.NewRequest(http.MethodGet, "/abc12", nil)
+	r.RemoteAddr = "203.0.113.77:51234"
+	r.Header.Set("Referer", "https://www.example.com/post")
+	r.Header.Set("Sec-GPC", "1")
+	click := app.newClick(r, UrlShortener{Id: 3}, Variant{})
+	if click.Link_id != 3 || click.Referrer != "" || click.Ip != "" || click.Visitor != "" {
+		t.Errorf("expected an anonymous click, got %+v", click)
+	}
+
+	// Outside privacy mode the headers are not honoured, and no address is
+	// kept whole
+	app.cfg.PrivacyMode = false
+	click = app.newClick(r, UrlShortener{Id: 3}, Variant{})
+	if click.Referrer != "example.com" || click.Ip != "203.0.113.0" || click.Visitor == "" {
+		t.Errorf("unexpected click %+v", click)
+	}
+}
+
+func TestPruneAnalytics(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(progressQuery).
+		WithArgs("hour").
+		WillReturnRows(sqlmock.NewRows(progressColumns).AddRow("hour", now))
+	mock.ExpectExec("^DELETE FROM click_events WHERE Clicked_at < \\?$").
+		WithArgs(now.AddDate(0, 0, -30)).
+		WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectExec("^DELETE FROM click_rollups WHERE Bucket_start < \\?$").
+		WithArgs(now.AddDate(0, 0, -365)).
+		WillReturnResult(sqlmock.NewResult(0, 10))
+	mock.ExpectExec("^DELETE FROM visitor_salts WHERE Day < \\?$").
+		WithArgs("2026-10-19").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// Without retention only the salts go
+	mock.ExpectExec("^DELETE FROM visitor_salts WHERE Day < \\?$").
+		WithArgs("2026-10-19").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	app.cfg.ClickRetentionDays = 30
+	app.cfg.RollupRetentionDays = 365
+	if err := app.pruneAnalytics(now); err != nil {
+		t.Errorf("Error pruning analytics: %v", err)
+	}
+	app.cfg.ClickRetentionDays, app.cfg.RollupRetentionDays = 0, 0
+	if err := app.pruneAnalytics(now); err != nil {
+		t.Errorf("Error pruning analytics: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDataSubject(t *testing.T) {
+	app := &MyApp{}
+	app.cfg.ActorHeader = "X-Forwarded-User"
+	app.cfg.APIKeys = []string{"deploy:s3cret"}
+
+	tests := []struct {
+		name    string
+		query   string
+		headers map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"anonymous", "", nil, "", true},
+		{"own account", "", map[string]string{"X-Forwarded-User": "alice"}, "alice", false},
+		{"own account by name", "?account=alice", map[string]string{"X-Forwarded-User": "alice"}, "alice", false},
+		{"other account", "?account=bob", map[string]string{"X-Forwarded-User": "alice"}, "", true},
+		{"API key", "?account=bob", map[string]string{"Authorization": "Bearer s3cret"}, "bob", false},
+		{"API key without account", "", map[string]string{"Authorization": "Bearer s3cret"}, "", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/privacy/export"+tt.query, nil)
+		for name, value := range tt.headers {
+			req.Header.Set(name, value)
+		}
+
+		got, err := app.dataSubject(req)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("%s: got %q, %v", tt.name, got, err)
+		}
+	}
+}
+
+func TestApiPrivacyExportHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	clickedAt := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id IN \\(SELECT Link_id FROM audit_events WHERE Action = \\? AND Actor = \\?\\) ORDER BY Id$").
+		WithArgs(auditCreate, "alice").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url"}).AddRow(7, "https://example.com", "abc12"))
+	mock.ExpectQuery("^SELECT \\* FROM click_events WHERE Link_id IN \\(SELECT Link_id FROM audit_events WHERE Action = \\? AND Actor = \\?\\) ORDER BY Id$").
+		WithArgs(auditCreate, "alice").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Clicked_at", "Country", "Ip", "Visitor"}).
+			AddRow(1, 7, clickedAt, "DE", "203.0.113.0", "5f1d0c3a"))
+	mock.ExpectQuery("^SELECT \\* FROM click_rollups WHERE Granularity = \\? AND Link_id IN \\(SELECT Link_id FROM audit_events WHERE Action = \\? AND Actor = \\?\\) ORDER BY Link_id, Bucket_start, Dimension, Value$").
+		WithArgs("day", auditCreate, "alice").
+		WillReturnRows(sqlmock.NewRows(rollupColumns).AddRow("day", clickedAt.Truncate(24*time.Hour), 7, "country", "DE", 1))
+	mock.ExpectQuery("^SELECT \\* FROM audit_events WHERE Actor = \\? ORDER BY Id$").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Occurred_at", "Action", "Link_id", "Actor"}).
+			AddRow(3, clickedAt, auditCreate, 7, "alice"))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	app.cfg.ActorHeader = "X-Forwarded-User"
+
+	req := httptest.NewRequest("GET", "/api/privacy/export", nil)
+	req.Header.Set("X-Forwarded-User", "alice")
+	rr := httptest.NewRecorder()
+
+	app.apiPrivacyExportHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	var export privacyExport
+	if err := json.Unmarshal(rr.Body.Bytes(), &export); err != nil {
+		t.Fatalf("Error decoding the export: %v", err)
+	}
+	if export.Account != "alice" || len(export.Links) != 1 || len(export.Clicks) != 1 || len(export.Click_counts) != 1 || len(export.Audit_events) != 1 {
+		t.Errorf("unexpected export %+v", export)
+	}
+	if click := export.Clicks[0]; click.Ip != "203.0.113.0" || click.Visitor != "5f1d0c3a" {
+		t.Errorf("unexpected click %+v", click)
+	}
+
+	// Nobody may ask about someone else
+	req = httptest.NewRequest("GET", "/api/privacy/export?account=bob", nil)
+	req.Header.Set("X-Forwarded-User", "alice")
+	rr = httptest.NewRecorder()
+	app.apiPrivacyExportHandler(rr, req)
+	if status := rr.Code; status != http.StatusForbidden {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusForbidden)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestEraseAccount(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	occurred := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id IN \\(SELECT Link_id FROM audit_events WHERE Action = \\? AND Actor = \\?\\) FOR UPDATE$").
+		WithArgs(auditCreate, "alice").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Short_url"}).AddRow(7, "abc12"))
+	mock.ExpectQuery("^SELECT \\* FROM audit_events WHERE Actor = \\? OR Link_id IN \\(\\?\\) ORDER BY Id$").
+		WithArgs("alice", 7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Occurred_at", "Action", "Link_id", "Actor", "Ip", "Request_id", "Before_json", "After_json"}).
+			AddRow(3, occurred, auditCreate, 7, "alice", "192.0.2.1", "req-1", "", `{"Id":7}`).
+			AddRow(4, occurred, auditUpdate, 7, "bob", "192.0.2.2", "req-2", `{"Id":7}`, `{"Id":7}`).
+			AddRow(5, occurred, auditCreate, 9, "alice", "192.0.2.1", "req-3", "", `{"Id":9}`))
+	// The account's name and address go, and so do the snapshots of its links
+	mock.ExpectExec("^UPDATE audit_events SET .* WHERE Id = \\?$").
+		WithArgs(occurred, auditCreate, 7, erasedActor, "", "req-1", "", "", 3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^UPDATE audit_events SET .* WHERE Id = \\?$").
+		WithArgs(occurred, auditUpdate, 7, "bob", "192.0.2.2", "req-2", "", "", 4).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^UPDATE audit_events SET .* WHERE Id = \\?$").
+		WithArgs(occurred, auditCreate, 9, erasedActor, "", "req-3", "", `{"Id":9}`, 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for _, table := range linkTables {
+		mock.ExpectExec("^DELETE FROM " + table + " WHERE Link_id = \\?$").
+			WithArgs(7).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectExec("^DELETE FROM url_shortener WHERE Id = \\?$").
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^INSERT INTO audit_events ").
+		WithArgs(recentTime{}, auditErase, 7, erasedActor, "", "req-4", "", "").
+		WillReturnResult(sqlmock.NewResult(6, 1))
+	mock.ExpectCommit()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	erased, err := app.eraseAccount(context.Background(), auditActor{Name: "alice", IP: "192.0.2.1", Request_id: "req-4"}, "alice")
+	if err != nil {
+		t.Fatalf("Error erasing the account: %v", err)
+	}
+	if erased != (privacyErasure{Account: "alice", Links_deleted: 1, Audit_events_scrubbed: 3}) {
+		t.Errorf("unexpected erasure %+v", erased)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"net/http"
+	"strings"
+)
+
+// utmParams are the campaign parameters that have their own form fields
+var utmParams = []string{"utm_source", "utm_medium", "utm_campaign"}
+
+// queryRulesFromForm reads the query rules submitted for a new link. Besides
+// the utm fields, query_params takes extra name=value pairs, one per line,
+// and passthrough a comma separated list of request parameters.
+func queryRulesFromForm(r *http.Request) (pkg.QueryRules, error) {
+	rules := pkg.QueryRules{
+		Set:      map[string]string{},
+		Conflict: r.FormValue("query_conflict"),
+	}
+	for _, name := range utmParams {
+		if value := strings.TrimSpace(r.FormValue(name)); value != "" {
+			rules.Set[name] = value
+		}
+	}
+	for _, line := range strings.Split(r.FormValue("query_params"), "\n") {
+		name, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		if name = strings.TrimSpace(name); name != "" {
+			rules.Set[name] = strings.TrimSpace(value)
+		}
+	}
+	rules.Passthrough = splitList(r.FormValue("passthrough"))
+	return rules, rules.Validate()
+}
+
+// applyQueryRules returns destination with the query rules of link applied
+// to the parameters of the short url request. Links that do not pick a
+// conflict resolution use the configured one.
+func (app *MyApp) applyQueryRules(r *http.Request, domain Domain, link UrlShortener, destination string) (string, error) {
+	rules, err := pkg.ParseQueryRules(link.Query_rules)
+	if err != nil || rules.IsEmpty() {
+		return destination, err
+	}
+	if rules.Conflict == "" {
+		rules.Conflict = app.cfg.QueryConflict
+	}
+	return rules.Apply(destination, pkg.QueryContext{
+		Code:    link.Short_url,
+		Host:    domain.Host,
+		Request: r.URL.Query(),
+	})
+}
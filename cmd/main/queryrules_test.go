@@ -0,0 +1,131 @@
+package main
+
+import (
+	"cmd/main/internal"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRedirectHandler_QueryRules(t *testing.T) {
+	testCases := []struct {
+		name     string
+		rules    string
+		cfg      internal.Config
+		path     string
+		location string
+	}{
+		{"no rules", "", internal.Config{}, "/abc12?ref=email", "https://example.com/?utm_source=old"},
+		{"utm and passthrough", `{"set":{"utm_medium":"email","utm_campaign":"{code}"},"passthrough":["ref"]}`, internal.Config{},
+			"/abc12?ref=email&other=x", "https://example.com/?ref=email&utm_campaign=abc12&utm_medium=email&utm_source=old"},
+		{"link conflict", `{"set":{"utm_source":"new"},"conflict":"append"}`, internal.Config{QueryConflict: "keep"},
+			"/abc12", "https://example.com/?utm_source=old&utm_source=new"},
+		{"configured conflict", `{"set":{"utm_source":"new"}}`, internal.Config{QueryConflict: "keep"},
+			"/abc12", "https://example.com/?utm_source=old"},
+		{"invalid rules", `{"conflict":"merge"}`, internal.Config{}, "/abc12", "https://example.com/?utm_source=old"},
+	}
+
+	for _, tc := range testCases {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+		}
+
+		rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Query_rules"}).
+			AddRow(1, "https://example.com/?utm_source=old", "abc12", tc.rules)
+		mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+			WithArgs("abc12", 0).
+			WillReturnRows(rows)
+
+		app := &MyApp{db: &MySQLDatabase{DB: db}, cfg: tc.cfg}
+
+		req := httptest.NewRequest("GET", tc.path, nil)
+		rr := httptest.NewRecorder()
+
+		app.redirectHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusFound {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", tc.name, status, http.StatusFound)
+		}
+		if location := rr.Header().Get("Location"); location != tc.location {
+			t.Errorf("%s: handler returned unexpected location: got %v want %v", tc.name, location, tc.location)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: there were unfulfilled expectations: %s", tc.name, err)
+		}
+		db.Close()
+	}
+}
+
+func TestFormHandler_QueryRules(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	rules := `{"set":{"lang":"en","utm_source":"newsletter"},"passthrough":["ref","gclid"],"conflict":"keep"}`
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Url_hash = \\? AND Domain_id = \\? AND Deleted_at IS NULL FOR UPDATE$").
+		WithArgs(normalizedHash(t, "https://example.com"), 0).
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("^INSERT INTO url_shortener ").
+		WithArgs(insertArgs(UrlShortener{Original_url: "https://example.com", Url_hash: normalizedHash(t, "https://example.com"), Query_rules: rules})...).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectLinkChanged(mock, auditCreate, 1)
+	mock.ExpectCommit()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	form := url.Values{
+		"textInput":      {"https://example.com"},
+		"utm_source":     {" newsletter "},
+		"utm_medium":     {""},
+		"query_params":   {"lang=en\r\n\r\n"},
+		"passthrough":    {"ref, gclid,"},
+		"query_conflict": {"keep"},
+	}
+	req := httptest.NewRequest("POST", "/submit", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	if f := expectFlash(t, rr, "/", flashSuccess); !strings.HasPrefix(f.Short_url, "http://example.com/") {
+		t.Errorf("expected the new short url in the flash message, got %q", f.Short_url)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFormHandler_InvalidQueryConflict(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	form := strings.NewReader("textInput=https://example.com&utm_source=a&query_conflict=merge")
+	req := httptest.NewRequest("POST", "/submit", form)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	expectFlash(t, rr, "/", flashError)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// redirectStatuses are the status codes a link can redirect with
+var redirectStatuses = map[int]bool{
+	http.StatusMovedPermanently:  true, // 301
+	http.StatusFound:             true, // 302
+	http.StatusTemporaryRedirect: true, // 307
+	http.StatusPermanentRedirect: true, // 308
+}
+
+// referrerPolicies are the values allowed in a Referrer-Policy header
+var referrerPolicies = map[string]bool{
+	"no-referrer":                     true,
+	"no-referrer-when-downgrade":      true,
+	"origin":                          true,
+	"origin-when-cross-origin":        true,
+	"same-origin":                     true,
+	"strict-origin":                   true,
+	"strict-origin-when-cross-origin": true,
+	"unsafe-url":                      true,
+}
+
+func isPermanentRedirect(status int) bool {
+	return status == http.StatusMovedPermanently || status == http.StatusPermanentRedirect
+}
+
+// redirectStatus returns the status code link redirects with: its own
+// setting, else the configured default, else 302 Found
+func (app *MyApp) redirectStatus(link UrlShortener) int {
+	if redirectStatuses[link.Redirect_type] {
+		return link.Redirect_type
+	}
+	if redirectStatuses[app.cfg.DefaultRedirectStatus] {
+		return app.cfg.DefaultRedirectStatus
+	}
+	return http.StatusFound
+}
+
+// cacheControl returns the Cache-Control header for a redirect. Unless the
+// link or the configuration says otherwise, permanent redirects may be cached
+// for a day and temporary ones not at all, so every click reaches the app.
+// Links with redirect rules or a split test are not cached unless they say
+// so, since their destination depends on the visitor. Password protected and
+// preview links are never cached, whatever they say, so the destination is
+// not replayed without the password or the preview.
+func (app *MyApp) cacheControl(link UrlShortener, status int) string {
+	if link.Password_hash != "" || link.Preview {
+		return "private, no-store"
+	}
+	if link.Cache_control != "" {
+		return link.Cache_control
+	}
+	if link.Redirect_rules != "" || link.Split_test {
+		return "no-store"
+	}
+	if app.cfg.DefaultCacheControl != "" {
+		return app.cfg.DefaultCacheControl
+	}
+	if isPermanentRedirect(status) {
+		return "public, max-age=86400"
+	}
+	return "no-store"
+}
+
+// writeRedirect sends the visitor to destination with the status code and
+// headers configured for link
+func (app *MyApp) writeRedirect(w http.ResponseWriter, r *http.Request, link UrlShortener, destination string) {
+	status := app.redirectStatus(link)
+	w.Header().Set("Cache-Control", app.cacheControl(link, status))
+
+	referrerPolicy := link.Referrer_policy
+	if referrerPolicy == "" {
+		referrerPolicy = app.cfg.DefaultReferrerPolicy
+	}
+	if referrerPolicy != "" {
+		w.Header().Set("Referrer-Policy", referrerPolicy)
+	}
+
+	if link.Canonical_link {
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"canonical\"", destination))
+	}
+
+	http.Redirect(w, r, destination, status)
+}
+
+// validateRedirectSettings checks the redirect settings submitted for a link
+func validateRedirectSettings(link UrlShortener) error {
+	if link.Redirect_type != 0 && !redirectStatuses[link.Redirect_type] {
+		return fmt.Errorf("unsupported redirect type %d", link.Redirect_type)
+	}
+	if link.Referrer_policy != "" && !referrerPolicies[link.Referrer_policy] {
+		return fmt.Errorf("unknown referrer policy %q", link.Referrer_policy)
+	}
+	if strings.ContainsAny(link.Cache_control, "\r\n") {
+		return fmt.Errorf("cache control must be a single line")
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"cmd/main/internal"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestRedirectStatusAndCacheControl(t *testing.T) {
+	testCases := []struct {
+		cfg          internal.Config
+		link         UrlShortener
+		status       int
+		cacheControl string
+	}{
+		{internal.Config{}, UrlShortener{}, http.StatusFound, "no-store"},
+		{internal.Config{DefaultRedirectStatus: 301}, UrlShortener{}, http.StatusMovedPermanently, "public, max-age=86400"},
+		{internal.Config{DefaultRedirectStatus: 301}, UrlShortener{Redirect_type: 307}, http.StatusTemporaryRedirect, "no-store"},
+		{internal.Config{}, UrlShortener{Redirect_type: 308}, http.StatusPermanentRedirect, "public, max-age=86400"},
+		{internal.Config{}, UrlShortener{Redirect_type: 399}, http.StatusFound, "no-store"},
+		{internal.Config{DefaultCacheControl: "private, max-age=60"}, UrlShortener{}, http.StatusFound, "private, max-age=60"},
+		{internal.Config{DefaultCacheControl: "private, max-age=60"}, UrlShortener{Cache_control: "no-cache"}, http.StatusFound, "no-cache"},
+		{internal.Config{}, UrlShortener{Redirect_type: 301, Password_hash: "hash"}, http.StatusMovedPermanently, "private, no-store"},
+		{internal.Config{}, UrlShortener{Redirect_type: 308, Cache_control: "public, max-age=600", Password_hash: "hash"}, http.StatusPermanentRedirect, "private, no-store"},
+		{internal.Config{DefaultRedirectStatus: 301}, UrlShortener{Preview: true}, http.StatusMovedPermanently, "private, no-store"},
+	}
+
+	for _, tc := range testCases {
+		app := &MyApp{cfg: tc.cfg}
+		status := app.redirectStatus(tc.link)
+		if status != tc.status {
+			t.Errorf("redirectStatus(%+v) = %d, expected %d", tc.link, status, tc.status)
+		}
+		if cacheControl := app.cacheControl(tc.link, status); cacheControl != tc.cacheControl {
+			t.Errorf("cacheControl(%+v) = %s, expected %s", tc.link, cacheControl, tc.cacheControl)
+		}
+	}
+}
+
+func TestRedirectHandler_RedirectSettings(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Redirect_type", "Cache_control", "Referrer_policy", "Canonical_link"}).
+		AddRow(1, "http://example.com", "abc12", 308, "", "no-referrer", true)
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+		WithArgs("abc12", 0).
+		WillReturnRows(rows)
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}, cfg: internal.Config{DefaultReferrerPolicy: "origin"}}
+
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	rr := httptest.NewRecorder()
+
+	app.redirectHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusPermanentRedirect {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusPermanentRedirect)
+	}
+
+	expectedHeaders := map[string]string{
+		"Location":        "http://example.com",
+		"Cache-Control":   "public, max-age=86400",
+		"Referrer-Policy": "no-referrer",
+		"Link":            "<http://example.com>; rel=\"canonical\"",
+		"Vary":            "User-Agent",
+	}
+	for name, expected := range expectedHeaders {
+		if value := rr.Header().Get(name); value != expected {
+			t.Errorf("handler returned unexpected %s header: got %v want %v", name, value, expected)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestValidateRedirectSettings(t *testing.T) {
+	testCases := []struct {
+		link  UrlShortener
+		valid bool
+	}{
+		{UrlShortener{}, true},
+		{UrlShortener{Redirect_type: 301, Referrer_policy: "origin", Cache_control: "max-age=60"}, true},
+		{UrlShortener{Redirect_type: 200}, false},
+		{UrlShortener{Referrer_policy: "everything"}, false},
+		{UrlShortener{Cache_control: "max-age=60\r\nSet-Cookie: a=b"}, false},
+	}
+
+	for _, tc := range testCases {
+		if err := validateRedirectSettings(tc.link); (err == nil) != tc.valid {
+			t.Errorf("validateRedirectSettings(%+v) = %v, expected valid to be %v", tc.link, err, tc.valid)
+		}
+	}
+}
+
+func TestFormHandler_InvalidRedirectType(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	form := strings.NewReader("textInput=https://example.com&redirect_type=303")
+	req := httptest.NewRequest("POST", "/submit", form)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	expectFlash(t, rr, "/", flashError)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// visitor describes the request for matching redirect rules. The country
+// comes from the GeoIP database, when one is configured.
+func (app *MyApp) visitor(r *http.Request) pkg.Visitor {
+	userAgent := r.UserAgent()
+	return pkg.Visitor{
+		UserAgent: userAgent,
+		Platform:  pkg.Platform(userAgent, r.Header.Get("Sec-CH-UA-Platform")),
+		Languages: pkg.AcceptedLanguages(r.Header.Get("Accept-Language")),
+		Country:   app.geoip.Country(app.clientIP(r)),
+		Time:      time.Now(),
+	}
+}
+
+// clientIP returns the address of the visitor. Behind a proxy the header
+// named by the configuration holds it. Each proxy appends the address it
+// received the request from, so the client can put anything at the start of
+// the list: the address added by the outermost trusted proxy, ClientIPHops
+// entries from the end, is used.
+func (app *MyApp) clientIP(r *http.Request) string {
+	if app.cfg.ClientIPHeader != "" {
+		if value := strings.Join(r.Header.Values(app.cfg.ClientIPHeader), ","); value != "" {
+			addresses := strings.Split(value, ",")
+			hops := app.cfg.ClientIPHops
+			if hops < 1 {
+				hops = 1
+			}
+			if hops > len(addresses) {
+				hops = len(addresses)
+			}
+			return strings.TrimSpace(addresses[len(addresses)-hops])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// pickDestination decides where the visitor of link goes: the destination of
+// the first matching redirect rule, else a variant when the link is split
+// tested, else Original_url. The variant is returned so the click can be
+// recorded with it.
+func (app *MyApp) pickDestination(w http.ResponseWriter, r *http.Request, link UrlShortener) (string, Variant) {
+	rules, err := pkg.ParseRedirectRules(link.Redirect_rules)
+	if err != nil {
+		log.Printf("Error evaluating redirect rules of %s: %v", link.Short_url, err)
+	} else if len(rules) > 0 {
+		if destination, ok := rules.Match(app.visitor(r)); ok {
+			return destination, Variant{}
+		}
+	}
+
+	if link.Split_test {
+		if variant, ok := app.pickVariant(w, r, link); ok {
+			return variant.Destination, variant
+		}
+	}
+	return link.Original_url, Variant{}
+}
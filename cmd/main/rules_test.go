@@ -0,0 +1,133 @@
+package main
+
+import (
+	"cmd/main/internal"
+	"cmd/main/pkg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+const testRedirectRules = `[
+	{"platforms":["ios"],"destination":"https://apps.apple.com/app"},
+	{"countries":["DE"],"destination":"https://example.de"},
+	{"languages":["fr"],"destination":"https://example.fr"},
+	{"user_agents":["curl"],"destination":"https://example.com/cli"}
+]`
+
+func TestRedirectHandler_RedirectRules(t *testing.T) {
+	geoip, err := pkg.ParseGeoIP(strings.NewReader("2.16.0.0/13,DE\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		headers  map[string]string
+		location string
+	}{
+		{"platform", map[string]string{"User-Agent": "Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X)"}, "https://apps.apple.com/app?ref=rules"},
+		{"country", map[string]string{"X-Forwarded-For": "10.0.0.1, 2.16.0.1"}, "https://example.de?ref=rules"},
+		{"language", map[string]string{"Accept-Language": "en;q=0.5, fr-FR"}, "https://example.fr?ref=rules"},
+		{"user agent", map[string]string{"User-Agent": "curl/8.0"}, "https://example.com/cli?ref=rules"},
+		{"default", map[string]string{"User-Agent": "Mozilla/5.0 (Windows NT 10.0)"}, "https://example.com?ref=rules"},
+	}
+
+	for _, tc := range testCases {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+		}
+
+		rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Query_rules", "Redirect_rules"}).
+			AddRow(1, "https://example.com", "abc12", `{"set":{"ref":"rules"},"passthrough":["ref"]}`, testRedirectRules)
+		mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+			WithArgs("abc12", 0).
+			WillReturnRows(rows)
+
+		app := &MyApp{db: &MySQLDatabase{DB: db}, cfg: internal.Config{ClientIPHeader: "X-Forwarded-For"}, geoip: geoip}
+
+		req := httptest.NewRequest("GET", "/abc12", nil)
+		for name, value := range tc.headers {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+
+		app.redirectHandler(rr, req)
+
+		if location := rr.Header().Get("Location"); location != tc.location {
+			t.Errorf("%s: handler returned unexpected location: got %v want %v", tc.name, location, tc.location)
+		}
+		if cacheControl := rr.Header().Get("Cache-Control"); cacheControl != "no-store" {
+			t.Errorf("%s: expected links with rules not to be cached, got %q", tc.name, cacheControl)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: there were unfulfilled expectations: %s", tc.name, err)
+		}
+		db.Close()
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 192.0.2.1")
+
+	if ip := (&MyApp{}).clientIP(req); ip != "192.0.2.1" {
+		t.Errorf("Expected the connection address without a configured header, got %s", ip)
+	}
+	app := &MyApp{cfg: internal.Config{ClientIPHeader: "X-Forwarded-For"}}
+	if ip := app.clientIP(req); ip != "192.0.2.1" {
+		t.Errorf("Expected the address added by the proxy, got %s", ip)
+	}
+	// The client cannot choose its address by sending the header itself
+	req.Header.Set("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+	if ip := app.clientIP(req); ip != "198.51.100.7" {
+		t.Errorf("Expected the address added by the proxy, got %s", ip)
+	}
+	req.Header.Add("X-Forwarded-For", "192.0.2.1")
+	app = &MyApp{cfg: internal.Config{ClientIPHeader: "X-Forwarded-For", ClientIPHops: 2}}
+	if ip := app.clientIP(req); ip != "198.51.100.7" {
+		t.Errorf("Expected the address added by the outermost of two proxies, got %s", ip)
+	}
+	app.cfg.ClientIPHops = 5
+	if ip := app.clientIP(req); ip != "203.0.113.9" {
+		t.Errorf("Expected the first address when there are fewer than the proxies, got %s", ip)
+	}
+	req.Header.Del("X-Forwarded-For")
+	if ip := app.clientIP(req); ip != "192.0.2.1" {
+		t.Errorf("Expected the connection address without the header, got %s", ip)
+	}
+}
+
+func TestRedirectHandler_InvalidRedirectRules(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Redirect_rules"}).
+		AddRow(1, "https://example.com", "abc12", "not json")
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+		WithArgs("abc12", 0).
+		WillReturnRows(rows)
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	rr := httptest.NewRecorder()
+
+	app.redirectHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusFound)
+	}
+	if location := rr.Header().Get("Location"); location != "https://example.com" {
+		t.Errorf("Expected broken rules to fall back to the original url, got %v", location)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Folder is a named collection of links
+type Folder struct {
+	Id   int
+	Name string
+}
+
+// Longest folder name and list of tags the database holds
+const (
+	maxFolderName = 128
+	maxTags       = 1024
+)
+
+// LinkTag is a row of link_tags, which indexes links by tag
+type LinkTag struct {
+	Link_id int
+	Tag     string
+}
+
+// linkSort is an order links can be listed in
+type linkSort struct {
+	Name    string // as given in the sort query parameter
+	Label   string
+	OrderBy []StorageInterfaces.Order
+}
+
+// linkSorts are the orders links can be listed in, the first being the
+// default. Each ends in Id, so no two links share a position, which keyset
+// pagination needs.
+var linkSorts = []linkSort{
+	{"newest", "Newest first", []StorageInterfaces.Order{{Column: "Id", Desc: true}}},
+	{"oldest", "Oldest first", []StorageInterfaces.Order{{Column: "Id"}}},
+	{"code", "Short URL", []StorageInterfaces.Order{{Column: "Short_url"}, {Column: "Id"}}},
+	{"destination", "Destination", []StorageInterfaces.Order{{Column: "Original_url"}, {Column: "Id"}}},
+	{"title", "Title", []StorageInterfaces.Order{{Column: "Title"}, {Column: "Id"}}},
+}
+
+// sortNamed returns the sort called name, and false when there is none
+func sortNamed(name string) (linkSort, bool) {
+	for _, s := range linkSorts {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return linkSorts[0], false
+}
+
+// Links listed per page when the configuration does not say, and the most
+// the API hands out at once
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+func (app *MyApp) pageSize() int {
+	if app.cfg.PageSize > 0 && app.cfg.PageSize <= maxPageSize {
+		return app.cfg.PageSize
+	}
+	return defaultPageSize
+}
+
+// linkFilter narrows down the links listed on the dashboard and by the API.
+// It is read from the q, tag, folder, broken and sort query parameters.
+type linkFilter struct {
+	Query  string   // full-text search over destination, title, tags and short url
+	Tags   []string // links must have every one of these tags
+	Folder string   // name of the folder the links are in
+	Broken bool     // only links whose destinations are flagged as broken
+	Sort   string   // name of one of linkSorts, "" for the default
+}
+
+func linkFilterFromQuery(values url.Values) linkFilter {
+	// A tag that is too long is on no link, so dropping it changes nothing
+	tags, _ := pkg.NormalizeTags(strings.Join(values["tag"], ","))
+	filter := linkFilter{
+		Query:  strings.TrimSpace(values.Get("q")),
+		Tags:   tags,
+		Folder: strings.TrimSpace(values.Get("folder")),
+		Broken: values.Get("broken") != "",
+	}
+	if s, ok := sortNamed(values.Get("sort")); ok {
+		filter.Sort = s.Name
+	}
+	return filter
+}
+
+// sort returns the order the filtered links are listed in
+func (f linkFilter) sort() linkSort {
+	s, _ := sortNamed(f.Sort)
+	return s
+}
+
+// values encodes the filter as query parameters
+func (f linkFilter) values() url.Values {
+	values := url.Values{}
+	if f.Query != "" {
+		values.Set("q", f.Query)
+	}
+	for _, tag := range f.Tags {
+		values.Add("tag", tag)
+	}
+	if f.Folder != "" {
+		values.Set("folder", f.Folder)
+	}
+	if f.Broken {
+		values.Set("broken", "1")
+	}
+	if f.Sort != "" && f.Sort != linkSorts[0].Name {
+		values.Set("sort", f.Sort)
+	}
+	return values
+}
+
+func (f linkFilter) hasTag(tag string) bool {
+	for _, t := range f.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// where returns the where clause selecting the links matching the filter
+// that are not in the trash. Short urls are matched exactly, as they are
+// shorter than the words the full-text index holds.
+func (f linkFilter) where(folderID int) (string, []interface{}) {
+	conditions := []string{"Deleted_at IS NULL"}
+	var args []interface{}
+
+	if f.Query != "" {
+		if query := pkg.BooleanSearchQuery(f.Query); query != "" {
+			conditions = append(conditions, "(MATCH(Original_url, Title, Tags, Short_url) AGAINST (? IN BOOLEAN MODE) OR Short_url = ?)")
+			args = append(args, query, f.Query)
+		} else {
+			conditions = append(conditions, "Short_url = ?")
+			args = append(args, f.Query)
+		}
+	}
+	for _, tag := range f.Tags {
+		conditions = append(conditions, "Id IN (SELECT Link_id FROM link_tags WHERE Tag = ?)")
+		args = append(args, tag)
+	}
+	if f.Folder != "" {
+		conditions = append(conditions, "Folder_id = ?")
+		args = append(args, folderID)
+	}
+	if f.Broken {
+		conditions = append(conditions, "Id IN (SELECT Link_id FROM link_health WHERE Broken)")
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+// findLinks returns the page of links matching filter that page's Limit,
+// Offset and After select, in the filter's sort order, along with the number
+// of links matching filter. folders are all folders, for looking up the
+// filter's folder by name.
+func (app *MyApp) findLinks(filter linkFilter, folders []Folder, page StorageInterfaces.Query) ([]UrlShortener, int, error) {
+	folderID := 0
+	if filter.Folder != "" {
+		for _, folder := range folders {
+			if folder.Name == filter.Folder {
+				folderID = folder.Id
+			}
+		}
+		if folderID == 0 {
+			return nil, 0, nil
+		}
+	}
+
+	page.Where, page.Args = filter.where(folderID)
+	total, err := app.db.Count("url_shortener", page.Where, page.Args)
+	if err != nil || total == 0 {
+		return nil, total, err
+	}
+
+	var links []UrlShortener
+	page.OrderBy = filter.sort().OrderBy
+	return links, total, app.db.Find("url_shortener", page, &links)
+}
+
+// folderNames maps folder ids to names
+func folderNames(folders []Folder) map[int]string {
+	names := make(map[int]string, len(folders))
+	for _, folder := range folders {
+		names[folder.Id] = folder.Name
+	}
+	return names
+}
+
+// folderID returns the id of the folder called name, creating the folder
+// when there is none yet. An empty name is no folder, id 0.
+func folderID(store StorageInterfaces.Store, name string) (int, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return 0, nil
+	}
+	if utf8.RuneCountInString(name) > maxFolderName {
+		return 0, fmt.Errorf("folder name is longer than %d characters", maxFolderName)
+	}
+
+	var folder Folder
+	err := store.GetByWhere("folders", "Name = ?", []interface{}{name}, &folder)
+	if err == nil {
+		return folder.Id, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	folder.Name = name
+	err = store.SaveReturningID("folders", &folder, "Id")
+	return folder.Id, err
+}
+
+// saveTags replaces the rows of link_tags for the link
+func saveTags(tx StorageInterfaces.Store, linkID int, tags []string) error {
+	if err := tx.Delete("link_tags", "Link_id = ?", []interface{}{linkID}); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if err := tx.Save("link_tags", &LinkTag{Link_id: linkID, Tag: tag}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkTags splits the Tags column of a link
+func linkTags(link UrlShortener) []string {
+	return splitList(link.Tags)
+}
+
+// Longest title, notes and OpenGraph tags a link can have
+const (
+	maxTitle         = 255
+	maxNotes         = 10000
+	maxOgDescription = 1024
+	maxOgImage       = 2048
+)
+
+// linkDetails are the fields describing a link, as submitted in a form
+type linkDetails struct {
+	Title  string
+	Notes  string
+	Tags   []string
+	Folder string
+
+	Og_title       string
+	Og_description string
+	Og_image       string
+}
+
+func linkDetailsFromForm(r *http.Request) (linkDetails, error) {
+	details := linkDetails{
+		Title:  strings.TrimSpace(r.FormValue("title")),
+		Notes:  strings.TrimSpace(r.FormValue("notes")),
+		Folder: strings.TrimSpace(r.FormValue("folder")),
+
+		Og_title:       strings.TrimSpace(r.FormValue("og_title")),
+		Og_description: strings.TrimSpace(r.FormValue("og_description")),
+		Og_image:       strings.TrimSpace(r.FormValue("og_image")),
+	}
+	tags, err := pkg.NormalizeTags(r.FormValue("tags"))
+	if err != nil {
+		return details, err
+	}
+	details.Tags = tags
+
+	switch {
+	case utf8.RuneCountInString(details.Title) > maxTitle:
+		return details, fmt.Errorf("title is longer than %d characters", maxTitle)
+	case utf8.RuneCountInString(details.Notes) > maxNotes:
+		return details, fmt.Errorf("notes are longer than %d characters", maxNotes)
+	case len(strings.Join(tags, ",")) > maxTags:
+		return details, fmt.Errorf("tags are longer than %d characters together", maxTags)
+	case utf8.RuneCountInString(details.Folder) > maxFolderName:
+		return details, fmt.Errorf("folder name is longer than %d characters", maxFolderName)
+	case utf8.RuneCountInString(details.Og_title) > maxTitle:
+		return details, fmt.Errorf("preview title is longer than %d characters", maxTitle)
+	case utf8.RuneCountInString(details.Og_description) > maxOgDescription:
+		return details, fmt.Errorf("preview description is longer than %d characters", maxOgDescription)
+	case len(details.Og_image) > maxOgImage:
+		return details, fmt.Errorf("preview image url is longer than %d characters", maxOgImage)
+	case details.Og_image != "" && absoluteURL(details.Og_image, details.Og_image) != details.Og_image:
+		return details, fmt.Errorf("preview image must be an http or https url")
+	}
+	return details, nil
+}
+
+// apply copies the details to link, except for the folder, which needs to be
+// looked up with folderID
+func (details linkDetails) apply(link *UrlShortener) {
+	link.Title = details.Title
+	link.Notes = details.Notes
+	link.Tags = strings.Join(details.Tags, ",")
+	link.Og_title = details.Og_title
+	link.Og_description = details.Og_description
+	link.Og_image = details.Og_image
+}
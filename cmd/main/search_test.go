@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestLinkFilterWhere(t *testing.T) {
+	testCases := []struct {
+		query       string
+		whereClause string
+		args        []interface{}
+	}{
+		{"", "Deleted_at IS NULL", nil},
+		{"q=release+notes", "Deleted_at IS NULL AND (MATCH(Original_url, Title, Tags, Short_url) AGAINST (? IN BOOLEAN MODE) OR Short_url = ?)",
+			[]interface{}{"+release* +notes*", "release notes"}},
+		{"q=%2B%2B", "Deleted_at IS NULL AND Short_url = ?", []interface{}{"++"}},
+		{"tag=News&tag=go&folder=Work", "Deleted_at IS NULL AND Id IN (SELECT Link_id FROM link_tags WHERE Tag = ?) AND Id IN (SELECT Link_id FROM link_tags WHERE Tag = ?) AND Folder_id = ?",
+			[]interface{}{"go", "news", 3}},
+		{"broken=1", "Deleted_at IS NULL AND Id IN (SELECT Link_id FROM link_health WHERE Broken)", nil},
+	}
+
+	for _, tc := range testCases {
+		values, _ := url.ParseQuery(tc.query)
+		whereClause, args := linkFilterFromQuery(values).where(3)
+		if whereClause != tc.whereClause || !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("where(%s) = %q, %v; expected %q, %v", tc.query, whereClause, args, tc.whereClause, tc.args)
+		}
+	}
+}
+
+func TestActiveFilterChips(t *testing.T) {
+	filter := linkFilter{Query: "spring", Tags: []string{"go", "news"}, Folder: "Work"}
+	expected := []filterChip{
+		{"search: spring", "/viewurls?folder=Work&tag=go&tag=news"},
+		{"tag: go", "/viewurls?folder=Work&q=spring&tag=news"},
+		{"tag: news", "/viewurls?folder=Work&q=spring&tag=go"},
+		{"folder: Work", "/viewurls?q=spring&tag=go&tag=news"},
+	}
+	if chips := activeFilterChips(filter); !reflect.DeepEqual(chips, expected) {
+		t.Errorf("activeFilterChips = %v, expected %v", chips, expected)
+	}
+	if chips := activeFilterChips(linkFilter{Tags: []string{"go"}}); chips[0].URL != "/viewurls" {
+		t.Errorf("Expected removing the last filter to lead to the plain page, got %s", chips[0].URL)
+	}
+}
+
+func TestViewUrlsHandler_Filters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("^SELECT \\* FROM folders$").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}).AddRow(3, "Work"))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM url_shortener WHERE Deleted_at IS NULL AND Id IN \\(SELECT Link_id FROM link_tags WHERE Tag = \\?\\) AND Folder_id = \\?$").
+		WithArgs("go", 3).
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(2))
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at IS NULL AND Id IN \\(SELECT Link_id FROM link_tags WHERE Tag = \\?\\) AND Folder_id = \\? ORDER BY Id DESC LIMIT 50$").
+		WithArgs("go", 3).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Title", "Tags", "Folder_id"}).
+			AddRow(1, "https://go.dev", "abc12", "Go", "go,news", 3).
+			AddRow(2, "https://go.dev/blog", "xyz78", "", "blog,go", 3))
+	expectLinkHealth(mock, 1, 2)
+
+	tmpl := template.Must(template.New("viewurls.html").Parse(
+		`{{range .Links}}{{.Short_url}}:{{.Folder}}:{{.TagList}} {{end}}|{{range .Active}}{{.Label}}={{.URL}} {{end}}|{{range .TagChips}}{{.Label}}={{.URL}} {{end}}`))
+	app := &MyApp{db: &MySQLDatabase{DB: db}, tmpl: tmpl}
+
+	req := httptest.NewRequest("GET", "/viewurls?tag=go&folder=Work", nil)
+	rr := httptest.NewRecorder()
+
+	app.viewUrlsHandler(rr, req)
+
+	expected := "abc12:Work:[go news] xyz78:Work:[blog go] " +
+		"|tag: go=/viewurls?folder=Work folder: Work=/viewurls?tag=go " +
+		"|blog=/viewurls?folder=Work&amp;tag=go&amp;tag=blog news=/viewurls?folder=Work&amp;tag=go&amp;tag=news "
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body:\n got %v\nwant %v", body, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestViewUrlsHandler_UnknownFolder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("^SELECT \\* FROM folders$").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}).AddRow(3, "Work"))
+
+	tmpl := template.Must(template.New("viewurls.html").Parse(`{{len .Links}}`))
+	app := &MyApp{db: &MySQLDatabase{DB: db}, tmpl: tmpl}
+
+	req := httptest.NewRequest("GET", "/viewurls?folder=Play", nil)
+	rr := httptest.NewRecorder()
+
+	app.viewUrlsHandler(rr, req)
+
+	if body := rr.Body.String(); body != "0" {
+		t.Errorf("Expected no links in a folder that does not exist, got %v", body)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFormHandler_Details(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("^SELECT \\* FROM folders WHERE Name = \\?$").
+		WithArgs("Work").
+		WillReturnError(sql.ErrNoRows)
+	mock.ExpectExec("^INSERT INTO folders \\(Name\\) VALUES \\(\\?\\)$").
+		WithArgs("Work").
+		WillReturnResult(sqlmock.NewResult(3, 1))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Url_hash = \\? AND Domain_id = \\? AND Deleted_at IS NULL FOR UPDATE$").
+		WithArgs(normalizedHash(t, "https://example.com"), 0).
+		WillReturnError(sql.ErrNoRows)
+	link := UrlShortener{
+		Original_url: "https://example.com",
+		Url_hash:     normalizedHash(t, "https://example.com"),
+		Title:        "Example",
+		Tags:         "go,release notes",
+		Folder_id:    3,
+	}
+	mock.ExpectExec("^INSERT INTO url_shortener ").
+		WithArgs(insertArgs(link)...).
+		WillReturnResult(sqlmock.NewResult(9, 1))
+	mock.ExpectExec("^INSERT INTO link_tags \\(Link_id, Tag\\) VALUES \\(\\?, \\?\\)$").
+		WithArgs(9, "go").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^INSERT INTO link_tags \\(Link_id, Tag\\) VALUES \\(\\?, \\?\\)$").
+		WithArgs(9, "release notes").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLinkChanged(mock, auditCreate, 9)
+	mock.ExpectCommit()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	form := url.Values{
+		"textInput": {"https://example.com"},
+		"title":     {" Example "},
+		"tags":      {"Release  Notes, go, GO"},
+		"folder":    {"Work"},
+	}
+	req := httptest.NewRequest("POST", "/submit", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	app.formHandler(rr, req)
+
+	if f := expectFlash(t, rr, "/", flashSuccess); !strings.HasPrefix(f.Short_url, "http://example.com/") {
+		t.Errorf("expected the new short url in the flash message, got %q", f.Short_url)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestFormHandler_InvalidDetails(t *testing.T) {
+	for _, field := range []string{"title", "tags", "folder", "notes", "og_title", "og_description", "og_image"} {
+		app := &MyApp{}
+
+		form := url.Values{"textInput": {"https://example.com"}, field: {strings.Repeat("x", maxNotes+1)}}
+		req := httptest.NewRequest("POST", "/submit", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		app.formHandler(rr, req)
+
+		if f := responseFlash(rr); rr.Header().Get("Location") != "/" || f == nil || f.Kind != flashError {
+			t.Errorf("%s: expected an error on the index page, got location %q and flash %+v", field, rr.Header().Get("Location"), f)
+		}
+	}
+}
+
+func TestLinkDetailsFromForm_OpenGraphImage(t *testing.T) {
+	for image, valid := range map[string]bool{
+		"https://example.com/cover.png": true,
+		"":                              true,
+		"/cover.png":                    false,
+		"javascript:alert(1)":           false,
+	} {
+		req := httptest.NewRequest("POST", "/submit", strings.NewReader(url.Values{"og_image": {image}}.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+		if _, err := linkDetailsFromForm(req); (err == nil) != valid {
+			t.Errorf("%q: got error %v, expected valid %v", image, err, valid)
+		}
+	}
+}
+
+func TestFolderID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("^SELECT \\* FROM folders WHERE Name = \\?$").
+		WithArgs("Work").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}).AddRow(3, "Work"))
+
+	store := &MySQLDatabase{DB: db}
+	if id, err := folderID(store, " Work "); id != 3 || err != nil {
+		t.Errorf("folderID = %d, %v; expected the existing folder 3", id, err)
+	}
+	if id, err := folderID(store, ""); id != 0 || err != nil {
+		t.Errorf("folderID = %d, %v; expected no folder", id, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestViewUrlsHandler_Pages(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("^SELECT \\* FROM folders$").WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM url_shortener WHERE Deleted_at IS NULL$").
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(5))
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at IS NULL ORDER BY Title, Id LIMIT 2 OFFSET 2$").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Short_url", "Title"}).
+			AddRow(4, "ccc33", "C").
+			AddRow(1, "ddd44", "D"))
+	expectLinkHealth(mock, 4, 1)
+	mock.ExpectQuery("^SELECT \\* FROM folders$").WillReturnRows(sqlmock.NewRows([]string{"Id", "Name"}))
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM url_shortener WHERE Deleted_at IS NULL$").
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(5))
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at IS NULL ORDER BY Id DESC LIMIT 2 OFFSET 18$").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Short_url", "Title"}))
+
+	tmpl := template.Must(template.New("viewurls.html").Parse(
+		`{{range .Links}}{{.Short_url}} {{end}}{{.First}}-{{.Last}}/{{.Total}} page {{.Page}}/{{.Pages}} prev={{.PrevURL}} next={{.NextURL}}`))
+	app := &MyApp{db: &MySQLDatabase{DB: db}, tmpl: tmpl}
+	app.cfg.PageSize = 2
+
+	testCases := []struct {
+		target string
+		body   string
+	}{
+		{"/viewurls?sort=title&page=2", "ccc33 ddd44 3-4/5 page 2/3 prev=/viewurls?sort=title next=/viewurls?page=3&amp;sort=title"},
+		{"/viewurls?sort=unknown&page=10", "0-0/5 page 10/3 prev=/viewurls?page=3 next="},
+	}
+	for _, tc := range testCases {
+		rr := httptest.NewRecorder()
+		app.viewUrlsHandler(rr, httptest.NewRequest("GET", tc.target, nil))
+
+		if body := rr.Body.String(); body != tc.body {
+			t.Errorf("%s: handler returned unexpected body:\n got %v\nwant %v", tc.target, body, tc.body)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
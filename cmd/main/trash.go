@@ -0,0 +1,192 @@
+package main
+
+import (
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// linkGone answers a request for a short url whose link is in the trash. The
+// answer must not be cached, as the link may be restored.
+func linkGone(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, "This link has been deleted", http.StatusGone)
+}
+
+// deleteLinkHandler moves the link named by the id parameter to the trash
+func (app *MyApp) deleteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	link, ok := app.linkByID(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.db.WithTx(r.Context(), func(tx StorageInterfaces.Store) error {
+		// Read again under a lock, so changes made since are kept and the
+		// link is not moved to the trash twice
+		if err := tx.GetByWhere("url_shortener", "Id = ? FOR UPDATE", []interface{}{link.Id}, &link); err != nil {
+			return err
+		}
+		if link.Deleted_at != nil {
+			return nil
+		}
+		before := link
+		now := time.Now().UTC().Truncate(time.Second)
+		link.Deleted_at = &now
+		if err := tx.UpdateFields("url_shortener", &link, "Id", "Deleted_at"); err != nil {
+			return err
+		}
+		return app.linkChanged(tx, app.auditActor(r), auditDelete, &before, &link)
+	})
+	if err != nil {
+		log.Printf("Error deleting link %d: %v", link.Id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/viewurls", http.StatusSeeOther)
+}
+
+// restoreLinkHandler takes the link named by the id parameter back out of the
+// trash
+func (app *MyApp) restoreLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	link, ok := app.linkByID(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.db.WithTx(r.Context(), func(tx StorageInterfaces.Store) error {
+		if err := tx.GetByWhere("url_shortener", "Id = ? FOR UPDATE", []interface{}{link.Id}, &link); err != nil {
+			return err
+		}
+		if link.Deleted_at == nil {
+			return nil
+		}
+		before := link
+		link.Deleted_at = nil
+		if err := tx.UpdateFields("url_shortener", &link, "Id", "Deleted_at"); err != nil {
+			return err
+		}
+		return app.linkChanged(tx, app.auditActor(r), auditRestore, &before, &link)
+	})
+	if err != nil {
+		log.Printf("Error restoring link %d: %v", link.Id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// trashedLink is a link as listed in the trash
+type trashedLink struct {
+	UrlShortener
+	Host     string
+	Purge_at *time.Time // when the link is removed for good, nil when it is kept
+}
+
+// trashPage is the data passed to trash.html
+type trashPage struct {
+	Links   []trashedLink
+	Total   int
+	PrevURL string // "" on the first page
+	NextURL string // "" on the last page
+}
+
+// trashHandler lists the links in the trash, most recently deleted first, a
+// page at a time
+func (app *MyApp) trashHandler(w http.ResponseWriter, r *http.Request) {
+	pageNumber, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || pageNumber < 1 {
+		pageNumber = 1
+	}
+	pageSize := app.pageSize()
+
+	whereClause := "Deleted_at IS NOT NULL"
+	total, err := app.db.Count("url_shortener", whereClause, nil)
+	var links []UrlShortener
+	if err == nil && total > 0 {
+		err = app.db.Find("url_shortener", StorageInterfaces.Query{
+			Where:   whereClause,
+			OrderBy: []StorageInterfaces.Order{{Column: "Deleted_at", Desc: true}, {Column: "Id", Desc: true}},
+			Limit:   pageSize,
+			Offset:  (pageNumber - 1) * pageSize,
+		}, &links)
+	}
+	if err != nil {
+		log.Printf("Error retrieving the trash: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	page := trashPage{Total: total}
+	if pageNumber > 1 {
+		page.PrevURL = "/trash?page=" + strconv.Itoa(pageNumber-1)
+	}
+	if pageNumber*pageSize < total {
+		page.NextURL = "/trash?page=" + strconv.Itoa(pageNumber+1)
+	}
+	hosts := app.domainHosts(r)
+	for _, link := range links {
+		trashed := trashedLink{UrlShortener: link, Host: hosts[link.Domain_id]}
+		if app.cfg.TrashRetentionDays > 0 {
+			purgeAt := link.Deleted_at.AddDate(0, 0, app.cfg.TrashRetentionDays)
+			trashed.Purge_at = &purgeAt
+		}
+		page.Links = append(page.Links, trashed)
+	}
+
+	err = app.render(w, r, "trash.html", page)
+	if err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// purgeTrash removes the links that were deleted before cutoff for good,
+// along with their tags, variants, clicks and their rollups, history,
+// scheduled changes and health, and records their removal in the audit log
+// and for webhooks. Their short urls can then be handed out again.
+func (app *MyApp) purgeTrash(ctx context.Context, cutoff time.Time) error {
+	return app.db.WithTx(ctx, func(tx StorageInterfaces.Store) error {
+		var expired []UrlShortener
+		if err := tx.GetAllByWhere("url_shortener", "Deleted_at < ?", []interface{}{cutoff}, &expired); err != nil {
+			return err
+		}
+
+		for _, link := range expired {
+			if err := removeLink(tx, link.Id); err != nil {
+				return err
+			}
+			if err := app.linkChanged(tx, systemActor, auditPurge, &link, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// linkTables are the tables holding rows of a link besides url_shortener
+var linkTables = []string{"link_tags", "link_variants", "click_events", "click_rollups", "link_versions", "scheduled_changes", "link_health"}
+
+// removeLink deletes the link with id for good, along with its rows in
+// linkTables, in tx
+func removeLink(tx StorageInterfaces.Store, id int) error {
+	args := []interface{}{id}
+	for _, table := range linkTables {
+		if err := tx.Delete(table, "Link_id = ?", args); err != nil {
+			return err
+		}
+	}
+	return tx.Delete("url_shortener", "Id = ?", args)
+}
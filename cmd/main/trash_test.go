@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// recentTime matches a time less than a minute old
+type recentTime struct{}
+
+func (recentTime) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	return ok && time.Since(t) < time.Minute
+}
+
+func TestRedirectHandler_DeletedLink(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+
+	// The preview page is gone as well
+	for _, path := range []string{"/abc12", "/abc12+"} {
+		rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Deleted_at"}).
+			AddRow(1, "http://example.com", "abc12", time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC))
+		mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+			WithArgs("abc12", 0).
+			WillReturnRows(rows)
+
+		req := httptest.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+
+		app.redirectHandler(rr, req)
+
+		if status := rr.Code; status != http.StatusGone {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", path, status, http.StatusGone)
+		}
+		if cacheControl := rr.Header().Get("Cache-Control"); cacheControl != "no-store" {
+			t.Errorf("%s: expected the 410 not to be cached, got Cache-Control %q", path, cacheControl)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteLinkHandler(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	expectLinkByID(mock, "")
+
+	// Only the column that changes is written, after reading the link again
+	// under a lock
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\? FOR UPDATE$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url"}).AddRow(7, "https://example.com", "abc12"))
+	mock.ExpectExec("^UPDATE url_shortener SET Deleted_at = \\? WHERE Id = \\?$").
+		WithArgs(recentTime{}, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLinkChanged(mock, auditDelete, 7)
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("POST", "/links/delete?id=7", nil)
+	rr := httptest.NewRecorder()
+
+	app.deleteLinkHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusSeeOther {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusSeeOther)
+	}
+	if location := rr.Header().Get("Location"); location != "/viewurls" {
+		t.Errorf("handler returned unexpected location: got %v want /viewurls", location)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRestoreLinkHandler(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\?$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Deleted_at"}).
+			AddRow(7, "https://example.com", "abc12", time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\? FOR UPDATE$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Deleted_at"}).
+			AddRow(7, "https://example.com", "abc12", time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)))
+	mock.ExpectExec("^UPDATE url_shortener SET Deleted_at = \\? WHERE Id = \\?$").
+		WithArgs(nil, 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLinkChanged(mock, auditRestore, 7)
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("POST", "/links/restore?id=7", nil)
+	rr := httptest.NewRecorder()
+
+	app.restoreLinkHandler(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "/trash" {
+		t.Errorf("handler returned unexpected location: got %v want /trash", location)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeleteLinkHandler_AlreadyDeleted(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	expectLinkByID(mock, "")
+
+	// Moved to the trash by another request in the meantime: nothing is
+	// written or recorded again
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\? FOR UPDATE$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Deleted_at"}).
+			AddRow(7, "https://example.com", "abc12", time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("POST", "/links/delete?id=7", nil)
+	rr := httptest.NewRecorder()
+
+	app.deleteLinkHandler(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "/viewurls" {
+		t.Errorf("handler returned unexpected location: got %v want /viewurls", location)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTrashHandlers_OnlyPost(t *testing.T) {
+	app := &MyApp{}
+	for _, handler := range []http.HandlerFunc{app.deleteLinkHandler, app.restoreLinkHandler} {
+		req := httptest.NewRequest("GET", "/links/delete?id=7", nil)
+		rr := httptest.NewRecorder()
+
+		handler(rr, req)
+
+		if status := rr.Code; status != http.StatusMethodNotAllowed {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func TestEditLinkHandler_DeletedLink(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\?$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Deleted_at"}).AddRow(7, time.Now()))
+
+	req := httptest.NewRequest("GET", "/links/edit?id=7", nil)
+	rr := httptest.NewRecorder()
+
+	app.editLinkHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestTrashHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM url_shortener WHERE Deleted_at IS NOT NULL$").
+		WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(3))
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at IS NOT NULL ORDER BY Deleted_at DESC, Id DESC LIMIT 2$").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Short_url", "Deleted_at"}).
+			AddRow(4, "abc12", time.Date(2026, 10, 5, 8, 30, 0, 0, time.UTC)).
+			AddRow(2, "xyz78", time.Date(2026, 9, 30, 23, 0, 0, 0, time.UTC)))
+
+	tmpl := template.Must(template.New("trash.html").Parse(
+		`{{range .Links}}{{.Short_url}} {{.Purge_at.Format "2006-01-02"}} {{end}}{{.Total}} prev={{.PrevURL}} next={{.NextURL}}`))
+	app := &MyApp{db: &MySQLDatabase{DB: db}, tmpl: tmpl}
+	app.cfg.PageSize = 2
+	app.cfg.TrashRetentionDays = 30
+
+	req := httptest.NewRequest("GET", "/trash", nil)
+	rr := httptest.NewRecorder()
+
+	app.trashHandler(rr, req)
+
+	expected := "abc12 2026-11-04 xyz78 2026-10-30 3 prev= next=/trash?page=2"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", body, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	cutoff := time.Date(2026, 9, 19, 0, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Deleted_at < \\?$").
+		WithArgs(cutoff).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Short_url", "Deleted_at"}).
+			AddRow(3, "abc12", cutoff.AddDate(0, 0, -1)).
+			AddRow(5, "xyz78", cutoff.AddDate(0, 0, -2)))
+	for _, id := range []int{3, 5} {
+		for _, table := range []string{"link_tags", "link_variants", "click_events", "click_rollups", "link_versions", "scheduled_changes", "link_health"} {
+			mock.ExpectExec("^DELETE FROM " + table + " WHERE Link_id = \\?$").
+				WithArgs(id).
+				WillReturnResult(sqlmock.NewResult(0, 2))
+		}
+		mock.ExpectExec("^DELETE FROM url_shortener WHERE Id = \\?$").
+			WithArgs(id).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("^INSERT INTO audit_events ").
+			WithArgs(recentTime{}, auditPurge, id, "system", "", "", sqlmock.AnyArg(), "").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	mock.ExpectCommit()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	if err := app.purgeTrash(context.Background(), cutoff); err != nil {
+		t.Errorf("Error purging the trash: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Variant is one of the destinations a split tested link divides its
+// visitors over, in proportion to the weights
+type Variant struct {
+	Id          int
+	Link_id     int
+	Name        string
+	Destination string
+	Weight      int
+}
+
+// linkVariants loads the variants of link in the order they were added
+func (app *MyApp) linkVariants(link UrlShortener) ([]Variant, error) {
+	var variants []Variant
+	err := app.db.GetAllByWhere("link_variants", "Link_id = ? ORDER BY Id", []interface{}{link.Id}, &variants)
+	return variants, err
+}
+
+// pickVariant chooses the variant of a split tested link the visitor is sent
+// to. Sticky tests keep a visitor on the variant stored in their cookie as
+// long as it still has a weight, and store new choices in it.
+func (app *MyApp) pickVariant(w http.ResponseWriter, r *http.Request, link UrlShortener) (Variant, bool) {
+	variants, err := app.linkVariants(link)
+	if err != nil {
+		log.Printf("Error retrieving variants of %s: %v", link.Short_url, err)
+		return Variant{}, false
+	}
+
+	cookieName := "variant_" + strconv.Itoa(link.Id)
+	if link.Sticky_variants {
+		if cookie, err := r.Cookie(cookieName); err == nil {
+			for _, variant := range variants {
+				if strconv.Itoa(variant.Id) == cookie.Value && variant.Weight > 0 {
+					return variant, true
+				}
+			}
+		}
+	}
+
+	weights := make([]int, len(variants))
+	for i, variant := range variants {
+		weights[i] = variant.Weight
+	}
+	i := pkg.PickWeighted(weights, nil)
+	if i < 0 {
+		return Variant{}, false
+	}
+
+	if link.Sticky_variants {
+		http.SetCookie(w, &http.Cookie{
+			Name:     cookieName,
+			Value:    strconv.Itoa(variants[i].Id),
+			Path:     "/",
+			MaxAge:   int(app.cfg.VariantCookieTTL.Seconds()),
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return variants[i], true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"cmd/main/internal"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newVariantTestApp(t *testing.T, sticky bool, weightB int) (*MyApp, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	rows := sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Split_test", "Sticky_variants"}).
+		AddRow(1, "https://example.com", "abc12", true, sticky)
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Short_url = \\? AND Domain_id = \\?$").
+		WithArgs("abc12", 0).
+		WillReturnRows(rows)
+	mock.ExpectQuery("^SELECT \\* FROM link_variants WHERE Link_id = \\? ORDER BY Id$").
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Name", "Destination", "Weight"}).
+			AddRow(3, 1, "A", "https://example.com/a", 0).
+			AddRow(4, 1, "B", "https://example.com/b", weightB))
+
+	app := &MyApp{
+		db:     &MySQLDatabase{DB: db},
+		cfg:    internal.Config{VariantCookieTTL: time.Hour},
+		clicks: &clickRecorder{events: make(chan ClickEvent, 1)},
+	}
+	return app, mock
+}
+
+func TestRedirectHandler_SplitTest(t *testing.T) {
+	app, mock := newVariantTestApp(t, false, 1)
+
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	rr := httptest.NewRecorder()
+
+	app.redirectHandler(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "https://example.com/b" {
+		t.Errorf("Expected the only variant with a weight, got %v", location)
+	}
+	if cacheControl := rr.Header().Get("Cache-Control"); cacheControl != "no-store" {
+		t.Errorf("Expected split tests not to be cached, got %q", cacheControl)
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("Expected no cookie for a test that is not sticky, got %v", cookies)
+	}
+
+	click := <-app.clicks.events
+	if click.Link_id != 1 || click.Variant_id != 4 || click.Clicked_at.IsZero() {
+		t.Errorf("Unexpected click %+v", click)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRedirectHandler_StickyVariant(t *testing.T) {
+	app, mock := newVariantTestApp(t, true, 1)
+
+	req := httptest.NewRequest("GET", "/abc12", nil)
+	rr := httptest.NewRecorder()
+
+	app.redirectHandler(rr, req)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "variant_1" || cookies[0].Value != "4" || cookies[0].MaxAge != 3600 {
+		t.Fatalf("Expected a cookie remembering variant 4, got %v", cookies)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	app, mock = newVariantTestApp(t, true, 0)
+	req = httptest.NewRequest("GET", "/abc12", nil)
+	req.AddCookie(&http.Cookie{Name: "variant_1", Value: "4"})
+	rr = httptest.NewRecorder()
+
+	app.redirectHandler(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "https://example.com" {
+		t.Errorf("Expected a variant without weight to be ignored, got %v", location)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+
+	app, mock = newVariantTestApp(t, true, 5)
+	req = httptest.NewRequest("GET", "/abc12", nil)
+	req.AddCookie(&http.Cookie{Name: "variant_1", Value: "4"})
+	rr = httptest.NewRecorder()
+
+	// A returning visitor keeps their variant
+	app.redirectHandler(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "https://example.com/b" {
+		t.Errorf("Expected the remembered variant, got %v", location)
+	}
+	if cookies := rr.Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("Expected the cookie not to be set again, got %v", cookies)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LinkVersion is a row of link_versions: a link and its variants as they
+// were after one of the changes to it. Version numbers count up from 1 for
+// each link.
+type LinkVersion struct {
+	Id            int64
+	Link_id       int
+	Version       int
+	Created_at    time.Time
+	Action        string // the audit action that made the change
+	Actor         string
+	Link_json     string // the UrlShortener
+	Variants_json string // its []Variant
+}
+
+// link decodes the link and variants of the version
+func (v LinkVersion) link() (UrlShortener, []Variant, error) {
+	var link UrlShortener
+	var variants []Variant
+	if err := json.Unmarshal([]byte(v.Link_json), &link); err != nil {
+		return link, nil, fmt.Errorf("version %d of link %d: %w", v.Version, v.Link_id, err)
+	}
+	if v.Variants_json != "" {
+		if err := json.Unmarshal([]byte(v.Variants_json), &variants); err != nil {
+			return link, nil, fmt.Errorf("version %d of link %d: %w", v.Version, v.Link_id, err)
+		}
+	}
+	return link, variants, nil
+}
+
+// saveVersion adds link, as it was just saved in tx, to its history
+func saveVersion(tx StorageInterfaces.Store, who auditActor, action string, link UrlShortener) error {
+	var variants []Variant
+	if err := tx.GetAllByWhere("link_variants", "Link_id = ? ORDER BY Id", []interface{}{link.Id}, &variants); err != nil {
+		return err
+	}
+	var latest []LinkVersion
+	err := tx.Find("link_versions", StorageInterfaces.Query{
+		Where:   "Link_id = ?",
+		Args:    []interface{}{link.Id},
+		OrderBy: []StorageInterfaces.Order{{Column: "Version", Desc: true}},
+		Limit:   1,
+	}, &latest)
+	if err != nil {
+		return err
+	}
+
+	version := LinkVersion{
+		Link_id:    link.Id,
+		Version:    1,
+		Created_at: time.Now().UTC(),
+		Action:     action,
+		Actor:      who.Name,
+	}
+	if len(latest) > 0 {
+		version.Version = latest[0].Version + 1
+	}
+	linkJSON, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	variantsJSON, err := json.Marshal(variants)
+	if err != nil {
+		return err
+	}
+	version.Link_json, version.Variants_json = string(linkJSON), string(variantsJSON)
+	return tx.SaveReturningID("link_versions", &version, "Id")
+}
+
+// linkChanged records a change to a link made in tx: a new version in its
+// history, unless the link is gone, an event in the audit log and the
+// deliveries of the event to the webhooks that want it
+func (app *MyApp) linkChanged(tx StorageInterfaces.Store, who auditActor, action string, before, after *UrlShortener) error {
+	if after != nil {
+		if err := saveVersion(tx, who, action, *after); err != nil {
+			return err
+		}
+	}
+	if err := audit(tx, who, action, before, after); err != nil {
+		return err
+	}
+	return app.webhooks.linkEvent(tx, who, action, before, after)
+}
+
+// fieldChange is a setting of a link that differs between two versions
+type fieldChange struct {
+	Field  string
+	Before string
+	After  string
+}
+
+// Fields left out of diffs: the id and short url never change, and the hash
+// follows the destination
+var undiffedFields = map[string]bool{"Id": true, "Short_url": true, "Url_hash": true}
+
+// displayValue formats a setting for diffs
+func displayValue(field string, value reflect.Value) string {
+	if field == "Password_hash" {
+		// Only whether there is a password is shown, never its hash
+		if value.String() == "" {
+			return "none"
+		}
+		return "set"
+	}
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return ""
+		}
+		value = value.Elem()
+	}
+	if t, ok := value.Interface().(time.Time); ok {
+		return t.Format("2006-01-02 15:04") + " UTC"
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+func displayVariants(variants []Variant) string {
+	var lines []string
+	for _, variant := range variants {
+		lines = append(lines, fmt.Sprintf("%s: %s (weight %d)", variant.Name, variant.Destination, variant.Weight))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// diffLinks lists the settings that differ between before and after
+func diffLinks(before, after UrlShortener, beforeVariants, afterVariants []Variant) []fieldChange {
+	var changes []fieldChange
+	beforeValue, afterValue := reflect.ValueOf(before), reflect.ValueOf(after)
+	for i := 0; i < beforeValue.NumField(); i++ {
+		field := beforeValue.Type().Field(i).Name
+		if undiffedFields[field] {
+			continue
+		}
+		from, to := displayValue(field, beforeValue.Field(i)), displayValue(field, afterValue.Field(i))
+		if field == "Password_hash" && before.Password_hash != after.Password_hash && from == to {
+			from, to = "set", "changed"
+		}
+		if from != to {
+			changes = append(changes, fieldChange{Field: field, Before: from, After: to})
+		}
+	}
+	if from, to := displayVariants(beforeVariants), displayVariants(afterVariants); from != to {
+		changes = append(changes, fieldChange{Field: "Variants", Before: from, After: to})
+	}
+	return changes
+}
+
+// changedFields returns the names of the fields of a link that differ
+// between before and after, so only those columns are written
+func changedFields(before, after UrlShortener) []string {
+	var fields []string
+	beforeValue, afterValue := reflect.ValueOf(before), reflect.ValueOf(after)
+	for i := 0; i < beforeValue.NumField(); i++ {
+		field := beforeValue.Type().Field(i).Name
+		if field != "Id" && !reflect.DeepEqual(beforeValue.Field(i).Interface(), afterValue.Field(i).Interface()) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// errLinkDeleted is returned inside transactions that find their link moved
+// to the trash in the meantime
+var errLinkDeleted = errors.New("link is in the trash")
+
+// versionView is a version as listed on the history page, with what it
+// changed compared to the version before it
+type versionView struct {
+	LinkVersion
+	Destination string
+	Changes     []fieldChange
+	Current     bool
+}
+
+// historyPage is the data passed to history.html
+type historyPage struct {
+	Link      UrlShortener
+	Host      string
+	Versions  []versionView
+	Scheduled []ScheduledChange // changes yet to be applied, soonest first
+}
+
+// linkHistoryHandler shows the versions of the link with the id query
+// parameter, newest first, each with what it changed, and the changes
+// scheduled for it
+func (app *MyApp) linkHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	link, ok := app.linkByID(w, r)
+	if !ok {
+		return
+	}
+	page := historyPage{Link: link, Host: app.domainHosts(r)[link.Domain_id]}
+
+	var versions []LinkVersion
+	err := app.db.GetAllByWhere("link_versions", "Link_id = ? ORDER BY Version", []interface{}{link.Id}, &versions)
+	if err == nil {
+		err = app.db.GetAllByWhere("scheduled_changes", "Link_id = ? AND Applied_at IS NULL ORDER BY Run_at, Id", []interface{}{link.Id}, &page.Scheduled)
+	}
+	if err != nil {
+		log.Printf("Error retrieving the history of link %d: %v", link.Id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	// Links created before versions were kept start their history with
+	// whatever version was saved first, which is diffed against nothing
+	var previous UrlShortener
+	var previousVariants []Variant
+	for i, version := range versions {
+		current, variants, err := version.link()
+		if err != nil {
+			log.Printf("Error reading the history of link %d: %v", link.Id, err)
+			continue
+		}
+		view := versionView{LinkVersion: version, Destination: current.Original_url, Current: i == len(versions)-1}
+		if i > 0 {
+			view.Changes = diffLinks(previous, current, previousVariants, variants)
+		}
+		page.Versions = append([]versionView{view}, page.Versions...)
+		previous, previousVariants = current, variants
+	}
+
+	if err := app.render(w, r, "history.html", page); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// historyURL is the history page of link id
+func historyURL(id int) string {
+	return "/links/history?id=" + strconv.Itoa(id)
+}
+
+// rollbackLinkHandler gives the link with the id query parameter back the
+// destination and settings it had in the version parameter. Its short url,
+// domain and place in or out of the trash stay as they are.
+func (app *MyApp) rollbackLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	link, ok := app.linkByID(w, r)
+	if !ok {
+		return
+	}
+	if link.Deleted_at != nil {
+		// Links in the trash are restored before they are rolled back
+		http.NotFound(w, r)
+		return
+	}
+
+	number, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	var version LinkVersion
+	err = app.db.GetByWhere("link_versions", "Link_id = ? AND Version = ?", []interface{}{link.Id, number}, &version)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving version %d of link %d: %v", number, link.Id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	restored, variants, err := version.link()
+	if err != nil {
+		log.Printf("Error rolling back link %d: %v", link.Id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	for i := range variants {
+		variants[i].Link_id = link.Id
+	}
+
+	err = app.db.WithTx(r.Context(), func(tx StorageInterfaces.Store) error {
+		// Read again under a lock, so the settings the version does not hold
+		// are those of the link as it is now
+		if err := tx.GetByWhere("url_shortener", "Id = ? FOR UPDATE", []interface{}{link.Id}, &link); err != nil {
+			return err
+		}
+		if link.Deleted_at != nil {
+			return errLinkDeleted
+		}
+		restored.Id, restored.Short_url, restored.Domain_id, restored.Deleted_at = link.Id, link.Short_url, link.Domain_id, link.Deleted_at
+		before := link
+		if fields := changedFields(before, restored); len(fields) > 0 {
+			if err := tx.UpdateFields("url_shortener", &restored, "Id", fields...); err != nil {
+				return err
+			}
+		}
+		if err := saveTags(tx, link.Id, splitList(restored.Tags)); err != nil {
+			return err
+		}
+		if err := saveVariants(tx, link.Id, variants); err != nil {
+			return err
+		}
+		return app.linkChanged(tx, app.auditActor(r), auditRollback, &before, &restored)
+	})
+	if errors.Is(err, errLinkDeleted) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error rolling back link %d: %v", link.Id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, historyURL(link.Id), http.StatusSeeOther)
+}
+
+// ScheduledChange is a row of scheduled_changes: a new destination a link
+// switches to at a given time
+type ScheduledChange struct {
+	Id           int
+	Link_id      int
+	Run_at       time.Time
+	Original_url string
+	Created_at   time.Time
+	Actor        string     // who scheduled the change
+	Applied_at   *time.Time // nil until the change is made
+}
+
+// scheduleChangeHandler schedules the link with the id query parameter to
+// switch to the destination posted, at the time posted. The time is read in
+// the posted timezone, UTC when there is none.
+func (app *MyApp) scheduleChangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	link, ok := app.linkByID(w, r)
+	if !ok {
+		return
+	}
+
+	change := ScheduledChange{
+		Link_id:      link.Id,
+		Original_url: strings.TrimSpace(r.PostFormValue("original_url")),
+		Created_at:   time.Now().UTC(),
+		Actor:        app.auditActor(r).Name,
+	}
+	runAt, err := parseScheduleTime(r.PostFormValue("run_at"), r.PostFormValue("timezone"))
+	if err == nil && !runAt.After(change.Created_at) {
+		err = fmt.Errorf("the change must be scheduled in the future")
+	}
+	if err == nil && !pkg.IsValidURL(change.Original_url) {
+		err = fmt.Errorf("url must be valid, for example https://www.google.com")
+	} else if err == nil && app.blocked.Blocked(change.Original_url) {
+		err = fmt.Errorf("this url cannot be shortened")
+	}
+	if err != nil {
+		app.redirectWithFlash(w, r, historyURL(link.Id), flash{Kind: flashError, Message: err.Error()})
+		return
+	}
+	change.Run_at = runAt
+
+	if err := app.db.SaveReturningID("scheduled_changes", &change, "Id"); err != nil {
+		log.Printf("Error scheduling a change of link %d: %v", link.Id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, historyURL(link.Id), http.StatusSeeOther)
+}
+
+// parseScheduleTime reads a time from a datetime-local input in the named
+// timezone
+func parseScheduleTime(value, timezone string) (time.Time, error) {
+	location := time.UTC
+	if timezone = strings.TrimSpace(timezone); timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return time.Time{}, fmt.Errorf("unknown timezone %q", timezone)
+		}
+	}
+	runAt, err := time.ParseInLocation("2006-01-02T15:04", strings.TrimSpace(value), location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("the time must be given as YYYY-MM-DDTHH:MM")
+	}
+	return runAt.UTC(), nil
+}
+
+// cancelScheduledChangeHandler drops the scheduled change with the change
+// query parameter from the link with the id query parameter, unless it has
+// been applied already
+func (app *MyApp) cancelScheduledChangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	link, ok := app.linkByID(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.URL.Query().Get("change"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	err = app.db.Delete("scheduled_changes", "Id = ? AND Link_id = ? AND Applied_at IS NULL", []interface{}{id, link.Id})
+	if err != nil {
+		log.Printf("Error canceling scheduled change %d: %v", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, historyURL(link.Id), http.StatusSeeOther)
+}
+
+// applyScheduledChanges makes the scheduled changes that are due at now.
+// Changes to links in the trash wait until the link is restored. Each change
+// is locked, applied and marked applied in one transaction, and changes
+// locked by another instance are left to it, so none is applied twice.
+func (app *MyApp) applyScheduledChanges(ctx context.Context, now time.Time) error {
+	var due []ScheduledChange
+	if err := app.db.GetAllByWhere("scheduled_changes", "Applied_at IS NULL AND Run_at <= ? ORDER BY Run_at, Id", []interface{}{now}, &due); err != nil {
+		return err
+	}
+
+	for _, change := range due {
+		err := app.db.WithTx(ctx, func(tx StorageInterfaces.Store) error {
+			err := tx.GetByWhere("scheduled_changes", "Id = ? AND Applied_at IS NULL AND Run_at <= ? FOR UPDATE SKIP LOCKED", []interface{}{change.Id, now}, &change)
+			if errors.Is(err, sql.ErrNoRows) {
+				// Applied, canceled or being applied since it was listed
+				return nil
+			} else if err != nil {
+				return err
+			}
+			var link UrlShortener
+			if err := tx.GetByWhere("url_shortener", "Id = ? FOR UPDATE", []interface{}{change.Link_id}, &link); err != nil {
+				return err
+			}
+			if link.Deleted_at != nil {
+				return nil
+			}
+
+			urlHash, err := app.urlHash(change.Original_url)
+			if err != nil {
+				return err
+			}
+			before := link
+			link.Original_url = change.Original_url
+			link.Url_hash = urlHash
+			if err := tx.UpdateFields("url_shortener", &link, "Id", "Original_url", "Url_hash"); err != nil {
+				return err
+			}
+			appliedAt := now
+			change.Applied_at = &appliedAt
+			if err := tx.UpdateFields("scheduled_changes", &change, "Id", "Applied_at"); err != nil {
+				return err
+			}
+			return app.linkChanged(tx, auditActor{Name: "schedule:" + change.Actor}, auditScheduled, &before, &link)
+		})
+		if err != nil {
+			log.Printf("Error applying scheduled change %d of link %d: %v", change.Id, change.Link_id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectLinkChanged expects a change to link linkID to be added to its
+// history, as its first version, and to the audit log
+func expectLinkChanged(mock sqlmock.Sqlmock, action string, linkID int) {
+	mock.ExpectQuery("^SELECT \\* FROM link_variants WHERE Link_id = \\? ORDER BY Id$").
+		WithArgs(linkID).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Name", "Destination", "Weight"}))
+	mock.ExpectQuery("^SELECT \\* FROM link_versions WHERE Link_id = \\? ORDER BY Version DESC LIMIT 1$").
+		WithArgs(linkID).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Version"}))
+	mock.ExpectExec("^INSERT INTO link_versions ").
+		WithArgs(linkID, 1, recentTime{}, action, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	expectAudit(mock, action, linkID)
+}
+
+func TestSaveVersion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	link := UrlShortener{Id: 7, Original_url: "https://example.com", Short_url: "abc12"}
+	mock.ExpectQuery("^SELECT \\* FROM link_variants WHERE Link_id = \\? ORDER BY Id$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Name", "Destination", "Weight"}).
+			AddRow(3, 7, "A", "https://example.com/a", 50))
+	mock.ExpectQuery("^SELECT \\* FROM link_versions WHERE Link_id = \\? ORDER BY Version DESC LIMIT 1$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Version"}).AddRow(40, 7, 4))
+	mock.ExpectExec("^INSERT INTO link_versions \\(Link_id, Version, Created_at, Action, Actor, Link_json, Variants_json\\) VALUES").
+		WithArgs(7, 5, recentTime{}, auditUpdate, "alice", sqlmock.AnyArg(),
+			`[{"Id":3,"Link_id":7,"Name":"A","Destination":"https://example.com/a","Weight":50}]`).
+		WillReturnResult(sqlmock.NewResult(41, 1))
+
+	store := &MySQLDatabase{DB: db}
+	if err := saveVersion(store, auditActor{Name: "alice"}, auditUpdate, link); err != nil {
+		t.Errorf("Error saving a version: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDiffLinks(t *testing.T) {
+	before := UrlShortener{Id: 7, Original_url: "https://example.com", Url_hash: "a", Password_hash: "hash1", Title: "Old"}
+	after := UrlShortener{Id: 7, Original_url: "https://example.org", Url_hash: "b", Password_hash: "hash2", Title: "Old", Preview: true}
+	variants := []Variant{{Name: "A", Destination: "https://example.com/a", Weight: 50}}
+
+	changes := diffLinks(before, after, nil, variants)
+	expected := []fieldChange{
+		{Field: "Original_url", Before: "https://example.com", After: "https://example.org"},
+		{Field: "Password_hash", Before: "set", After: "changed"},
+		{Field: "Preview", Before: "false", After: "true"},
+		{Field: "Variants", Before: "", After: "A: https://example.com/a (weight 50)"},
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("got changes %+v want %+v", changes, expected)
+	}
+
+	if changes := diffLinks(before, before, variants, variants); len(changes) != 0 {
+		t.Errorf("expected no changes between equal versions, got %+v", changes)
+	}
+}
+
+func TestLinkHistoryHandler(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	app.tmpl = template.Must(template.New("history.html").Parse(
+		`{{range .Versions}}{{.Version}}{{if .Current}}*{{end}}:{{range .Changes}} {{.Field}} {{.Before}}->{{.After}}{{end}};{{end}}` +
+			`{{range .Scheduled}} {{.Original_url}}{{end}}`))
+	expectLinkByID(mock, "")
+	mock.ExpectQuery("^SELECT \\* FROM link_versions WHERE Link_id = \\? ORDER BY Version$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Version", "Link_json", "Variants_json"}).
+			AddRow(1, 7, 1, `{"Id":7,"Original_url":"https://example.com"}`, `[]`).
+			AddRow(2, 7, 2, `{"Id":7,"Original_url":"https://example.org","Title":"Example"}`, `[]`))
+	mock.ExpectQuery("^SELECT \\* FROM scheduled_changes WHERE Link_id = \\? AND Applied_at IS NULL ORDER BY Run_at, Id$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Original_url"}).AddRow(1, 7, "https://example.net"))
+
+	req := httptest.NewRequest("GET", "/links/history?id=7", nil)
+	rr := httptest.NewRecorder()
+
+	app.linkHistoryHandler(rr, req)
+
+	expected := "2*: Original_url https://example.com->https://example.org Title ->Example;1:; https://example.net"
+	if body := rr.Body.String(); body != expected {
+		t.Errorf("handler returned unexpected body: got %q want %q", body, expected)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRollbackLinkHandler(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	expectLinkByID(mock, "")
+	mock.ExpectQuery("^SELECT \\* FROM link_versions WHERE Link_id = \\? AND Version = \\?$").
+		WithArgs(7, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Version", "Link_json", "Variants_json"}).
+			AddRow(2, 7, 2,
+				`{"Id":7,"Original_url":"https://example.org","Short_url":"old12","Url_hash":"orghash","Title":"Example","Tags":"a,b"}`,
+				`[{"Id":3,"Link_id":7,"Name":"A","Destination":"https://example.org/a","Weight":1}]`))
+
+	// Only the columns that differ from the link as read under the lock are
+	// written
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\? FOR UPDATE$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Url_hash", "Title", "Split_test"}).
+			AddRow(7, "https://example.com", "abc12", "oldhash", "Example", true))
+	mock.ExpectExec("^UPDATE url_shortener SET Original_url = \\?, Url_hash = \\?, Split_test = \\?, Tags = \\? WHERE Id = \\?$").
+		WithArgs("https://example.org", "orghash", false, "a,b", 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^DELETE FROM link_tags WHERE Link_id = \\?$").
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, tag := range []string{"a", "b"} {
+		mock.ExpectExec("^INSERT INTO link_tags ").
+			WithArgs(7, tag).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectQuery("^SELECT \\* FROM link_variants WHERE Link_id = \\?$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Name", "Destination", "Weight"}))
+	mock.ExpectExec("^INSERT INTO link_variants ").
+		WithArgs(7, "A", "https://example.org/a", 1).
+		WillReturnResult(sqlmock.NewResult(8, 1))
+	expectLinkChanged(mock, auditRollback, 7)
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("POST", "/links/rollback?id=7&version=2", nil)
+	rr := httptest.NewRecorder()
+
+	app.rollbackLinkHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusSeeOther {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusSeeOther)
+	}
+	if location := rr.Header().Get("Location"); location != "/links/history?id=7" {
+		t.Errorf("handler returned unexpected location: got %v want /links/history?id=7", location)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRollbackLinkHandler_DeletedMeanwhile(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	expectLinkByID(mock, "")
+	mock.ExpectQuery("^SELECT \\* FROM link_versions WHERE Link_id = \\? AND Version = \\?$").
+		WithArgs(7, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Version", "Link_json"}).
+			AddRow(2, 7, 2, `{"Id":7,"Original_url":"https://example.org","Short_url":"abc12"}`))
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM url_shortener WHERE Id = \\? FOR UPDATE$").
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url", "Deleted_at"}).
+			AddRow(7, "https://example.com", "abc12", time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)))
+	mock.ExpectRollback()
+
+	req := httptest.NewRequest("POST", "/links/rollback?id=7&version=2", nil)
+	rr := httptest.NewRecorder()
+
+	app.rollbackLinkHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestRollbackLinkHandler_UnknownVersion(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	expectLinkByID(mock, "")
+	mock.ExpectQuery("^SELECT \\* FROM link_versions WHERE Link_id = \\? AND Version = \\?$").
+		WithArgs(7, 9).
+		WillReturnRows(sqlmock.NewRows([]string{"Id"}))
+
+	req := httptest.NewRequest("POST", "/links/rollback?id=7&version=9", nil)
+	rr := httptest.NewRecorder()
+
+	app.rollbackLinkHandler(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestScheduleChangeHandler(t *testing.T) {
+	app, mock := newEditTestApp(t)
+	runAt := time.Now().Add(24 * time.Hour).Truncate(time.Minute)
+	expectLinkByID(mock, "")
+	mock.ExpectExec("^INSERT INTO scheduled_changes \\(Link_id, Run_at, Original_url, Created_at, Actor, Applied_at\\) VALUES").
+		WithArgs(7, runAt.UTC(), "https://example.org/sale", recentTime{}, "anonymous", nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	form := url.Values{
+		"original_url": {" https://example.org/sale "},
+		"run_at":       {runAt.In(time.FixedZone("", 2*60*60)).Format("2006-01-02T15:04")},
+		"timezone":     {"Etc/GMT-2"}, // two hours ahead of UTC
+	}
+	req := httptest.NewRequest("POST", "/links/schedule?id=7", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	app.scheduleChangeHandler(rr, req)
+
+	if location := rr.Header().Get("Location"); location != "/links/history?id=7" {
+		t.Errorf("handler returned unexpected location: got %v want /links/history?id=7", location)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestScheduleChangeHandler_Invalid(t *testing.T) {
+	future := time.Now().UTC().Add(time.Hour).Format("2006-01-02T15:04")
+	tests := []url.Values{
+		{"original_url": {"https://example.org"}, "run_at": {"2020-01-01T10:00"}},
+		{"original_url": {"https://example.org"}, "run_at": {"tomorrow"}},
+		{"original_url": {"https://example.org"}, "run_at": {future}, "timezone": {"Mars/Olympus"}},
+		{"original_url": {"not a url"}, "run_at": {future}},
+	}
+	for _, form := range tests {
+		app, mock := newEditTestApp(t)
+		expectLinkByID(mock, "")
+
+		req := httptest.NewRequest("POST", "/links/schedule?id=7", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		app.scheduleChangeHandler(rr, req)
+
+		if f := responseFlash(rr); rr.Header().Get("Location") != "/links/history?id=7" || f == nil || f.Kind != flashError {
+			t.Errorf("%v: expected an error on the history page, got location %q and flash %+v", form, rr.Header().Get("Location"), f)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%v: there were unfulfilled expectations: %s", form, err)
+		}
+	}
+}
+
+func TestApplyScheduledChanges(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	runAt := now.Add(-time.Minute)
+	createdAt := now.AddDate(0, 0, -1)
+	mock.ExpectQuery("^SELECT \\* FROM scheduled_changes WHERE Applied_at IS NULL AND Run_at <= \\? ORDER BY Run_at, Id$").
+		WithArgs(now).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Link_id", "Run_at", "Original_url", "Created_at", "Actor"}).
+			AddRow(1, 7, runAt, "https://example.org/sale", createdAt, "alice").
+			AddRow(2, 8, runAt, "https://example.org/other", createdAt, "alice").
+			AddRow(3, 9, runAt, "https://example.org/taken", createdAt, "alice"))
+	lockChange := "^SELECT \\* FROM scheduled_changes WHERE Id = \\? AND Applied_at IS NULL AND Run_at <= \\? FOR UPDATE SKIP LOCKED$"
+	changeColumns := []string{"Id", "Link_id", "Run_at", "Original_url", "Created_at", "Actor"}
+	lockLink := "^SELECT \\* FROM url_shortener WHERE Id = \\? FOR UPDATE$"
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockChange).
+		WithArgs(1, now).
+		WillReturnRows(sqlmock.NewRows(changeColumns).AddRow(1, 7, runAt, "https://example.org/sale", createdAt, "alice"))
+	mock.ExpectQuery(lockLink).
+		WithArgs(7).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Original_url", "Short_url"}).AddRow(7, "https://example.com", "abc12"))
+	mock.ExpectExec("^UPDATE url_shortener SET Original_url = \\?, Url_hash = \\? WHERE Id = \\?$").
+		WithArgs("https://example.org/sale", normalizedHash(t, "https://example.org/sale"), 7).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("^UPDATE scheduled_changes SET Applied_at = \\? WHERE Id = \\?$").
+		WithArgs(now, 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectLinkChanged(mock, auditScheduled, 7)
+	mock.ExpectCommit()
+
+	// Changes to links in the trash wait
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockChange).
+		WithArgs(2, now).
+		WillReturnRows(sqlmock.NewRows(changeColumns).AddRow(2, 8, runAt, "https://example.org/other", createdAt, "alice"))
+	mock.ExpectQuery(lockLink).
+		WithArgs(8).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Deleted_at"}).AddRow(8, now.AddDate(0, 0, -2)))
+	mock.ExpectCommit()
+
+	// Changes locked or applied by another instance are left alone
+	mock.ExpectBegin()
+	mock.ExpectQuery(lockChange).
+		WithArgs(3, now).
+		WillReturnRows(sqlmock.NewRows(changeColumns))
+	mock.ExpectCommit()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	if err := app.applyScheduledChanges(context.Background(), now); err != nil {
+		t.Errorf("Error applying scheduled changes: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhooksPage is the data passed to webhooks.html
+type webhooksPage struct {
+	Webhooks   []Webhook
+	Events     []string
+	Statuses   []string
+	Deliveries []deliveryView
+	Status     string // of the deliveries listed, "" for all of them
+	Total      int    // deliveries with that status
+	PrevURL    string // "" on the first page
+	NextURL    string // "" on the last page
+}
+
+// deliveryView is a delivery as listed on the webhooks page
+type deliveryView struct {
+	WebhookDelivery
+	Url     string // of its webhook
+	Payload string // indented for reading
+}
+
+// newWebhookSecret makes the secret of a webhook created without one
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// webhookFromForm reads a new webhook from the url, event and secret form
+// fields. No events checked subscribes it to all of them.
+func webhookFromForm(r *http.Request) (Webhook, error) {
+	hook := Webhook{
+		Url:        strings.TrimSpace(r.PostFormValue("url")),
+		Secret:     strings.TrimSpace(r.PostFormValue("secret")),
+		Active:     true,
+		Created_at: time.Now().UTC().Truncate(time.Second),
+	}
+	if !pkg.IsValidURL(hook.Url) {
+		return hook, fmt.Errorf("url must be valid, for example https://example.com/hooks")
+	}
+
+	var events []string
+	for _, event := range r.PostForm["event"] {
+		known := false
+		for _, name := range webhookEvents {
+			known = known || event == name
+		}
+		if !known {
+			return hook, fmt.Errorf("unknown event %q", event)
+		}
+		events = append(events, event)
+	}
+	if len(events) < len(webhookEvents) {
+		hook.Events = strings.Join(events, ",")
+	}
+
+	if hook.Secret == "" {
+		secret, err := newWebhookSecret()
+		if err != nil {
+			return hook, err
+		}
+		hook.Secret = secret
+	}
+	return hook, nil
+}
+
+// webhooksHandler lists the webhooks and the log of their deliveries, newest
+// first, a page at a time and narrowed down by the status parameter. POSTs
+// add a webhook.
+func (app *MyApp) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		app.createWebhook(w, r)
+		return
+	}
+
+	page := webhooksPage{
+		Events:   webhookEvents,
+		Statuses: deliveryStatuses,
+		Status:   r.URL.Query().Get("status"),
+	}
+	pageNumber, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || pageNumber < 1 {
+		pageNumber = 1
+	}
+	pageSize := app.pageSize()
+
+	var whereClause string
+	var args []interface{}
+	if page.Status != "" {
+		whereClause, args = "Status = ?", []interface{}{page.Status}
+	}
+	err = app.db.GetAll("webhooks", &page.Webhooks)
+	if err == nil {
+		page.Total, err = app.db.Count("webhook_deliveries", whereClause, args)
+	}
+	var deliveries []WebhookDelivery
+	if err == nil && page.Total > 0 {
+		err = app.db.Find("webhook_deliveries", StorageInterfaces.Query{
+			Where:   whereClause,
+			Args:    args,
+			OrderBy: []StorageInterfaces.Order{{Column: "Id", Desc: true}},
+			Limit:   pageSize,
+			Offset:  (pageNumber - 1) * pageSize,
+		}, &deliveries)
+	}
+	if err != nil {
+		log.Printf("Error retrieving webhooks: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	urls := make(map[int]string, len(page.Webhooks))
+	for _, hook := range page.Webhooks {
+		urls[hook.Id] = hook.Url
+	}
+	for _, delivery := range deliveries {
+		page.Deliveries = append(page.Deliveries, deliveryView{
+			WebhookDelivery: delivery,
+			Url:             urls[delivery.Webhook_id],
+			Payload:         indentJSON(delivery.Payload),
+		})
+	}
+
+	values := url.Values{}
+	if page.Status != "" {
+		values.Set("status", page.Status)
+	}
+	if pageNumber > 1 {
+		values.Set("page", strconv.Itoa(pageNumber-1))
+		page.PrevURL = "/webhooks?" + values.Encode()
+	}
+	if pageNumber*pageSize < page.Total {
+		values.Set("page", strconv.Itoa(pageNumber+1))
+		page.NextURL = "/webhooks?" + values.Encode()
+	}
+
+	if err := app.render(w, r, "webhooks.html", page); err != nil {
+		log.Printf("Error executing template: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// createWebhook adds the webhook posted to the webhooks page
+func (app *MyApp) createWebhook(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	hook, err := webhookFromForm(r)
+	if err != nil {
+		app.redirectWithFlash(w, r, "/webhooks", flash{Kind: flashError, Message: err.Error()})
+		return
+	}
+	if err := app.db.SaveReturningID("webhooks", &hook, "Id"); err != nil {
+		log.Printf("Error saving webhook: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	app.webhooksChanged(w, r)
+}
+
+// webhookByID loads the webhook named by the id query parameter, answering
+// the request itself when there is none
+func (app *MyApp) webhookByID(w http.ResponseWriter, r *http.Request) (Webhook, bool) {
+	var hook Webhook
+	id, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return hook, false
+	}
+
+	err = app.db.GetByWhere("webhooks", "Id = ?", []interface{}{id}, &hook)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return hook, false
+	} else if err != nil {
+		log.Printf("Error retrieving webhook %d: %v", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return hook, false
+	}
+	return hook, true
+}
+
+// toggleWebhookHandler pauses the webhook with the id query parameter, or
+// resumes it when it is paused
+func (app *MyApp) toggleWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	hook, ok := app.webhookByID(w, r)
+	if !ok {
+		return
+	}
+
+	hook.Active = !hook.Active
+	if err := app.db.Update("webhooks", &hook, "Id"); err != nil {
+		log.Printf("Error updating webhook %d: %v", hook.Id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	app.webhooksChanged(w, r)
+}
+
+// deleteWebhookHandler removes the webhook with the id query parameter,
+// along with its deliveries
+func (app *MyApp) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	hook, ok := app.webhookByID(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.db.WithTx(r.Context(), func(tx StorageInterfaces.Store) error {
+		if err := tx.Delete("webhook_deliveries", "Webhook_id = ?", []interface{}{hook.Id}); err != nil {
+			return err
+		}
+		return tx.Delete("webhooks", "Id = ?", []interface{}{hook.Id})
+	})
+	if err != nil {
+		log.Printf("Error deleting webhook %d: %v", hook.Id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	app.webhooksChanged(w, r)
+}
+
+// webhooksChanged reloads the webhooks after a change made on the webhooks
+// page, so it applies to the very next event, and goes back to the page
+func (app *MyApp) webhooksChanged(w http.ResponseWriter, r *http.Request) {
+	if err := app.loadWebhooks(); err != nil {
+		log.Printf("Error loading webhooks: %v", err)
+	}
+	http.Redirect(w, r, "/webhooks", http.StatusSeeOther)
+}
+
+// retryDeliveryHandler queues the dead delivery with the id query parameter
+// again, with a fresh set of attempts
+func (app *MyApp) retryDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var delivery WebhookDelivery
+	err = app.db.GetByWhere("webhook_deliveries", "Id = ?", []interface{}{id}, &delivery)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		log.Printf("Error retrieving webhook delivery %d: %v", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if delivery.Status != deliveryDead {
+		app.redirectWithFlash(w, r, "/webhooks", flash{Kind: flashError, Message: "Only dead deliveries can be retried."})
+		return
+	}
+
+	delivery.Status = deliveryPending
+	delivery.Attempts = 0
+	delivery.Next_attempt_at = time.Now().UTC().Truncate(time.Second)
+	if err := app.db.Update("webhook_deliveries", &delivery, "Id"); err != nil {
+		log.Printf("Error retrying webhook delivery %d: %v", id, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/webhooks?status="+deliveryPending, http.StatusSeeOther)
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"cmd/main/pkg"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Events webhooks can subscribe to. Links do not expire, so there is no
+// link.expired event until they can.
+const (
+	webhookCreated  = "link.created"
+	webhookUpdated  = "link.updated" // edited, rolled back or switched to a scheduled destination
+	webhookDeleted  = "link.deleted" // moved to the trash
+	webhookRestored = "link.restored"
+	webhookPurged   = "link.purged"
+	webhookClicked  = "link.clicked"
+)
+
+var webhookEvents = []string{webhookCreated, webhookUpdated, webhookDeleted, webhookRestored, webhookPurged, webhookClicked}
+
+// auditWebhookEvents maps the actions of the audit log to the webhook events
+// sent about them
+var auditWebhookEvents = map[string]string{
+	auditCreate:    webhookCreated,
+	auditUpdate:    webhookUpdated,
+	auditRollback:  webhookUpdated,
+	auditScheduled: webhookUpdated,
+	auditDelete:    webhookDeleted,
+	auditRestore:   webhookRestored,
+	auditPurge:     webhookPurged,
+	auditErase:     webhookPurged,
+}
+
+// Webhook is a row of webhooks: an address that events about links are
+// posted to
+type Webhook struct {
+	Id         int
+	Url        string
+	Secret     string // key of the signatures of its deliveries
+	Events     string // the events it wants joined by commas, "" for all of them
+	Active     bool   // paused webhooks are sent nothing, and their deliveries wait
+	Created_at time.Time
+}
+
+// wants reports whether the webhook subscribes to eventType
+func (h Webhook) wants(eventType string) bool {
+	if !h.Active {
+		return false
+	}
+	if h.Events == "" {
+		return true
+	}
+	for _, event := range strings.Split(h.Events, ",") {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Statuses of webhook deliveries
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead" // given up on after too many attempts, until retried by hand
+)
+
+var deliveryStatuses = []string{deliveryPending, deliveryDelivered, deliveryDead}
+
+// WebhookDelivery is a row of webhook_deliveries: an event to post to a
+// webhook. The table is the queue deliveries are sent from, so they survive
+// restarts, and the log of how they went.
+type WebhookDelivery struct {
+	Id              int64
+	Webhook_id      int
+	Event_type      string
+	Payload         string // the webhookEvent as JSON, the body of every attempt
+	Status          string
+	Attempts        int
+	Next_attempt_at time.Time
+	Last_attempt_at *time.Time // nil before the first attempt
+	Response_status int        // of the last attempt, 0 when there was no response
+	Last_error      string
+	Created_at      time.Time
+	Delivered_at    *time.Time
+}
+
+// webhookEvent is the body of a delivery
+type webhookEvent struct {
+	Id          string      `json:"id"` // the same in the deliveries of the event to every webhook
+	Type        string      `json:"type"`
+	Occurred_at time.Time   `json:"occurred_at"`
+	Actor       string      `json:"actor,omitempty"`
+	Data        interface{} `json:"data"`
+}
+
+// webhookLinkData is the data of events about changes to links. The link is
+// encoded as in the audit log, so without its password hash.
+type webhookLinkData struct {
+	Link     json.RawMessage `json:"link"`               // null once the link is purged
+	Previous json.RawMessage `json:"previous,omitempty"` // absent for new links
+}
+
+// webhookClickData is the data of link.clicked events
+type webhookClickData struct {
+	Link_id    int       `json:"link_id"`
+	Variant_id int       `json:"variant_id,omitempty"`
+	Clicked_at time.Time `json:"clicked_at"`
+}
+
+// webhookRegistry keeps the webhooks table in memory, so changes to links
+// can tell cheaply whether anyone wants to hear about them
+type webhookRegistry struct {
+	mu    sync.RWMutex
+	hooks []Webhook
+}
+
+// loadWebhooks reads the webhooks table into the registry
+func (app *MyApp) loadWebhooks() error {
+	var hooks []Webhook
+	if err := app.db.GetAll("webhooks", &hooks); err != nil {
+		return err
+	}
+	app.webhooks.mu.Lock()
+	app.webhooks.hooks = hooks
+	app.webhooks.mu.Unlock()
+	return nil
+}
+
+// refreshWebhooks reloads the webhooks table every interval, to pick up
+// changes made by other instances of the app
+func (app *MyApp) refreshWebhooks(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := app.loadWebhooks(); err != nil {
+			log.Printf("Error loading webhooks: %v", err)
+		}
+	}
+}
+
+// subscribers returns the webhooks that want eventType. A nil registry has
+// none.
+func (reg *webhookRegistry) subscribers(eventType string) []Webhook {
+	if reg == nil {
+		return nil
+	}
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	var hooks []Webhook
+	for _, hook := range reg.hooks {
+		if hook.wants(eventType) {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// enqueue queues a delivery of an event to every webhook that wants it. Run
+// it in the transaction making the change the event is about, so that the
+// deliveries are queued if and only if the change is saved.
+func (reg *webhookRegistry) enqueue(tx StorageInterfaces.Store, eventType string, who auditActor, data interface{}) error {
+	hooks := reg.subscribers(eventType)
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	payload, err := json.Marshal(webhookEvent{
+		Id:          newRequestID(),
+		Type:        eventType,
+		Occurred_at: now,
+		Actor:       who.Name,
+		Data:        data,
+	})
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		delivery := WebhookDelivery{
+			Webhook_id:      hook.Id,
+			Event_type:      eventType,
+			Payload:         string(payload),
+			Status:          deliveryPending,
+			Next_attempt_at: now,
+			Created_at:      now,
+		}
+		if err := tx.SaveReturningID("webhook_deliveries", &delivery, "Id"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkEvent queues the webhook event about a change recorded in the audit
+// log as action
+func (reg *webhookRegistry) linkEvent(tx StorageInterfaces.Store, who auditActor, action string, before, after *UrlShortener) error {
+	eventType, ok := auditWebhookEvents[action]
+	if !ok || len(reg.subscribers(eventType)) == 0 {
+		return nil
+	}
+
+	var data webhookLinkData
+	snapshot, err := auditSnapshot(after)
+	if err != nil {
+		return err
+	}
+	data.Link = json.RawMessage("null")
+	if snapshot != "" {
+		data.Link = json.RawMessage(snapshot)
+	}
+	if snapshot, err = auditSnapshot(before); err != nil {
+		return err
+	}
+	if snapshot != "" {
+		data.Previous = json.RawMessage(snapshot)
+	}
+	return reg.enqueue(tx, eventType, who, data)
+}
+
+// webhookBatch is the number of due deliveries sent at a time
+const webhookBatch = 100
+
+// maxWebhookBackoff caps the time between two attempts of a delivery
+const maxWebhookBackoff = 6 * time.Hour
+
+// webhookBackoff is the time to wait before the next attempt of a delivery
+// that failed attempts times
+func webhookBackoff(base time.Duration, attempts int) time.Duration {
+	return pkg.Backoff(base, maxWebhookBackoff, attempts)
+}
+
+// deliverWebhooks sends the deliveries that are due at now to webhooks that
+// are not paused, oldest first. Each webhook is sent its deliveries one at a
+// time, while the webhooks are sent theirs at the same time, so a slow
+// webhook only holds up its own deliveries.
+func (app *MyApp) deliverWebhooks(ctx context.Context, now time.Time) error {
+	var due []WebhookDelivery
+	err := app.db.Find("webhook_deliveries", StorageInterfaces.Query{
+		Where:   "Status = ? AND Next_attempt_at <= ? AND Webhook_id IN (SELECT Id FROM webhooks WHERE Active)",
+		Args:    []interface{}{deliveryPending, now},
+		OrderBy: []StorageInterfaces.Order{{Column: "Id"}},
+		Limit:   webhookBatch,
+	}, &due)
+	if err != nil || len(due) == 0 {
+		return err
+	}
+
+	var hooks []Webhook
+	if err := app.db.GetAll("webhooks", &hooks); err != nil {
+		return err
+	}
+	byID := make(map[int]Webhook, len(hooks))
+	for _, hook := range hooks {
+		byID[hook.Id] = hook
+	}
+
+	// The deliveries of every webhook, in order
+	queues := make(map[int][]int)
+	for i, delivery := range due {
+		queues[delivery.Webhook_id] = append(queues[delivery.Webhook_id], i)
+	}
+	errs := make([]error, len(due))
+	cutShort := make([]bool, len(due))
+	var wg sync.WaitGroup
+	for hookID, queue := range queues {
+		hook, ok := byID[hookID]
+		if !ok {
+			for _, i := range queue {
+				errs[i] = fmt.Errorf("webhook %d no longer exists", hookID)
+			}
+			continue
+		}
+		wg.Add(1)
+		go func(hook Webhook, queue []int) {
+			defer wg.Done()
+			for _, i := range queue {
+				due[i].Response_status, errs[i] = sendWebhook(ctx, app.webhookClient, hook, due[i])
+				// Attempts cut short say nothing about the webhook
+				if ctx.Err() != nil {
+					cutShort[i] = true
+				}
+			}
+		}(hook, queue)
+	}
+	wg.Wait()
+
+	for i := range due {
+		if cutShort[i] {
+			continue
+		}
+		_, hookExists := byID[due[i].Webhook_id]
+		app.recordAttempt(&due[i], errs[i], hookExists, now)
+		if err := app.saveAttempt(&due[i]); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// attemptFields are the columns of webhook_deliveries an attempt changes
+var attemptFields = []string{"Status", "Attempts", "Next_attempt_at", "Last_attempt_at", "Response_status", "Last_error", "Delivered_at"}
+
+// saveAttempt writes the outcome of the attempt recorded in delivery. It is
+// only written while the delivery is still pending with the attempts it was
+// sent after, so an attempt does not undo one made meanwhile by another
+// instance of the app, nor a delivery given up on or removed. The outcome is
+// saved even when the deliveries were cut short, as the attempt was made.
+func (app *MyApp) saveAttempt(delivery *WebhookDelivery) error {
+	return app.db.WithTx(context.Background(), func(tx StorageInterfaces.Store) error {
+		var saved WebhookDelivery
+		err := tx.GetByWhere("webhook_deliveries", "Id = ? AND Status = ? AND Attempts = ? FOR UPDATE",
+			[]interface{}{delivery.Id, deliveryPending, delivery.Attempts - 1}, &saved)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return tx.UpdateFields("webhook_deliveries", delivery, "Id", attemptFields...)
+	})
+}
+
+// recordAttempt updates delivery after an attempt that failed with err, or
+// succeeded when err is nil. Deliveries to webhooks that no longer exist,
+// and those that failed too often, are given up on.
+func (app *MyApp) recordAttempt(delivery *WebhookDelivery, err error, hookExists bool, now time.Time) {
+	delivery.Attempts++
+	delivery.Last_attempt_at = &now
+	if err == nil {
+		delivery.Status = deliveryDelivered
+		delivery.Delivered_at = &now
+		delivery.Last_error = ""
+		return
+	}
+
+	delivery.Last_error = err.Error()
+	if !hookExists || delivery.Attempts >= app.cfg.WebhookMaxAttempts {
+		delivery.Status = deliveryDead
+		return
+	}
+	delivery.Next_attempt_at = now.Add(webhookBackoff(app.cfg.WebhookBackoff, delivery.Attempts))
+}
+
+// Headers sent along with every delivery
+const (
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+// sendWebhook posts a delivery to hook, signed with its secret, and returns
+// the status it was answered with. Answers other than 2xx are errors. The
+// signature carries the time the request is sent, so receivers rejecting
+// old timestamps accept it however long the deliveries before it took.
+func sendWebhook(ctx context.Context, client *http.Client, hook Webhook, delivery WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, delivery.Event_type)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(delivery.Id, 10))
+	req.Header.Set(webhookSignatureHeader, fmt.Sprintf("t=%d,v1=%s", timestamp, pkg.SignWebhook([]byte(hook.Secret), timestamp, body)))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	// Reading some of the body lets the connection be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
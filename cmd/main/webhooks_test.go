@@ -0,0 +1,427 @@
+package main
+
+import (
+	"cmd/main/pkg"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// capturedArg matches any string argument and remembers it
+type capturedArg struct {
+	value *string
+}
+
+func (a capturedArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	*a.value = s
+	return ok
+}
+
+// newWebhookRegistry returns a registry holding hooks
+func newWebhookRegistry(hooks ...Webhook) webhookRegistry {
+	return webhookRegistry{hooks: hooks}
+}
+
+func TestWebhookWants(t *testing.T) {
+	testCases := []struct {
+		hook      Webhook
+		eventType string
+		expected  bool
+	}{
+		{Webhook{Active: true}, webhookClicked, true},
+		{Webhook{Active: true, Events: "link.created,link.deleted"}, webhookDeleted, true},
+		{Webhook{Active: true, Events: "link.created,link.deleted"}, webhookUpdated, false},
+		{Webhook{Active: false}, webhookCreated, false},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.hook.wants(tc.eventType); got != tc.expected {
+			t.Errorf("%+v wants(%s) = %v; expected %v", tc.hook, tc.eventType, got, tc.expected)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	testCases := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{4, 4 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, maxWebhookBackoff},
+		{100, maxWebhookBackoff},
+	}
+
+	for _, tc := range testCases {
+		if got := webhookBackoff(30*time.Second, tc.attempts); got != tc.expected {
+			t.Errorf("webhookBackoff(30s, %d) = %v; expected %v", tc.attempts, got, tc.expected)
+		}
+	}
+}
+
+func TestLinkChanged_QueuesWebhookDeliveries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	app.webhooks = newWebhookRegistry(
+		Webhook{Id: 1, Active: true, Events: webhookDeleted},
+		Webhook{Id: 2, Active: true},
+		Webhook{Id: 3, Active: true, Events: webhookCreated},
+		Webhook{Id: 4, Active: false},
+	)
+
+	var payload string
+	expectLinkChanged(mock, auditDelete, 7)
+	for _, hookID := range []int{1, 2} {
+		mock.ExpectExec("^INSERT INTO webhook_deliveries ").
+			WithArgs(hookID, webhookDeleted, capturedArg{&payload}, deliveryPending, 0, recentTime{}, nil, 0, "", recentTime{}, nil).
+			WillReturnResult(sqlmock.NewResult(int64(hookID), 1))
+	}
+
+	deletedAt := time.Now().UTC()
+	before := UrlShortener{Id: 7, Original_url: "https://example.com", Short_url: "abc12", Password_hash: "secret-hash"}
+	after := before
+	after.Deleted_at = &deletedAt
+	if err := app.linkChanged(app.db, auditActor{Name: "alice"}, auditDelete, &before, &after); err != nil {
+		t.Fatalf("Error recording the change: %v", err)
+	}
+
+	var event struct {
+		Id    string
+		Type  string
+		Actor string
+		Data  struct {
+			Link     UrlShortener
+			Previous UrlShortener
+		}
+	}
+	if err := json.Unmarshal([]byte(payload), &event); err != nil {
+		t.Fatalf("Error decoding payload %s: %v", payload, err)
+	}
+	if event.Id == "" || event.Type != webhookDeleted || event.Actor != "alice" ||
+		event.Data.Link.Deleted_at == nil || event.Data.Previous.Short_url != "abc12" {
+		t.Errorf("unexpected payload %s", payload)
+	}
+	if strings.Contains(payload, "secret-hash") {
+		t.Errorf("payload leaks the password hash: %s", payload)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestClickRecorder_QueuesClickedWebhooks(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	registry := newWebhookRegistry(Webhook{Id: 5, Active: true, Events: webhookClicked})
+	recorder := newClickRecorder(&MySQLDatabase{DB: db}, 1)
+	recorder.webhooks = &registry
+
+	clickedAt := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	var payload string
+	mock.ExpectBegin()
+	mock.ExpectExec("^INSERT INTO click_events ").
+		WithArgs(7, 2, clickedAt, "", "", "", "", "", "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("^INSERT INTO webhook_deliveries ").
+		WithArgs(5, webhookClicked, capturedArg{&payload}, deliveryPending, 0, recentTime{}, nil, 0, "", recentTime{}, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	if err := recorder.save(ClickEvent{Link_id: 7, Variant_id: 2, Clicked_at: clickedAt}); err != nil {
+		t.Fatalf("Error saving click: %v", err)
+	}
+	if !strings.Contains(payload, `"data":{"link_id":7,"variant_id":2,"clicked_at":"2026-10-19T12:00:00Z"}`) {
+		t.Errorf("unexpected payload %s", payload)
+	}
+
+	// Webhooks do not hear of bots
+	mock.ExpectExec("^INSERT INTO click_events ").
+		WithArgs(7, 0, clickedAt, "", "", "", "", "", "slackbot").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	if err := recorder.save(ClickEvent{Link_id: 7, Clicked_at: clickedAt, Bot: "slackbot"}); err != nil {
+		t.Fatalf("Error saving click: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+// expectAttemptSaved expects the delivery id, still pending after attempts
+// attempts, to be locked and the columns an attempt changes to be written
+func expectAttemptSaved(mock sqlmock.Sqlmock, id, attempts int) *sqlmock.ExpectedExec {
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM webhook_deliveries WHERE Id = \\? AND Status = \\? AND Attempts = \\? FOR UPDATE$").
+		WithArgs(id, deliveryPending, attempts).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Status", "Attempts"}).AddRow(id, deliveryPending, attempts))
+	return mock.ExpectExec("^UPDATE webhook_deliveries SET Status = \\?, Attempts = \\?, Next_attempt_at = \\?, Last_attempt_at = \\?, " +
+		"Response_status = \\?, Last_error = \\?, Delivered_at = \\? WHERE Id = \\?$")
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	payload := `{"id":"e1","type":"link.created"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.Error(w, "nope", http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		// Signed when sent, not at the time the batch was picked
+		var timestamp int64
+		fmt.Sscanf(r.Header.Get(webhookSignatureHeader), "t=%d,", &timestamp)
+		if sent := time.Unix(timestamp, 0); time.Since(sent) > time.Minute {
+			t.Errorf("delivery signed at %v", sent)
+		}
+		expected := fmt.Sprintf("t=%d,v1=%s", timestamp, pkg.SignWebhook([]byte("s3cret"), timestamp, body))
+		if r.Header.Get(webhookSignatureHeader) != expected || r.Header.Get(webhookEventHeader) != webhookCreated ||
+			r.Header.Get(webhookDeliveryHeader) != "11" || string(body) != payload {
+			t.Errorf("unexpected delivery %v %s", r.Header, body)
+		}
+	}))
+	defer server.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	created := now.Add(-time.Hour)
+	columns := []string{"Id", "Webhook_id", "Event_type", "Payload", "Status", "Attempts", "Next_attempt_at", "Created_at"}
+	mock.ExpectQuery("^SELECT \\* FROM webhook_deliveries WHERE Status = \\? AND Next_attempt_at <= \\? AND Webhook_id IN \\(SELECT Id FROM webhooks WHERE Active\\) ORDER BY Id LIMIT 100$").
+		WithArgs(deliveryPending, now).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(11, 1, webhookCreated, payload, deliveryPending, 0, created, created).
+			AddRow(12, 2, webhookCreated, payload, deliveryPending, 1, created, created).
+			AddRow(13, 2, webhookCreated, payload, deliveryPending, 2, created, created).
+			AddRow(14, 3, webhookCreated, payload, deliveryPending, 0, created, created))
+	mock.ExpectQuery("^SELECT \\* FROM webhooks$").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Url", "Secret", "Events", "Active"}).
+			AddRow(1, server.URL+"/ok", "s3cret", "", true).
+			AddRow(2, server.URL+"/fail", "s3cret", "", true))
+
+	// Delivered
+	expectAttemptSaved(mock, 11, 0).
+		WithArgs(deliveryDelivered, 1, created, now, 200, "", now, 11).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// Tried again after the backoff
+	expectAttemptSaved(mock, 12, 1).
+		WithArgs(deliveryPending, 2, now.Add(time.Minute), now, 500, "answered 500 Internal Server Error", nil, 12).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	// Out of attempts, but meanwhile sent by another instance of the app,
+	// whose attempt is kept
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT \\* FROM webhook_deliveries WHERE Id = \\? AND Status = \\? AND Attempts = \\? FOR UPDATE$").
+		WithArgs(13, deliveryPending, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"Id"}))
+	mock.ExpectCommit()
+	// Its webhook is gone
+	expectAttemptSaved(mock, 14, 0).
+		WithArgs(deliveryDead, 1, created, now, 0, "webhook 3 no longer exists", nil, 14).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}, webhookClient: &http.Client{Timeout: time.Second}}
+	app.cfg.WebhookMaxAttempts = 3
+	app.cfg.WebhookBackoff = 30 * time.Second
+
+	if err := app.deliverWebhooks(context.Background(), now); err != nil {
+		t.Errorf("Error delivering webhooks: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestDeliverWebhooks_SlowWebhook(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	fastDelivered := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fast" {
+			close(fastDelivered)
+			return
+		}
+		// The slow webhook only answers once the other one was delivered to
+		select {
+		case <-fastDelivered:
+		case <-time.After(2 * time.Second):
+			t.Errorf("the slow webhook held up the delivery to the other one")
+		}
+	}))
+	defer server.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	created := now.Add(-time.Hour)
+	columns := []string{"Id", "Webhook_id", "Event_type", "Payload", "Status", "Attempts", "Next_attempt_at", "Created_at"}
+	mock.ExpectQuery("^SELECT \\* FROM webhook_deliveries ").
+		WithArgs(deliveryPending, now).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(11, 1, webhookCreated, "{}", deliveryPending, 0, created, created).
+			AddRow(12, 2, webhookCreated, "{}", deliveryPending, 0, created, created))
+	mock.ExpectQuery("^SELECT \\* FROM webhooks$").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Url", "Secret", "Events", "Active"}).
+			AddRow(1, server.URL+"/slow", "s3cret", "", true).
+			AddRow(2, server.URL+"/fast", "s3cret", "", true))
+	for _, id := range []int{11, 12} {
+		expectAttemptSaved(mock, id, 0).
+			WithArgs(deliveryDelivered, 1, created, now, 200, "", now, id).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}, webhookClient: &http.Client{Timeout: 5 * time.Second}}
+	app.cfg.WebhookMaxAttempts = 3
+
+	if err := app.deliverWebhooks(context.Background(), now); err != nil {
+		t.Errorf("Error delivering webhooks: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSendWebhook_PrivateAddress(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	hook := Webhook{Id: 1, Url: server.URL, Secret: "s3cret", Active: true}
+	delivery := WebhookDelivery{Id: 11, Event_type: webhookCreated, Payload: "{}"}
+	status, err := sendWebhook(context.Background(), outboundClient(time.Second, false), hook, delivery)
+	if !errors.Is(err, pkg.ErrNonPublicAddress) || status != 0 || requests != 0 {
+		t.Errorf("expected the delivery to a loopback address to be refused, got %d, %v", status, err)
+	}
+
+	// Unless deliveries to private addresses are allowed
+	if _, err := sendWebhook(context.Background(), outboundClient(time.Second, true), hook, delivery); err != nil || requests != 1 {
+		t.Errorf("expected the delivery to be sent, got %v", err)
+	}
+}
+
+func TestWebhooksHandler_Create(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("^INSERT INTO webhooks ").
+		WithArgs("https://example.com/hooks", sqlmock.AnyArg(), "link.created,link.clicked", true, recentTime{}).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("^SELECT \\* FROM webhooks$").
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Url", "Events", "Active"}).
+			AddRow(1, "https://example.com/hooks", "link.created,link.clicked", true))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	form := url.Values{"url": {"https://example.com/hooks"}, "event": {webhookCreated, webhookClicked}}
+	req := httptest.NewRequest("POST", "/webhooks", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr := httptest.NewRecorder()
+
+	app.webhooksHandler(rr, req)
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/webhooks" {
+		t.Errorf("handler returned %d to %s", rr.Code, rr.Header().Get("Location"))
+	}
+	if hooks := app.webhooks.subscribers(webhookClicked); len(hooks) != 1 {
+		t.Errorf("expected the new webhook to be loaded, got %+v", hooks)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestWebhookFromForm(t *testing.T) {
+	testCases := []struct {
+		form   url.Values
+		events string
+		err    bool
+	}{
+		{url.Values{"url": {"https://example.com/hooks"}}, "", false},
+		{url.Values{"url": {"https://example.com/hooks"}, "event": webhookEvents}, "", false},
+		{url.Values{"url": {"https://example.com/hooks"}, "event": {webhookPurged}}, webhookPurged, false},
+		{url.Values{"url": {"https://example.com/hooks"}, "event": {"link.exploded"}}, "", true},
+		{url.Values{"url": {"not a url"}}, "", true},
+	}
+
+	for _, tc := range testCases {
+		req := httptest.NewRequest("POST", "/webhooks", strings.NewReader(tc.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.ParseForm()
+		hook, err := webhookFromForm(req)
+		if (err != nil) != tc.err {
+			t.Errorf("webhookFromForm(%v) error = %v; expected an error: %v", tc.form, err, tc.err)
+			continue
+		}
+		if err == nil && (hook.Events != tc.events || len(hook.Secret) != 64 || !hook.Active) {
+			t.Errorf("webhookFromForm(%v) = %+v; expected events %q and a generated secret", tc.form, hook, tc.events)
+		}
+	}
+}
+
+func TestRetryDeliveryHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer db.Close()
+
+	created := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	mock.ExpectQuery("^SELECT \\* FROM webhook_deliveries WHERE Id = \\?$").
+		WithArgs(9).
+		WillReturnRows(sqlmock.NewRows([]string{"Id", "Webhook_id", "Event_type", "Payload", "Status", "Attempts", "Next_attempt_at", "Last_attempt_at", "Response_status", "Last_error", "Created_at"}).
+			AddRow(9, 1, webhookCreated, "{}", deliveryDead, 10, created, created, 500, "answered 500", created))
+	mock.ExpectExec("^UPDATE webhook_deliveries SET ").
+		WithArgs(1, webhookCreated, "{}", deliveryPending, 0, recentTime{}, created, 500, "answered 500", created, nil, 9).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	app := &MyApp{db: &MySQLDatabase{DB: db}}
+	req := httptest.NewRequest("POST", "/webhooks/deliveries/retry?id=9", nil)
+	rr := httptest.NewRecorder()
+
+	app.retryDeliveryHandler(rr, req)
+
+	if rr.Code != http.StatusSeeOther {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusSeeOther)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -2,10 +2,12 @@ module cmd/main
 
 go 1.20
 
-require github.com/go-sql-driver/mysql v1.7.1
+require (
+	github.com/DATA-DOG/go-sqlmock v1.5.1
+	github.com/go-sql-driver/mysql v1.7.1
+)
 
 require (
-	github.com/DATA-DOG/go-sqlmock v1.5.1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.0 // indirect
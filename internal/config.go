@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings that can be changed without rebuilding the app.
+// Every setting is read from an environment variable and has a default.
+type Config struct {
+	TxIsolation  string // isolation level used when creating links
+	TxMaxRetries int    // retries for transactions that hit a deadlock
+
+	DedupeMode     string   // reject, return-existing or always-new
+	TrackingParams []string // query parameters ignored when matching repeated urls
+
+	DedupeRemoveFragment      bool // ignore everything after # when matching repeated urls
+	DedupeRemoveTrailingSlash bool // ignore trailing slashes when matching repeated urls
+
+	Blocklist []string // hosts and urls that may not be shortened
+
+	CookieSecret          string        // key for signing cookies, random on every start when empty
+	PasswordCookieTTL     time.Duration // how long a correct link password is remembered
+	PasswordMaxAttempts   int           // failed password attempts allowed per link within the window
+	PasswordAttemptWindow time.Duration
+
+	MetadataTimeout      time.Duration // how long fetching a destination's title may take
+	MetadataCacheTTL     time.Duration // how long fetched titles are cached
+	MetadataAllowPrivate bool          // fetch titles of destinations on loopback and private addresses too
+
+	DomainsRefresh time.Duration // how often the domains table is reloaded
+
+	DefaultRedirectStatus int    // 301, 302, 307 or 308
+	DefaultCacheControl   string // empty picks one based on the redirect status
+	DefaultReferrerPolicy string
+
+	QueryConflict string // override, keep or append, for links that do not choose
+
+	GeoIPDatabase  string // CSV file mapping networks to countries, for redirect rules
+	ClientIPHeader string // header holding the client address behind a proxy, e.g. X-Forwarded-For
+	ClientIPHops   int    // proxies in front of the application that append to ClientIPHeader
+
+	VariantCookieTTL time.Duration // how long a visitor keeps seeing the same variant of a sticky split test
+	ClickBuffer      int           // clicks waiting to be saved before new ones are dropped
+
+	ClickRetentionDays  int  // days raw clicks are kept once rolled up, 0 to keep them for good
+	RollupRetentionDays int  // days hourly and daily click counts are kept, 0 to keep them for good
+	PrivacyMode         bool // hash visitors with a salt rotated daily and honour DNT and Sec-GPC
+
+	BotSignatures string // file of user agent signatures of bots, reloaded every minute, empty for the built-in list
+	BotPreview    bool   // serve every crawler, not only those of social networks, the link's OpenGraph tags
+
+	StaticDir string // directory of templates and assets replacing the built-in ones of the same name, empty for none
+
+	PageSize int // links per page on the dashboard, and per API response unless asked otherwise
+
+	TrashRetentionDays int // days deleted links stay in the trash, 0 to keep them until restored
+
+	ActorHeader string   // header naming the user, set by an authenticating proxy, for the audit log
+	APIKeys     []string // name:key pairs identifying API clients
+
+	HealthInterval     time.Duration // how often destinations are checked, 0 to never check them
+	HealthTimeout      time.Duration // for each request to a destination
+	HealthConcurrency  int           // checks running at once
+	HealthHostDelay    time.Duration // time between requests to the same host
+	HealthFailures     int           // failed checks in a row before a link is flagged as broken
+	HealthAlertURL     string        // address broken links are posted to as JSON, empty to only log them
+	HealthAllowPrivate bool          // check destinations on loopback and private addresses too
+
+	WebhookTimeout      time.Duration // for each attempt of a webhook delivery
+	WebhookMaxAttempts  int           // attempts of a delivery before it is given up on
+	WebhookBackoff      time.Duration // wait after the first failed attempt, doubled after every further one
+	WebhookAllowPrivate bool          // post webhooks and health alerts to loopback and private addresses too
+
+	JobQueue   string        // where background jobs are kept: mysql, or memory to lose them on restart
+	JobWorkers int           // background jobs run at once
+	JobPoll    time.Duration // how often the queue is checked for due jobs
+	JobLease   time.Duration // how long a job may run before another worker takes it for lost
+	JobDrain   time.Duration // how long running jobs may take to finish on shutdown
+}
+
+// LoadConfig reads the configuration from the environment
+func LoadConfig() Config {
+	return Config{
+		TxIsolation:  getEnv("URL_SHORTENER_TX_ISOLATION", "repeatable-read"),
+		TxMaxRetries: getEnvInt("URL_SHORTENER_TX_MAX_RETRIES", 3),
+
+		DedupeMode:     getEnv("URL_SHORTENER_DEDUPE_MODE", "reject"),
+		TrackingParams: getEnvList("URL_SHORTENER_TRACKING_PARAMS", "utm_*,fbclid,gclid"),
+
+		DedupeRemoveFragment:      getEnvBool("URL_SHORTENER_DEDUPE_REMOVE_FRAGMENT", false),
+		DedupeRemoveTrailingSlash: getEnvBool("URL_SHORTENER_DEDUPE_REMOVE_TRAILING_SLASH", false),
+
+		Blocklist: getEnvList("URL_SHORTENER_BLOCKLIST", ""),
+
+		CookieSecret:          getEnv("URL_SHORTENER_COOKIE_SECRET", ""),
+		PasswordCookieTTL:     getEnvDuration("URL_SHORTENER_PASSWORD_COOKIE_TTL", 30*time.Minute),
+		PasswordMaxAttempts:   getEnvInt("URL_SHORTENER_PASSWORD_MAX_ATTEMPTS", 5),
+		PasswordAttemptWindow: getEnvDuration("URL_SHORTENER_PASSWORD_ATTEMPT_WINDOW", 15*time.Minute),
+
+		MetadataTimeout:      getEnvDuration("URL_SHORTENER_METADATA_TIMEOUT", 3*time.Second),
+		MetadataCacheTTL:     getEnvDuration("URL_SHORTENER_METADATA_CACHE_TTL", time.Hour),
+		MetadataAllowPrivate: getEnvBool("URL_SHORTENER_METADATA_ALLOW_PRIVATE", false),
+
+		DomainsRefresh: getEnvDuration("URL_SHORTENER_DOMAINS_REFRESH", time.Minute),
+
+		DefaultRedirectStatus: getEnvInt("URL_SHORTENER_REDIRECT_STATUS", 302),
+		DefaultCacheControl:   getEnv("URL_SHORTENER_CACHE_CONTROL", ""),
+		DefaultReferrerPolicy: getEnv("URL_SHORTENER_REFERRER_POLICY", ""),
+
+		QueryConflict: getEnv("URL_SHORTENER_QUERY_CONFLICT", "override"),
+
+		GeoIPDatabase:  getEnv("URL_SHORTENER_GEOIP_DB", ""),
+		ClientIPHeader: getEnv("URL_SHORTENER_CLIENT_IP_HEADER", ""),
+		ClientIPHops:   getEnvInt("URL_SHORTENER_CLIENT_IP_HOPS", 1),
+
+		VariantCookieTTL: getEnvDuration("URL_SHORTENER_VARIANT_COOKIE_TTL", 30*24*time.Hour),
+		ClickBuffer:      getEnvInt("URL_SHORTENER_CLICK_BUFFER", 1000),
+
+		ClickRetentionDays:  getEnvInt("URL_SHORTENER_CLICK_RETENTION_DAYS", 90),
+		RollupRetentionDays: getEnvInt("URL_SHORTENER_ROLLUP_RETENTION_DAYS", 0),
+		PrivacyMode:         getEnvBool("URL_SHORTENER_PRIVACY_MODE", true),
+
+		BotSignatures: getEnv("URL_SHORTENER_BOT_SIGNATURES", ""),
+		BotPreview:    getEnvBool("URL_SHORTENER_BOT_PREVIEW", false),
+
+		StaticDir: getEnv("URL_SHORTENER_STATIC_DIR", ""),
+
+		PageSize: getEnvInt("URL_SHORTENER_PAGE_SIZE", 50),
+
+		TrashRetentionDays: getEnvInt("URL_SHORTENER_TRASH_RETENTION_DAYS", 30),
+
+		ActorHeader: getEnv("URL_SHORTENER_ACTOR_HEADER", ""),
+		APIKeys:     getEnvList("URL_SHORTENER_API_KEYS", ""),
+
+		HealthInterval:     getEnvDuration("URL_SHORTENER_HEALTH_INTERVAL", 24*time.Hour),
+		HealthTimeout:      getEnvDuration("URL_SHORTENER_HEALTH_TIMEOUT", 10*time.Second),
+		HealthConcurrency:  getEnvInt("URL_SHORTENER_HEALTH_CONCURRENCY", 8),
+		HealthHostDelay:    getEnvDuration("URL_SHORTENER_HEALTH_HOST_DELAY", time.Second),
+		HealthFailures:     getEnvInt("URL_SHORTENER_HEALTH_FAILURES", 2),
+		HealthAlertURL:     getEnv("URL_SHORTENER_HEALTH_ALERT_URL", ""),
+		HealthAllowPrivate: getEnvBool("URL_SHORTENER_HEALTH_ALLOW_PRIVATE", false),
+
+		WebhookTimeout:      getEnvDuration("URL_SHORTENER_WEBHOOK_TIMEOUT", 10*time.Second),
+		WebhookMaxAttempts:  getEnvInt("URL_SHORTENER_WEBHOOK_MAX_ATTEMPTS", 10),
+		WebhookBackoff:      getEnvDuration("URL_SHORTENER_WEBHOOK_BACKOFF", 30*time.Second),
+		WebhookAllowPrivate: getEnvBool("URL_SHORTENER_WEBHOOK_ALLOW_PRIVATE", false),
+
+		JobQueue:   getEnv("URL_SHORTENER_JOB_QUEUE", "mysql"),
+		JobWorkers: getEnvInt("URL_SHORTENER_JOB_WORKERS", 4),
+		JobPoll:    getEnvDuration("URL_SHORTENER_JOB_POLL", time.Second),
+		JobLease:   getEnvDuration("URL_SHORTENER_JOB_LEASE", time.Hour),
+		JobDrain:   getEnvDuration("URL_SHORTENER_JOB_DRAIN", 30*time.Second),
+	}
+}
+
+func getEnv(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// getEnvList splits a comma separated variable, dropping empty entries
+func getEnvList(key string, fallback string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(key, fallback), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Ignoring invalid value %q for %s: %v", value, key, err)
+		return fallback
+	}
+	return n
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Ignoring invalid value %q for %s: %v", value, key, err)
+		return fallback
+	}
+	return b
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Ignoring invalid value %q for %s: %v", value, key, err)
+		return fallback
+	}
+	return d
+}
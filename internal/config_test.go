@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// unsetEnv removes key from the environment for the rest of the test
+func unsetEnv(t *testing.T, key string) {
+	if value, ok := os.LookupEnv(key); ok {
+		t.Cleanup(func() { os.Setenv(key, value) })
+	}
+	os.Unsetenv(key)
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	unsetEnv(t, "URL_SHORTENER_TX_ISOLATION")
+	unsetEnv(t, "URL_SHORTENER_PRIVACY_MODE")
+	t.Setenv("URL_SHORTENER_TX_MAX_RETRIES", "not a number")
+
+	cfg := LoadConfig()
+	if cfg.TxIsolation != "repeatable-read" {
+		t.Errorf("Expected the repeatable-read isolation level by default, got %q", cfg.TxIsolation)
+	}
+	if cfg.TxMaxRetries != 3 {
+		t.Errorf("Expected the default of 3 retries for an invalid value, got %d", cfg.TxMaxRetries)
+	}
+	if !cfg.PrivacyMode {
+		t.Errorf("Expected privacy mode to be on by default")
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	t.Setenv("URL_SHORTENER_TX_ISOLATION", "read-committed")
+	t.Setenv("URL_SHORTENER_TX_MAX_RETRIES", "5")
+	t.Setenv("URL_SHORTENER_TRACKING_PARAMS", " utm_*, ,ref ")
+	t.Setenv("URL_SHORTENER_PASSWORD_COOKIE_TTL", "2h")
+	t.Setenv("URL_SHORTENER_PRIVACY_MODE", "false")
+
+	cfg := LoadConfig()
+	if cfg.TxIsolation != "read-committed" {
+		t.Errorf("Expected read-committed, got %q", cfg.TxIsolation)
+	}
+	if cfg.TxMaxRetries != 5 {
+		t.Errorf("Expected 5 retries, got %d", cfg.TxMaxRetries)
+	}
+	if len(cfg.TrackingParams) != 2 || cfg.TrackingParams[0] != "utm_*" || cfg.TrackingParams[1] != "ref" {
+		t.Errorf("Unexpected tracking parameters %q", cfg.TrackingParams)
+	}
+	if cfg.PasswordCookieTTL != 2*time.Hour {
+		t.Errorf("Expected a password cookie TTL of 2h, got %v", cfg.PasswordCookieTTL)
+	}
+	if cfg.PrivacyMode {
+		t.Errorf("Expected privacy mode to be off")
+	}
+}
@@ -2,42 +2,378 @@ package internal
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL error numbers for a column, index or table that already exists, and
+// for an index that is already gone
+const (
+	errDupFieldName = 1060
+	errDupKeyName   = 1061
+	errTableExists  = 1050
+	errCantDropKey  = 1091
 )
 
+// tables holds the CREATE TABLE statement of every table the app uses
+var tables = []string{`
+    CREATE TABLE IF NOT EXISTS url_shortener (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        original_url VARCHAR(2048) NOT NULL,
+        short_url VARCHAR(5) NOT NULL,
+        url_hash CHAR(64) NOT NULL DEFAULT '',
+        password_hash VARCHAR(255) NOT NULL DEFAULT '',
+        preview BOOLEAN NOT NULL DEFAULT FALSE,
+        domain_id INT NOT NULL DEFAULT 0,
+        redirect_type SMALLINT NOT NULL DEFAULT 0,
+        cache_control VARCHAR(255) NOT NULL DEFAULT '',
+        referrer_policy VARCHAR(64) NOT NULL DEFAULT '',
+        canonical_link BOOLEAN NOT NULL DEFAULT FALSE,
+        query_rules VARCHAR(4096) NOT NULL DEFAULT '',
+        redirect_rules TEXT NOT NULL,
+        split_test BOOLEAN NOT NULL DEFAULT FALSE,
+        sticky_variants BOOLEAN NOT NULL DEFAULT FALSE,
+        title VARCHAR(255) NOT NULL DEFAULT '',
+        notes TEXT NOT NULL,
+        tags VARCHAR(1024) NOT NULL DEFAULT '',
+        folder_id INT NOT NULL DEFAULT 0,
+        og_title VARCHAR(255) NOT NULL DEFAULT '',
+        og_description VARCHAR(1024) NOT NULL DEFAULT '',
+        og_image VARCHAR(2048) NOT NULL DEFAULT '',
+        deleted_at DATETIME NULL DEFAULT NULL,
+        INDEX idx_url_hash (url_hash),
+        UNIQUE INDEX uq_domain_short_url (domain_id, short_url),
+        INDEX idx_folder_id (folder_id),
+        INDEX idx_deleted_at (deleted_at),
+        FULLTEXT INDEX ft_search (original_url, title, tags, short_url)
+    );`, `
+    CREATE TABLE IF NOT EXISTS domains (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        host VARCHAR(255) NOT NULL UNIQUE,
+        not_found_url VARCHAR(2048) NOT NULL DEFAULT '',
+        template_dir VARCHAR(255) NOT NULL DEFAULT ''
+    );`, `
+    CREATE TABLE IF NOT EXISTS link_variants (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        link_id INT NOT NULL,
+        name VARCHAR(64) NOT NULL,
+        destination VARCHAR(2048) NOT NULL,
+        weight INT NOT NULL DEFAULT 1,
+        INDEX idx_link_id (link_id)
+    );`, `
+    CREATE TABLE IF NOT EXISTS link_tags (
+        link_id INT NOT NULL,
+        tag VARCHAR(64) NOT NULL,
+        PRIMARY KEY (link_id, tag),
+        INDEX idx_tag (tag)
+    );`, `
+    CREATE TABLE IF NOT EXISTS folders (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        name VARCHAR(128) NOT NULL UNIQUE
+    );`, `
+    CREATE TABLE IF NOT EXISTS click_events (
+        id BIGINT AUTO_INCREMENT PRIMARY KEY,
+        link_id INT NOT NULL,
+        variant_id INT NOT NULL DEFAULT 0,
+        clicked_at DATETIME NOT NULL,
+        referrer VARCHAR(255) NOT NULL DEFAULT '',
+        country CHAR(2) NOT NULL DEFAULT '',
+        device VARCHAR(16) NOT NULL DEFAULT '',
+        ip VARCHAR(45) NOT NULL DEFAULT '',
+        visitor CHAR(32) NOT NULL DEFAULT '',
+        bot VARCHAR(255) NOT NULL DEFAULT '',
+        INDEX idx_link_clicked_at (link_id, clicked_at),
+        INDEX idx_clicked_at (clicked_at)
+    );`, `
+    CREATE TABLE IF NOT EXISTS click_rollups (
+        granularity VARCHAR(8) NOT NULL,
+        bucket_start DATETIME NOT NULL,
+        link_id INT NOT NULL,
+        dimension VARCHAR(16) NOT NULL,
+        value VARCHAR(255) NOT NULL,
+        clicks BIGINT NOT NULL,
+        PRIMARY KEY (granularity, link_id, dimension, value, bucket_start),
+        INDEX idx_granularity_dimension_bucket (granularity, dimension, bucket_start)
+    );`, `
+    CREATE TABLE IF NOT EXISTS visitor_salts (
+        day CHAR(10) PRIMARY KEY,
+        salt CHAR(64) NOT NULL
+    );`, `
+    CREATE TABLE IF NOT EXISTS rollup_progress (
+        granularity VARCHAR(8) PRIMARY KEY,
+        rolled_up_to DATETIME NOT NULL
+    );`, `
+    CREATE TABLE IF NOT EXISTS audit_events (
+        id BIGINT AUTO_INCREMENT PRIMARY KEY,
+        occurred_at DATETIME NOT NULL,
+        action VARCHAR(32) NOT NULL,
+        link_id INT NOT NULL DEFAULT 0,
+        actor VARCHAR(255) NOT NULL DEFAULT '',
+        ip VARCHAR(45) NOT NULL DEFAULT '',
+        request_id VARCHAR(64) NOT NULL DEFAULT '',
+        before_json MEDIUMTEXT NOT NULL,
+        after_json MEDIUMTEXT NOT NULL,
+        INDEX idx_link_id (link_id),
+        INDEX idx_actor (actor),
+        INDEX idx_occurred_at (occurred_at)
+    );`, `
+    CREATE TABLE IF NOT EXISTS link_versions (
+        id BIGINT AUTO_INCREMENT PRIMARY KEY,
+        link_id INT NOT NULL,
+        version INT NOT NULL,
+        created_at DATETIME NOT NULL,
+        action VARCHAR(32) NOT NULL,
+        actor VARCHAR(255) NOT NULL DEFAULT '',
+        link_json MEDIUMTEXT NOT NULL,
+        variants_json MEDIUMTEXT NOT NULL,
+        UNIQUE INDEX idx_link_version (link_id, version)
+    );`, `
+    CREATE TABLE IF NOT EXISTS scheduled_changes (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        link_id INT NOT NULL,
+        run_at DATETIME NOT NULL,
+        original_url VARCHAR(2048) NOT NULL,
+        created_at DATETIME NOT NULL,
+        actor VARCHAR(255) NOT NULL DEFAULT '',
+        applied_at DATETIME NULL DEFAULT NULL,
+        INDEX idx_link_id (link_id),
+        INDEX idx_applied_run_at (applied_at, run_at)
+    );`, `
+    CREATE TABLE IF NOT EXISTS link_health (
+        link_id INT PRIMARY KEY,
+        checked_at DATETIME NOT NULL,
+        status_code SMALLINT NOT NULL DEFAULT 0,
+        latency_ms INT NOT NULL DEFAULT 0,
+        redirect_chain TEXT NOT NULL,
+        error TEXT NOT NULL,
+        failures INT NOT NULL DEFAULT 0,
+        broken BOOLEAN NOT NULL DEFAULT FALSE,
+        broken_since DATETIME NULL DEFAULT NULL,
+        INDEX idx_broken (broken)
+    );`, `
+    CREATE TABLE IF NOT EXISTS webhooks (
+        id INT AUTO_INCREMENT PRIMARY KEY,
+        url VARCHAR(2048) NOT NULL,
+        secret VARCHAR(255) NOT NULL,
+        events VARCHAR(255) NOT NULL DEFAULT '',
+        active BOOLEAN NOT NULL DEFAULT TRUE,
+        created_at DATETIME NOT NULL
+    );`, `
+    CREATE TABLE IF NOT EXISTS webhook_deliveries (
+        id BIGINT AUTO_INCREMENT PRIMARY KEY,
+        webhook_id INT NOT NULL,
+        event_type VARCHAR(32) NOT NULL,
+        payload MEDIUMTEXT NOT NULL,
+        status VARCHAR(16) NOT NULL,
+        attempts INT NOT NULL DEFAULT 0,
+        next_attempt_at DATETIME NOT NULL,
+        last_attempt_at DATETIME NULL DEFAULT NULL,
+        response_status SMALLINT NOT NULL DEFAULT 0,
+        last_error TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        delivered_at DATETIME NULL DEFAULT NULL,
+        INDEX idx_status_next_attempt_at (status, next_attempt_at),
+        INDEX idx_webhook_id (webhook_id)
+    );`, `
+    CREATE TABLE IF NOT EXISTS jobs (
+        id BIGINT AUTO_INCREMENT PRIMARY KEY,
+        kind VARCHAR(64) NOT NULL,
+        payload MEDIUMTEXT NOT NULL,
+        status VARCHAR(16) NOT NULL,
+        attempts INT NOT NULL DEFAULT 0,
+        max_attempts INT NOT NULL,
+        run_at DATETIME NOT NULL,
+        locked_by VARCHAR(128) NOT NULL DEFAULT '',
+        locked_until DATETIME NULL DEFAULT NULL,
+        last_error TEXT NOT NULL,
+        created_at DATETIME NOT NULL,
+        finished_at DATETIME NULL DEFAULT NULL,
+        INDEX idx_status_run_at (status, run_at),
+        INDEX idx_status_locked_until (status, locked_until),
+        INDEX idx_kind_status (kind, status)
+    );`, `
+    CREATE TABLE IF NOT EXISTS job_schedules (
+        kind VARCHAR(64) PRIMARY KEY,
+        spec VARCHAR(255) NOT NULL,
+        next_run_at DATETIME NOT NULL
+    );`, `
+    CREATE TABLE IF NOT EXISTS settings (
+        name VARCHAR(64) PRIMARY KEY,
+        value VARCHAR(4096) NOT NULL
+    );`,
+}
+
+// migrations bring tables created by an older version of the app up to date.
+// They run on every start, so errors for columns or indexes that already
+// exist, or were already dropped, are ignored.
+var migrations = []string{
+	"ALTER TABLE url_shortener ADD COLUMN url_hash CHAR(64) NOT NULL DEFAULT ''",
+	"ALTER TABLE url_shortener ADD INDEX idx_url_hash (url_hash)",
+	"ALTER TABLE url_shortener ADD COLUMN password_hash VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE url_shortener ADD COLUMN preview BOOLEAN NOT NULL DEFAULT FALSE",
+	"ALTER TABLE url_shortener ADD COLUMN domain_id INT NOT NULL DEFAULT 0",
+	"ALTER TABLE url_shortener ADD UNIQUE INDEX uq_domain_short_url (domain_id, short_url)",
+	"ALTER TABLE url_shortener DROP INDEX idx_domain_short_url",
+	"ALTER TABLE url_shortener ADD COLUMN redirect_type SMALLINT NOT NULL DEFAULT 0",
+	"ALTER TABLE url_shortener ADD COLUMN cache_control VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE url_shortener ADD COLUMN referrer_policy VARCHAR(64) NOT NULL DEFAULT ''",
+	"ALTER TABLE url_shortener ADD COLUMN canonical_link BOOLEAN NOT NULL DEFAULT FALSE",
+	"ALTER TABLE url_shortener ADD COLUMN query_rules VARCHAR(4096) NOT NULL DEFAULT ''",
+	"ALTER TABLE url_shortener ADD COLUMN redirect_rules TEXT NOT NULL",
+	"ALTER TABLE url_shortener ADD COLUMN split_test BOOLEAN NOT NULL DEFAULT FALSE",
+	"ALTER TABLE url_shortener ADD COLUMN sticky_variants BOOLEAN NOT NULL DEFAULT FALSE",
+	"ALTER TABLE url_shortener ADD COLUMN title VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE url_shortener ADD COLUMN notes TEXT NOT NULL",
+	"ALTER TABLE url_shortener ADD COLUMN tags VARCHAR(1024) NOT NULL DEFAULT ''",
+	"ALTER TABLE url_shortener ADD COLUMN folder_id INT NOT NULL DEFAULT 0",
+	"ALTER TABLE url_shortener ADD INDEX idx_folder_id (folder_id)",
+	"ALTER TABLE url_shortener ADD FULLTEXT INDEX ft_search (original_url, title, tags, short_url)",
+	"ALTER TABLE url_shortener ADD COLUMN deleted_at DATETIME NULL DEFAULT NULL",
+	"ALTER TABLE url_shortener ADD INDEX idx_deleted_at (deleted_at)",
+	"ALTER TABLE url_shortener ADD COLUMN og_title VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE url_shortener ADD COLUMN og_description VARCHAR(1024) NOT NULL DEFAULT ''",
+	"ALTER TABLE url_shortener ADD COLUMN og_image VARCHAR(2048) NOT NULL DEFAULT ''",
+	"ALTER TABLE click_events ADD COLUMN referrer VARCHAR(255) NOT NULL DEFAULT ''",
+	"ALTER TABLE click_events ADD COLUMN country CHAR(2) NOT NULL DEFAULT ''",
+	"ALTER TABLE click_events ADD COLUMN device VARCHAR(16) NOT NULL DEFAULT ''",
+	"ALTER TABLE click_events ADD INDEX idx_clicked_at (clicked_at)",
+	"ALTER TABLE click_events ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT ''",
+	"ALTER TABLE click_events ADD COLUMN visitor CHAR(32) NOT NULL DEFAULT ''",
+	"ALTER TABLE click_events ADD COLUMN bot VARCHAR(255) NOT NULL DEFAULT ''",
+}
+
 func InitMySqlDB(db *sql.DB) {
-	log.Println("Creating database if it doesn't exist")
+	var err error
 
-	_, err := db.Exec("CREATE DATABASE IF NOT EXISTS final_project")
-	if err != nil {
-		log.Fatalf("Error creating database: %v", err)
+	// Create the tables if they don't exist
+	for _, createTableSQL := range tables {
+		_, err = db.Exec(createTableSQL)
+		if err != nil {
+			log.Fatalf("Error creating table: %v", err)
+		}
 	}
 
-	// Select the database for use
-	_, err = db.Exec("USE final_project")
-	if err != nil {
-		log.Fatalf("Error selecting database: %v", err)
+	for _, migrationSQL := range migrations {
+		_, err = db.Exec(migrationSQL)
+		if err != nil && !alreadyApplied(err) {
+			log.Fatalf("Error migrating table: %v", err)
+		}
 	}
 
-	// Create the table if it doesn't exist
-	createTableSQL := `
-    CREATE TABLE IF NOT EXISTS url_shortener (
-        id INT AUTO_INCREMENT PRIMARY KEY,
-        original_url VARCHAR(2048) NOT NULL,
-        short_url VARCHAR(5) NOT NULL
-    );`
-	_, err = db.Exec(createTableSQL)
+	log.Println("Successfully initialized database")
+}
+
+// alreadyApplied reports whether err means a migration has already been run
+func alreadyApplied(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case errDupFieldName, errDupKeyName, errTableExists, errCantDropKey:
+			return true
+		}
+	}
+	return false
+}
+
+// urlHashRulesSetting names the setting holding the rules the stored url
+// hashes were computed with
+const urlHashRulesSetting = "url_hash_rules"
+
+// UpdateURLHashes computes the url_hash of links stored before the column was
+// added, which are otherwise never found as repeats. When the hashes stored
+// were computed with other rules than rules, those of every link are
+// computed again. Links whose url cannot be hashed are left as they are.
+func UpdateURLHashes(db *sql.DB, rules string, hash func(originalURL string) (string, error)) error {
+	var stored string
+	err := db.QueryRow("SELECT value FROM settings WHERE name = ?", urlHashRulesSetting).Scan(&stored)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	query := "SELECT id, original_url FROM url_shortener WHERE url_hash = ''"
+	if stored != rules {
+		query = "SELECT id, original_url FROM url_shortener"
+	}
+
+	rows, err := db.Query(query)
 	if err != nil {
-		log.Fatalf("Error creating table: %v", err)
+		return err
+	}
+	type link struct {
+		id          int
+		originalURL string
+	}
+	var links []link
+	for rows.Next() {
+		var l link
+		if err := rows.Scan(&l.id, &l.originalURL); err != nil {
+			rows.Close()
+			return err
+		}
+		links = append(links, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
 	}
 
-	log.Println("Successfully initialized database")
+	for _, l := range links {
+		urlHash, err := hash(l.originalURL)
+		if err != nil {
+			log.Printf("Error hashing the url of link %d: %v", l.id, err)
+			continue
+		}
+		if _, err := db.Exec("UPDATE url_shortener SET url_hash = ? WHERE id = ?", urlHash, l.id); err != nil {
+			return err
+		}
+	}
+	if len(links) > 0 {
+		log.Printf("Computed the url hash of %d links", len(links))
+	}
+
+	if stored != rules {
+		_, err = db.Exec("INSERT INTO settings (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)", urlHashRulesSetting, rules)
+	}
+	return err
 }
 
 var sqlOpen = sql.Open
 
+// databaseName is the database holding the tables of the application
+const databaseName = "final_project"
+
+// ConnectToMySqlDB creates the database if it doesn't exist and returns a
+// pool whose connections all use it
 func ConnectToMySqlDB() (*sql.DB, error) {
-	db, err := sqlOpen("mysql", ConnectionString)
+	dsn, err := mysql.ParseDSN(ConnectionString)
+	if err != nil {
+		log.Printf("Invalid connection string: %v", err)
+		return nil, err
+	}
+	// DATETIME columns are scanned into time.Time
+	dsn.ParseTime = true
+
+	// The database is created over a connection to the server alone, since
+	// connecting to a database that doesn't exist fails
+	dsn.DBName = ""
+	server, err := sqlOpen("mysql", dsn.FormatDSN())
+	if err != nil {
+		log.Printf("Failed to connect to MySQL: %v", err)
+		return nil, err
+	}
+	log.Println("Creating database if it doesn't exist")
+	_, err = server.Exec("CREATE DATABASE IF NOT EXISTS " + databaseName)
+	server.Close()
+	if err != nil {
+		log.Printf("Error creating database: %v", err)
+		return nil, err
+	}
+
+	// A USE statement would only select the database on the connection it
+	// runs on, so every connection of the pool names it instead
+	dsn.DBName = databaseName
+	db, err := sqlOpen("mysql", dsn.FormatDSN())
 	if err != nil {
 		log.Printf("Failed to connect to MySQL: %v", err)
 		return nil, err
@@ -2,10 +2,13 @@ package internal
 
 import (
 	"database/sql"
+	"errors"
 	"log"
+	"strings"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 )
 
 func TestInitMySqlDB(t *testing.T) {
@@ -17,9 +20,35 @@ func TestInitMySqlDB(t *testing.T) {
 	defer db.Close()
 
 	// Set expectations
-	mock.ExpectExec("CREATE DATABASE IF NOT EXISTS final_project").WillReturnResult(sqlmock.NewResult(0, 0))
-	mock.ExpectExec("USE final_project").WillReturnResult(sqlmock.NewResult(0, 0))
 	mock.ExpectExec("CREATE TABLE IF NOT EXISTS url_shortener").WillReturnResult(sqlmock.NewResult(0, 0))
+	for range tables[1:] {
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	for range migrations {
+		mock.ExpectExec("ALTER TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	InitMySqlDB(db)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestInitMySqlDBSkipsAppliedMigrations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		log.Fatalf("Error creating mock database: %v", err)
+	}
+	defer db.Close()
+
+	for range tables {
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	// Every migration has already been applied to this database
+	for range migrations {
+		mock.ExpectExec("ALTER TABLE").WillReturnError(&mysql.MySQLError{Number: errDupFieldName})
+	}
 
 	InitMySqlDB(db)
 
@@ -29,7 +58,16 @@ func TestInitMySqlDB(t *testing.T) {
 }
 
 func TestConnectToMySqlDB(t *testing.T) {
-	// Mock successful database connection
+	// Mock successful database connections, first to the server to create
+	// the database, then to the database itself
+	serverDB, serverMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
+	}
+	defer serverDB.Close()
+	serverMock.ExpectExec("^CREATE DATABASE IF NOT EXISTS final_project$").WillReturnResult(sqlmock.NewResult(0, 1))
+	serverMock.ExpectClose()
+
 	mockDB, _, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("An error '%s' was not expected when opening a mock database connection", err)
@@ -38,15 +76,34 @@ func TestConnectToMySqlDB(t *testing.T) {
 
 	// Replace sqlOpen with a mock
 	originalSqlOpen := sqlOpen
+	var dataSources []string
 	sqlOpen = func(driverName string, dataSourceName string) (*sql.DB, error) {
+		if !strings.Contains(dataSourceName, "parseTime=true") {
+			t.Errorf("Expected times to be parsed, got data source %s", dataSourceName)
+		}
+		dataSources = append(dataSources, dataSourceName)
+		if len(dataSources) == 1 {
+			return serverDB, nil
+		}
 		return mockDB, nil
 	}
 	defer func() { sqlOpen = originalSqlOpen }()
 
 	// Call the function - expecting no error as the connection is successful
-	if _, err := ConnectToMySqlDB(); err != nil {
+	db, err := ConnectToMySqlDB()
+	if err != nil {
 		t.Errorf("Expected no error, but got %v", err)
 	}
+	if db != mockDB {
+		t.Errorf("Expected the connection to the database to be returned")
+	}
+	// Every connection of the pool selects the database
+	if len(dataSources) != 2 || strings.Contains(dataSources[0], "/final_project") || !strings.Contains(dataSources[1], "/final_project?") {
+		t.Errorf("Expected to connect to the server then to the database, got data sources %v", dataSources)
+	}
+	if err := serverMock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
 
 	// Now, simulate a connection error
 	sqlOpen = func(driverName string, dataSourceName string) (*sql.DB, error) {
@@ -58,3 +115,69 @@ func TestConnectToMySqlDB(t *testing.T) {
 		t.Errorf("Expected an error, but got none")
 	}
 }
+
+// hashForTest hashes urls starting with https:// and refuses any other
+func hashForTest(originalURL string) (string, error) {
+	if !strings.HasPrefix(originalURL, "https://") {
+		return "", errors.New("not a url")
+	}
+	return "hash of " + originalURL, nil
+}
+
+func expectURLHashUpdate(mock sqlmock.Sqlmock, urlStr string, id int) {
+	mock.ExpectExec("^UPDATE url_shortener SET url_hash = \\? WHERE id = \\?$").
+		WithArgs("hash of "+urlStr, id).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func TestUpdateURLHashes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer db.Close()
+
+	// Only links stored before the column existed are hashed
+	mock.ExpectQuery("^SELECT value FROM settings WHERE name = \\?$").WithArgs(urlHashRulesSetting).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}).AddRow("v2 rules"))
+	mock.ExpectQuery("^SELECT id, original_url FROM url_shortener WHERE url_hash = ''$").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "original_url"}).
+			AddRow(1, "https://example.com").
+			AddRow(2, "not hashable").
+			AddRow(3, "https://example.org"))
+	expectURLHashUpdate(mock, "https://example.com", 1)
+	expectURLHashUpdate(mock, "https://example.org", 3)
+
+	if err := UpdateURLHashes(db, "v2 rules", hashForTest); err != nil {
+		t.Errorf("Error updating url hashes: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestUpdateURLHashesAfterRulesChange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error creating mock database: %v", err)
+	}
+	defer db.Close()
+
+	// No rules recorded yet: every link is hashed again, then the rules are
+	// recorded
+	mock.ExpectQuery("^SELECT value FROM settings WHERE name = \\?$").WithArgs(urlHashRulesSetting).
+		WillReturnRows(sqlmock.NewRows([]string{"value"}))
+	mock.ExpectQuery("^SELECT id, original_url FROM url_shortener$").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "original_url"}).AddRow(1, "https://example.com"))
+	expectURLHashUpdate(mock, "https://example.com", 1)
+	mock.ExpectExec("^INSERT INTO settings \\(name, value\\) VALUES \\(\\?, \\?\\) ON DUPLICATE KEY UPDATE value = VALUES\\(value\\)$").
+		WithArgs(urlHashRulesSetting, "v2 rules").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := UpdateURLHashes(db, "v2 rules", hashForTest); err != nil {
+		t.Errorf("Error updating url hashes: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
@@ -0,0 +1,13 @@
+package StorageInterfaces
+
+import (
+	"database/sql"
+)
+
+// DBTX is satisfied by both *sql.DB and *sql.Tx, so the same queries can run
+// inside or outside of a transaction
+type DBTX interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
@@ -0,0 +1,20 @@
+package StorageInterfaces
+
+// Order sorts rows on a column
+type Order struct {
+	Column string
+	Desc   bool
+}
+
+// Query selects a page of the rows of a table. A page either starts at
+// Offset, or, for keyset pagination, right after the row whose OrderBy
+// columns held the values in After. Keyset pagination needs the last OrderBy
+// column to be unique, so no two rows share a position.
+type Query struct {
+	Where   string // condition without the WHERE keyword, "" for every row
+	Args    []interface{}
+	OrderBy []Order
+	Limit   int // 0 for no limit
+	Offset  int
+	After   []interface{} // one value per OrderBy column, nil for the first page
+}
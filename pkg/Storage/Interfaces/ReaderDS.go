@@ -1,10 +1,9 @@
 package StorageInterfaces
 
-import (
-	"database/sql"
-)
-
 type ReaderDS interface {
-	GetAll(db *sql.DB, tableName string, slicePtr interface{}) error
-	GetByWhere(db *sql.DB, tableName string, whereClause string, objPtr interface{}) error
+	GetAll(db DBTX, tableName string, slicePtr interface{}) error
+	GetAllByWhere(db DBTX, tableName string, whereClause string, args []interface{}, slicePtr interface{}) error
+	GetByWhere(db DBTX, tableName string, whereClause string, args []interface{}, objPtr interface{}) error
+	Find(db DBTX, tableName string, query Query, slicePtr interface{}) error
+	Count(db DBTX, tableName string, whereClause string, args []interface{}) (int, error)
 }
\ No newline at end of file
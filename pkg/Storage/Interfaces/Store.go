@@ -0,0 +1,25 @@
+package StorageInterfaces
+
+import (
+	"context"
+)
+
+// Store is a DataStorage already bound to a database handle, which is either
+// the connection pool or an open transaction
+type Store interface {
+	GetAll(tableName string, slicePtr interface{}) error
+	GetAllByWhere(tableName string, whereClause string, args []interface{}, slicePtr interface{}) error
+	GetByWhere(tableName string, whereClause string, args []interface{}, objPtr interface{}) error
+	Find(tableName string, query Query, slicePtr interface{}) error
+	Count(tableName string, whereClause string, args []interface{}) (int, error)
+	Save(tableName string, structPtr interface{}) error
+	SaveReturningID(tableName string, structPtr interface{}, keyField string) error
+	Update(tableName string, structPtr interface{}, keyField string) error
+	UpdateFields(tableName string, structPtr interface{}, keyField string, fields ...string) error
+	Delete(tableName string, whereClause string, args []interface{}) error
+	Upsert(tableName string, structPtr interface{}) error
+
+	// WithTx runs fn inside a transaction. The transaction is rolled back when
+	// fn returns an error or panics, and committed otherwise.
+	WithTx(ctx context.Context, fn func(tx Store) error) error
+}
\ No newline at end of file
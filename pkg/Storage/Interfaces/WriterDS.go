@@ -1,9 +1,10 @@
 package StorageInterfaces
 
-import (
-	"database/sql"
-)
-
 type WriterDS interface {
-	Save(db *sql.DB, tableName string, structPtr interface{}) error 
+	Save(db DBTX, tableName string, structPtr interface{}) error 
+	SaveReturningID(db DBTX, tableName string, structPtr interface{}, keyField string) error
+	Update(db DBTX, tableName string, structPtr interface{}, keyField string) error
+	UpdateFields(db DBTX, tableName string, structPtr interface{}, keyField string, fields ...string) error
+	Delete(db DBTX, tableName string, whereClause string, args []interface{}) error
+	Upsert(db DBTX, tableName string, structPtr interface{}) error
 }
\ No newline at end of file
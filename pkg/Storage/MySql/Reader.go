@@ -1,12 +1,158 @@
 package MySql
 
 import (
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
 	"database/sql"
 	"fmt"
 	"reflect"
+	"strings"
 )
 
-func GetAll(db *sql.DB, tableName string, slicePtr interface{}) error {
+func GetAll(db StorageInterfaces.DBTX, tableName string, slicePtr interface{}) error {
+	query := fmt.Sprintf("SELECT * FROM %s", tableName)
+	return queryAll(db, slicePtr, query)
+}
+
+// GetAllByWhere fills the slice with every row matching the where clause
+func GetAllByWhere(db StorageInterfaces.DBTX, tableName string, whereClause string, args []interface{}, slicePtr interface{}) error {
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s", tableName, whereClause)
+	return queryAll(db, slicePtr, query, args...)
+}
+
+// Find fills the slice with the page of rows that query selects. Only the
+// columns of the slice's struct can be ordered on, as field names double as
+// column names.
+func Find(db StorageInterfaces.DBTX, tableName string, query StorageInterfaces.Query, slicePtr interface{}) error {
+	sliceVal := reflect.ValueOf(slicePtr)
+	if sliceVal.Kind() != reflect.Ptr || sliceVal.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("slicePtr must be a pointer to a slice")
+	}
+	elementType := sliceVal.Elem().Type().Elem()
+	if elementType.Kind() != reflect.Struct {
+		return fmt.Errorf("slicePtr must be a pointer to a slice of structs")
+	}
+
+	// Columns are written as their field names, so nothing but a column name
+	// ends up in the statement
+	orderBy := make([]StorageInterfaces.Order, len(query.OrderBy))
+	var order []string
+	for i, o := range query.OrderBy {
+		field, ok := elementType.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, o.Column)
+		})
+		if !ok || field.PkgPath != "" {
+			return fmt.Errorf("cannot order by unknown column %q", o.Column)
+		}
+		orderBy[i] = StorageInterfaces.Order{Column: field.Name, Desc: o.Desc}
+		if o.Desc {
+			order = append(order, field.Name+" DESC")
+		} else {
+			order = append(order, field.Name)
+		}
+	}
+
+	var conditions []string
+	var args []interface{}
+	if query.Where != "" {
+		conditions = append(conditions, query.Where)
+		args = append(args, query.Args...)
+	}
+	if query.After != nil {
+		keyset, keysetArgs, err := keysetCondition(orderBy, query.After)
+		if err != nil {
+			return err
+		}
+		conditions = append(conditions, keyset)
+		args = append(args, keysetArgs...)
+	}
+
+	statement := fmt.Sprintf("SELECT * FROM %s", tableName)
+	if len(conditions) == 1 {
+		statement += " WHERE " + conditions[0]
+	} else if len(conditions) > 1 {
+		statement += " WHERE (" + strings.Join(conditions, ") AND (") + ")"
+	}
+	if len(order) > 0 {
+		statement += " ORDER BY " + strings.Join(order, ", ")
+	}
+	if query.Limit > 0 {
+		statement += fmt.Sprintf(" LIMIT %d", query.Limit)
+	}
+	if query.Offset > 0 {
+		if query.Limit <= 0 {
+			return fmt.Errorf("an offset needs a limit")
+		}
+		statement += fmt.Sprintf(" OFFSET %d", query.Offset)
+	}
+	return queryAll(db, slicePtr, statement, args...)
+}
+
+// keysetCondition selects the rows ordered after the row holding the values
+// in after. For ORDER BY a DESC, b that is a < ? OR (a = ? AND b > ?).
+func keysetCondition(orderBy []StorageInterfaces.Order, after []interface{}) (string, []interface{}, error) {
+	if len(orderBy) == 0 || len(after) != len(orderBy) {
+		return "", nil, fmt.Errorf("a cursor needs one value per order column, got %d for %d", len(after), len(orderBy))
+	}
+
+	var alternatives []string
+	var args []interface{}
+	for i, o := range orderBy {
+		var terms []string
+		for j := 0; j < i; j++ {
+			terms = append(terms, orderBy[j].Column+" = ?")
+			args = append(args, after[j])
+		}
+		if o.Desc {
+			terms = append(terms, o.Column+" < ?")
+		} else {
+			terms = append(terms, o.Column+" > ?")
+		}
+		args = append(args, after[i])
+
+		if len(terms) == 1 {
+			alternatives = append(alternatives, terms[0])
+		} else {
+			alternatives = append(alternatives, "("+strings.Join(terms, " AND ")+")")
+		}
+	}
+	return strings.Join(alternatives, " OR "), args, nil
+}
+
+// Count returns the number of rows matching the where clause, or of all rows
+// when it is ""
+func Count(db StorageInterfaces.DBTX, tableName string, whereClause string, args []interface{}) (int, error) {
+	query := fmt.Sprintf("SELECT COUNT(*) FROM %s", tableName)
+	if whereClause != "" {
+		query += " WHERE " + whereClause
+	}
+	var count int
+	err := db.QueryRow(query, args...).Scan(&count)
+	return count, err
+}
+
+// CursorValues returns the values of the order columns in row, which is a
+// struct or a pointer to one, for resuming a Query right after row
+func CursorValues(row interface{}, orderBy []StorageInterfaces.Order) ([]interface{}, error) {
+	rowVal := reflect.Indirect(reflect.ValueOf(row))
+	if rowVal.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("row must be a struct or a pointer to a struct")
+	}
+
+	values := make([]interface{}, len(orderBy))
+	for i, o := range orderBy {
+		field := rowVal.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, o.Column)
+		})
+		if !field.IsValid() || !field.CanInterface() {
+			return nil, fmt.Errorf("row has no column %q", o.Column)
+		}
+		values[i] = field.Interface()
+	}
+	return values, nil
+}
+
+// queryAll appends a struct to the slice for every row the query returns
+func queryAll(db StorageInterfaces.DBTX, slicePtr interface{}, query string, args ...interface{}) error {
 	// Check that slicePtr is a pointer to a slice
 	sliceVal := reflect.ValueOf(slicePtr)
 	if sliceVal.Kind() != reflect.Ptr || sliceVal.Elem().Kind() != reflect.Slice {
@@ -15,21 +161,20 @@ func GetAll(db *sql.DB, tableName string, slicePtr interface{}) error {
 
 	// Check that the slice element is a struct
 	elementType := sliceVal.Elem().Type().Elem()
-	query := fmt.Sprintf("SELECT * FROM %s", tableName)
-	rows, err := db.Query(query)
+	rows, err := db.Query(query, args...)
 	if err != nil {
 		return err
 	}
 	defer rows.Close()
 
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
 	for rows.Next() {
 		element := reflect.New(elementType).Elem()
-		fieldValues := make([]interface{}, element.NumField())
-		for i := 0; i < element.NumField(); i++ {
-			fieldValues[i] = element.Field(i).Addr().Interface()
-		}
-
-		if err := rows.Scan(fieldValues...); err != nil {
+		if err := rows.Scan(scanTargets(columns, element)...); err != nil {
 			return err
 		}
 
@@ -39,24 +184,53 @@ func GetAll(db *sql.DB, tableName string, slicePtr interface{}) error {
 	return rows.Err()
 }
 
-func GetByWhere(db *sql.DB, tableName string, whereClause string, args []interface{}, objPtr interface{}) error {
+func GetByWhere(db StorageInterfaces.DBTX, tableName string, whereClause string, args []interface{}, objPtr interface{}) error {
     objVal := reflect.ValueOf(objPtr)
     if objVal.Kind() != reflect.Ptr || objVal.Elem().Kind() != reflect.Struct {
         return fmt.Errorf("objPtr must be a pointer to a struct")
     }
 
     query := fmt.Sprintf("SELECT * FROM %s WHERE %s", tableName, whereClause)
-    row := db.QueryRow(query, args...) // Pass the arguments to QueryRow
+    rows, err := db.Query(query, args...) // Pass the arguments to Query
+    if err != nil {
+        return fmt.Errorf("error scanning row: %w", err)
+    }
+    defer rows.Close()
 
-    fieldValues := make([]interface{}, objVal.Elem().NumField())
-    for i := 0; i < objVal.Elem().NumField(); i++ {
-        fieldValues[i] = objVal.Elem().Field(i).Addr().Interface()
+    if !rows.Next() {
+        if err := rows.Err(); err != nil {
+            return fmt.Errorf("error scanning row: %w", err)
+        }
+        return fmt.Errorf("error scanning row: %w", sql.ErrNoRows)
     }
 
-    err := row.Scan(fieldValues...)
+    columns, err := rows.Columns()
+    if err != nil {
+        return err
+    }
+
+    err = rows.Scan(scanTargets(columns, objVal.Elem())...)
     if err != nil {
         return fmt.Errorf("error scanning row: %v", err)
     }
 
     return nil
-}
\ No newline at end of file
+}
+
+// scanTargets matches each column to the struct field with the same name,
+// ignoring case. Columns without a matching field are scanned and discarded,
+// so a table can gain columns before the struct does.
+func scanTargets(columns []string, element reflect.Value) []interface{} {
+	targets := make([]interface{}, len(columns))
+	for i, column := range columns {
+		field := element.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, column)
+		})
+		if field.IsValid() && field.CanAddr() && field.CanInterface() {
+			targets[i] = field.Addr().Interface()
+		} else {
+			targets[i] = new(interface{})
+		}
+	}
+	return targets
+}
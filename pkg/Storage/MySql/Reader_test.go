@@ -1,7 +1,12 @@
 package MySql
 import (
+    "database/sql"
+    "errors"
+    "reflect"
     "testing"
 
+    StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
+
     "github.com/DATA-DOG/go-sqlmock"
 )
 
@@ -61,4 +66,211 @@ func TestGetByWhereWithSqlmock(t *testing.T) {
     if err := mock.ExpectationsWereMet(); err != nil {
         t.Errorf("There were unfulfilled expectations: %s", err)
     }
-}
\ No newline at end of file
+}
+
+func TestGetByWhereMatchesColumnsByName(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    columns := []string{"value", "extra", "id"}
+    mock.ExpectQuery("^SELECT \\* FROM test_table WHERE id = \\?$").
+        WithArgs(1).
+        WillReturnRows(sqlmock.NewRows(columns).AddRow("testValue", "ignored", 1))
+
+    var result TestStruct
+    err = GetByWhere(db, "test_table", "id = ?", []interface{}{1}, &result)
+    if err != nil {
+        t.Errorf("Error in GetByWhere: %v", err)
+    }
+
+    if result.ID != 1 || result.Value != "testValue" || result.Name != "" {
+        t.Errorf("Unexpected result %+v", result)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+func TestGetByWhereNoRows(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    mock.ExpectQuery("^SELECT \\* FROM test_table WHERE id = \\?$").
+        WithArgs(2).
+        WillReturnRows(sqlmock.NewRows([]string{"id", "name", "value"}))
+
+    var result TestStruct
+    err = GetByWhere(db, "test_table", "id = ?", []interface{}{2}, &result)
+    if !errors.Is(err, sql.ErrNoRows) {
+        t.Errorf("Expected sql.ErrNoRows, got %v", err)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+func TestGetAllByWhereWithSqlmock(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    columns := []string{"id", "name", "value"}
+    mock.ExpectQuery("^SELECT \\* FROM test_table WHERE name = \\?$").
+        WithArgs("testName").
+        WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "testName", "a").AddRow(2, "testName", "b"))
+
+    var results []TestStruct
+    err = GetAllByWhere(db, "test_table", "name = ?", []interface{}{"testName"}, &results)
+    if err != nil {
+        t.Errorf("Error in GetAllByWhere: %v", err)
+    }
+
+    if len(results) != 2 || results[0].Value != "a" || results[1].ID != 2 {
+        t.Errorf("Unexpected results %+v", results)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+func TestFindWithSqlmock(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    columns := []string{"id", "name", "value"}
+    mock.ExpectQuery("^SELECT \\* FROM test_table WHERE name = \\? ORDER BY Value DESC, ID LIMIT 2 OFFSET 4$").
+        WithArgs("testName").
+        WillReturnRows(sqlmock.NewRows(columns).AddRow(5, "testName", "b").AddRow(6, "testName", "a"))
+
+    var results []TestStruct
+    err = Find(db, "test_table", StorageInterfaces.Query{
+        Where:   "name = ?",
+        Args:    []interface{}{"testName"},
+        OrderBy: []StorageInterfaces.Order{{Column: "value", Desc: true}, {Column: "id"}},
+        Limit:   2,
+        Offset:  4,
+    }, &results)
+    if err != nil {
+        t.Errorf("Error in Find: %v", err)
+    }
+
+    if len(results) != 2 || results[0].ID != 5 || results[1].Value != "a" {
+        t.Errorf("Unexpected results %+v", results)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+func TestFindAfterCursor(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    columns := []string{"id", "name", "value"}
+    mock.ExpectQuery("^SELECT \\* FROM test_table WHERE \\(name = \\?\\) AND \\(Value < \\? OR \\(Value = \\? AND ID > \\?\\)\\) ORDER BY Value DESC, ID LIMIT 10$").
+        WithArgs("testName", "b", "b", 5).
+        WillReturnRows(sqlmock.NewRows(columns).AddRow(6, "testName", "a"))
+    mock.ExpectQuery("^SELECT \\* FROM test_table WHERE ID > \\? ORDER BY ID$").
+        WithArgs(6).
+        WillReturnRows(sqlmock.NewRows(columns))
+
+    orderBy := []StorageInterfaces.Order{{Column: "Value", Desc: true}, {Column: "ID"}}
+    after, err := CursorValues(TestStruct{ID: 5, Value: "b"}, orderBy)
+    if err != nil || !reflect.DeepEqual(after, []interface{}{"b", 5}) {
+        t.Fatalf("CursorValues = %v, %v", after, err)
+    }
+
+    var results []TestStruct
+    err = Find(db, "test_table", StorageInterfaces.Query{
+        Where:   "name = ?",
+        Args:    []interface{}{"testName"},
+        OrderBy: orderBy,
+        Limit:   10,
+        After:   after,
+    }, &results)
+    if err != nil || len(results) != 1 || results[0].ID != 6 {
+        t.Errorf("Unexpected results %+v, %v", results, err)
+    }
+
+    results = nil
+    err = Find(db, "test_table", StorageInterfaces.Query{
+        OrderBy: []StorageInterfaces.Order{{Column: "ID"}},
+        After:   []interface{}{6},
+    }, &results)
+    if err != nil || len(results) != 0 {
+        t.Errorf("Unexpected results %+v, %v", results, err)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+func TestFindRejectsBadQueries(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    queries := []StorageInterfaces.Query{
+        {OrderBy: []StorageInterfaces.Order{{Column: "ID; DROP TABLE test_table"}}},
+        {OrderBy: []StorageInterfaces.Order{{Column: "Missing"}}},
+        {OrderBy: []StorageInterfaces.Order{{Column: "ID"}}, After: []interface{}{1, "extra"}},
+        {After: []interface{}{1}},
+        {Offset: 10},
+    }
+    for _, query := range queries {
+        var results []TestStruct
+        if err := Find(db, "test_table", query, &results); err == nil {
+            t.Errorf("Expected an error for %+v", query)
+        }
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+func TestCount(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM test_table$").
+        WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(7))
+    mock.ExpectQuery("^SELECT COUNT\\(\\*\\) FROM test_table WHERE name = \\?$").
+        WithArgs("testName").
+        WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(2))
+
+    if count, err := Count(db, "test_table", "", nil); count != 7 || err != nil {
+        t.Errorf("Count = %d, %v; expected 7", count, err)
+    }
+    if count, err := Count(db, "test_table", "name = ?", []interface{}{"testName"}); count != 2 || err != nil {
+        t.Errorf("Count = %d, %v; expected 2", count, err)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
@@ -0,0 +1,111 @@
+package MySql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// MySQL error numbers for a deadlock and a lock wait timeout. Both mean the
+// transaction lost a race and can safely be run again from the start.
+const (
+	errDeadlock        = 1213
+	errLockWaitTimeout = 1205
+)
+
+// errDupEntry is the MySQL error number for a row that would break a unique
+// index
+const errDupEntry = 1062
+
+// TxOptions configures how WithTx runs a transaction
+type TxOptions struct {
+	Isolation  sql.IsolationLevel
+	ReadOnly   bool
+	MaxRetries int           // how many times a deadlocked transaction is retried
+	RetryDelay time.Duration // delay before the first retry, doubled after each one
+}
+
+// WithTx runs fn inside a transaction. The transaction is rolled back when fn
+// returns an error or panics, and committed otherwise. Transactions that fail
+// with a deadlock or serialization error are retried up to opts.MaxRetries times.
+func WithTx(ctx context.Context, db *sql.DB, opts TxOptions, fn func(tx *sql.Tx) error) error {
+	delay := opts.RetryDelay
+	if delay <= 0 {
+		delay = 10 * time.Millisecond
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, db, opts, fn)
+		if err == nil || !IsRetryable(err) || attempt >= opts.MaxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func runTx(ctx context.Context, db *sql.DB, opts TxOptions, fn func(tx *sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: opts.Isolation, ReadOnly: opts.ReadOnly})
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsRetryable reports whether err is a deadlock or serialization failure
+func IsRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == errDeadlock || mysqlErr.Number == errLockWaitTimeout
+	}
+	return false
+}
+
+// IsDuplicateEntry reports whether err means a row was refused because it
+// would break a unique index
+func IsDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == errDupEntry
+}
+
+// ParseIsolationLevel converts a name such as "repeatable-read" or
+// "SERIALIZABLE" to an sql.IsolationLevel. An empty name is the driver default.
+func ParseIsolationLevel(name string) (sql.IsolationLevel, error) {
+	switch strings.ToLower(strings.NewReplacer("-", " ", "_", " ").Replace(name)) {
+	case "", "default":
+		return sql.LevelDefault, nil
+	case "read uncommitted":
+		return sql.LevelReadUncommitted, nil
+	case "read committed":
+		return sql.LevelReadCommitted, nil
+	case "repeatable read":
+		return sql.LevelRepeatableRead, nil
+	case "serializable":
+		return sql.LevelSerializable, nil
+	}
+	return sql.LevelDefault, fmt.Errorf("unknown isolation level %q", name)
+}
@@ -0,0 +1,137 @@
+package MySql
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestWithTxCommit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM test_table WHERE ID = \\?$").
+		WithArgs(1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = WithTx(context.Background(), db, TxOptions{Isolation: sql.LevelSerializable}, func(tx *sql.Tx) error {
+		return Delete(tx, "test_table", "ID = ?", []interface{}{1})
+	})
+	if err != nil {
+		t.Errorf("Error in WithTx: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestWithTxRollbackOnError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	failure := errors.New("failure")
+	err = WithTx(context.Background(), db, TxOptions{}, func(tx *sql.Tx) error {
+		return failure
+	})
+	if err != failure {
+		t.Errorf("Expected the error from fn, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestWithTxRollbackOnPanic(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected the panic to be re-raised")
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("There were unfulfilled expectations: %s", err)
+		}
+	}()
+
+	WithTx(context.Background(), db, TxOptions{}, func(tx *sql.Tx) error {
+		panic("boom")
+	})
+}
+
+func TestWithTxRetriesDeadlock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	deadlock := &mysql.MySQLError{Number: errDeadlock, Message: "Deadlock found"}
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM test_table").WithArgs(1).WillReturnError(deadlock)
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectExec("^DELETE FROM test_table").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	attempts := 0
+	err = WithTx(context.Background(), db, TxOptions{MaxRetries: 2, RetryDelay: 1}, func(tx *sql.Tx) error {
+		attempts++
+		return Delete(tx, "test_table", "ID = ?", []interface{}{1})
+	})
+	if err != nil {
+		t.Errorf("Error in WithTx: %v", err)
+	}
+
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("There were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestParseIsolationLevel(t *testing.T) {
+	testCases := []struct {
+		name  string
+		level sql.IsolationLevel
+		valid bool
+	}{
+		{"", sql.LevelDefault, true},
+		{"serializable", sql.LevelSerializable, true},
+		{"REPEATABLE-READ", sql.LevelRepeatableRead, true},
+		{"read_committed", sql.LevelReadCommitted, true},
+		{"snapshot", sql.LevelDefault, false},
+	}
+
+	for _, tc := range testCases {
+		level, err := ParseIsolationLevel(tc.name)
+		if (err == nil) != tc.valid || level != tc.level {
+			t.Errorf("ParseIsolationLevel(%s) = %v, %v", tc.name, level, err)
+		}
+	}
+}
@@ -1,20 +1,184 @@
 package MySql
 
 import (
-	"database/sql"
+	StorageInterfaces "cmd/main/pkg/Storage/Interfaces"
 	"fmt"
 	"reflect"
 	"strings"
 )
 
-func Save(db *sql.DB, tableName string, structPtr interface{}) error {
+func Save(db StorageInterfaces.DBTX, tableName string, structPtr interface{}) error {
+	// Get the field names and values of the struct
+	fieldNames, values, err := structFields(structPtr, "")
+	if err != nil {
+		return err
+	}
+
+	// Construct the query string
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		tableName,
+		strings.Join(fieldNames, ", "),
+		placeholders(len(fieldNames)),
+	)
+
+	// Execute the query
+	_, err = db.Exec(query, values...)
+	return err
+}
+
+// SaveReturningID inserts the struct without its key field and fills the key
+// field with the auto-increment id generated by the database
+func SaveReturningID(db StorageInterfaces.DBTX, tableName string, structPtr interface{}, keyField string) error {
+	fieldNames, values, err := structFields(structPtr, keyField)
+	if err != nil {
+		return err
+	}
+
+	key := reflect.ValueOf(structPtr).Elem().FieldByName(keyField)
+	if !key.IsValid() || !key.CanSet() {
+		return fmt.Errorf("struct has no settable field %s", keyField)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
+		tableName,
+		strings.Join(fieldNames, ", "),
+		placeholders(len(fieldNames)),
+	)
+
+	result, err := db.Exec(query, values...)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		key.SetInt(id)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		key.SetUint(uint64(id))
+	default:
+		return fmt.Errorf("key field %s must be an integer", keyField)
+	}
+	return nil
+}
+
+// Update writes every field of the struct to the row identified by keyField
+func Update(db StorageInterfaces.DBTX, tableName string, structPtr interface{}, keyField string) error {
+	fieldNames, values, err := structFields(structPtr, keyField)
+	if err != nil {
+		return err
+	}
+
+	key := reflect.ValueOf(structPtr).Elem().FieldByName(keyField)
+	if !key.IsValid() || !key.CanInterface() {
+		return fmt.Errorf("struct has no exported field %s", keyField)
+	}
+
+	assignments := make([]string, len(fieldNames))
+	for i, name := range fieldNames {
+		assignments[i] = name + " = ?"
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s = ?",
+		tableName,
+		strings.Join(assignments, ", "),
+		keyField,
+	)
+
+	_, err = db.Exec(query, append(values, key.Interface())...)
+	return err
+}
+
+// UpdateFields writes only the named fields of the struct to the row
+// identified by keyField, leaving the other columns as they are in the table
+func UpdateFields(db StorageInterfaces.DBTX, tableName string, structPtr interface{}, keyField string, fields ...string) error {
+	ptr := reflect.ValueOf(structPtr)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("structPtr must be a pointer to a struct")
+	}
+	if len(fields) == 0 {
+		return fmt.Errorf("no fields to update")
+	}
+
+	key := ptr.Elem().FieldByName(keyField)
+	if !key.IsValid() || !key.CanInterface() {
+		return fmt.Errorf("struct has no exported field %s", keyField)
+	}
+
+	assignments := make([]string, len(fields))
+	values := make([]interface{}, len(fields))
+	for i, name := range fields {
+		value := ptr.Elem().FieldByName(name)
+		if !value.IsValid() || !value.CanInterface() || name == keyField {
+			return fmt.Errorf("struct has no exported field %s to update", name)
+		}
+		assignments[i] = name + " = ?"
+		values[i] = value.Interface()
+	}
+
+	query := fmt.Sprintf("UPDATE %s SET %s WHERE %s = ?",
+		tableName,
+		strings.Join(assignments, ", "),
+		keyField,
+	)
+
+	_, err := db.Exec(query, append(values, key.Interface())...)
+	return err
+}
+
+// Delete removes the rows matching the where clause
+func Delete(db StorageInterfaces.DBTX, tableName string, whereClause string, args []interface{}) error {
+	if strings.TrimSpace(whereClause) == "" {
+		return fmt.Errorf("whereClause must not be empty")
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s", tableName, whereClause)
+	_, err := db.Exec(query, args...)
+	return err
+}
+
+// Upsert inserts the struct, or updates every field of the existing row when
+// the insert collides with a primary or unique key
+func Upsert(db StorageInterfaces.DBTX, tableName string, structPtr interface{}) error {
+	fieldNames, values, err := structFields(structPtr, "")
+	if err != nil {
+		return err
+	}
+
+	assignments := make([]string, len(fieldNames))
+	for i, name := range fieldNames {
+		assignments[i] = fmt.Sprintf("%s = VALUES(%s)", name, name)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON DUPLICATE KEY UPDATE %s",
+		tableName,
+		strings.Join(fieldNames, ", "),
+		placeholders(len(fieldNames)),
+		strings.Join(assignments, ", "),
+	)
+
+	_, err = db.Exec(query, values...)
+	return err
+}
+
+// structFields returns the names and values of the exported fields of the
+// struct, leaving out the field named skip
+func structFields(structPtr interface{}, skip string) ([]string, []interface{}, error) {
+	ptr := reflect.ValueOf(structPtr)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Struct {
+		return nil, nil, fmt.Errorf("structPtr must be a pointer to a struct")
+	}
+
 	// Get the type of the struct
-	val := reflect.ValueOf(structPtr).Elem()
+	val := ptr.Elem()
 	typ := val.Type()
 
 	// Prepare a slice to hold the field names and values for the query
 	var fieldNames []string
-	var placeholders []string
 	var values []interface{}
 
 	// Iterate over the struct fields
@@ -23,24 +187,16 @@ func Save(db *sql.DB, tableName string, structPtr interface{}) error {
 		value := val.Field(i)
 
 		// Skip unexported fields
-		if !value.CanInterface() {
+		if !value.CanInterface() || field.Name == skip {
 			continue
 		}
 
-		// Add the field name and a placeholder to the slices
 		fieldNames = append(fieldNames, field.Name)
-		placeholders = append(placeholders, "?")
 		values = append(values, value.Interface())
 	}
+	return fieldNames, values, nil
+}
 
-	// Construct the query string
-	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
-		tableName,
-		strings.Join(fieldNames, ", "),
-		strings.Join(placeholders, ", "),
-	)
-
-	// Execute the query
-	_, err := db.Exec(query, values...)
-	return err
-}
\ No newline at end of file
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
@@ -38,3 +38,157 @@ func TestSave(t *testing.T) {
         t.Errorf("There were unfulfilled expectations: %s", err)
     }
 }
+
+func TestSaveReturningID(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    entity := TestEntity{
+        Name:  "Test Name",
+        Value: "Test Value",
+    }
+
+    mock.ExpectExec("^INSERT INTO test_table \\(Name, Value\\) VALUES \\(\\?, \\?\\)$").
+        WithArgs(entity.Name, entity.Value).
+        WillReturnResult(sqlmock.NewResult(42, 1))
+
+    err = SaveReturningID(db, "test_table", &entity, "ID")
+    if err != nil {
+        t.Errorf("Error in SaveReturningID: %v", err)
+    }
+
+    if entity.ID != 42 {
+        t.Errorf("Expected ID to be 42, got %d", entity.ID)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+func TestUpdate(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    entity := TestEntity{
+        ID:    1,
+        Name:  "New Name",
+        Value: "New Value",
+    }
+
+    mock.ExpectExec("^UPDATE test_table SET Name = \\?, Value = \\? WHERE ID = \\?$").
+        WithArgs(entity.Name, entity.Value, entity.ID).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    err = Update(db, "test_table", &entity, "ID")
+    if err != nil {
+        t.Errorf("Error in Update: %v", err)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+func TestUpdateUnknownKeyField(t *testing.T) {
+    db, _, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    entity := TestEntity{ID: 1}
+    if err := Update(db, "test_table", &entity, "Missing"); err == nil {
+        t.Error("Expected an error for an unknown key field")
+    }
+}
+
+func TestUpdateFields(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    entity := TestEntity{
+        ID:    1,
+        Name:  "New Name",
+        Value: "New Value",
+    }
+
+    mock.ExpectExec("^UPDATE test_table SET Value = \\? WHERE ID = \\?$").
+        WithArgs(entity.Value, entity.ID).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    if err := UpdateFields(db, "test_table", &entity, "ID", "Value"); err != nil {
+        t.Errorf("Error in UpdateFields: %v", err)
+    }
+
+    for _, fields := range [][]string{nil, {"Missing"}, {"ID"}} {
+        if err := UpdateFields(db, "test_table", &entity, "ID", fields...); err == nil {
+            t.Errorf("Expected an error updating fields %v", fields)
+        }
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+func TestDelete(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    mock.ExpectExec("^DELETE FROM test_table WHERE ID = \\?$").
+        WithArgs(1).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+
+    err = Delete(db, "test_table", "ID = ?", []interface{}{1})
+    if err != nil {
+        t.Errorf("Error in Delete: %v", err)
+    }
+
+    if err := Delete(db, "test_table", "", nil); err == nil {
+        t.Error("Expected an error for an empty where clause")
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
+
+func TestUpsert(t *testing.T) {
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatalf("An error '%s' was not expected when opening a stub database connection", err)
+    }
+    defer db.Close()
+
+    entity := TestEntity{
+        ID:    1,
+        Name:  "Test Name",
+        Value: "Test Value",
+    }
+
+    mock.ExpectExec("^INSERT INTO test_table \\(ID, Name, Value\\) VALUES \\(\\?, \\?, \\?\\) ON DUPLICATE KEY UPDATE ID = VALUES\\(ID\\), Name = VALUES\\(Name\\), Value = VALUES\\(Value\\)$").
+        WithArgs(entity.ID, entity.Name, entity.Value).
+        WillReturnResult(sqlmock.NewResult(1, 2))
+
+    err = Upsert(db, "test_table", &entity)
+    if err != nil {
+        t.Errorf("Error in Upsert: %v", err)
+    }
+
+    if err := mock.ExpectationsWereMet(); err != nil {
+        t.Errorf("There were unfulfilled expectations: %s", err)
+    }
+}
@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Device classes of visitors
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceOther   = "other"
+)
+
+// DeviceClass sorts a visitor into desktop, mobile, tablet or other from its
+// user agent, trusting the Sec-CH-UA-Mobile client hint ("?1") when sent
+func DeviceClass(userAgent string, mobileHint string) string {
+	if strings.TrimSpace(mobileHint) == "?1" {
+		return DeviceMobile
+	}
+
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return DeviceOther
+	case strings.Contains(ua, "ipad"), strings.Contains(ua, "tablet"),
+		strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"):
+		return DeviceTablet
+	case strings.Contains(ua, "mobile"), strings.Contains(ua, "iphone"), strings.Contains(ua, "ipod"):
+		return DeviceMobile
+	case strings.Contains(ua, "windows"), strings.Contains(ua, "macintosh"), strings.Contains(ua, "x11"),
+		strings.Contains(ua, "cros"), strings.Contains(ua, "linux"):
+		return DeviceDesktop
+	}
+	return DeviceOther
+}
+
+// ReferrerDomain returns the host a Referer header points to, lower cased
+// and without a port or leading www., or "" when there is none
+func ReferrerDomain(referer string) string {
+	u, err := url.Parse(strings.TrimSpace(referer))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.ToLower(host), "www.")
+	if len(host) > 255 {
+		return ""
+	}
+	return host
+}
+
+// Granularities of time series
+const (
+	Hourly = "hour"
+	Daily  = "day"
+)
+
+// BucketSize returns the length of the buckets of granularity
+func BucketSize(granularity string) (time.Duration, error) {
+	switch granularity {
+	case Hourly:
+		return time.Hour, nil
+	case Daily:
+		return 24 * time.Hour, nil
+	}
+	return 0, fmt.Errorf("granularity must be %s or %s", Hourly, Daily)
+}
+
+// BucketStart returns the start of the bucket of size holding t. Buckets
+// are aligned in UTC, so days start at midnight UTC.
+func BucketStart(t time.Time, size time.Duration) time.Time {
+	return t.UTC().Truncate(size)
+}
+
+// BucketRange widens [from, to) to whole buckets of size and returns the
+// start of each
+func BucketRange(from, to time.Time, size time.Duration) []time.Time {
+	var starts []time.Time
+	for t := BucketStart(from, size); t.Before(to); t = t.Add(size) {
+		starts = append(starts, t)
+	}
+	return starts
+}
@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeviceClass(t *testing.T) {
+	testCases := []struct {
+		userAgent string
+		hint      string
+		expected  string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/120.0 Safari/537.36", "", DeviceDesktop},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_0) AppleWebKit/605.1.15 Safari/605.1.15", "", DeviceDesktop},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) Mobile/15E148 Safari/604.1", "", DeviceMobile},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) Chrome/120.0 Mobile Safari/537.36", "", DeviceMobile},
+		{"Mozilla/5.0 (Linux; Android 13; SM-X700) Chrome/120.0 Safari/537.36", "", DeviceTablet},
+		{"Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) Safari/604.1", "", DeviceTablet},
+		{"Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0", "?1", DeviceMobile},
+		{"curl/8.4.0", "", DeviceOther},
+		{"", "", DeviceOther},
+	}
+
+	for _, tc := range testCases {
+		if got := DeviceClass(tc.userAgent, tc.hint); got != tc.expected {
+			t.Errorf("DeviceClass(%q, %q) = %q; expected %q", tc.userAgent, tc.hint, got, tc.expected)
+		}
+	}
+}
+
+func TestReferrerDomain(t *testing.T) {
+	testCases := []struct {
+		referer  string
+		expected string
+	}{
+		{"https://www.Example.com/some/page?q=1", "example.com"},
+		{"http://news.example.org:8080/", "news.example.org"},
+		{"android-app://com.google.android.gm/", "com.google.android.gm"},
+		{"", ""},
+		{"not a url", ""},
+	}
+
+	for _, tc := range testCases {
+		if got := ReferrerDomain(tc.referer); got != tc.expected {
+			t.Errorf("ReferrerDomain(%q) = %q; expected %q", tc.referer, got, tc.expected)
+		}
+	}
+}
+
+func TestBucketRange(t *testing.T) {
+	from := time.Date(2026, 10, 18, 22, 30, 0, 0, time.UTC)
+	to := time.Date(2026, 10, 19, 1, 0, 0, 0, time.UTC)
+
+	hours := BucketRange(from, to, time.Hour)
+	if len(hours) != 3 || !hours[0].Equal(time.Date(2026, 10, 18, 22, 0, 0, 0, time.UTC)) || !hours[2].Equal(time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the hours from 22:00 to 00:00, got %v", hours)
+	}
+
+	// Days start at midnight UTC whatever the zone of the times
+	zone := time.FixedZone("UTC+2", 2*60*60)
+	days := BucketRange(from.In(zone), to.In(zone), 24*time.Hour)
+	if len(days) != 2 || !days[0].Equal(time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)) || days[0].Location() != time.UTC {
+		t.Errorf("expected two UTC days, got %v", days)
+	}
+
+	if _, err := BucketSize("week"); err == nil {
+		t.Errorf("expected an error for an unknown granularity")
+	}
+}
@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// blocklistCanonicalizer brings urls and blocklist entries to the form they
+// are compared in, so that an uppercase or internationalized host, a default
+// port, escaped characters or dot segments cannot slip a url past an entry
+var blocklistCanonicalizer = &Canonicalizer{
+	LowercaseHost:            true,
+	IDNToASCII:               true,
+	RemoveDefaultPort:        true,
+	NormalizePercentEncoding: true,
+	RemoveDotSegments:        true,
+	RemoveTrailingSlash:      true,
+	RemoveFragment:           true,
+}
+
+// Blocklist holds the hosts and urls that may not be shortened. An entry
+// without a scheme, such as "evil.example", blocks that host and its
+// subdomains. An entry with one, such as "https://example.com/phish", blocks
+// that url and everything below it, whatever the scheme of the url.
+type Blocklist struct {
+	hosts    []string // in punycode
+	prefixes []string // canonical urls without their scheme
+}
+
+// NewBlocklist returns a Blocklist of entries
+func NewBlocklist(entries []string) (*Blocklist, error) {
+	b := &Blocklist{}
+	for _, entry := range entries {
+		if !strings.Contains(entry, "://") {
+			host, err := ToASCIIHost(strings.TrimSuffix(entry, "."))
+			if err != nil || host == "" {
+				return nil, fmt.Errorf("invalid blocklist host %q", entry)
+			}
+			b.hosts = append(b.hosts, host)
+			continue
+		}
+		canonical, err := blocklistCanonicalizer.Canonicalize(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid blocklist url %q: %v", entry, err)
+		}
+		b.prefixes = append(b.prefixes, withoutScheme(canonical))
+	}
+	return b, nil
+}
+
+// Blocked reports whether urlStr is on the blocklist. A nil Blocklist blocks
+// nothing, and neither does any blocklist block urls that cannot be parsed.
+func (b *Blocklist) Blocked(urlStr string) bool {
+	if b == nil {
+		return false
+	}
+	canonical, err := blocklistCanonicalizer.Canonicalize(urlStr)
+	if err != nil {
+		return false
+	}
+	u, err := url.Parse(canonical)
+	if err != nil {
+		return false
+	}
+
+	host := strings.TrimSuffix(u.Hostname(), ".")
+	for _, blocked := range b.hosts {
+		if host == blocked || strings.HasSuffix(host, "."+blocked) {
+			return true
+		}
+	}
+	rest := withoutScheme(canonical)
+	for _, prefix := range b.prefixes {
+		// Only whole path segments match, so /phish does not block /phishing
+		if tail, ok := strings.CutPrefix(rest, prefix); ok &&
+			(tail == "" || strings.HasSuffix(prefix, "/") || strings.ContainsAny(tail[:1], "/?")) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutScheme returns a canonical url without its scheme and the // that
+// follows it
+func withoutScheme(canonical string) string {
+	if _, rest, ok := strings.Cut(canonical, "://"); ok {
+		return rest
+	}
+	return canonical
+}
@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestBlocklist(t *testing.T) {
+	blocklist, err := NewBlocklist([]string{"evil.example", "bücher.example", "https://example.com/phish", "http://Tracker.example:80/"})
+	if err != nil {
+		t.Fatalf("Error creating blocklist: %v", err)
+	}
+
+	testCases := []struct {
+		urlStr  string
+		blocked bool
+	}{
+		{"https://evil.example/", true},
+		{"https://EVIL.example./login", true},
+		{"https://www.evil.example/", true},
+		{"https://notevil.example/", false},
+		{"https://evil.example.org/", false},
+
+		// Internationalized hosts match in either spelling
+		{"https://xn--bcher-kva.example/", true},
+		{"https://BÜCHER.example/", true},
+
+		{"https://example.com/phish", true},
+		{"http://example.com:80/phish/", true},
+		{"https://example.com/phish/page?x=1", true},
+		{"https://example.com/phish?x=1", true},
+		{"https://example.com/%70hish", true},
+		{"https://example.com/safe/../phish", true},
+		{"https://example.com/phish#top", true},
+		{"https://example.com/phishing", false},
+		{"https://example.com/", false},
+		{"https://example.com:8443/phish", false},
+
+		// A root url blocks everything on its host, but not its subdomains
+		{"https://tracker.example/a/b", true},
+		{"https://tracker.example", true},
+		{"https://cdn.tracker.example/", false},
+	}
+
+	for _, tc := range testCases {
+		if blocked := blocklist.Blocked(tc.urlStr); blocked != tc.blocked {
+			t.Errorf("Blocked(%q) = %t, want %t", tc.urlStr, blocked, tc.blocked)
+		}
+	}
+}
+
+func TestNilBlocklist(t *testing.T) {
+	var blocklist *Blocklist
+	if blocklist.Blocked("https://evil.example/") {
+		t.Errorf("A nil blocklist should block nothing")
+	}
+}
+
+func TestNewBlocklistRejectsInvalidEntries(t *testing.T) {
+	for _, entry := range []string{"", "https://exa mple.com/"} {
+		if _, err := NewBlocklist([]string{entry}); err == nil {
+			t.Errorf("NewBlocklist(%q) should fail", entry)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// BotSignatures recognises bots by their user agent. Each signature is a
+// piece of text, matched regardless of case, that the user agents of a bot
+// contain.
+type BotSignatures struct {
+	signatures []string // lower case, in the order they are tried
+}
+
+// defaultBotSignatures are used when no list is configured. Link previews of
+// chat apps and social networks come first, as they make most of the hits on
+// short links, then search engines, scanners and HTTP libraries.
+var defaultBotSignatures = []string{
+	"slackbot", "slack-imgproxy", "twitterbot", "facebookexternalhit", "facebookcatalog", "linkedinbot",
+	"discordbot", "telegrambot", "whatsapp", "skypeuripreview", "mattermost", "redditbot", "pinterest",
+	"embedly", "iframely", "vkshare", "snapchat", "bitlybot", "google-pagerenderer", "bingpreview",
+	"googlebot", "bingbot", "applebot", "duckduckbot", "yandex", "baiduspider", "petalbot",
+	"ahrefsbot", "semrushbot", "mj12bot", "dotbot", "ia_archiver",
+	"urlscan", "virustotal", "safebrowsing", "barracuda", "proofpoint", "mimecast", "uptimerobot",
+	"headlesschrome", "phantomjs", "curl/", "wget/", "python-requests", "python-urllib", "aiohttp",
+	"go-http-client", "okhttp", "java/", "apache-httpclient", "libwww-perl", "node-fetch", "axios/",
+	"crawler", "spider", "+http",
+}
+
+// DefaultBotSignatures returns the built-in list of signatures
+func DefaultBotSignatures() *BotSignatures {
+	return &BotSignatures{signatures: defaultBotSignatures}
+}
+
+// LoadBotSignatures reads a file of signatures, see ParseBotSignatures for
+// the format
+func LoadBotSignatures(path string) (*BotSignatures, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseBotSignatures(f)
+}
+
+// ParseBotSignatures reads one signature per line. Empty lines and lines
+// starting with # are skipped.
+func ParseBotSignatures(r io.Reader) (*BotSignatures, error) {
+	bots := &BotSignatures{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		bots.signatures = append(bots.signatures, line)
+	}
+	return bots, scanner.Err()
+}
+
+// Match returns the first signature found in userAgent, "" when none is
+func (b *BotSignatures) Match(userAgent string) string {
+	if b == nil {
+		return ""
+	}
+	userAgent = strings.ToLower(userAgent)
+	for _, signature := range b.signatures {
+		if strings.Contains(userAgent, signature) {
+			return signature
+		}
+	}
+	return ""
+}
+
+// Len returns the number of signatures
+func (b *BotSignatures) Len() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.signatures)
+}
+
+// socialCrawlerSignatures are the user agents of the crawlers of chat apps
+// and social networks, which build the preview card of a link posted there
+var socialCrawlerSignatures = []string{
+	"slackbot", "twitterbot", "facebookexternalhit", "facebookcatalog", "linkedinbot", "discordbot",
+	"telegrambot", "whatsapp", "skypeuripreview", "mattermost", "redditbot", "pinterest", "embedly",
+	"iframely", "vkshare", "snapchat", "applebot", "google-pagerenderer", "bingpreview",
+}
+
+// IsSocialCrawler reports whether userAgent is that of a crawler building a
+// link preview for a chat app or social network
+func IsSocialCrawler(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, signature := range socialCrawlerSignatures {
+		if strings.Contains(userAgent, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPrefetch reports whether a request was made by a browser loading a page
+// ahead of time, in case it is visited, rather than by someone visiting it
+func IsPrefetch(header http.Header) bool {
+	for _, name := range []string{"Sec-Purpose", "Purpose", "X-Purpose", "X-Moz"} {
+		value := strings.ToLower(header.Get(name))
+		if strings.Contains(value, "prefetch") || strings.Contains(value, "prerender") || strings.Contains(value, "preview") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBotSignatures_Match(t *testing.T) {
+	bots := DefaultBotSignatures()
+	testCases := []struct {
+		userAgent string
+		expected  string
+	}{
+		{"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", "slackbot"},
+		{"Twitterbot/1.0", "twitterbot"},
+		{"facebookexternalhit/1.1 (+http://www.facebook.com/externalhit_uatext.php)", "facebookexternalhit"},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "googlebot"},
+		{"curl/8.4.0", "curl/"},
+		{"Mozilla/5.0 (compatible; SomeNewCrawler/0.1)", "crawler"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36", ""},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148 Safari/604.1", ""},
+	}
+
+	for _, tc := range testCases {
+		if got := bots.Match(tc.userAgent); got != tc.expected {
+			t.Errorf("Match(%q) = %q; expected %q", tc.userAgent, got, tc.expected)
+		}
+	}
+
+	var none *BotSignatures
+	if got := none.Match("curl/8.4.0"); got != "" || none.Len() != 0 {
+		t.Errorf("expected no signatures to match nothing, got %q", got)
+	}
+}
+
+func TestParseBotSignatures(t *testing.T) {
+	bots, err := ParseBotSignatures(strings.NewReader("# link previews\nSlackbot\n\n  MyScanner/  \n"))
+	if err != nil {
+		t.Fatalf("Error parsing signatures: %v", err)
+	}
+	if bots.Len() != 2 {
+		t.Errorf("expected 2 signatures, got %d", bots.Len())
+	}
+	if got := bots.Match("myscanner/2.0"); got != "myscanner/" {
+		t.Errorf("expected the signature in lower case, got %q", got)
+	}
+	// The list replaces the built-in one
+	if got := bots.Match("curl/8.4.0"); got != "" {
+		t.Errorf("expected curl not to match, got %q", got)
+	}
+}
+
+func TestIsSocialCrawler(t *testing.T) {
+	for _, userAgent := range []string{"Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", "facebookexternalhit/1.1", "WhatsApp/2.23.20.0"} {
+		if !IsSocialCrawler(userAgent) {
+			t.Errorf("expected %q to be a social crawler", userAgent)
+		}
+	}
+	for _, userAgent := range []string{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "curl/8.4.0", "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0"} {
+		if IsSocialCrawler(userAgent) {
+			t.Errorf("expected %q not to be a social crawler", userAgent)
+		}
+	}
+}
+
+func TestIsPrefetch(t *testing.T) {
+	testCases := []struct {
+		name, value string
+		expected    bool
+	}{
+		{"Sec-Purpose", "prefetch", true},
+		{"Sec-Purpose", "prefetch;prerender", true},
+		{"Purpose", "prefetch", true},
+		{"X-Moz", "prefetch", true},
+		{"X-Purpose", "preview", true},
+		{"Sec-Fetch-Mode", "navigate", false},
+	}
+
+	for _, tc := range testCases {
+		header := http.Header{}
+		header.Set(tc.name, tc.value)
+		if got := IsPrefetch(header); got != tc.expected {
+			t.Errorf("IsPrefetch(%s: %s) = %v; expected %v", tc.name, tc.value, got, tc.expected)
+		}
+	}
+}
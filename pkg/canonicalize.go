@@ -0,0 +1,277 @@
+package pkg
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Canonicalizer rewrites urls to a canonical form so that urls which point to
+// the same place compare equal. Every rule can be turned on or off on its own.
+type Canonicalizer struct {
+	LowercaseHost            bool     // lowercase the scheme and host
+	IDNToASCII               bool     // encode internationalized host names as punycode
+	IDNToUnicode             bool     // decode punycode host names, ignored when IDNToASCII is set
+	RemoveDefaultPort        bool     // drop :80 from http and :443 from https urls
+	NormalizePercentEncoding bool     // uppercase escapes and decode escaped unreserved characters
+	RemoveDotSegments        bool     // resolve "." and ".." path segments
+	RemoveTrailingSlash      bool     // drop trailing slashes, but always keep the root path /
+	RemoveFragment           bool     // drop everything after #
+	SortQuery                bool     // order query parameters by name
+	StripParams              []string // query parameters to drop, a trailing * matches any suffix
+}
+
+// NewCanonicalizer returns a Canonicalizer with every rule that keeps the
+// destination the same enabled, which is what repeated urls are matched on
+func NewCanonicalizer(stripParams []string) *Canonicalizer {
+	return &Canonicalizer{
+		LowercaseHost:            true,
+		IDNToASCII:               true,
+		RemoveDefaultPort:        true,
+		NormalizePercentEncoding: true,
+		RemoveDotSegments:        true,
+		RemoveTrailingSlash:      true,
+		RemoveFragment:           true,
+		SortQuery:                true,
+		StripParams:              stripParams,
+	}
+}
+
+// displayCanonicalizer tidies a url for showing it to people without
+// changing anything they might care about
+var displayCanonicalizer = &Canonicalizer{
+	LowercaseHost:            true,
+	IDNToUnicode:             true,
+	RemoveDefaultPort:        true,
+	NormalizePercentEncoding: true,
+	RemoveDotSegments:        true,
+}
+
+// asciiCanonicalizer tidies a url like displayCanonicalizer but keeps its
+// host in punycode, the form that cannot pass for another host
+var asciiCanonicalizer = &Canonicalizer{
+	LowercaseHost:            true,
+	IDNToASCII:               true,
+	RemoveDefaultPort:        true,
+	NormalizePercentEncoding: true,
+	RemoveDotSegments:        true,
+}
+
+// ASCIIURL returns urlStr as it should be shown where lookalike hosts must be
+// told apart, with internationalized host names encoded as punycode.
+// Unparseable urls are returned as is.
+func ASCIIURL(urlStr string) string {
+	ascii, err := asciiCanonicalizer.Canonicalize(urlStr)
+	if err != nil {
+		return urlStr
+	}
+	return ascii
+}
+
+// DisplayURL returns urlStr as it should be shown to people, with
+// internationalized host names decoded. Unparseable urls are returned as is.
+func DisplayURL(urlStr string) string {
+	display, err := displayCanonicalizer.Canonicalize(urlStr)
+	if err != nil {
+		return urlStr
+	}
+	return display
+}
+
+// Canonicalize applies the enabled rules to urlStr
+func (c *Canonicalizer) Canonicalize(urlStr string) (string, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return "", err
+	}
+
+	scheme := u.Scheme
+	if c.LowercaseHost {
+		scheme = strings.ToLower(scheme)
+	}
+	if u.Opaque != "" {
+		// e.g. mailto:someone@example.com has no host or path to work on
+		return scheme + ":" + u.Opaque, nil
+	}
+
+	host, err := c.canonicalHost(scheme, u)
+	if err != nil {
+		return "", err
+	}
+
+	path := u.EscapedPath()
+	if c.NormalizePercentEncoding {
+		path = normalizeEscapes(path)
+	}
+	if c.RemoveDotSegments {
+		path = removeDotSegments(path)
+	}
+	if c.RemoveTrailingSlash {
+		path = strings.TrimRight(path, "/")
+		if path == "" && host != "" {
+			path = "/"
+		}
+	}
+
+	var b strings.Builder
+	if scheme != "" {
+		b.WriteString(scheme + ":")
+	}
+	if host != "" || u.User != nil || scheme != "" {
+		b.WriteString("//")
+		if u.User != nil {
+			b.WriteString(u.User.String() + "@")
+		}
+		b.WriteString(host)
+	}
+	b.WriteString(path)
+	if query := c.canonicalQuery(u.RawQuery); query != "" {
+		b.WriteString("?" + query)
+	}
+	if !c.RemoveFragment && u.Fragment != "" {
+		fragment := u.EscapedFragment()
+		if c.NormalizePercentEncoding {
+			fragment = normalizeEscapes(fragment)
+		}
+		b.WriteString("#" + fragment)
+	}
+	return b.String(), nil
+}
+
+func (c *Canonicalizer) canonicalHost(scheme string, u *url.URL) (string, error) {
+	host, port := u.Hostname(), u.Port()
+	if c.LowercaseHost {
+		host = strings.ToLower(host)
+	}
+	if c.IDNToASCII {
+		ascii, err := ToASCIIHost(host)
+		if err != nil {
+			return "", err
+		}
+		host = ascii
+	} else if c.IDNToUnicode {
+		host = ToUnicodeHost(host)
+	}
+
+	if c.RemoveDefaultPort && ((scheme == "http" && port == "80") || (scheme == "https" && port == "443")) {
+		port = ""
+	}
+	if port != "" {
+		return net.JoinHostPort(host, port), nil
+	} else if strings.Contains(host, ":") {
+		return "[" + host + "]", nil // IPv6 literal
+	}
+	return host, nil
+}
+
+// canonicalQuery strips and sorts the query parameters without re-encoding
+// them, so "a=b+c" and "a=b%20c" keep their original spelling
+func (c *Canonicalizer) canonicalQuery(rawQuery string) string {
+	type param struct {
+		name string
+		raw  string
+	}
+
+	var params []param
+	for _, raw := range strings.Split(rawQuery, "&") {
+		if raw == "" {
+			continue
+		}
+		if c.NormalizePercentEncoding {
+			raw = normalizeEscapes(raw)
+		}
+		name, _, _ := strings.Cut(raw, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if MatchesParam(name, c.StripParams) {
+			continue
+		}
+		params = append(params, param{name: name, raw: raw})
+	}
+
+	if c.SortQuery {
+		// Stable, so repeated parameters keep their relative order
+		sort.SliceStable(params, func(i, j int) bool { return params[i].name < params[j].name })
+	}
+
+	raws := make([]string, len(params))
+	for i, p := range params {
+		raws[i] = p.raw
+	}
+	return strings.Join(raws, "&")
+}
+
+// normalizeEscapes uppercases the hex digits of percent escapes and decodes
+// the escapes of unreserved characters, which never need escaping
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			c := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if isUnreserved(c) {
+				b.WriteByte(c)
+			} else {
+				b.WriteString("%" + strings.ToUpper(s[i+1:i+3]))
+			}
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// removeDotSegments resolves "." and ".." segments as described in RFC 3986
+// section 5.2.4. Going above the root is not possible.
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, segment)
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+func isUnreserved(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	}
+	return c - 'A' + 10
+}
@@ -0,0 +1,48 @@
+package pkg
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	// A Monday
+	from := time.Date(2026, 10, 19, 12, 34, 56, 0, time.UTC)
+	testCases := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2026, 10, 19, 12, 35, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, 10, 19, 12, 45, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2026, 10, 20, 3, 0, 0, 0, time.UTC)},
+		{"30 9-17/4 * * 1-5", time.Date(2026, 10, 19, 13, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		// Either the day of month or the day of week
+		{"0 0 31 * 3", time.Date(2026, 10, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 10, 19, 13, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)},
+		{"@every 90m", time.Date(2026, 10, 19, 14, 4, 56, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	}
+
+	for _, tc := range testCases {
+		cron, err := ParseCron(tc.spec)
+		if err != nil {
+			t.Errorf("ParseCron(%q) returned error %v", tc.spec, err)
+			continue
+		}
+		if next := cron.Next(from); !next.Equal(tc.expected) {
+			t.Errorf("ParseCron(%q).Next = %v; expected %v", tc.spec, next, tc.expected)
+		}
+	}
+}
+
+func TestParseCron_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *", "@every", "@every 10ms", "@often"} {
+		if _, err := ParseCron(spec); err == nil {
+			t.Errorf("ParseCron(%q) accepted an invalid schedule", spec)
+		}
+	}
+}
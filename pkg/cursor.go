@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// cursor is the content of a pagination token: the order a listing is in and
+// the values of its order columns in the last row handed out
+type cursor struct {
+	Sort   string        `json:"s"`
+	Values []interface{} `json:"v"`
+}
+
+// EncodeCursor makes an opaque pagination token resuming a listing sorted by
+// sort after the row holding values. Values must be strings or numbers.
+func EncodeCursor(sort string, values []interface{}) (string, error) {
+	data, err := json.Marshal(cursor{Sort: sort, Values: values})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeCursor returns the sort and values of a token made by EncodeCursor.
+// Whole numbers come back as int64 and other numbers as float64.
+func DecodeCursor(token string) (string, []interface{}, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed cursor: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var c cursor
+	if err := decoder.Decode(&c); err != nil {
+		return "", nil, fmt.Errorf("malformed cursor: %w", err)
+	}
+	if len(c.Values) == 0 {
+		return "", nil, fmt.Errorf("cursor holds no values")
+	}
+
+	for i, value := range c.Values {
+		switch v := value.(type) {
+		case string:
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				c.Values[i] = n
+			} else if f, err := v.Float64(); err == nil {
+				c.Values[i] = f
+			} else {
+				return "", nil, fmt.Errorf("malformed number %s in cursor", v)
+			}
+		default:
+			return "", nil, fmt.Errorf("unsupported value %v in cursor", value)
+		}
+	}
+	return c.Sort, c.Values, nil
+}
@@ -0,0 +1,41 @@
+package pkg
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	token, err := EncodeCursor("code", []interface{}{"abc12", 42, 1.5})
+	if err != nil {
+		t.Fatalf("EncodeCursor: %v", err)
+	}
+
+	sort, values, err := DecodeCursor(token)
+	if err != nil {
+		t.Fatalf("DecodeCursor(%s): %v", token, err)
+	}
+	if sort != "code" {
+		t.Errorf("Expected sort code, got %s", sort)
+	}
+	if expected := []interface{}{"abc12", int64(42), 1.5}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("DecodeCursor values = %#v, expected %#v", values, expected)
+	}
+}
+
+func TestDecodeCursorErrors(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	for _, token := range []string{
+		"not base64!",
+		encode("not json"),
+		encode(`{"s":"newest","v":[]}`),
+		encode(`{"s":"newest","v":[true]}`),
+		encode(`{"s":"newest","v":[[1]]}`),
+		encode(`{"s":"newest","v":[1e999]}`),
+	} {
+		if _, _, err := DecodeCursor(token); err == nil {
+			t.Errorf("Expected an error decoding %s", token)
+		}
+	}
+}
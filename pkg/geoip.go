@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// GeoIP maps IP addresses to ISO country codes using a local database
+type GeoIP struct {
+	ranges []ipRange // sorted by start, not overlapping
+}
+
+type ipRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// LoadGeoIP reads a GeoIP database file, see ParseGeoIP for the format
+func LoadGeoIP(path string) (*GeoIP, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseGeoIP(f)
+}
+
+// ParseGeoIP reads a CSV database with one network per line, either as
+// "first_ip,last_ip,country" or as "cidr,country". Empty lines and lines
+// starting with # are skipped, as is a header line.
+func ParseGeoIP(r io.Reader) (*GeoIP, error) {
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.FieldsPerRecord = -1
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	geo := &GeoIP{}
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		rng, err := parseRange(record)
+		if err != nil && n == 1 {
+			continue // header
+		} else if err != nil {
+			return nil, fmt.Errorf("record %d: %w", n, err)
+		}
+		geo.ranges = append(geo.ranges, rng)
+	}
+
+	sort.Slice(geo.ranges, func(i, j int) bool {
+		return geo.ranges[i].start.Less(geo.ranges[j].start)
+	})
+	for i := 1; i < len(geo.ranges); i++ {
+		if !geo.ranges[i-1].end.Less(geo.ranges[i].start) {
+			return nil, fmt.Errorf("overlapping ranges %s and %s", geo.ranges[i-1].start, geo.ranges[i].start)
+		}
+	}
+	return geo, nil
+}
+
+// Country returns the country code of ip, or "" when it is not in the
+// database or cannot be parsed. A nil GeoIP knows no countries.
+func (g *GeoIP) Country(ip string) string {
+	if g == nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	// The last range starting at or before addr is the only one that can hold it
+	i := sort.Search(len(g.ranges), func(i int) bool {
+		return addr.Less(g.ranges[i].start)
+	}) - 1
+	if i < 0 || g.ranges[i].end.Less(addr) || g.ranges[i].start.Is4() != addr.Is4() {
+		return ""
+	}
+	return g.ranges[i].country
+}
+
+func parseRange(record []string) (ipRange, error) {
+	var rng ipRange
+	var err error
+	switch len(record) {
+	case 2:
+		var prefix netip.Prefix
+		if prefix, err = netip.ParsePrefix(strings.TrimSpace(record[0])); err != nil {
+			return rng, err
+		}
+		prefix = prefix.Masked()
+		rng.start, rng.end = prefix.Addr(), lastAddr(prefix)
+	case 3:
+		if rng.start, err = netip.ParseAddr(strings.TrimSpace(record[0])); err != nil {
+			return rng, err
+		}
+		if rng.end, err = netip.ParseAddr(strings.TrimSpace(record[1])); err != nil {
+			return rng, err
+		}
+	default:
+		return rng, fmt.Errorf("expected 2 or 3 fields, got %d", len(record))
+	}
+
+	rng.start, rng.end = rng.start.Unmap(), rng.end.Unmap()
+	if rng.start.Is4() != rng.end.Is4() || rng.end.Less(rng.start) {
+		return rng, fmt.Errorf("invalid range %s-%s", rng.start, rng.end)
+	}
+	rng.country = strings.ToUpper(strings.TrimSpace(record[len(record)-1]))
+	return rng, nil
+}
+
+// lastAddr returns the highest address in prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 1 << (7 - bit%8)
+	}
+	addr, _ := netip.AddrFromSlice(bytes)
+	return addr
+}
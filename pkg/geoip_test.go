@@ -0,0 +1,79 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testGeoIP = `first,last,country
+# ranges
+1.0.0.0,1.0.0.255,au
+2.16.0.0/13,DE
+192.168.1.0,192.168.1.9,NL
+2001:db8::/32,US
+`
+
+func TestGeoIPCountry(t *testing.T) {
+	geo, err := ParseGeoIP(strings.NewReader(testGeoIP))
+	if err != nil {
+		t.Fatalf("ParseGeoIP returned %v", err)
+	}
+
+	testCases := []struct {
+		ip      string
+		country string
+	}{
+		{"1.0.0.0", "AU"},
+		{"1.0.0.255", "AU"},
+		{"1.0.1.0", ""},
+		{"2.23.255.255", "DE"},
+		{"2.24.0.0", ""},
+		{"192.168.1.5", "NL"},
+		{"::ffff:192.168.1.5", "NL"},
+		{"192.168.1.10", ""},
+		{"0.0.0.1", ""},
+		{"2001:db8:1::1", "US"},
+		{"2001:db9::1", ""},
+		{"not an ip", ""},
+	}
+	for _, tc := range testCases {
+		if country := geo.Country(tc.ip); country != tc.country {
+			t.Errorf("Country(%s) = %q, expected %q", tc.ip, country, tc.country)
+		}
+	}
+
+	var none *GeoIP
+	if country := none.Country("1.0.0.1"); country != "" {
+		t.Errorf("Expected a nil GeoIP to know no countries, got %q", country)
+	}
+}
+
+func TestParseGeoIPErrors(t *testing.T) {
+	testCases := []string{
+		"1.0.0.0,1.0.0.255,AU\nbad,range,NL\n",
+		"1.0.0.0,1.0.0.255,AU\n1.0.0.9,1.0.0.0,NL\n",
+		"1.0.0.0,1.0.0.255,AU\n1.0.0.128/25,NL\n",
+		"1.0.0.0,1.0.0.255,AU\n1.0.0.0,2001:db8::,NL\n",
+	}
+	for _, database := range testCases {
+		if _, err := ParseGeoIP(strings.NewReader(database)); err == nil {
+			t.Errorf("Expected an error for %q", database)
+		}
+	}
+}
+
+func TestLoadGeoIP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geoip.csv")
+	if err := os.WriteFile(path, []byte(testGeoIP), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	geo, err := LoadGeoIP(path)
+	if err != nil || geo.Country("1.0.0.1") != "AU" {
+		t.Errorf("LoadGeoIP did not load the database: %v", err)
+	}
+	if _, err := LoadGeoIP(filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Errorf("Expected an error for a missing file")
+	}
+}
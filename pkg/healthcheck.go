@@ -0,0 +1,203 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// HealthResult is what a check of a destination found
+type HealthResult struct {
+	URL       string
+	Status    int // status of the final response, 0 when there was none
+	Latency   time.Duration
+	Redirects []string // the addresses redirected to, in order
+	Err       error    // why there was no response
+}
+
+// Broken tells whether the destination is dead. Pages that want a login or
+// are rate limiting the checker are alive, only not to the checker.
+func (r HealthResult) Broken() bool {
+	if r.Err != nil {
+		return true
+	}
+	switch r.Status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return false
+	}
+	return r.Status >= 400
+}
+
+// HealthChecker checks whether destinations still answer. At most
+// Concurrency requests run at once, and requests to the same host are made
+// one at a time, HostDelay apart, so a host with many links is not hammered.
+// Destinations are given by users, so by default Client only connects to
+// public addresses: the results would otherwise map the internal network.
+type HealthChecker struct {
+	Client       *http.Client
+	Timeout      time.Duration // for each request
+	Concurrency  int
+	HostDelay    time.Duration
+	MaxRedirects int
+	UserAgent    string
+
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// hostQueue holds the destinations of one host, checked one after the
+// other, and when the host may be sent the next request
+type hostQueue struct {
+	destinations []int // indexes in the urls of the run
+	next         time.Time
+}
+
+func NewHealthChecker(timeout time.Duration, concurrency int, hostDelay time.Duration) *HealthChecker {
+	return &HealthChecker{
+		Client:       NewPublicClient(),
+		Timeout:      timeout,
+		Concurrency:  concurrency,
+		HostDelay:    hostDelay,
+		MaxRedirects: 10,
+		UserAgent:    "url-shortener-health-check/1.0",
+		now:          time.Now,
+		sleep:        sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CheckAll checks every destination in urls, and returns the results in the
+// same order. The destinations are queued by host; a request only takes one
+// of the Concurrency slots once its host may be sent it, so waiting out the
+// delay of one host never holds up the others.
+func (c *HealthChecker) CheckAll(ctx context.Context, urls []string) []HealthResult {
+	results := make([]HealthResult, len(urls))
+	concurrency := c.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+
+	// The queues only live as long as the run
+	queues := make(map[string]*hostQueue)
+	var order []*hostQueue
+	for i, destination := range urls {
+		host := ""
+		if parsed, err := url.Parse(destination); err == nil {
+			host = parsed.Host
+		}
+		queue, ok := queues[host]
+		if !ok {
+			queue = &hostQueue{}
+			queues[host] = queue
+			order = append(order, queue)
+		}
+		queue.destinations = append(queue.destinations, i)
+	}
+
+	var wg sync.WaitGroup
+	for _, queue := range order {
+		wg.Add(1)
+		go func(queue *hostQueue) {
+			defer wg.Done()
+			for _, i := range queue.destinations {
+				results[i] = c.check(ctx, urls[i], queue, slots)
+			}
+		}(queue)
+	}
+	wg.Wait()
+	return results
+}
+
+// Check checks the destination at target with a HEAD request, and with a GET
+// request when that fails, as some servers do not answer HEAD properly
+func (c *HealthChecker) Check(ctx context.Context, target string) HealthResult {
+	return c.check(ctx, target, &hostQueue{}, make(chan struct{}, 1))
+}
+
+func (c *HealthChecker) check(ctx context.Context, target string, queue *hostQueue, slots chan struct{}) HealthResult {
+	result := c.request(ctx, http.MethodHead, target, queue, slots)
+	if result.Err == nil && result.Status < 400 {
+		return result
+	}
+	if ctx.Err() != nil {
+		return result
+	}
+	return c.request(ctx, http.MethodGet, target, queue, slots)
+}
+
+// request sends a request to target once its host may be sent one and a
+// slot is free
+func (c *HealthChecker) request(ctx context.Context, method, target string, queue *hostQueue, slots chan struct{}) HealthResult {
+	result := HealthResult{URL: target}
+	if _, err := url.Parse(target); err != nil {
+		result.Err = err
+		return result
+	}
+
+	if wait := queue.next.Sub(c.now()); wait > 0 {
+		if err := c.sleep(ctx, wait); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+	select {
+	case slots <- struct{}{}:
+	case <-ctx.Done():
+		result.Err = ctx.Err()
+		return result
+	}
+	defer func() { <-slots }()
+	defer func() { queue.next = c.now().Add(c.HostDelay) }()
+
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	// The client is copied to follow redirects for this request only
+	client := *c.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) > c.MaxRedirects {
+			return errTooManyRedirects
+		}
+		result.Redirects = append(result.Redirects, req.URL.String())
+		return nil
+	}
+
+	start := c.now()
+	resp, err := client.Do(req)
+	result.Latency = c.now().Sub(start)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+	// Reading a little of the body lets the connection be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	result.Status = resp.StatusCode
+	return result
+}
+
+var errTooManyRedirects = errors.New("too many redirects")
@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckerCheck(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.WriteHeader(http.StatusNoContent)
+		case "/no-head":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Write([]byte("hello"))
+		case "/moved":
+			http.Redirect(w, r, "/moved-again", http.StatusMovedPermanently)
+		case "/moved-again":
+			http.Redirect(w, r, "/ok", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/login":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	checker := NewHealthChecker(100*time.Millisecond, 2, 0)
+	checker.Client = server.Client()
+	testCases := []struct {
+		path      string
+		status    int
+		redirects int
+		broken    bool
+	}{
+		{"/ok", http.StatusNoContent, 0, false},
+		{"/no-head", http.StatusOK, 0, false},
+		{"/moved", http.StatusNoContent, 2, false},
+		{"/loop", 0, 10, true},
+		{"/login", http.StatusUnauthorized, 0, false},
+		{"/gone", http.StatusNotFound, 0, true},
+		{"/slow", 0, 0, true},
+	}
+
+	for _, tc := range testCases {
+		result := checker.Check(context.Background(), server.URL+tc.path)
+		if result.Status != tc.status || len(result.Redirects) != tc.redirects || result.Broken() != tc.broken {
+			t.Errorf("Check(%s) = status %d, redirects %v, broken %v, error %v; expected status %d, %d redirects, broken %v",
+				tc.path, result.Status, result.Redirects, result.Broken(), result.Err, tc.status, tc.redirects, tc.broken)
+		}
+	}
+
+	result := checker.Check(context.Background(), server.URL+"/moved")
+	expected := []string{server.URL + "/moved-again", server.URL + "/ok"}
+	if len(result.Redirects) != 2 || result.Redirects[0] != expected[0] || result.Redirects[1] != expected[1] {
+		t.Errorf("Check(/moved) redirects = %v; expected %v", result.Redirects, expected)
+	}
+}
+
+// inFlight counts the requests a server is answering at once
+type inFlight struct {
+	mu      sync.Mutex
+	current int
+	max     int
+	starts  []time.Time
+}
+
+func (f *inFlight) handler(delay time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.current++
+		if f.current > f.max {
+			f.max = f.current
+		}
+		f.starts = append(f.starts, time.Now())
+		f.mu.Unlock()
+
+		time.Sleep(delay)
+
+		f.mu.Lock()
+		f.current--
+		f.mu.Unlock()
+	})
+}
+
+func TestHealthCheckerCheckAll_BoundsConcurrency(t *testing.T) {
+	counter := &inFlight{}
+	var urls []string
+	for i := 0; i < 6; i++ {
+		// Every server is a host of its own, so only the concurrency limit
+		// keeps the checks apart
+		server := httptest.NewServer(counter.handler(20 * time.Millisecond))
+		defer server.Close()
+		urls = append(urls, server.URL+"/")
+	}
+
+	checker := NewHealthChecker(time.Second, 2, 0)
+	checker.Client = &http.Client{}
+	results := checker.CheckAll(context.Background(), urls)
+
+	for i, result := range results {
+		if result.URL != urls[i] || result.Status != http.StatusOK {
+			t.Errorf("result %d = %+v; expected status 200 for %s", i, result, urls[i])
+		}
+	}
+	if counter.max > 2 {
+		t.Errorf("expected at most 2 checks at once, got %d", counter.max)
+	}
+}
+
+func TestHealthCheckerCheckAll_PoliteToHosts(t *testing.T) {
+	counter := &inFlight{}
+	server := httptest.NewServer(counter.handler(0))
+	defer server.Close()
+
+	delay := 30 * time.Millisecond
+	checker := NewHealthChecker(time.Second, 4, delay)
+	checker.Client = server.Client()
+	checker.CheckAll(context.Background(), []string{server.URL + "/a", server.URL + "/b", server.URL + "/c"})
+
+	if counter.max != 1 {
+		t.Errorf("expected one request at a time to the host, got %d", counter.max)
+	}
+	for i := 1; i < len(counter.starts); i++ {
+		if gap := counter.starts[i].Sub(counter.starts[i-1]); gap < delay {
+			t.Errorf("request %d came %v after the one before; expected at least %v", i, gap, delay)
+		}
+	}
+}
+
+func TestHealthCheckerCheckAll_WaitingHostHoldsNoSlot(t *testing.T) {
+	busy := &inFlight{}
+	busyServer := httptest.NewServer(busy.handler(0))
+	defer busyServer.Close()
+	other := &inFlight{}
+	otherServer := httptest.NewServer(other.handler(0))
+	defer otherServer.Close()
+
+	// With a single slot, the second request to the busy host waits out the
+	// delay without keeping the other host from being checked
+	delay := 300 * time.Millisecond
+	checker := NewHealthChecker(time.Second, 1, delay)
+	checker.Client = &http.Client{}
+	start := time.Now()
+	checker.CheckAll(context.Background(), []string{busyServer.URL + "/a", busyServer.URL + "/b", otherServer.URL + "/c"})
+
+	if len(other.starts) != 1 || other.starts[0].Sub(start) >= delay {
+		t.Errorf("expected the other host to be checked while the busy one waits, got requests at %v", other.starts)
+	}
+	if len(busy.starts) != 2 || busy.starts[1].Sub(busy.starts[0]) < delay {
+		t.Errorf("expected the busy host to get its requests %v apart, got %v", delay, busy.starts)
+	}
+}
+
+func TestHealthCheckerRefusesInternalAddresses(t *testing.T) {
+	counter := &inFlight{}
+	server := httptest.NewServer(counter.handler(0))
+	defer server.Close()
+	redirector := httptest.NewServer(http.RedirectHandler(server.URL, http.StatusFound))
+	defer redirector.Close()
+
+	checker := NewHealthChecker(time.Second, 2, 0)
+	for _, target := range []string{server.URL + "/", "http://169.254.169.254/latest/meta-data/"} {
+		result := checker.Check(context.Background(), target)
+		if !errors.Is(result.Err, ErrNonPublicAddress) || result.Status != 0 {
+			t.Errorf("Check(%s) = %+v; expected the address to be refused", target, result)
+		}
+	}
+	if len(counter.starts) != 0 {
+		t.Errorf("expected no request to reach the loopback server, got %d", len(counter.starts))
+	}
+}
@@ -0,0 +1,453 @@
+package pkg
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Statuses of jobs
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed" // out of attempts
+)
+
+// Job is a piece of background work, as stored in a JobQueue
+type Job struct {
+	Id           int64
+	Kind         string // picks the handler that runs it
+	Payload      string // input of the handler, "" when it needs none
+	Status       string
+	Attempts     int // started so far, including a running one
+	Max_attempts int
+	Run_at       time.Time  // not started before then
+	Locked_by    string     // the claim of the worker running it, or that ran it last
+	Locked_until *time.Time // when a running job is taken for lost and may be claimed again
+	Last_error   string
+	Created_at   time.Time
+	Finished_at  *time.Time
+}
+
+// JobSchedule is the state a JobQueue keeps of a recurring job
+type JobSchedule struct {
+	Kind        string
+	Spec        string
+	Next_run_at time.Time
+}
+
+// Schedule is a recurring job: a job of Kind is queued every time Cron fires
+type Schedule struct {
+	Kind         string
+	Spec         string // Cron as it was written
+	Cron         *Cron
+	Max_attempts int
+}
+
+// JobQueue stores the jobs of a JobRunner. Several runners, in several
+// processes, may share one queue.
+type JobQueue interface {
+	// Enqueue adds a job
+	Enqueue(ctx context.Context, job *Job) error
+
+	// Claim hands out up to limit jobs due at now, oldest first: queued ones,
+	// and running ones whose lock expired. They are marked as running under
+	// lock until now+lease, with one more attempt. Jobs whose lock expired on
+	// their last attempt are failed instead.
+	Claim(ctx context.Context, lock string, now time.Time, lease time.Duration, limit int) ([]Job, error)
+
+	// Finish saves a claimed job after an attempt, and clears its lock. It
+	// returns false, saving nothing, when the lock expired and the job has
+	// been claimed again meanwhile.
+	Finish(ctx context.Context, job Job) (bool, error)
+
+	// RunSchedules queues a job for each schedule that is due at now, unless
+	// one of its kind is still queued or running, and moves the schedule on
+	// to its next time. Schedules new to the queue, or with a changed spec,
+	// start at their next time.
+	RunSchedules(ctx context.Context, now time.Time, schedules []Schedule) error
+
+	// Prune removes jobs that were done before cutoff
+	Prune(ctx context.Context, cutoff time.Time) error
+}
+
+// Backoff is the time to wait after attempts failed attempts: base, doubled
+// for every attempt after the first, and at most max
+func Backoff(base, max time.Duration, attempts int) time.Duration {
+	backoff := base
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		return max
+	}
+	return backoff
+}
+
+// JobHandler runs a job. Returning an error fails the attempt. The context
+// ends when the job's lock expires, or when the runner gives up draining.
+type JobHandler func(ctx context.Context, job Job) error
+
+// JobRunner runs the jobs of a queue with a pool of workers, and queues its
+// recurring jobs
+type JobRunner struct {
+	Queue       JobQueue
+	Workers     int           // jobs run at once
+	Poll        time.Duration // time between looks for due jobs
+	Lease       time.Duration // how long a job may run before it is taken for lost
+	Backoff     time.Duration // wait after the first failed attempt, doubled after each further one
+	MaxBackoff  time.Duration
+	MaxAttempts int           // of jobs enqueued without one
+	Drain       time.Duration // how long Run waits for running jobs once stopped, before canceling them
+
+	worker    string
+	handlers  map[string]JobHandler
+	schedules []Schedule
+	now       func() time.Time
+}
+
+func NewJobRunner(queue JobQueue, workers int) *JobRunner {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return &JobRunner{
+		Queue:       queue,
+		Workers:     workers,
+		Poll:        time.Second,
+		Lease:       10 * time.Minute,
+		Backoff:     30 * time.Second,
+		MaxBackoff:  time.Hour,
+		MaxAttempts: 5,
+		Drain:       30 * time.Second,
+		worker:      fmt.Sprintf("%s:%d", host, os.Getpid()),
+		handlers:    make(map[string]JobHandler),
+		now:         func() time.Time { return time.Now().UTC().Truncate(time.Second) },
+	}
+}
+
+// Handle makes handler run the jobs of kind. Call it before Run.
+func (r *JobRunner) Handle(kind string, handler JobHandler) {
+	r.handlers[kind] = handler
+}
+
+// Schedule queues a job of kind every time spec fires. Call it before Run.
+func (r *JobRunner) Schedule(kind, spec string) error {
+	cron, err := ParseCron(spec)
+	if err != nil {
+		return err
+	}
+	r.schedules = append(r.schedules, Schedule{Kind: kind, Spec: spec, Cron: cron, Max_attempts: r.MaxAttempts})
+	return nil
+}
+
+// Enqueue queues a job of kind to run at runAt, or as soon as possible when
+// runAt is zero
+func (r *JobRunner) Enqueue(ctx context.Context, kind, payload string, runAt time.Time) error {
+	now := r.now()
+	if runAt.IsZero() {
+		runAt = now
+	}
+	return r.Queue.Enqueue(ctx, &Job{
+		Kind:         kind,
+		Payload:      payload,
+		Status:       JobQueued,
+		Max_attempts: r.MaxAttempts,
+		Run_at:       runAt,
+		Created_at:   now,
+	})
+}
+
+// Run runs jobs until ctx ends, then waits for the running ones to finish.
+// Jobs still running after Drain are canceled, and queued again without
+// counting the attempt.
+func (r *JobRunner) Run(ctx context.Context) {
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	slots := make(chan struct{}, r.Workers)
+	var running sync.WaitGroup
+
+	ticker := time.NewTicker(r.Poll)
+	defer ticker.Stop()
+	for {
+		if err := r.dispatch(ctx, jobCtx, slots, &running); err != nil && ctx.Err() == nil {
+			log.Printf("Error claiming jobs: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			r.drain(&running, cancelJobs)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dispatch queues the recurring jobs that are due, and starts as many due
+// jobs as there are free workers
+func (r *JobRunner) dispatch(ctx, jobCtx context.Context, slots chan struct{}, running *sync.WaitGroup) error {
+	now := r.now()
+	if len(r.schedules) > 0 {
+		if err := r.Queue.RunSchedules(ctx, now, r.schedules); err != nil {
+			return err
+		}
+	}
+	free := cap(slots) - len(slots)
+	if free == 0 {
+		return nil
+	}
+
+	jobs, err := r.Queue.Claim(ctx, r.worker+"/"+newLockID(), now, r.Lease, free)
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		slots <- struct{}{}
+		running.Add(1)
+		go func(job Job) {
+			defer func() {
+				<-slots
+				running.Done()
+			}()
+			r.run(jobCtx, job)
+		}(job)
+	}
+	return nil
+}
+
+// drain waits for the running jobs, canceling them after r.Drain
+func (r *JobRunner) drain(running *sync.WaitGroup, cancelJobs context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(r.Drain):
+		log.Printf("Jobs still running after %v, canceling them", r.Drain)
+		cancelJobs()
+		<-done
+	}
+}
+
+// run makes an attempt at a claimed job and saves how it went
+func (r *JobRunner) run(jobCtx context.Context, job Job) {
+	ctx := jobCtx
+	if job.Locked_until != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(jobCtx, *job.Locked_until)
+		defer cancel()
+	}
+	err := r.call(ctx, job)
+
+	now := r.now()
+	switch {
+	case err == nil:
+		job.Status = JobDone
+		job.Finished_at = &now
+		job.Last_error = ""
+	case jobCtx.Err() != nil:
+		// Cut short by shutdown, which says nothing about the job
+		job.Status = JobQueued
+		job.Attempts--
+		job.Run_at = now
+		job.Last_error = err.Error()
+	case job.Attempts >= job.Max_attempts:
+		log.Printf("Job %d (%s) failed for good: %v", job.Id, job.Kind, err)
+		job.Status = JobFailed
+		job.Finished_at = &now
+		job.Last_error = err.Error()
+	default:
+		log.Printf("Job %d (%s) failed, attempt %d of %d: %v", job.Id, job.Kind, job.Attempts, job.Max_attempts, err)
+		job.Status = JobQueued
+		job.Run_at = now.Add(Backoff(r.Backoff, r.MaxBackoff, job.Attempts))
+		job.Last_error = err.Error()
+	}
+
+	saved, err := r.Queue.Finish(context.Background(), job)
+	if err != nil {
+		log.Printf("Error saving job %d (%s): %v", job.Id, job.Kind, err)
+	} else if !saved {
+		log.Printf("Job %d (%s) ran past its lock and was claimed again", job.Id, job.Kind)
+	}
+}
+
+// call runs the handler of job, turning panics into errors
+func (r *JobRunner) call(ctx context.Context, job Job) (err error) {
+	handler, ok := r.handlers[job.Kind]
+	if !ok {
+		return fmt.Errorf("no handler for jobs of kind %q", job.Kind)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+func newLockID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("Error generating job lock: %v", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// MemoryJobQueue is a JobQueue that keeps its jobs in memory, for tests and
+// for running without a database. Its jobs are lost when the process ends.
+type MemoryJobQueue struct {
+	mu        sync.Mutex
+	jobs      map[int64]*Job
+	lastID    int64
+	schedules map[string]*JobSchedule
+}
+
+var _ JobQueue = (*MemoryJobQueue)(nil)
+
+func NewMemoryJobQueue() *MemoryJobQueue {
+	return &MemoryJobQueue{jobs: make(map[int64]*Job), schedules: make(map[string]*JobSchedule)}
+}
+
+// Jobs returns a copy of every job in the queue, in order of id
+func (q *MemoryJobQueue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var jobs []Job
+	for _, job := range q.ordered() {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+// ordered returns the jobs in order of id. The caller must hold q.mu.
+func (q *MemoryJobQueue) ordered() []*Job {
+	jobs := make([]*Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Id < jobs[j].Id })
+	return jobs
+}
+
+func (q *MemoryJobQueue) Enqueue(ctx context.Context, job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.enqueue(job)
+	return nil
+}
+
+// enqueue adds job. The caller must hold q.mu.
+func (q *MemoryJobQueue) enqueue(job *Job) {
+	q.lastID++
+	job.Id = q.lastID
+	copied := *job
+	q.jobs[job.Id] = &copied
+}
+
+func (q *MemoryJobQueue) Claim(ctx context.Context, lock string, now time.Time, lease time.Duration, limit int) ([]Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var due []*Job
+	for _, job := range q.ordered() {
+		queued := job.Status == JobQueued && !job.Run_at.After(now)
+		lost := job.Status == JobRunning && job.Locked_until != nil && !job.Locked_until.After(now)
+		if queued || lost {
+			due = append(due, job)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].Run_at.Before(due[j].Run_at) })
+
+	var claimed []Job
+	for _, job := range due {
+		if len(claimed) == limit {
+			break
+		}
+		if job.Status == JobRunning && job.Attempts >= job.Max_attempts {
+			job.Status = JobFailed
+			job.Finished_at = &now
+			job.Locked_until = nil
+			job.Last_error = "lock expired"
+			continue
+		}
+		until := now.Add(lease)
+		job.Status = JobRunning
+		job.Attempts++
+		job.Locked_by = lock
+		job.Locked_until = &until
+		claimed = append(claimed, *job)
+	}
+	return claimed, nil
+}
+
+func (q *MemoryJobQueue) Finish(ctx context.Context, job Job) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stored, ok := q.jobs[job.Id]
+	if !ok {
+		return false, errors.New("no such job")
+	}
+	if stored.Status != JobRunning || stored.Locked_by != job.Locked_by {
+		return false, nil
+	}
+	job.Locked_until = nil
+	*stored = job
+	return true, nil
+}
+
+func (q *MemoryJobQueue) RunSchedules(ctx context.Context, now time.Time, schedules []Schedule) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, schedule := range schedules {
+		state, ok := q.schedules[schedule.Kind]
+		if !ok || state.Spec != schedule.Spec {
+			q.schedules[schedule.Kind] = &JobSchedule{Kind: schedule.Kind, Spec: schedule.Spec, Next_run_at: schedule.Cron.Next(now)}
+			continue
+		}
+		if state.Next_run_at.After(now) {
+			continue
+		}
+		if !q.pending(schedule.Kind) {
+			q.enqueue(&Job{
+				Kind:         schedule.Kind,
+				Status:       JobQueued,
+				Max_attempts: schedule.Max_attempts,
+				Run_at:       now,
+				Created_at:   now,
+			})
+		}
+		state.Next_run_at = schedule.Cron.Next(now)
+	}
+	return nil
+}
+
+// pending reports whether a job of kind is queued or running. The caller
+// must hold q.mu.
+func (q *MemoryJobQueue) pending(kind string) bool {
+	for _, job := range q.jobs {
+		if job.Kind == kind && (job.Status == JobQueued || job.Status == JobRunning) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *MemoryJobQueue) Prune(ctx context.Context, cutoff time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for id, job := range q.jobs {
+		if job.Status == JobDone && job.Finished_at != nil && job.Finished_at.Before(cutoff) {
+			delete(q.jobs, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestRunner returns a runner on an in-memory queue whose clock is at
+// *now
+func newTestRunner(workers int, now *time.Time) (*JobRunner, *MemoryJobQueue) {
+	queue := NewMemoryJobQueue()
+	runner := NewJobRunner(queue, workers)
+	runner.now = func() time.Time { return *now }
+	return runner, queue
+}
+
+// runDue starts the due jobs and waits for them
+func runDue(t *testing.T, r *JobRunner) {
+	t.Helper()
+	slots := make(chan struct{}, r.Workers)
+	var running sync.WaitGroup
+	if err := r.dispatch(context.Background(), context.Background(), slots, &running); err != nil {
+		t.Fatalf("Error dispatching jobs: %v", err)
+	}
+	running.Wait()
+}
+
+func TestBackoff(t *testing.T) {
+	testCases := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, time.Second},
+		{3, 4 * time.Second},
+		{6, 30 * time.Second},
+		{60, 30 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		if got := Backoff(time.Second, 30*time.Second, tc.attempts); got != tc.expected {
+			t.Errorf("Backoff(1s, 30s, %d) = %v; expected %v", tc.attempts, got, tc.expected)
+		}
+	}
+}
+
+func TestJobRunner_RetriesThenFails(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	runner, queue := newTestRunner(2, &now)
+	runner.MaxAttempts = 3
+	runner.Backoff = time.Minute
+
+	var payloads []string
+	runner.Handle("ok", func(ctx context.Context, job Job) error {
+		payloads = append(payloads, job.Payload)
+		return nil
+	})
+	runner.Handle("broken", func(ctx context.Context, job Job) error {
+		return errors.New("boom")
+	})
+	runner.Handle("panics", func(ctx context.Context, job Job) error {
+		panic("oops")
+	})
+	for _, kind := range []string{"ok", "broken", "panics", "unknown"} {
+		if err := runner.Enqueue(context.Background(), kind, kind+" payload", time.Time{}); err != nil {
+			t.Fatalf("Error enqueuing %s: %v", kind, err)
+		}
+	}
+
+	runDue(t, runner) // ok and broken
+	runDue(t, runner) // panics and unknown
+	jobs := queue.Jobs()
+	if jobs[0].Status != JobDone || jobs[0].Finished_at == nil || len(payloads) != 1 || payloads[0] != "ok payload" {
+		t.Errorf("expected the ok job to be done, got %+v", jobs[0])
+	}
+	for _, job := range jobs[1:] {
+		if job.Status != JobQueued || job.Attempts != 1 || !job.Run_at.Equal(now.Add(time.Minute)) || job.Last_error == "" {
+			t.Errorf("expected job %s to be retried in a minute, got %+v", job.Kind, job)
+		}
+	}
+	if jobs[2].Last_error != "panic: oops" {
+		t.Errorf("expected the panic to fail the job, got %q", jobs[2].Last_error)
+	}
+
+	// The second retry waits twice as long
+	now = now.Add(time.Minute)
+	runDue(t, runner)
+	runDue(t, runner)
+	if job := queue.Jobs()[1]; job.Attempts != 2 || !job.Run_at.Equal(now.Add(2*time.Minute)) {
+		t.Errorf("expected a second attempt and a two minute wait, got %+v", job)
+	}
+
+	now = now.Add(2 * time.Minute)
+	runDue(t, runner)
+	runDue(t, runner)
+	for _, job := range queue.Jobs()[1:] {
+		if job.Status != JobFailed || job.Attempts != 3 || job.Finished_at == nil {
+			t.Errorf("expected job %s to fail for good, got %+v", job.Kind, job)
+		}
+	}
+}
+
+func TestJobRunner_BoundsWorkers(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	runner, queue := newTestRunner(2, &now)
+	var mu sync.Mutex
+	current, max := 0, 0
+	runner.Handle("slow", func(ctx context.Context, job Job) error {
+		mu.Lock()
+		current++
+		if current > max {
+			max = current
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		current--
+		mu.Unlock()
+		return nil
+	})
+	for i := 0; i < 5; i++ {
+		runner.Enqueue(context.Background(), "slow", "", time.Time{})
+	}
+
+	for i := 0; i < 3; i++ {
+		runDue(t, runner)
+	}
+	for _, job := range queue.Jobs() {
+		if job.Status != JobDone {
+			t.Errorf("expected every job to be done, got %+v", job)
+		}
+	}
+	if max != 2 {
+		t.Errorf("expected 2 jobs at once, got %d", max)
+	}
+}
+
+func TestMemoryJobQueue_LockExpiry(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	queue := NewMemoryJobQueue()
+	queue.Enqueue(context.Background(), &Job{Kind: "a", Status: JobQueued, Max_attempts: 2, Run_at: now})
+
+	first, _ := queue.Claim(context.Background(), "w1", now, time.Minute, 10)
+	if len(first) != 1 || first[0].Attempts != 1 || first[0].Locked_by != "w1" {
+		t.Fatalf("expected the job to be claimed by w1, got %+v", first)
+	}
+	// Locked jobs are not handed out again before their lock expires
+	if again, _ := queue.Claim(context.Background(), "w2", now.Add(30*time.Second), time.Minute, 10); len(again) != 0 {
+		t.Errorf("expected no job while the lock holds, got %+v", again)
+	}
+
+	second, _ := queue.Claim(context.Background(), "w2", now.Add(time.Minute), time.Minute, 10)
+	if len(second) != 1 || second[0].Attempts != 2 || second[0].Locked_by != "w2" {
+		t.Fatalf("expected the lost job to be claimed by w2, got %+v", second)
+	}
+	// The first worker finishing late saves nothing
+	done := first[0]
+	done.Status = JobDone
+	if saved, err := queue.Finish(context.Background(), done); saved || err != nil {
+		t.Errorf("Finish with an expired lock = %v, %v; expected false", saved, err)
+	}
+
+	// Out of attempts once the second lock expires too
+	if third, _ := queue.Claim(context.Background(), "w3", now.Add(2*time.Minute), time.Minute, 10); len(third) != 0 {
+		t.Errorf("expected no more attempts, got %+v", third)
+	}
+	if job := queue.Jobs()[0]; job.Status != JobFailed {
+		t.Errorf("expected the job to fail, got %+v", job)
+	}
+}
+
+func TestMemoryJobQueue_RunSchedules(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	cron, _ := ParseCron("@every 1h")
+	schedules := []Schedule{{Kind: "purge", Spec: "@every 1h", Cron: cron, Max_attempts: 3}}
+	queue := NewMemoryJobQueue()
+
+	// New schedules wait for their first time
+	queue.RunSchedules(context.Background(), now, schedules)
+	if jobs := queue.Jobs(); len(jobs) != 0 {
+		t.Errorf("expected no job yet, got %+v", jobs)
+	}
+
+	now = now.Add(time.Hour)
+	queue.RunSchedules(context.Background(), now, schedules)
+	queue.RunSchedules(context.Background(), now, schedules)
+	jobs := queue.Jobs()
+	if len(jobs) != 1 || jobs[0].Kind != "purge" || jobs[0].Max_attempts != 3 {
+		t.Fatalf("expected one purge job, got %+v", jobs)
+	}
+
+	// Not queued again while the last one is pending
+	now = now.Add(time.Hour)
+	queue.RunSchedules(context.Background(), now, schedules)
+	if jobs := queue.Jobs(); len(jobs) != 1 {
+		t.Errorf("expected the pending job to be kept alone, got %+v", jobs)
+	}
+
+	claimed, _ := queue.Claim(context.Background(), "w", now, time.Minute, 1)
+	finished := now
+	claimed[0].Status = JobDone
+	claimed[0].Finished_at = &finished
+	queue.Finish(context.Background(), claimed[0])
+	now = now.Add(time.Hour)
+	queue.RunSchedules(context.Background(), now, schedules)
+	if jobs := queue.Jobs(); len(jobs) != 2 {
+		t.Errorf("expected a second purge job, got %+v", jobs)
+	}
+
+	queue.Prune(context.Background(), now)
+	if jobs := queue.Jobs(); len(jobs) != 1 || jobs[0].Status != JobQueued {
+		t.Errorf("expected only the queued job to be left, got %+v", jobs)
+	}
+}
+
+func TestJobRunner_DrainsOnShutdown(t *testing.T) {
+	queue := NewMemoryJobQueue()
+	runner := NewJobRunner(queue, 2)
+	runner.Poll = 5 * time.Millisecond
+	runner.Drain = 50 * time.Millisecond
+
+	started := make(chan string, 2)
+	runner.Handle("quick", func(ctx context.Context, job Job) error {
+		started <- job.Kind
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	})
+	runner.Handle("stuck", func(ctx context.Context, job Job) error {
+		started <- job.Kind
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	runner.Enqueue(context.Background(), "quick", "", time.Time{})
+	runner.Enqueue(context.Background(), "stuck", "", time.Time{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		runner.Run(ctx)
+		close(stopped)
+	}()
+	<-started
+	<-started
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after draining")
+	}
+	jobs := queue.Jobs()
+	if jobs[0].Status != JobDone {
+		t.Errorf("expected the quick job to finish while draining, got %+v", jobs[0])
+	}
+	if jobs[1].Status != JobQueued || jobs[1].Attempts != 0 {
+		t.Errorf("expected the stuck job to be queued again without using an attempt, got %+v", jobs[1])
+	}
+}
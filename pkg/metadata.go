@@ -0,0 +1,183 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PageMetadata is what a destination page says about itself
+type PageMetadata struct {
+	Title       string
+	Description string
+	Image       string
+}
+
+// MetadataFetcher downloads pages and extracts their title and description.
+// Results, including failures, are cached for TTL so a popular link does not
+// hit its destination on every view.
+type MetadataFetcher struct {
+	Client     *http.Client // only connects to public addresses unless replaced
+	Timeout    time.Duration
+	TTL        time.Duration
+	MaxBytes   int64 // only this much of a page is read
+	MaxEntries int   // pages cached at once, 0 for no limit
+
+	mu    sync.Mutex
+	cache map[string]cachedMetadata
+	now   func() time.Time
+}
+
+type cachedMetadata struct {
+	metadata PageMetadata
+	err      error
+	expires  time.Time
+}
+
+func NewMetadataFetcher(timeout time.Duration, ttl time.Duration) *MetadataFetcher {
+	return &MetadataFetcher{
+		Client:     NewPublicClient(),
+		Timeout:    timeout,
+		TTL:        ttl,
+		MaxBytes:   512 * 1024,
+		MaxEntries: 10000,
+		cache:      make(map[string]cachedMetadata),
+		now:        time.Now,
+	}
+}
+
+// Fetch returns the metadata of the page at pageUrl. A nil fetcher fetches
+// nothing and finds no metadata.
+func (f *MetadataFetcher) Fetch(ctx context.Context, pageUrl string) (PageMetadata, error) {
+	if f == nil {
+		return PageMetadata{}, nil
+	}
+	f.mu.Lock()
+	cached, ok := f.cache[pageUrl]
+	f.mu.Unlock()
+	if ok && f.now().Before(cached.expires) {
+		return cached.metadata, cached.err
+	}
+
+	metadata, err := f.fetch(ctx, pageUrl)
+	f.store(pageUrl, cachedMetadata{metadata: metadata, err: err, expires: f.now().Add(f.TTL)})
+	return metadata, err
+}
+
+// store caches the result for pageUrl. When the cache is full, expired
+// results are dropped first, then those closest to expiring.
+func (f *MetadataFetcher) store(pageUrl string, result cachedMetadata) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.cache[pageUrl]; !ok && f.MaxEntries > 0 && len(f.cache) >= f.MaxEntries {
+		now := f.now()
+		for key, cached := range f.cache {
+			if !now.Before(cached.expires) {
+				delete(f.cache, key)
+			}
+		}
+		for len(f.cache) >= f.MaxEntries {
+			var oldest string
+			for key, cached := range f.cache {
+				if oldest == "" || cached.expires.Before(f.cache[oldest].expires) {
+					oldest = key
+				}
+			}
+			delete(f.cache, oldest)
+		}
+	}
+	f.cache[pageUrl] = result
+}
+
+func (f *MetadataFetcher) fetch(ctx context.Context, pageUrl string) (PageMetadata, error) {
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageUrl, nil)
+	if err != nil {
+		return PageMetadata{}, err
+	}
+	req.Header.Set("Accept", "text/html")
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return PageMetadata{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return PageMetadata{}, fmt.Errorf("fetching %s: %s", pageUrl, resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" && !strings.Contains(contentType, "html") {
+		return PageMetadata{}, fmt.Errorf("fetching %s: not an html page (%s)", pageUrl, contentType)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.MaxBytes))
+	if err != nil {
+		return PageMetadata{}, err
+	}
+	return ParseMetadata(string(body)), nil
+}
+
+var (
+	titlePattern     = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	metaPattern      = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attributePattern = regexp.MustCompile(`(?s)([a-zA-Z_:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+// ParseMetadata extracts the title, description and image from an html page.
+// OpenGraph tags take precedence over <title> and the description meta tag.
+func ParseMetadata(page string) PageMetadata {
+	var metadata PageMetadata
+	if match := titlePattern.FindStringSubmatch(page); match != nil {
+		metadata.Title = cleanText(match[1])
+	}
+
+	var description string
+	for _, tag := range metaPattern.FindAllString(page, -1) {
+		attributes := make(map[string]string)
+		for _, attribute := range attributePattern.FindAllStringSubmatch(tag, -1) {
+			attributes[strings.ToLower(attribute[1])] = attribute[2] + attribute[3] + attribute[4]
+		}
+
+		name := strings.ToLower(attributes["property"])
+		if name == "" {
+			name = strings.ToLower(attributes["name"])
+		}
+		content := cleanText(attributes["content"])
+		if content == "" {
+			continue
+		}
+
+		switch name {
+		case "og:title":
+			metadata.Title = content
+		case "og:description":
+			metadata.Description = content
+		case "og:image":
+			metadata.Image = content
+		case "description":
+			description = content
+		}
+	}
+
+	if metadata.Description == "" {
+		metadata.Description = description
+	}
+	return metadata
+}
+
+// cleanText decodes html entities and collapses whitespace
+func cleanText(s string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(s)), " ")
+}
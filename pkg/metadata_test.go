@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseMetadata(t *testing.T) {
+	testCases := []struct {
+		page     string
+		metadata PageMetadata
+	}{
+		{"", PageMetadata{}},
+		{"<html><head><title>Example</title></head></html>", PageMetadata{Title: "Example"}},
+		{"<TITLE lang=en>\n  Tom &amp; Jerry\n</TITLE>", PageMetadata{Title: "Tom & Jerry"}},
+		{`<title>Page</title><meta name="description" content="About the page">`, PageMetadata{Title: "Page", Description: "About the page"}},
+		{`<meta content='Reversed' name='DESCRIPTION'>`, PageMetadata{Description: "Reversed"}},
+		{`<title>Page</title><meta property="og:title" content="Open Graph"><meta property="og:description" content="OG text"><meta name="description" content="Plain"><meta property="og:image" content="https://example.com/a.png"/>`,
+			PageMetadata{Title: "Open Graph", Description: "OG text", Image: "https://example.com/a.png"}},
+		{`<meta name="description" content="">`, PageMetadata{}},
+	}
+
+	for _, tc := range testCases {
+		if metadata := ParseMetadata(tc.page); metadata != tc.metadata {
+			t.Errorf("ParseMetadata(%q) = %+v; expected %+v", tc.page, metadata, tc.metadata)
+		}
+	}
+}
+
+func TestMetadataFetcherCaches(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<title>Visit %d</title>", requests)
+	}))
+	defer server.Close()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fetcher := NewMetadataFetcher(time.Second, time.Minute)
+	fetcher.Client = server.Client()
+	fetcher.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		metadata, err := fetcher.Fetch(context.Background(), server.URL)
+		if err != nil || metadata.Title != "Visit 1" {
+			t.Errorf("Fetch = %+v, %v; expected the cached title Visit 1", metadata, err)
+		}
+	}
+
+	now = now.Add(2 * time.Minute)
+	metadata, err := fetcher.Fetch(context.Background(), server.URL)
+	if err != nil || metadata.Title != "Visit 2" {
+		t.Errorf("Fetch = %+v, %v; expected a fresh title Visit 2", metadata, err)
+	}
+}
+
+func TestMetadataFetcherTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	fetcher := NewMetadataFetcher(20*time.Millisecond, time.Minute)
+	fetcher.Client = server.Client()
+	if _, err := fetcher.Fetch(context.Background(), server.URL); err == nil {
+		t.Errorf("Expected a timeout error")
+	}
+}
+
+func TestMetadataFetcherErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image" {
+			w.Header().Set("Content-Type", "image/png")
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	fetcher := NewMetadataFetcher(time.Second, time.Minute)
+	fetcher.Client = server.Client()
+	for _, path := range []string{"/missing", "/image"} {
+		if _, err := fetcher.Fetch(context.Background(), server.URL+path); err == nil {
+			t.Errorf("Expected an error for %s", path)
+		}
+	}
+
+	var none *MetadataFetcher
+	if metadata, err := none.Fetch(context.Background(), server.URL+"/missing"); err != nil || metadata != (PageMetadata{}) {
+		t.Errorf("Expected a nil fetcher to find nothing, got %+v, %v", metadata, err)
+	}
+}
+
+func TestMetadataFetcherEvicts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, "<title>%s</title>", r.URL.Path)
+	}))
+	defer server.Close()
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	fetcher := NewMetadataFetcher(time.Second, time.Minute)
+	fetcher.Client = server.Client()
+	fetcher.MaxEntries = 2
+	fetcher.now = func() time.Time { return now }
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		fetcher.Fetch(context.Background(), server.URL+path)
+		now = now.Add(time.Second)
+	}
+	if len(fetcher.cache) != 2 {
+		t.Errorf("expected 2 cached pages, got %d", len(fetcher.cache))
+	}
+	if _, ok := fetcher.cache[server.URL+"/a"]; ok {
+		t.Errorf("expected the page closest to expiring to be evicted")
+	}
+
+	// Expired pages make room before live ones
+	now = now.Add(time.Minute)
+	fetcher.Fetch(context.Background(), server.URL+"/d")
+	if len(fetcher.cache) != 1 {
+		t.Errorf("expected the expired pages to be evicted, got %d cached", len(fetcher.cache))
+	}
+}
+
+func TestMetadataFetcherRefusesInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<title>Internal</title>")
+	}))
+	defer server.Close()
+
+	fetcher := NewMetadataFetcher(time.Second, time.Minute)
+	if _, err := fetcher.Fetch(context.Background(), server.URL); !errors.Is(err, ErrNonPublicAddress) {
+		t.Errorf("expected the loopback server to be refused, got %v", err)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	testCases := map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1":     true,
+		"127.0.0.1":        false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"::ffff:127.0.0.1": false,
+	}
+	for address, expected := range testCases {
+		if got := IsPublicIP(net.ParseIP(address)); got != expected {
+			t.Errorf("IsPublicIP(%s) = %v; expected %v", address, got, expected)
+		}
+	}
+}
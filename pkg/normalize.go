@@ -0,0 +1,61 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// NormalizeOptions are the rules of NormalizeURL that may make urls leading
+// to different pages compare equal, so they are off unless enabled
+type NormalizeOptions struct {
+	StripParams         []string // query parameters to drop, a trailing * matches any suffix
+	RemoveFragment      bool     // drop everything after #, which single page apps route on
+	RemoveTrailingSlash bool     // drop trailing slashes, which some servers tell apart
+}
+
+// normalizeVersion changes whenever NormalizeURL does, so urls normalized by
+// an older version are recognised and normalized again
+const normalizeVersion = 2
+
+// String describes the options and the version of NormalizeURL. Normalized
+// urls stored under another description have to be normalized again.
+func (o NormalizeOptions) String() string {
+	return fmt.Sprintf("v%d strip=%s fragment=%t trailing_slash=%t",
+		normalizeVersion, strings.Join(o.StripParams, ","), o.RemoveFragment, o.RemoveTrailingSlash)
+}
+
+// NormalizeURL returns the form of urlStr used to recognise a url that was
+// already shortened, using a Canonicalizer with every rule that keeps the
+// destination the same enabled and the others as set in opts
+func NormalizeURL(urlStr string, opts NormalizeOptions) (string, error) {
+	c := NewCanonicalizer(opts.StripParams)
+	c.RemoveFragment = opts.RemoveFragment
+	c.RemoveTrailingSlash = opts.RemoveTrailingSlash
+	return c.Canonicalize(urlStr)
+}
+
+// MatchesParam reports whether the query parameter name matches one of the
+// patterns. Matching ignores case and a trailing * matches any suffix.
+func MatchesParam(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// HashURL returns the hex encoded SHA-256 hash of a normalized url, which is
+// what gets stored in the indexed url_hash column
+func HashURL(normalized string) string {
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,73 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestNormalizeURL(t *testing.T) {
+	opts := NormalizeOptions{StripParams: []string{"utm_*", "fbclid"}, RemoveFragment: true, RemoveTrailingSlash: true}
+	testCases := []struct {
+		urlStr     string
+		normalized string
+	}{
+		{"https://example.com", "https://example.com/"},
+		{"HTTPS://Example.COM/Path", "https://example.com/Path"},
+		{"http://example.com:80/a/", "http://example.com/a"},
+		{"https://example.com:443/a", "https://example.com/a"},
+		{"http://example.com:443/a", "http://example.com:443/a"},
+		{"https://example.com/?b=2&a=1", "https://example.com/?a=1&b=2"},
+		{"https://example.com/?utm_source=x&UTM_Medium=y&id=5", "https://example.com/?id=5"},
+		{"https://example.com/?fbclid=abc#top", "https://example.com/"},
+		{"https://[::1]:443/", "https://[::1]/"},
+	}
+
+	for _, tc := range testCases {
+		normalized, err := NormalizeURL(tc.urlStr, opts)
+		if err != nil || normalized != tc.normalized {
+			t.Errorf("NormalizeURL(%s) = %s, %v; expected %s", tc.urlStr, normalized, err, tc.normalized)
+		}
+	}
+}
+
+func TestNormalizeURLWithoutStripping(t *testing.T) {
+	normalized, err := NormalizeURL("https://example.com/?utm_source=x", NormalizeOptions{})
+	if err != nil || normalized != "https://example.com/?utm_source=x" {
+		t.Errorf("Expected tracking parameters to be kept, got %s, %v", normalized, err)
+	}
+}
+
+func TestNormalizeURLKeepsFragmentAndTrailingSlash(t *testing.T) {
+	// Unless enabled, urls that may lead to different pages stay apart
+	for urlStr, expected := range map[string]string{
+		"https://app.example.com/#/settings": "https://app.example.com/#/settings",
+		"https://example.com/docs/":          "https://example.com/docs/",
+		"HTTPS://Example.com:443/docs":       "https://example.com/docs",
+	} {
+		normalized, err := NormalizeURL(urlStr, NormalizeOptions{})
+		if err != nil || normalized != expected {
+			t.Errorf("NormalizeURL(%s) = %s, %v; expected %s", urlStr, normalized, err, expected)
+		}
+	}
+}
+
+func TestNormalizeOptionsString(t *testing.T) {
+	opts := NormalizeOptions{StripParams: []string{"utm_*"}}
+	if opts.String() != (NormalizeOptions{StripParams: []string{"utm_*"}}).String() {
+		t.Errorf("Expected equal options to be described alike")
+	}
+	for _, other := range []NormalizeOptions{{}, {StripParams: []string{"utm_*"}, RemoveFragment: true}, {StripParams: []string{"utm_*"}, RemoveTrailingSlash: true}} {
+		if other.String() == opts.String() {
+			t.Errorf("Expected %+v to be described apart from %+v", other, opts)
+		}
+	}
+}
+
+func TestHashURL(t *testing.T) {
+	hash := HashURL("https://example.com")
+	if len(hash) != 64 {
+		t.Errorf("Expected a 64 character hash, got %d characters", len(hash))
+	}
+	if hash != HashURL("https://example.com") || hash == HashURL("https://example.org") {
+		t.Errorf("HashURL should be deterministic and distinguish urls")
+	}
+}
@@ -0,0 +1,91 @@
+package pkg
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// OverlayFS serves the files of Upper, falling back to Lower for the files
+// Upper does not have, so a directory of a few files can replace some of a
+// larger set. Directories list the files of both.
+type OverlayFS struct {
+	Upper fs.FS
+	Lower fs.FS
+}
+
+var _ fs.ReadDirFS = OverlayFS{}
+
+// Open opens name from Upper, or from Lower when Upper does not have it.
+// Directories list the files of both.
+func (o OverlayFS) Open(name string) (fs.File, error) {
+	f, err := o.Upper.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = o.Lower.Open(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		entries, err := o.ReadDir(name)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &overlayDir{File: f, entries: entries}, nil
+	}
+	return f, nil
+}
+
+// overlayDir is a directory of an OverlayFS, listing the files of both
+type overlayDir struct {
+	fs.File
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *overlayDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.offset += n
+	return rest[:n], nil
+}
+
+// ReadDir lists the directory name of both file systems, sorted by name. An
+// entry in both is listed once, as Upper has it.
+func (o OverlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	upper, upperErr := fs.ReadDir(o.Upper, name)
+	if upperErr != nil && !errors.Is(upperErr, fs.ErrNotExist) {
+		return nil, upperErr
+	}
+	lower, lowerErr := fs.ReadDir(o.Lower, name)
+	if lowerErr != nil && !errors.Is(lowerErr, fs.ErrNotExist) {
+		return nil, lowerErr
+	}
+	if upperErr != nil && lowerErr != nil {
+		return nil, upperErr
+	}
+
+	entries := upper
+	seen := make(map[string]bool, len(upper))
+	for _, entry := range upper {
+		seen[entry.Name()] = true
+	}
+	for _, entry := range lower {
+		if !seen[entry.Name()] {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
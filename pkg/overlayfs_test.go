@@ -0,0 +1,49 @@
+package pkg
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOverlayFS(t *testing.T) {
+	overlay := OverlayFS{
+		Upper: fstest.MapFS{
+			"templates/index.html": {Data: []byte("branded")},
+			"logo.png":             {Data: []byte("png")},
+		},
+		Lower: fstest.MapFS{
+			"templates/index.html": {Data: []byte("default")},
+			"templates/edit.html":  {Data: []byte("edit")},
+			"styles.css":           {Data: []byte("css")},
+		},
+	}
+
+	for name, expected := range map[string]string{
+		"templates/index.html": "branded",
+		"templates/edit.html":  "edit",
+		"styles.css":           "css",
+		"logo.png":             "png",
+	} {
+		data, err := fs.ReadFile(overlay, name)
+		if err != nil || string(data) != expected {
+			t.Errorf("%s: got %q, %v; expected %q", name, data, err, expected)
+		}
+	}
+	if _, err := overlay.Open("missing.css"); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+
+	matches, err := fs.Glob(overlay, "templates/*.html")
+	if err != nil || len(matches) != 2 || matches[0] != "templates/edit.html" || matches[1] != "templates/index.html" {
+		t.Errorf("unexpected matches %v, %v", matches, err)
+	}
+	if _, err := fs.ReadDir(overlay, "missing"); err == nil {
+		t.Errorf("expected an error for a missing directory")
+	}
+
+	// The overlay passes the checks of every file system
+	if err := fstest.TestFS(overlay, "templates/index.html", "templates/edit.html", "styles.css", "logo.png"); err != nil {
+		t.Errorf("%v", err)
+	}
+}
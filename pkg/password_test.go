@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestPbkdf2SHA256(t *testing.T) {
+	// Test vectors for PBKDF2-HMAC-SHA256 from RFC 7914 section 11
+	testCases := []struct {
+		password   string
+		salt       string
+		iterations int
+		keyLength  int
+		key        string
+	}{
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+
+	for _, tc := range testCases {
+		key := hex.EncodeToString(pbkdf2SHA256([]byte(tc.password), []byte(tc.salt), tc.iterations, tc.keyLength))
+		if key != tc.key {
+			t.Errorf("pbkdf2SHA256(%s, %s) = %s; expected %s", tc.password, tc.salt, key, tc.key)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatalf("Error in HashPassword: %v", err)
+	}
+
+	if !strings.HasPrefix(hash, "pbkdf2-sha256$600000$") {
+		t.Errorf("Unexpected hash format %s", hash)
+	}
+	if !CheckPassword("secret", hash) {
+		t.Errorf("CheckPassword rejected the correct password")
+	}
+	if CheckPassword("Secret", hash) {
+		t.Errorf("CheckPassword accepted a wrong password")
+	}
+
+	other, _ := HashPassword("secret")
+	if other == hash {
+		t.Errorf("Expected a different salt for every hash")
+	}
+}
+
+func TestCheckPasswordMalformedHash(t *testing.T) {
+	testCases := []string{
+		"",
+		"secret",
+		"bcrypt$10$abc$def",
+		"pbkdf2-sha256$zero$abc$def",
+		"pbkdf2-sha256$1$not base64$def",
+	}
+
+	for _, encoded := range testCases {
+		if CheckPassword("secret", encoded) {
+			t.Errorf("CheckPassword accepted the malformed hash %q", encoded)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+)
+
+// TruncateIP drops the host part of an address, keeping the /24 network of
+// IPv4 addresses and the /48 of IPv6 ones, which is enough for rough
+// location but no longer points at a household. Addresses that cannot be
+// parsed give "".
+func TruncateIP(ip string) string {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return ""
+	}
+	addr = addr.Unmap().WithZone("")
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.Addr().String()
+}
+
+// VisitorHash identifies a visitor by its address and user agent without
+// keeping either. Hashes made with the same salt match; once the salt is
+// thrown away they can no longer be tied to an address.
+func VisitorHash(salt []byte, ip string, userAgent string) string {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(ip))
+	mac.Write([]byte{0})
+	mac.Write([]byte(userAgent))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// DoNotTrack reports whether the DNT or Sec-GPC header of a request asks not
+// to be tracked
+func DoNotTrack(dnt string, gpc string) bool {
+	return strings.TrimSpace(dnt) == "1" || strings.TrimSpace(gpc) == "1"
+}
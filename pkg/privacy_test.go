@@ -0,0 +1,58 @@
+package pkg
+
+import "testing"
+
+func TestTruncateIP(t *testing.T) {
+	testCases := []struct {
+		ip       string
+		expected string
+	}{
+		{"203.0.113.77", "203.0.113.0"},
+		{"::ffff:203.0.113.77", "203.0.113.0"},
+		{"2001:db8:85a3:8d3:1319:8a2e:370:7348", "2001:db8:85a3::"},
+		{"fe80::1%eth0", "fe80::"},
+		{"", ""},
+		{"not an ip", ""},
+	}
+
+	for _, tc := range testCases {
+		if got := TruncateIP(tc.ip); got != tc.expected {
+			t.Errorf("TruncateIP(%q) = %q; expected %q", tc.ip, got, tc.expected)
+		}
+	}
+}
+
+func TestVisitorHash(t *testing.T) {
+	today, tomorrow := []byte("salt of today"), []byte("salt of tomorrow")
+	hash := VisitorHash(today, "203.0.113.77", "Firefox")
+	if len(hash) != 32 {
+		t.Errorf("expected 32 hex digits, got %q", hash)
+	}
+	if VisitorHash(today, "203.0.113.77", "Firefox") != hash {
+		t.Errorf("expected the same visitor to hash the same with the same salt")
+	}
+	if VisitorHash(today, "203.0.113.78", "Firefox") == hash || VisitorHash(today, "203.0.113.77", "Chrome") == hash {
+		t.Errorf("expected other visitors to hash differently")
+	}
+	if VisitorHash(tomorrow, "203.0.113.77", "Firefox") == hash {
+		t.Errorf("expected a new salt to give a new hash")
+	}
+}
+
+func TestDoNotTrack(t *testing.T) {
+	testCases := []struct {
+		dnt, gpc string
+		expected bool
+	}{
+		{"1", "", true},
+		{"", "1", true},
+		{"0", "", false},
+		{"", "", false},
+	}
+
+	for _, tc := range testCases {
+		if got := DoNotTrack(tc.dnt, tc.gpc); got != tc.expected {
+			t.Errorf("DoNotTrack(%q, %q) = %v; expected %v", tc.dnt, tc.gpc, got, tc.expected)
+		}
+	}
+}
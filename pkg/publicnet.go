@@ -0,0 +1,51 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrNonPublicAddress is returned when a connection to an address that is not
+// on the public internet is refused
+var ErrNonPublicAddress = errors.New("not a public address")
+
+// sharedAddressSpace is the carrier-grade NAT range, private but not covered
+// by net.IP.IsPrivate
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// IsPublicIP reports whether ip is an address on the public internet, rather
+// than a loopback, private, link-local, multicast or unspecified one
+func IsPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// publicOnly is a net.Dialer Control refusing connections to addresses that
+// are not public. It runs once the host name is resolved, for every address
+// tried, so names resolving to internal addresses and redirects to them are
+// refused as well.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !IsPublicIP(ip) {
+		return fmt.Errorf("connecting to %s: %w", host, ErrNonPublicAddress)
+	}
+	return nil
+}
+
+// NewPublicClient returns an HTTP client that only connects to public
+// addresses, for requests to urls given by users. Proxies from the
+// environment are not used, as they would connect on the client's behalf.
+func NewPublicClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, Control: publicOnly}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Transport: transport}
+}
@@ -0,0 +1,206 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Punycode parameters from RFC 3492
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	acePrefix       = "xn--"
+)
+
+// ToASCIIHost lowercases host and encodes every label that contains non-ASCII
+// characters as punycode, e.g. "bücher.example" becomes "xn--bcher-kva.example".
+// Only lowercasing is applied before encoding, not the full IDNA mapping.
+func ToASCIIHost(host string) (string, error) {
+	labels := strings.Split(strings.ToLower(host), ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		encoded, err := punycodeEncode(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = acePrefix + encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// ToUnicodeHost decodes every punycode label of host. Labels that fail to
+// decode are left as they are.
+func ToUnicodeHost(host string) string {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if !strings.HasPrefix(strings.ToLower(label), acePrefix) {
+			continue
+		}
+		if decoded, err := punycodeDecode(strings.ToLower(label[len(acePrefix):])); err == nil {
+			labels[i] = decoded
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+func punycodeEncode(label string) (string, error) {
+	if !utf8.ValidString(label) {
+		return "", fmt.Errorf("invalid UTF-8 in host label %q", label)
+	}
+	input := []rune(label)
+
+	var output strings.Builder
+	for _, r := range input {
+		if r < utf8.RuneSelf {
+			output.WriteRune(r)
+		}
+	}
+	basic := output.Len()
+	if basic > 0 {
+		output.WriteByte('-')
+	}
+
+	n, delta, bias := rune(punyInitialN), 0, punyInitialBias
+	for handled := basic; handled < len(input); {
+		// Find the smallest code point that has not been handled yet
+		m := rune(unicode.MaxRune)
+		for _, r := range input {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (handled + 1)
+		n = m
+
+		for _, r := range input {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				output.WriteByte(punyDigit(t + (q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			output.WriteByte(punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return output.String(), nil
+}
+
+func punycodeDecode(encoded string) (string, error) {
+	var output []rune
+	pos := 0
+	if b := strings.LastIndexByte(encoded, '-'); b > 0 {
+		output = []rune(encoded[:b])
+		pos = b + 1
+	}
+
+	n, i, bias := rune(punyInitialN), 0, punyInitialBias
+	for pos < len(encoded) {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(encoded) {
+				return "", fmt.Errorf("truncated punycode %q", encoded)
+			}
+			digit, ok := punyDigitValue(encoded[pos])
+			pos++
+			if !ok {
+				return "", fmt.Errorf("invalid punycode %q", encoded)
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			w *= punyBase - t
+			if w > unicode.MaxRune {
+				return "", fmt.Errorf("punycode overflow in %q", encoded)
+			}
+		}
+		bias = punyAdapt(i-oldi, len(output)+1, oldi == 0)
+		n += rune(i / (len(output) + 1))
+		if n > unicode.MaxRune {
+			return "", fmt.Errorf("punycode overflow in %q", encoded)
+		}
+		i %= len(output) + 1
+
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = n
+		i++
+	}
+	return string(output), nil
+}
+
+func punyThreshold(k int, bias int) int {
+	if k <= bias+punyTMin {
+		return punyTMin
+	} else if k >= bias+punyTMax {
+		return punyTMax
+	}
+	return k - bias
+}
+
+func punyAdapt(delta int, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyDigitValue(c byte) (int, bool) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	}
+	return 0, false
+}
@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestToASCIIHost(t *testing.T) {
+	testCases := []struct {
+		host  string
+		ascii string
+	}{
+		{"example.com", "example.com"},
+		{"Example.COM", "example.com"},
+		{"bücher.example", "xn--bcher-kva.example"},
+		{"BÜCHER.example", "xn--bcher-kva.example"},
+		{"münchen.de", "xn--mnchen-3ya.de"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah"},
+		{"президент.рф", "xn--d1abbgf6aiiy.xn--p1ai"},
+	}
+
+	for _, tc := range testCases {
+		ascii, err := ToASCIIHost(tc.host)
+		if err != nil || ascii != tc.ascii {
+			t.Errorf("ToASCIIHost(%s) = %s, %v; expected %s", tc.host, ascii, err, tc.ascii)
+		}
+	}
+}
+
+func TestToUnicodeHost(t *testing.T) {
+	testCases := []struct {
+		host    string
+		unicode string
+	}{
+		{"example.com", "example.com"},
+		{"xn--bcher-kva.example", "bücher.example"},
+		{"XN--MNCHEN-3YA.de", "münchen.de"},
+		{"xn--r8jz45g.xn--zckzah", "例え.テスト"},
+		{"xn--!!.example", "xn--!!.example"},
+	}
+
+	for _, tc := range testCases {
+		if unicode := ToUnicodeHost(tc.host); unicode != tc.unicode {
+			t.Errorf("ToUnicodeHost(%s) = %s; expected %s", tc.host, unicode, tc.unicode)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Conflict resolutions for a parameter that is already in the destination
+const (
+	QueryOverride = "override" // replace the destination's value
+	QueryKeep     = "keep"     // leave the destination's value alone
+	QueryAppend   = "append"   // add the new value next to the existing one
+)
+
+// QueryRules merge query parameters into a link's destination at redirect
+// time. Set is applied first, then the parameters passed through from the
+// short url request, each using the Conflict resolution.
+type QueryRules struct {
+	Set         map[string]string `json:"set,omitempty"`
+	Passthrough []string          `json:"passthrough,omitempty"` // names copied from the request, "*" for all
+	Conflict    string            `json:"conflict,omitempty"`    // override (default), keep or append
+}
+
+// QueryContext is what the placeholders in QueryRules.Set values expand to.
+// {code} and {host} are replaced by the short url and its host, and
+// {query:name} by the name parameter of the short url request.
+type QueryContext struct {
+	Code    string
+	Host    string
+	Request url.Values
+}
+
+// ParseQueryRules decodes rules stored as JSON. An empty string has no rules.
+func ParseQueryRules(s string) (QueryRules, error) {
+	var rules QueryRules
+	if strings.TrimSpace(s) == "" {
+		return rules, nil
+	}
+	if err := json.Unmarshal([]byte(s), &rules); err != nil {
+		return rules, err
+	}
+	return rules, rules.Validate()
+}
+
+// Validate checks the conflict resolution and parameter names
+func (rules QueryRules) Validate() error {
+	switch rules.Conflict {
+	case "", QueryOverride, QueryKeep, QueryAppend:
+	default:
+		return fmt.Errorf("unknown conflict resolution %q", rules.Conflict)
+	}
+	for name := range rules.Set {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("query parameter names must not be empty")
+		}
+	}
+	return nil
+}
+
+// IsEmpty reports whether the rules leave every destination unchanged
+func (rules QueryRules) IsEmpty() bool {
+	return len(rules.Set) == 0 && len(rules.Passthrough) == 0
+}
+
+// String encodes the rules as JSON for storage. Empty rules are stored as "".
+func (rules QueryRules) String() string {
+	if rules.IsEmpty() {
+		return ""
+	}
+	encoded, _ := json.Marshal(rules)
+	return string(encoded)
+}
+
+// Apply returns destination with the rules applied
+func (rules QueryRules) Apply(destination string, ctx QueryContext) (string, error) {
+	if rules.IsEmpty() {
+		return destination, nil
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+
+	// Sorted, so the result does not depend on map order
+	names := make([]string, 0, len(rules.Set))
+	for name := range rules.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rules.merge(query, name, []string{expandPlaceholders(rules.Set[name], ctx)})
+	}
+
+	for _, name := range rules.Passthrough {
+		if name == "*" {
+			for requestName, values := range ctx.Request {
+				rules.merge(query, requestName, values)
+			}
+		} else if values, ok := ctx.Request[name]; ok {
+			rules.merge(query, name, values)
+		}
+	}
+
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func (rules QueryRules) merge(query url.Values, name string, values []string) {
+	if _, exists := query[name]; !exists {
+		query[name] = append([]string(nil), values...)
+		return
+	}
+	switch rules.Conflict {
+	case QueryKeep:
+	case QueryAppend:
+		query[name] = append(query[name], values...)
+	default:
+		query[name] = append([]string(nil), values...)
+	}
+}
+
+// expandPlaceholders fills in {code}, {host} and {query:name} in one pass
+// from left to right. Substituted text is never scanned again, so values
+// taken from the request cannot bring in placeholders of their own.
+func expandPlaceholders(value string, ctx QueryContext) string {
+	if !strings.Contains(value, "{") {
+		return value
+	}
+	var b strings.Builder
+	for {
+		start := strings.IndexByte(value, '{')
+		if start < 0 {
+			b.WriteString(value)
+			return b.String()
+		}
+		end := strings.IndexByte(value[start:], '}')
+		if end < 0 {
+			b.WriteString(value)
+			return b.String()
+		}
+		b.WriteString(value[:start])
+		placeholder := value[start+1 : start+end]
+		switch {
+		case placeholder == "code":
+			b.WriteString(ctx.Code)
+		case placeholder == "host":
+			b.WriteString(ctx.Host)
+		case strings.HasPrefix(placeholder, "query:"):
+			b.WriteString(ctx.Request.Get(strings.TrimPrefix(placeholder, "query:")))
+		default:
+			// Not a placeholder: keep the brace and look for one after it
+			b.WriteByte('{')
+			value = value[start+1:]
+			continue
+		}
+		value = value[start+end+1:]
+	}
+}
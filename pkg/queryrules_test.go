@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestQueryRulesApply(t *testing.T) {
+	request := url.Values{"ref": {"email"}, "utm_source": {"twitter"}, "other": {"x"}}
+	ctx := QueryContext{Code: "abc12", Host: "go.example", Request: request}
+
+	testCases := []struct {
+		name        string
+		rules       QueryRules
+		destination string
+		result      string
+	}{
+		{"no rules", QueryRules{}, "https://example.com/?b=2&a=1", "https://example.com/?b=2&a=1"},
+		{"set", QueryRules{Set: map[string]string{"utm_source": "newsletter", "utm_medium": "email", "utm_campaign": "spring"}},
+			"https://example.com/page", "https://example.com/page?utm_campaign=spring&utm_medium=email&utm_source=newsletter"},
+		{"set override", QueryRules{Set: map[string]string{"utm_source": "newsletter"}},
+			"https://example.com/?utm_source=old", "https://example.com/?utm_source=newsletter"},
+		{"set keep", QueryRules{Set: map[string]string{"utm_source": "newsletter"}, Conflict: QueryKeep},
+			"https://example.com/?utm_source=old", "https://example.com/?utm_source=old"},
+		{"set append", QueryRules{Set: map[string]string{"utm_source": "newsletter"}, Conflict: QueryAppend},
+			"https://example.com/?utm_source=old", "https://example.com/?utm_source=old&utm_source=newsletter"},
+		{"placeholders", QueryRules{Set: map[string]string{"utm_campaign": "{code}-{host}", "utm_content": "{query:ref}", "missing": "{query:none}"}},
+			"https://example.com/", "https://example.com/?missing=&utm_campaign=abc12-go.example&utm_content=email"},
+		{"passthrough", QueryRules{Passthrough: []string{"ref", "absent"}},
+			"https://example.com/", "https://example.com/?ref=email"},
+		{"passthrough all", QueryRules{Passthrough: []string{"*"}},
+			"https://example.com/", "https://example.com/?other=x&ref=email&utm_source=twitter"},
+		{"passthrough wins over set", QueryRules{Set: map[string]string{"utm_source": "newsletter"}, Passthrough: []string{"utm_source"}},
+			"https://example.com/", "https://example.com/?utm_source=twitter"},
+		{"passthrough keep", QueryRules{Passthrough: []string{"utm_source"}, Conflict: QueryKeep},
+			"https://example.com/?utm_source=site", "https://example.com/?utm_source=site"},
+		{"fragment kept", QueryRules{Set: map[string]string{"a": "1"}}, "https://example.com/p#top", "https://example.com/p?a=1#top"},
+	}
+
+	for _, tc := range testCases {
+		result, err := tc.rules.Apply(tc.destination, ctx)
+		if err != nil || result != tc.result {
+			t.Errorf("%s: Apply(%s) = %s, %v; expected %s", tc.name, tc.destination, result, err, tc.result)
+		}
+	}
+}
+
+func TestQueryRulesApply_SelfReferencingValue(t *testing.T) {
+	// Values from the request are not expanded again, however many
+	// placeholders they hold
+	request := url.Values{"ref": {"{query:ref}{query:ref}{code}"}}
+	ctx := QueryContext{Code: "abc12", Host: "go.example", Request: request}
+	rules := QueryRules{Set: map[string]string{"utm_content": "{query:ref}-{query:ref}", "literal": "{a}{code}"}}
+
+	done := make(chan string, 1)
+	go func() {
+		result, _ := rules.Apply("https://example.com/", ctx)
+		done <- result
+	}()
+	select {
+	case result := <-done:
+		expected := "https://example.com/?" + url.Values{
+			"literal":     {"{a}abc12"},
+			"utm_content": {"{query:ref}{query:ref}{code}-{query:ref}{query:ref}{code}"},
+		}.Encode()
+		if result != expected {
+			t.Errorf("Apply = %s; expected %s", result, expected)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Apply did not return")
+	}
+}
+
+func TestParseQueryRules(t *testing.T) {
+	testCases := []struct {
+		stored string
+		valid  bool
+	}{
+		{"", true},
+		{`{"set":{"utm_source":"newsletter"},"passthrough":["ref"],"conflict":"keep"}`, true},
+		{`{"conflict":"merge"}`, false},
+		{`{"set":{"":"x"}}`, false},
+		{`not json`, false},
+	}
+
+	for _, tc := range testCases {
+		if _, err := ParseQueryRules(tc.stored); (err == nil) != tc.valid {
+			t.Errorf("ParseQueryRules(%s) = %v, expected valid to be %v", tc.stored, err, tc.valid)
+		}
+	}
+
+	rules := QueryRules{Set: map[string]string{"utm_source": "newsletter"}, Conflict: QueryAppend}
+	parsed, err := ParseQueryRules(rules.String())
+	if err != nil || parsed.Set["utm_source"] != "newsletter" || parsed.Conflict != QueryAppend {
+		t.Errorf("Rules did not survive being stored: %+v, %v", parsed, err)
+	}
+
+	if (QueryRules{Conflict: QueryKeep}).String() != "" {
+		t.Errorf("Expected empty rules to be stored as an empty string")
+	}
+}
@@ -0,0 +1,88 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+// AttemptLimiter counts failed attempts per key and blocks a key once it has
+// failed Limit times within Window
+type AttemptLimiter struct {
+	Limit  int
+	Window time.Duration
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	now      func() time.Time
+}
+
+func NewAttemptLimiter(limit int, window time.Duration) *AttemptLimiter {
+	return &AttemptLimiter{
+		Limit:    limit,
+		Window:   window,
+		failures: make(map[string][]time.Time),
+		now:      time.Now,
+	}
+}
+
+// Allowed reports whether key may make another attempt
+func (l *AttemptLimiter) Allowed(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.recent(key)) < l.Limit
+}
+
+// RecordFailure counts a failed attempt for key
+func (l *AttemptLimiter) RecordFailure(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures[key] = append(l.recent(key), l.now())
+}
+
+// Take counts an attempt of key before it is made, and reports whether key
+// may make it. Counting and checking under one lock means concurrent
+// attempts cannot all slip in before the first of them fails. Attempts that
+// succeed are handed back with Refund.
+func (l *AttemptLimiter) Take(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	failures := l.recent(key)
+	if len(failures) >= l.Limit {
+		return false
+	}
+	l.failures[key] = append(failures, l.now())
+	return true
+}
+
+// Refund hands back an attempt of key counted by Take that succeeded. The
+// failures of other attempts are kept.
+func (l *AttemptLimiter) Refund(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if failures := l.recent(key); len(failures) > 0 {
+		l.failures[key] = failures[:len(failures)-1]
+	}
+}
+
+// Reset forgets the failed attempts of key
+func (l *AttemptLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+}
+
+// recent drops the failures of key that are older than the window. The
+// caller must hold l.mu.
+func (l *AttemptLimiter) recent(key string) []time.Time {
+	cutoff := l.now().Add(-l.Window)
+	failures := l.failures[key]
+	for len(failures) > 0 && failures[0].Before(cutoff) {
+		failures = failures[1:]
+	}
+	if len(failures) == 0 {
+		delete(l.failures, key)
+		return nil
+	}
+	l.failures[key] = failures
+	return failures
+}
@@ -0,0 +1,92 @@
+package pkg
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewAttemptLimiter(2, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	limiter.RecordFailure("a")
+	if !limiter.Allowed("a") {
+		t.Errorf("Expected a to be allowed after one failure")
+	}
+
+	limiter.RecordFailure("a")
+	if limiter.Allowed("a") {
+		t.Errorf("Expected a to be blocked after two failures")
+	}
+	if !limiter.Allowed("b") {
+		t.Errorf("Expected failures of a not to block b")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if !limiter.Allowed("a") {
+		t.Errorf("Expected a to be allowed once the window has passed")
+	}
+
+	limiter.RecordFailure("a")
+	limiter.RecordFailure("a")
+	limiter.Reset("a")
+	if !limiter.Allowed("a") {
+		t.Errorf("Expected a to be allowed after a reset")
+	}
+}
+
+func TestAttemptLimiterTake(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter := NewAttemptLimiter(3, time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	// Attempts are counted as they are taken, before they fail
+	for i := 0; i < 3; i++ {
+		if !limiter.Take("a") {
+			t.Fatalf("Expected attempt %d of a to be allowed", i+1)
+		}
+	}
+	if limiter.Take("a") {
+		t.Errorf("Expected a to be blocked while three attempts are under way")
+	}
+
+	// A successful attempt is handed back, and the others still count
+	limiter.Refund("a")
+	if !limiter.Take("a") {
+		t.Errorf("Expected a refunded attempt to be available again")
+	}
+	if limiter.Take("a") {
+		t.Errorf("Expected the other attempts to still count after a refund")
+	}
+
+	limiter.Refund("b")
+	if !limiter.Take("b") {
+		t.Errorf("Expected refunding a key without attempts to do nothing")
+	}
+}
+
+func TestAttemptLimiterTakeConcurrently(t *testing.T) {
+	limiter := NewAttemptLimiter(5, time.Minute)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter.Take("a") {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 5 {
+		t.Errorf("Expected exactly 5 concurrent attempts to be allowed, got %d", allowed)
+	}
+}
@@ -0,0 +1,282 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Platforms a redirect rule can match on
+var Platforms = []string{"android", "ios", "windows", "macos", "linux", "chromeos"}
+
+// Visitor is what redirect rules are matched against
+type Visitor struct {
+	UserAgent string
+	Platform  string   // one of Platforms, or "" when unknown
+	Languages []string // from Accept-Language, most preferred first
+	Country   string   // ISO country code, or "" when unknown
+	Time      time.Time
+}
+
+// TimeWindow limits a rule to some days and hours. A window whose To is
+// before its From runs past midnight.
+type TimeWindow struct {
+	Days     []string `json:"days,omitempty"`     // mon, tue, ..., empty for every day
+	From     string   `json:"from,omitempty"`     // HH:MM, inclusive
+	To       string   `json:"to,omitempty"`       // HH:MM, exclusive
+	Timezone string   `json:"timezone,omitempty"` // IANA name, UTC when empty
+}
+
+// RedirectRule sends visitors matching every condition it sets to
+// Destination. Within one condition any of the listed values matches.
+type RedirectRule struct {
+	UserAgents  []string    `json:"user_agents,omitempty"` // case insensitive substrings
+	Platforms   []string    `json:"platforms,omitempty"`
+	Languages   []string    `json:"languages,omitempty"` // "en" also matches "en-GB"
+	Countries   []string    `json:"countries,omitempty"`
+	Window      *TimeWindow `json:"window,omitempty"`
+	Destination string      `json:"destination"`
+}
+
+// RedirectRules are evaluated in order; the first matching rule wins
+type RedirectRules []RedirectRule
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseRedirectRules decodes rules stored as JSON. An empty string has no rules.
+func ParseRedirectRules(s string) (RedirectRules, error) {
+	var rules RedirectRules
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(s), &rules); err != nil {
+		return nil, err
+	}
+	return rules, rules.Validate()
+}
+
+// String encodes the rules as JSON for storage. No rules are stored as "".
+func (rules RedirectRules) String() string {
+	if len(rules) == 0 {
+		return ""
+	}
+	encoded, _ := json.Marshal(rules)
+	return string(encoded)
+}
+
+// Validate checks every rule, numbering them from 1 in errors
+func (rules RedirectRules) Validate() error {
+	for i, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks the destination, platforms and time window of the rule
+func (rule RedirectRule) Validate() error {
+	if !IsValidURL(rule.Destination) {
+		return fmt.Errorf("invalid destination %q", rule.Destination)
+	}
+	for _, platform := range rule.Platforms {
+		if !containsFold(Platforms, platform) {
+			return fmt.Errorf("unknown platform %q", platform)
+		}
+	}
+	if rule.Window == nil {
+		return nil
+	}
+	for _, day := range rule.Window.Days {
+		if !containsFold(weekdays, day) {
+			return fmt.Errorf("unknown day %q", day)
+		}
+	}
+	if _, err := parseClock(rule.Window.From); err != nil {
+		return err
+	}
+	if _, err := parseClock(rule.Window.To); err != nil {
+		return err
+	}
+	if _, err := time.LoadLocation(rule.Window.Timezone); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Match returns the destination of the first rule visitor matches
+func (rules RedirectRules) Match(visitor Visitor) (string, bool) {
+	for _, rule := range rules {
+		if rule.Matches(visitor) {
+			return rule.Destination, true
+		}
+	}
+	return "", false
+}
+
+// Matches reports whether visitor meets every condition of the rule
+func (rule RedirectRule) Matches(visitor Visitor) bool {
+	if len(rule.UserAgents) > 0 && !matchesUserAgent(rule.UserAgents, visitor.UserAgent) {
+		return false
+	}
+	if len(rule.Platforms) > 0 && !containsFold(rule.Platforms, visitor.Platform) {
+		return false
+	}
+	if len(rule.Languages) > 0 && !matchesLanguage(rule.Languages, visitor.Languages) {
+		return false
+	}
+	if len(rule.Countries) > 0 && !containsFold(rule.Countries, visitor.Country) {
+		return false
+	}
+	return rule.Window == nil || rule.Window.Contains(visitor.Time)
+}
+
+// Contains reports whether t falls in the window
+func (window TimeWindow) Contains(t time.Time) bool {
+	location, err := time.LoadLocation(window.Timezone)
+	if err != nil {
+		return false
+	}
+	t = t.In(location)
+	minute := t.Hour()*60 + t.Minute()
+
+	from, _ := parseClock(window.From)
+	to, err := parseClock(window.To)
+	if window.To == "" || err != nil {
+		to = 24 * 60
+	}
+
+	day := t.Weekday()
+	switch {
+	case from <= to:
+		if minute < from || minute >= to {
+			return false
+		}
+	case minute >= from:
+		// Before midnight in a window running past midnight
+	case minute < to:
+		// After midnight, so the window started the day before
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+	return len(window.Days) == 0 || containsFold(window.Days, weekdays[day])
+}
+
+// parseClock returns the minutes since midnight of an HH:MM time. An empty
+// string is midnight.
+func parseClock(clock string) (int, error) {
+	if clock == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Platform guesses the platform from the Sec-CH-UA-Platform client hint, or
+// from the user agent when the hint is empty
+func Platform(userAgent string, platformHint string) string {
+	switch strings.ToLower(strings.Trim(platformHint, `" `)) {
+	case "android":
+		return "android"
+	case "ios":
+		return "ios"
+	case "windows":
+		return "windows"
+	case "macos":
+		return "macos"
+	case "linux":
+		return "linux"
+	case "chrome os", "chromeos":
+		return "chromeos"
+	}
+
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "android"):
+		return "android"
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"), strings.Contains(ua, "ipod"):
+		return "ios"
+	case strings.Contains(ua, "windows"):
+		return "windows"
+	case strings.Contains(ua, "cros"):
+		return "chromeos"
+	case strings.Contains(ua, "macintosh"), strings.Contains(ua, "mac os x"):
+		return "macos"
+	case strings.Contains(ua, "linux"):
+		return "linux"
+	}
+	return ""
+}
+
+// AcceptedLanguages returns the languages of an Accept-Language header, most
+// preferred first, leaving out * and languages with a quality of 0
+func AcceptedLanguages(header string) []string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+	var languages []language
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+		if quality > 0 {
+			languages = append(languages, language{tag, quality})
+		}
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+	tags := make([]string, len(languages))
+	for i, l := range languages {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+func matchesUserAgent(patterns []string, userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, pattern := range patterns {
+		if pattern != "" && strings.Contains(userAgent, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesLanguage(wanted []string, accepted []string) bool {
+	for _, tag := range accepted {
+		for _, want := range wanted {
+			want = strings.ToLower(want)
+			if tag == want || strings.HasPrefix(tag, want+"-") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
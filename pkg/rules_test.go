@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedirectRulesMatch(t *testing.T) {
+	rules := RedirectRules{
+		{Platforms: []string{"ios"}, Destination: "https://apps.apple.com/app"},
+		{Platforms: []string{"android"}, Countries: []string{"de", "at"}, Destination: "https://play.google.com/de"},
+		{Platforms: []string{"android"}, Destination: "https://play.google.com/app"},
+		{UserAgents: []string{"Firefox"}, Languages: []string{"fr"}, Destination: "https://example.fr/firefox"},
+		{Window: &TimeWindow{Days: []string{"sat", "sun"}}, Destination: "https://example.com/weekend"},
+	}
+	weekday := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC) // a Wednesday
+	weekend := time.Date(2024, 5, 18, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name        string
+		visitor     Visitor
+		destination string
+	}{
+		{"first rule wins", Visitor{Platform: "ios", Time: weekend}, "https://apps.apple.com/app"},
+		{"all conditions", Visitor{Platform: "android", Country: "DE", Time: weekday}, "https://play.google.com/de"},
+		{"falls through", Visitor{Platform: "android", Country: "US", Time: weekday}, "https://play.google.com/app"},
+		{"language prefix", Visitor{UserAgent: "Mozilla/5.0 Firefox/120.0", Languages: []string{"de", "fr-ca"}, Time: weekday}, "https://example.fr/firefox"},
+		{"language missing", Visitor{UserAgent: "Mozilla/5.0 Firefox/120.0", Languages: []string{"fry"}, Time: weekday}, ""},
+		{"time window", Visitor{Platform: "windows", Time: weekend}, "https://example.com/weekend"},
+		{"no match", Visitor{Platform: "windows", Time: weekday}, ""},
+	}
+
+	for _, tc := range testCases {
+		destination, ok := rules.Match(tc.visitor)
+		if destination != tc.destination || ok != (tc.destination != "") {
+			t.Errorf("%s: Match = %q, %v; expected %q", tc.name, destination, ok, tc.destination)
+		}
+	}
+}
+
+func TestTimeWindowContains(t *testing.T) {
+	testCases := []struct {
+		window   TimeWindow
+		time     time.Time
+		contains bool
+	}{
+		{TimeWindow{From: "09:00", To: "17:00"}, time.Date(2024, 5, 15, 9, 0, 0, 0, time.UTC), true},
+		{TimeWindow{From: "09:00", To: "17:00"}, time.Date(2024, 5, 15, 17, 0, 0, 0, time.UTC), false},
+		{TimeWindow{From: "09:00"}, time.Date(2024, 5, 15, 23, 59, 0, 0, time.UTC), true},
+		{TimeWindow{From: "22:00", To: "06:00"}, time.Date(2024, 5, 15, 23, 0, 0, 0, time.UTC), true},
+		{TimeWindow{From: "22:00", To: "06:00"}, time.Date(2024, 5, 15, 5, 0, 0, 0, time.UTC), true},
+		{TimeWindow{From: "22:00", To: "06:00"}, time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC), false},
+		// Friday night windows still hold early on Saturday
+		{TimeWindow{Days: []string{"fri"}, From: "22:00", To: "06:00"}, time.Date(2024, 5, 18, 2, 0, 0, 0, time.UTC), true},
+		{TimeWindow{Days: []string{"fri"}, From: "22:00", To: "06:00"}, time.Date(2024, 5, 17, 2, 0, 0, 0, time.UTC), false},
+		{TimeWindow{Days: []string{"Wed"}}, time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC), true},
+		{TimeWindow{From: "09:00", To: "17:00", Timezone: "America/New_York"}, time.Date(2024, 5, 15, 14, 0, 0, 0, time.UTC), true},
+		{TimeWindow{From: "09:00", To: "17:00", Timezone: "America/New_York"}, time.Date(2024, 5, 15, 22, 0, 0, 0, time.UTC), false},
+	}
+
+	for _, tc := range testCases {
+		if contains := tc.window.Contains(tc.time); contains != tc.contains {
+			t.Errorf("%+v.Contains(%v) = %v, expected %v", tc.window, tc.time, contains, tc.contains)
+		}
+	}
+}
+
+func TestParseRedirectRules(t *testing.T) {
+	testCases := []struct {
+		stored string
+		valid  bool
+	}{
+		{"", true},
+		{`[{"platforms":["iOS"],"destination":"https://apps.apple.com/app"}]`, true},
+		{`[{"window":{"days":["mon"],"from":"09:00","to":"17:30","timezone":"Europe/Berlin"},"destination":"https://example.com"}]`, true},
+		{`[{"destination":"not a url"}]`, false},
+		{`[{"platforms":["symbian"],"destination":"https://example.com"}]`, false},
+		{`[{"window":{"days":["someday"]},"destination":"https://example.com"}]`, false},
+		{`[{"window":{"from":"9am"},"destination":"https://example.com"}]`, false},
+		{`[{"window":{"timezone":"Mars/Olympus"},"destination":"https://example.com"}]`, false},
+		{`{"destination":"https://example.com"}`, false},
+	}
+
+	for _, tc := range testCases {
+		if _, err := ParseRedirectRules(tc.stored); (err == nil) != tc.valid {
+			t.Errorf("ParseRedirectRules(%s) = %v, expected valid to be %v", tc.stored, err, tc.valid)
+		}
+	}
+
+	rules := RedirectRules{{Countries: []string{"NL"}, Window: &TimeWindow{From: "08:00"}, Destination: "https://example.nl"}}
+	parsed, err := ParseRedirectRules(rules.String())
+	if err != nil || !reflect.DeepEqual(parsed, rules) {
+		t.Errorf("Rules did not survive being stored: %+v, %v", parsed, err)
+	}
+	if RedirectRules(nil).String() != "" {
+		t.Errorf("Expected no rules to be stored as an empty string")
+	}
+}
+
+func TestPlatform(t *testing.T) {
+	testCases := []struct {
+		userAgent string
+		hint      string
+		platform  string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15", "", "ios"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36", "", "android"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36", "", "windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15", "", "macos"},
+		{"Mozilla/5.0 (X11; CrOS x86_64 14541.0.0) AppleWebKit/537.36", "", "chromeos"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0", "", "linux"},
+		{"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36", `"Android"`, "android"},
+		{"curl/8.0", "", ""},
+	}
+
+	for _, tc := range testCases {
+		if platform := Platform(tc.userAgent, tc.hint); platform != tc.platform {
+			t.Errorf("Platform(%s, %s) = %q, expected %q", tc.userAgent, tc.hint, platform, tc.platform)
+		}
+	}
+}
+
+func TestAcceptedLanguages(t *testing.T) {
+	languages := AcceptedLanguages("fr-CH, fr;q=0.9, en;q=0.8, de;q=0.95, *;q=0.5, it;q=0")
+	expected := []string{"fr-ch", "de", "fr", "en"}
+	if !reflect.DeepEqual(languages, expected) {
+		t.Errorf("AcceptedLanguages = %q, expected %q", languages, expected)
+	}
+	if languages := AcceptedLanguages(""); len(languages) != 0 {
+		t.Errorf("Expected no languages for an empty header, got %q", languages)
+	}
+}
@@ -0,0 +1,50 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MaxTagLength is the longest tag a link can have
+const MaxTagLength = 64
+
+// NormalizeTags splits a comma separated list of tags. Tags are lower cased,
+// runs of whitespace are collapsed and duplicates are dropped. The result is
+// sorted.
+func NormalizeTags(input string) ([]string, error) {
+	seen := map[string]bool{}
+	var tags []string
+	for _, tag := range strings.Split(input, ",") {
+		tag = strings.ToLower(strings.Join(strings.Fields(tag), " "))
+		if tag == "" || seen[tag] {
+			continue
+		}
+		if len(tag) > MaxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, MaxTagLength)
+		}
+		seen[tag] = true
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// BooleanSearchQuery turns what someone typed in a search box into a MySQL
+// boolean mode full-text query requiring every word, each as a prefix.
+// Operators in the input are dropped rather than interpreted. It returns ""
+// when nothing searchable is left.
+func BooleanSearchQuery(input string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`+-<>()~*"@`, r) {
+			return ' '
+		}
+		return r
+	}, input)
+
+	words := strings.Fields(cleaned)
+	for i, word := range words {
+		words[i] = "+" + word + "*"
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTags(t *testing.T) {
+	testCases := []struct {
+		input string
+		tags  []string
+	}{
+		{"", nil},
+		{" , ,", nil},
+		{"News, go,  Release   Notes ,news", []string{"go", "news", "release notes"}},
+	}
+	for _, tc := range testCases {
+		tags, err := NormalizeTags(tc.input)
+		if err != nil || !reflect.DeepEqual(tags, tc.tags) {
+			t.Errorf("NormalizeTags(%q) = %q, %v; expected %q", tc.input, tags, err, tc.tags)
+		}
+	}
+
+	if _, err := NormalizeTags("ok, " + strings.Repeat("x", MaxTagLength+1)); err == nil {
+		t.Errorf("Expected an error for a tag that is too long")
+	}
+}
+
+func TestBooleanSearchQuery(t *testing.T) {
+	testCases := []struct {
+		input string
+		query string
+	}{
+		{"", ""},
+		{"  ", ""},
+		{"golang", "+golang*"},
+		{"release  notes", "+release* +notes*"},
+		{`-spam +"quoted" (x) ~y a*b@c`, "+spam* +quoted* +x* +y* +a* +b* +c*"},
+		{"***", ""},
+	}
+	for _, tc := range testCases {
+		if query := BooleanSearchQuery(tc.input); query != tc.query {
+			t.Errorf("BooleanSearchQuery(%q) = %q, expected %q", tc.input, query, tc.query)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// SignValue appends an HMAC-SHA256 signature of value made with secret, so
+// the value can be handed to a browser in a cookie and trusted when it
+// comes back
+func SignValue(secret []byte, value string) string {
+	return value + "." + signature(secret, value)
+}
+
+// VerifyValue returns the value of a string made by SignValue, and false when
+// the signature does not match
+func VerifyValue(secret []byte, signed string) (string, bool) {
+	i := strings.LastIndexByte(signed, '.')
+	if i < 0 || len(secret) == 0 {
+		return "", false
+	}
+	value, sig := signed[:i], signed[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, value))) {
+		return "", false
+	}
+	return value, true
+}
+
+func signature(secret []byte, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignWebhook signs the body of a webhook request sent at timestamp, so the
+// receiver can check that it came from us and is not an old request played
+// again. The signature is the hex HMAC-SHA256 of "<unix timestamp>.<body>".
+func SignWebhook(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
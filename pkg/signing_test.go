@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestSignValue(t *testing.T) {
+	secret := []byte("secret")
+	signed := SignValue(secret, "1.1700000000")
+
+	value, ok := VerifyValue(secret, signed)
+	if !ok || value != "1.1700000000" {
+		t.Errorf("VerifyValue(%s) = %s, %v", signed, value, ok)
+	}
+
+	testCases := []struct {
+		secret []byte
+		signed string
+	}{
+		{[]byte("other"), signed},
+		{secret, "2" + signed[1:]},
+		{secret, "no signature"},
+		{nil, signed},
+	}
+
+	for _, tc := range testCases {
+		if _, ok := VerifyValue(tc.secret, tc.signed); ok {
+			t.Errorf("VerifyValue(%s) accepted a forged value", tc.signed)
+		}
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"type":"link.created"}`)
+	signature := SignWebhook(secret, 1700000000, body)
+
+	if len(signature) != 64 {
+		t.Errorf("SignWebhook returned %q; expected 64 hex digits", signature)
+	}
+	if SignWebhook(secret, 1700000000, body) != signature {
+		t.Errorf("SignWebhook is not deterministic")
+	}
+	for _, other := range []string{
+		SignWebhook([]byte("other"), 1700000000, body),
+		SignWebhook(secret, 1700000001, body),
+		SignWebhook(secret, 1700000000, []byte(`{"type":"link.deleted"}`)),
+	} {
+		if other == signature {
+			t.Errorf("SignWebhook gave the same signature for a different secret, time or body")
+		}
+	}
+}
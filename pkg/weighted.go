@@ -0,0 +1,35 @@
+package pkg
+
+import "math/rand"
+
+// PickWeighted returns the index of a weight chosen with a probability
+// proportional to it, or -1 when no weight is positive. Negative weights
+// count as 0.
+func PickWeighted(weights []int, rnd *rand.Rand) int {
+	total := 0
+	for _, weight := range weights {
+		if weight > 0 {
+			total += weight
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+
+	var n int
+	if rnd == nil {
+		n = rand.Intn(total)
+	} else {
+		n = rnd.Intn(total)
+	}
+	for i, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		if n < weight {
+			return i
+		}
+		n -= weight
+	}
+	return -1
+}
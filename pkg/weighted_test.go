@@ -0,0 +1,30 @@
+package pkg
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestPickWeighted(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	counts := make([]int, 3)
+	for i := 0; i < 10000; i++ {
+		counts[PickWeighted([]int{70, 0, 30}, rnd)]++
+	}
+
+	if counts[1] != 0 {
+		t.Errorf("Expected a weight of 0 never to be picked, got %d picks", counts[1])
+	}
+	if counts[0] < 6700 || counts[0] > 7300 {
+		t.Errorf("Expected about 7000 of 10000 picks for a weight of 70, got %d", counts[0])
+	}
+
+	for _, weights := range [][]int{nil, {0, 0}, {-5}} {
+		if i := PickWeighted(weights, rnd); i != -1 {
+			t.Errorf("PickWeighted(%v) = %d, expected -1", weights, i)
+		}
+	}
+	if i := PickWeighted([]int{-1, 5}, nil); i != 1 {
+		t.Errorf("Expected the only positive weight to be picked, got %d", i)
+	}
+}
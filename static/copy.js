@@ -0,0 +1,18 @@
+// Buttons with a data-copy attribute copy the value of the input it names
+document.querySelectorAll("[data-copy]").forEach(function (button) {
+    button.addEventListener("click", function () {
+        var input = document.getElementById(button.dataset.copy);
+        var copied = function () {
+            button.textContent = "Copied";
+        };
+        if (navigator.clipboard) {
+            navigator.clipboard.writeText(input.value).then(copied);
+            return;
+        }
+        // Browsers without the clipboard API, or pages not served over https
+        input.select();
+        if (document.execCommand("copy")) {
+            copied();
+        }
+    });
+});
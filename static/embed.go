@@ -0,0 +1,11 @@
+// Package static holds the templates and assets of the app, built into the
+// binary so it runs from any directory
+package static
+
+import "embed"
+
+// Files holds the page templates under templates/ and the assets served
+// under /static/
+//
+//go:embed templates/*.html *.css *.js
+var Files embed.FS